@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aclMaxClients is how many clients' rate limit buckets are kept before
+// those of clients gone quiet are dropped
+const aclMaxClients = 4096
+
+// acl decides which clients serve answers: by source address, against the
+// -allow and -deny prefixes, and at most rate queries a second each
+type acl struct {
+	allow []netip.Prefix // empty allows all
+	deny  []netip.Prefix // takes precedence over allow
+	rate  float64        // queries a second per client, 0 for no limit
+
+	mu      sync.Mutex
+	buckets map[netip.Addr]*bucket
+}
+
+// bucket is a client's token bucket: it holds up to a second's worth of
+// queries, refilled at the rate
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// parsePrefixes parses a comma separated list of CIDRs, single addresses
+// standing for themselves
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+
+	var out []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(s); err == nil {
+			out = append(out, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", s)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// newACL returns the acl of the -allow and -deny lists and -rate-limit, or
+// nil when they leave every client be
+func newACL(allow string, deny string, rate float64) (*acl, error) {
+
+	a := &acl{rate: rate, buckets: make(map[netip.Addr]*bucket)}
+	var err error
+	if a.allow, err = parsePrefixes(allow); err != nil {
+		return nil, fmt.Errorf("-allow: %w", err)
+	}
+	if a.deny, err = parsePrefixes(deny); err != nil {
+		return nil, fmt.Errorf("-deny: %w", err)
+	}
+	if rate < 0 {
+		return nil, fmt.Errorf("-rate-limit: must not be negative")
+	}
+	if a.allow == nil && a.deny == nil && rate == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// clientAddr is the IP address a query came from
+func clientAddr(from net.Addr) netip.Addr {
+	if a, ok := from.(interface{ AddrPort() netip.AddrPort }); ok {
+		return a.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// check tells why a query from addr is not to be answered: "denied" by the
+// lists or "rate_limited", "" when it is. A nil acl allows everything.
+func (a *acl) check(addr netip.Addr) string {
+
+	if a == nil {
+		return ""
+	}
+	matches := func(prefixes []netip.Prefix) bool {
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(a.deny) || a.allow != nil && !matches(a.allow) {
+		return "denied"
+	}
+	if a.rate == 0 {
+		return ""
+	}
+
+	now := time.Now()
+	burst := max(a.rate, 1)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := a.buckets[addr]
+	if b == nil {
+		if len(a.buckets) >= aclMaxClients {
+			// Buckets full again are no different from new ones
+			for k, b := range a.buckets {
+				if b.tokens+now.Sub(b.last).Seconds()*a.rate >= burst {
+					delete(a.buckets, k)
+				}
+			}
+		}
+		b = &bucket{tokens: burst, last: now}
+		a.buckets[addr] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*a.rate, burst)
+	b.last = now
+	if b.tokens < 1 {
+		return "rate_limited"
+	}
+	b.tokens--
+	return ""
+}
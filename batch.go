@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// batchResult is the rendered output of one batch lookup
+type batchResult struct {
+	seq  int
+	out  bytes.Buffer
+	code int
+}
+
+// runBatch resolves every name for every type over a bounded pool of workers
+// sharing resolver r. Output is emitted in input order, grouped by type per name,
+// unless stream is set, in which case each result is printed as soon as it
+// completes. The first non-zero code is returned.
+//
+// When the run is interrupted no more lookups are started, those in flight
+// are cancelled and whatever completed is still printed.
+func runBatch(r *resolver, names []string, types []string, workers int,
+	stream bool, render printer, po *printOpts) int {
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	results := make(chan *batchResult, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := range jobs {
+				br := &batchResult{seq: seq}
+				name, qtype := names[seq/len(types)], types[seq%len(types)]
+				if jdns, err := r.lookup(name, qtype); err != nil {
+					br.code = report(&br.out, name, qtype, err, po)
+				} else {
+					br.code = emit(&br.out, name, jdns, render, r.annotate(po, name, qtype, jdns))
+				}
+				results <- br
+			}
+		}()
+	}
+
+	total := len(names) * len(types)
+	go func() {
+	feed:
+		for seq := 0; seq < total; seq++ {
+			select {
+			case jobs <- seq:
+			case <-r.ctx.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	rc := 0
+	next := 0
+	done := 0
+	pending := make(map[int]*batchResult)
+
+	for br := range results {
+		if br.code != exitInterrupted {
+			done++
+		}
+		if br.code != 0 && rc == 0 {
+			rc = br.code
+		}
+		if stream {
+			os.Stdout.Write(br.out.Bytes())
+			continue
+		}
+		// Hold out-of-order results until their predecessors are printed
+		pending[br.seq] = br
+		for p, ok := pending[next]; ok; p, ok = pending[next] {
+			os.Stdout.Write(p.out.Bytes())
+			delete(pending, next)
+			next++
+		}
+	}
+
+	if r.ctx.Err() != nil {
+		// Results held behind a cancelled lookup are complete, print them
+		for _, seq := range slices.Sorted(maps.Keys(pending)) {
+			os.Stdout.Write(pending[seq].out.Bytes())
+		}
+		fmt.Fprintf(os.Stderr, "Interrupted, %d of %d lookups done\n", done, total)
+		return exitInterrupted
+	}
+	return rc
+}
+
+// splitTypes breaks a comma separated -t value into individual query types.
+// An empty value yields a single empty type so IP literals still default to PTR.
+func splitTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	if len(types) == 0 {
+		types = []string{""}
+	}
+	return types
+}
+
+// readNames collects query names from r, one per line.
+// Blank lines and lines starting with # are skipped.
+func readNames(r io.Reader) ([]string, error) {
+	var names []string
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, s.Err()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// benchResult is what bench learned about one provider
+type benchResult struct {
+	provider string
+	latency  []time.Duration // successful queries, sorted
+	failed   int
+}
+
+// percentile returns the p-th percentile (nearest rank) of the sorted latencies
+func (b *benchResult) percentile(p int) time.Duration {
+	if len(b.latency) == 0 {
+		return 0
+	}
+	rank := (p*len(b.latency) + 99) / 100
+	return b.latency[max(rank, 1)-1]
+}
+
+func (b *benchResult) avg() time.Duration {
+	if len(b.latency) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, l := range b.latency {
+		total += l
+	}
+	return total / time.Duration(len(b.latency))
+}
+
+// cmdBench times repeated queries against each provider of -s and prints
+// a comparison table, fastest (by p95) first.
+func cmdBench() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optName string
+	var optType string
+	var optCount int
+	var optConcurrency int
+
+	fs := newFlagSet("bench", "h53 bench [options] -n name",
+		"Time -count queries against each provider of -s ("+doh.DefaultChain+" by default), "+
+			"\none provider after the other, and compare their latency.")
+	co.register(fs)
+	fs.StringVar(&optName, "n", "example.com",
+		"Query Name Ex.: example.com")
+	fs.StringVar(&optType, "t", "A",
+		"Query Type Ex.: AAAA")
+	fs.IntVar(&optCount, "count", 10,
+		"Queries per provider")
+	fs.IntVar(&optConcurrency, "c", 1,
+		"Queries in flight per provider Ex.: 8")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if optCount < 1 || optConcurrency < 1 {
+			fmt.Fprint(os.Stderr, "Count (-count) and concurrency (-c) must be at least 1.\n")
+			return 1
+		}
+		if !set["s"] {
+			co.server = doh.DefaultChain
+		}
+		client, err := co.client(set, optConcurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+
+		var results []*benchResult
+		for _, p := range client.Providers {
+			// One provider at a time, no fallback muddying the numbers
+			c := *client
+			c.Providers = []doh.Provider{p}
+			c.Fallback, c.Race = false, false
+			results = append(results, bench(&c, optName, optType, optCount, optConcurrency))
+		}
+
+		sort.SliceStable(results, func(i, j int) bool {
+			ri, rj := results[i], results[j]
+			if (len(ri.latency) == 0) != (len(rj.latency) == 0) {
+				return len(rj.latency) == 0
+			}
+			return ri.percentile(95) < rj.percentile(95)
+		})
+
+		ms := func(d time.Duration) string {
+			return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond))
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PROVIDER\tOK\tERR%\tMIN ms\tAVG ms\tP95 ms\tP99 ms")
+		code := 3
+		for _, r := range results {
+			total := len(r.latency) + r.failed
+			errRate := fmt.Sprintf("%.1f", 100*float64(r.failed)/float64(total))
+			if len(r.latency) == 0 {
+				fmt.Fprintf(tw, "%s\t0\t%s\t-\t-\t-\t-\n", r.provider, errRate)
+				continue
+			}
+			code = 0
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", r.provider, len(r.latency), errRate,
+				ms(r.latency[0]), ms(r.avg()), ms(r.percentile(95)), ms(r.percentile(99)))
+		}
+		tw.Flush()
+
+		// Failing all providers is a failure of the run
+		return code
+	}
+}
+
+// bench sends count queries through c, workers at a time
+func bench(c *doh.Client, name string, qtype string, count int, workers int) *benchResult {
+
+	res := &benchResult{provider: c.Providers[0].Name}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan struct{})
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				start := time.Now()
+				_, err := c.Lookup(context.Background(), name, qtype)
+				elapsed := time.Since(start)
+				mu.Lock()
+				if err != nil {
+					res.failed++
+					slog.Debug("lookup failed", "provider", c.Providers[0].Name, "error", err)
+				} else {
+					res.latency = append(res.latency, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(res.latency, func(i, j int) bool { return res.latency[i] < res.latency[j] })
+	return res
+}
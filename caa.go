@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// caaKnownTags are the CAA property tags a CA can be expected to know; an
+// unknown one with the critical flag forbids issuance altogether
+var caaKnownTags = []string{"issue", "issuewild", "iodef", "contactemail", "contactphone", "issuemail", "issuevmc"}
+
+// cmdCAA finds the CAA records that govern certificates for a domain, the
+// way a CA does (RFC 8659 3): at the domain, else at the closest parent
+// that has any. It prints the policy they make and with -ca checks whether
+// that CA may issue.
+func cmdCAA() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optCA string
+	var optWildcard bool
+
+	fs := newFlagSet("caa", "h53 caa [options] domain",
+		"Find the CAA records that apply to domain, climbing to its parents like a CA, and print the issuance policy.")
+	co.register(fs)
+	fs.StringVar(&optCA, "ca", "",
+		"Check whether this CA (its CAA issuer domain) may issue, exit 9 if not Ex.: letsencrypt.org")
+	fs.BoolVar(&optWildcard, "wildcard", false,
+		"Check for a wildcard certificate (*.domain), governed by issuewild")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		domain := strings.TrimSuffix(fs.Arg(0), ".")
+		if d, ok := strings.CutPrefix(domain, "*."); ok {
+			domain, optWildcard = d, true
+		}
+
+		at, records, err := r.relevantCAA(domain)
+		if err != nil {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return code
+			}
+			return exitInterrupted
+		}
+		if records == nil {
+			fmt.Printf("Policy for %s: no CAA records up to the root, any CA may issue\n", domain)
+			return 0
+		}
+
+		p := caaPolicyOf(records)
+		fmt.Printf("Policy for %s (from %s):\n", domain, at)
+		fmt.Printf("  Certificates: %s\n", p.describe(p.issue))
+		fmt.Printf("  Wildcard certificates: %s\n", p.describe(p.wild()))
+		if len(p.iodef) != 0 {
+			fmt.Printf("  Violation reports: %s\n", strings.Join(p.iodef, ", "))
+		}
+		for _, t := range p.critical {
+			fmt.Printf("  Unknown critical tag %s: no CA may issue\n", t)
+		}
+
+		if optCA == "" {
+			return 0
+		}
+		if p.permits(optCA, optWildcard) {
+			fmt.Printf("%s may issue\n", optCA)
+			return 0
+		}
+		fmt.Printf("%s may NOT issue\n", optCA)
+		return exitCheckFailed
+	}
+}
+
+// relevantCAA returns the closest name from domain upwards that has CAA
+// records, and the records. CNAMEs are followed by the resolver as for any
+// query. A failed lookup is an error: CAs refuse to issue then too.
+func (r *resolver) relevantCAA(domain string) (string, []doh.CAA, error) {
+
+	labels := strings.Split(domain, ".")
+	for i := range labels {
+		name := strings.Join(labels[i:], ".")
+		jdns, err := r.lookup(name, "CAA")
+		if err != nil {
+			return "", nil, err
+		}
+		if jdns.Status != 3 {
+			if err := jdns.Err(); err != nil {
+				return "", nil, err
+			}
+		}
+
+		var records []doh.CAA
+		for _, a := range jdns.Answers {
+			if c, err := doh.ParseCAA(a.Data); a.Type == 257 && err == nil {
+				records = append(records, c)
+			}
+		}
+		if len(records) == 0 {
+			fmt.Printf("%s: no CAA records\n", name)
+			continue
+		}
+		fmt.Printf("%s: %d CAA records\n", name, len(records))
+		for _, c := range records {
+			fmt.Printf("  %d %s %q\n", c.Flags, c.Tag, c.Value)
+		}
+		return name, records, nil
+	}
+	return "", nil, nil
+}
+
+// caaPolicy is what a CAA record set allows
+type caaPolicy struct {
+	issue    []string // issuer domains of issue, "" for ";" (none), nil without any
+	wildcard []string // of issuewild
+	iodef    []string
+	critical []string // unknown tags flagged critical
+}
+
+func caaPolicyOf(records []doh.CAA) *caaPolicy {
+
+	p := &caaPolicy{}
+	for _, c := range records {
+		issuer, _, _ := strings.Cut(c.Value, ";")
+		issuer = strings.ToLower(strings.TrimSpace(issuer))
+		switch c.Tag {
+		case "issue":
+			p.issue = append(p.issue, issuer)
+		case "issuewild":
+			p.wildcard = append(p.wildcard, issuer)
+		case "iodef":
+			p.iodef = append(p.iodef, c.Value)
+		default:
+			if c.Critical() && !slices.Contains(caaKnownTags, c.Tag) {
+				p.critical = append(p.critical, c.Tag)
+			}
+		}
+	}
+	return p
+}
+
+// wild is the issuer list for wildcard certificates: issuewild when there
+// is one, issue otherwise
+func (p *caaPolicy) wild() []string {
+	if p.wildcard != nil {
+		return p.wildcard
+	}
+	return p.issue
+}
+
+// describe renders an issuer list
+func (p *caaPolicy) describe(issuers []string) string {
+	if len(p.critical) != 0 {
+		return "none may issue (unknown critical tag)"
+	}
+	if issuers == nil {
+		return "any CA may issue"
+	}
+	var cas []string
+	for _, i := range issuers {
+		if i != "" && !slices.Contains(cas, i) {
+			cas = append(cas, i)
+		}
+	}
+	if len(cas) == 0 {
+		return "none may issue"
+	}
+	return strings.Join(cas, ", ")
+}
+
+// permits reports whether the CA known by issuer domain ca may issue
+func (p *caaPolicy) permits(ca string, wildcard bool) bool {
+	if len(p.critical) != 0 {
+		return false
+	}
+	issuers := p.issue
+	if wildcard {
+		issuers = p.wild()
+	}
+	return issuers == nil || (ca != "" && slices.Contains(issuers, strings.ToLower(ca)))
+}
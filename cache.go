@@ -0,0 +1,522 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// staleTTL is the TTL of answers served stale, as RFC 8767 section 4
+// recommends: clients come back soon, by when the providers may be back
+const staleTTL = 30
+
+// prefetchWindow is the end part of an entry's lifetime (1/prefetchWindow
+// of it) in which a popular entry is refreshed ahead of expiry, the last
+// 10% as Unbound has it
+const prefetchWindow = 10
+
+// cacheEntry is a cached response along with the time it stops being fresh
+type cacheEntry struct {
+	Response *doh.DNSJ `json:"response"`
+	Wire     []byte    `json:"wire,omitempty"` // the response message, as serve forwards it
+	Stored   time.Time `json:"stored"`
+	Expires  time.Time `json:"expires"`
+
+	hits        int  // times answered from while fresh
+	prefetching bool // refresh under way or tried (see prefetchDue)
+}
+
+// cache holds decoded responses keyed by name and type, honoring answer TTLs.
+// When path is set the entries are loaded from and saved to that file so
+// they survive across invocations.
+type cache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*cacheEntry
+
+	// maxStale is how long past their expiry entries are kept, to answer
+	// with when the providers cannot be reached (RFC 8767); zero keeps none
+	maxStale time.Duration
+
+	// minTTL and maxTTL (seconds) bound the TTLs of the entries and their
+	// records; zero leaves that side be
+	minTTL, maxTTL int
+
+	keepExpired bool // save leaves expired entries be, h53 cache flush edits files as they are
+
+	hits, misses, staleHits atomic.Int64 // get and stale outcomes, for metrics
+	prefetches              atomic.Int64 // entries refreshed ahead of expiry
+}
+
+// newCache returns an empty cache, preloaded from path when it exists
+func newCache(path string) (*cache, error) {
+
+	c := &cache{path: path, entries: make(map[string]*cacheEntry)}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// cacheKey normalizes name (case, trailing dot) and type into a lookup key
+func cacheKey(name string, qtype string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "/" + strings.ToUpper(qtype)
+}
+
+// cacheTTL is how long a response may be cached, in seconds: its shortest
+// answer TTL or, for NXDOMAIN and NODATA, the negative caching TTL of RFC
+// 2308 section 5, the lesser of the SOA's TTL and its MINIMUM. Other errors,
+// and negative answers without a SOA to tell, are not to be cached (false).
+func cacheTTL(jdns *doh.DNSJ) (int, bool) {
+
+	switch {
+	case jdns.Status == 0 && len(jdns.Answers) != 0:
+		ttl := jdns.Answers[0].TTL
+		for _, a := range jdns.Answers[1:] {
+			ttl = min(ttl, a.TTL)
+		}
+		return ttl, true
+	case jdns.Status == 0 || jdns.Status == 3:
+		for _, a := range jdns.Authority {
+			if a.Type != 6 {
+				continue
+			}
+			if soa, err := doh.ParseSOA(a.Data); err == nil {
+				return min(a.TTL, int(soa.Minimum)), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// clamp bounds a TTL to the cache's minTTL and maxTTL
+func (c *cache) clamp(ttl int) int {
+
+	if c.maxTTL > 0 {
+		ttl = min(ttl, c.maxTTL)
+	}
+	return max(ttl, c.minTTL)
+}
+
+// clampMsg is msg with its record TTLs clamped, as serve hands it out
+func (c *cache) clampMsg(msg []byte) []byte {
+
+	if c.minTTL == 0 && c.maxTTL == 0 {
+		return msg
+	}
+	if out, err := doh.RewriteTTLs(msg, func(t uint32) uint32 { return uint32(c.clamp(int(t))) }); err == nil {
+		return out
+	}
+	return msg
+}
+
+// find returns the entry for key along with the TTL its records are to be
+// served with: fresh entries' reduced by the time spent in the cache (and
+// to the time left) or, with stale set, staleTTL for entries expired no
+// longer than maxStale ago.
+func (c *cache) find(key string, stale bool) (*cacheEntry, func(int) int, bool) {
+
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && now.Before(e.Expires) {
+		e.hits++
+	}
+	c.mu.Unlock()
+
+	switch {
+	case !ok:
+	case now.Before(e.Expires):
+		// No record outlives the entry: a negative answer's SOA, say
+		elapsed, left := int(now.Sub(e.Stored).Seconds()), int(e.Expires.Sub(now).Seconds())
+		return e, func(ttl int) int { return min(max(ttl-elapsed, 0), left) }, true
+	case stale && now.Before(e.Expires.Add(c.maxStale)):
+		return e, func(int) int { return staleTTL }, true
+	}
+	return nil, nil, false
+}
+
+// response is the entry's response with the TTLs of its records set by ttl
+func (e *cacheEntry) response(ttl func(int) int) *doh.DNSJ {
+
+	jdns := *e.Response
+	jdns.Timing = nil // nothing went over the wire
+	age := func(rrs []doh.Answer) []doh.Answer {
+		if rrs == nil {
+			return nil
+		}
+		out := make([]doh.Answer, len(rrs))
+		for i, a := range rrs {
+			a.TTL = ttl(a.TTL)
+			out[i] = a
+		}
+		return out
+	}
+	jdns.Answers, jdns.Authority = age(e.Response.Answers), age(e.Response.Authority)
+	return &jdns
+}
+
+// get returns a fresh cached response for key (see cacheKey). Answer TTLs
+// are reduced by the time the entry has spent in the cache.
+func (c *cache) get(key string) (*doh.DNSJ, bool) {
+
+	e, ttl, ok := c.find(key, false)
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return e.response(ttl), true
+}
+
+// stale returns the response for key expired no longer than maxStale ago,
+// for when the providers fail, with its TTLs set to staleTTL
+func (c *cache) stale(key string) (*doh.DNSJ, bool) {
+
+	e, ttl, ok := c.find(key, true)
+	if !ok {
+		return nil, false
+	}
+	c.staleHits.Add(1)
+	return e.response(ttl), true
+}
+
+// getMsg is get for the response messages serve stores (see putMsg); with
+// stale set it is stale.
+func (c *cache) getMsg(key string, stale bool) ([]byte, bool) {
+
+	e, ttl, ok := c.find(key, stale)
+	if ok && e.Wire != nil {
+		msg, err := doh.RewriteTTLs(e.Wire, func(t uint32) uint32 { return uint32(ttl(int(t))) })
+		if ok = err == nil; ok {
+			if stale {
+				c.staleHits.Add(1)
+			} else {
+				c.hits.Add(1)
+			}
+			return msg, true
+		}
+	}
+	if !stale {
+		c.misses.Add(1)
+	}
+	return nil, false
+}
+
+// prefetchDue reports whether the entry for key, just answered from, is to
+// be refreshed now: answered from at least threshold times and in the last
+// 1/prefetchWindow of its lifetime. It reports so once per entry, the
+// refresh replacing it (or, failing, leaving it to expire as usual).
+func (c *cache) prefetchDue(key string, threshold int) bool {
+
+	if threshold <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.prefetching || e.hits < threshold {
+		return false
+	}
+	left, lifetime := time.Until(e.Expires), e.Expires.Sub(e.Stored)
+	if left <= 0 || left > lifetime/prefetchWindow {
+		return false
+	}
+	e.prefetching = true
+	return true
+}
+
+// put stores a response for as long as cacheTTL allows: answers for their
+// shortest TTL, NXDOMAIN and NODATA for their SOA's negative TTL, within
+// minTTL and maxTTL.
+func (c *cache) put(key string, jdns *doh.DNSJ) {
+	c.store(key, &cacheEntry{Response: jdns})
+}
+
+// putMsg stores a response message, jdns being its decoded form
+func (c *cache) putMsg(key string, msg []byte, jdns *doh.DNSJ) {
+	c.store(key, &cacheEntry{Response: jdns, Wire: msg})
+}
+
+func (c *cache) store(key string, e *cacheEntry) {
+
+	ttl, ok := cacheTTL(e.Response)
+	if ttl = c.clamp(ttl); !ok || ttl <= 0 {
+		return
+	}
+	if c.minTTL != 0 || c.maxTTL != 0 {
+		e.Response = e.response(c.clamp)
+		e.Wire = c.clampMsg(e.Wire)
+	}
+	e.Stored = time.Now()
+	e.Expires = e.Stored.Add(time.Duration(ttl) * time.Second)
+	c.mu.Lock()
+	c.entries[key] = e
+	c.mu.Unlock()
+}
+
+// save writes the unexpired entries (and those still to be served stale)
+// back to the cache file, if any.
+// The file is replaced atomically so concurrent readers never see a partial write.
+func (c *cache) save() error {
+
+	if c.path == "" {
+		return nil
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if !c.keepExpired && !now.Before(e.Expires.Add(c.maxStale)) {
+			delete(c.entries, k)
+		}
+	}
+	data, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".h53cache")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// keyName is the query name part of a cache key (see cacheKey)
+func keyName(key string) string {
+	name, _, _ := strings.Cut(key, "/")
+	return name
+}
+
+// keyType is the query type part of a cache key, without the option flags
+func keyType(key string) string {
+	_, rest, _ := strings.Cut(key, "/")
+	qtype, _, _ := strings.Cut(rest, "+")
+	return qtype
+}
+
+// flush evicts the entries for name, every type and option set of it, or
+// all entries when name is empty. It returns how many went.
+func (c *cache) flush(name string) int {
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k := range c.entries {
+		if name == "" || keyName(k) == name {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// writeList writes the fresh entries, one per line and in key order: the
+// key, the seconds left and the answers (or the RCODE, NODATA)
+func (c *cache) writeList(w io.Writer) {
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.entries))
+	for k, e := range c.entries {
+		if now.Before(e.Expires) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e := c.entries[k]
+		var data []string
+		for _, a := range e.Response.Answers {
+			data = append(data, a.Data)
+		}
+		switch {
+		case e.Response.Status != 0:
+			data = []string{doh.RcodeString(e.Response.Status)}
+		case data == nil:
+			data = []string{"NODATA"}
+		}
+		fmt.Fprintf(w, "%s\t%ds\t%s\n", k, int(e.Expires.Sub(now).Seconds()), strings.Join(data, ", "))
+	}
+}
+
+// writeStats summarizes the entries: how many are fresh or expired, how
+// many negative, by type; with counters set, the lookups this process
+// answered from the cache too.
+func (c *cache) writeStats(w io.Writer, counters bool) {
+
+	now := time.Now()
+	var fresh, expired, nx, nodata int
+	types := make(map[string]int)
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if now.Before(e.Expires) {
+			fresh++
+		} else {
+			expired++
+		}
+		switch {
+		case e.Response.Status == 3:
+			nx++
+		case e.Response.Status == 0 && len(e.Response.Answers) == 0:
+			nodata++
+		}
+		types[keyType(k)]++
+	}
+	c.mu.Unlock()
+
+	var byType []string
+	for _, t := range sortedKeys(types) {
+		byType = append(byType, fmt.Sprintf("%s %d", t, types[t]))
+	}
+	fmt.Fprintf(w, "Entries:  %d (%d fresh, %d expired", fresh+expired, fresh, expired)
+	if c.maxStale > 0 {
+		fmt.Fprintf(w, ", kept %v to serve stale", c.maxStale)
+	}
+	fmt.Fprintln(w, ")")
+	fmt.Fprintf(w, "Negative: %d (NXDOMAIN %d, NODATA %d)\n", nx+nodata, nx, nodata)
+	if byType != nil {
+		fmt.Fprintf(w, "Types:    %s\n", strings.Join(byType, ", "))
+	}
+	if counters {
+		hits, misses := c.hits.Load(), c.misses.Load()
+		ratio := 0.0
+		if hits+misses != 0 {
+			ratio = float64(hits) / float64(hits+misses)
+		}
+		fmt.Fprintf(w, "Lookups:  %d hits, %d misses (%.1f%% hit ratio), %d answered stale, %d prefetched\n",
+			hits, misses, 100*ratio, c.staleHits.Load(), c.prefetches.Load())
+	}
+}
+
+// ServeHTTP is serve's -admin endpoint: GET /cache lists the entries (as
+// h53 cache ls), GET /cache/stats sums them up, DELETE /cache flushes them
+// and DELETE /cache/{name} the entries of one name.
+func (c *cache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case req.Method == http.MethodDelete:
+		fmt.Fprintf(w, "%d entries flushed\n", c.flush(req.PathValue("name")))
+	case req.URL.Path == "/cache/stats":
+		c.writeStats(w, true)
+	default:
+		c.writeList(w)
+	}
+}
+
+// serveAdmin serves the cache administration endpoint on addr (see
+// cache.ServeHTTP), in the background
+func serveAdmin(addr string, c *cache) error {
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /cache", c)
+	mux.Handle("GET /cache/stats", c)
+	mux.Handle("DELETE /cache", c)
+	mux.Handle("DELETE /cache/{name}", c)
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// cmdCache inspects or maintains a cache file: ls (the default) shows the
+// fresh entries, stats sums them up, flush evicts those of a name (or all),
+// prune drops the expired ones and clear removes the file.
+func cmdCache() (*flag.FlagSet, func(args []string) int) {
+
+	var optCacheFile string
+
+	fs := newFlagSet("cache", "h53 cache -cache-file path [ls|stats|flush [name]|prune|clear]",
+		"ls shows the fresh entries, stats sums them up, flush evicts the entries of a name (all without one),\n"+
+			"prune drops expired ones, clear removes the file. A running h53 serve has its own copy of the\n"+
+			"entries, which it saves when it stops: use its -admin endpoint instead.")
+	fs.StringVar(&optCacheFile, "cache-file", "",
+		"Cache file Ex.: h53.cache")
+	return fs, func(args []string) int {
+		parseArgs(fs, args)
+
+		if optCacheFile == "" || fs.NArg() > 2 || fs.NArg() == 2 && fs.Arg(0) != "flush" {
+			fs.Usage()
+			return 1
+		}
+		action := "ls"
+		if fs.NArg() != 0 {
+			action = fs.Arg(0)
+		}
+
+		if action == "clear" {
+			if err := os.Remove(optCacheFile); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Unable to remove cache file: %v\n", err)
+				return 1
+			}
+			return 0
+		}
+
+		store, err := newCache(optCacheFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load cache file: %v\n", err)
+			return 1
+		}
+
+		switch action {
+		case "prune":
+			before := len(store.entries)
+			code := exit(store, 0)
+			fmt.Printf("%d expired entries removed, %d left\n", before-len(store.entries), len(store.entries))
+			return code
+		case "flush":
+			store.keepExpired = true
+			n := store.flush(fs.Arg(1))
+			code := exit(store, 0)
+			fmt.Printf("%d entries flushed, %d left\n", n, len(store.entries))
+			return code
+		case "ls", "list":
+			store.writeList(os.Stdout)
+			return 0
+		case "stats":
+			store.writeStats(os.Stdout, false)
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Unknown cache action: %s\n", action)
+		return 1
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// certResult is the chain one address of a name presented
+type certResult struct {
+	addr  netip.Addr
+	chain []*x509.Certificate
+	err   error
+}
+
+// cmdCert resolves a name over DoH, fetches the certificate chain every
+// address presents for it and checks them as a browser would, pointing out
+// the ones that do not cover the name or do not chain to a trusted root:
+// a captive portal, a middlebox or a TLS intercepting proxy.
+func cmdCert() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optName string
+	var optPort int
+	var optStartTLS string
+	var optWarnDays int
+
+	fs := newFlagSet("cert", "h53 cert [options] -n name",
+		"Resolve name over DoH, then show and check the certificate chain each of its addresses presents.")
+	co.register(fs)
+	fs.StringVar(&optName, "n", "",
+		"Name to resolve and check Ex.: example.com")
+	fs.IntVar(&optPort, "port", 443,
+		"Port to connect to")
+	fs.StringVar(&optStartTLS, "starttls", "",
+		"Protocol to upgrade with STARTTLS: smtp, imap, pop3 or none (default: smtp for 25/587, imap for 143, pop3 for 110)")
+	fs.IntVar(&optWarnDays, "warn-days", 14,
+		"Flag certificates expiring within this many days")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if optName == "" || fs.NArg() != 0 {
+			fs.Usage()
+			return 1
+		}
+		if optPort < 1 || optPort > 65535 {
+			fmt.Fprintf(os.Stderr, "Invalid port (-port): %d\n", optPort)
+			return 1
+		}
+		port := strconv.Itoa(optPort)
+		if optStartTLS == "" {
+			optStartTLS = starttlsPorts[port]
+		}
+		switch optStartTLS {
+		case "", "none", "smtp", "imap", "pop3":
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown STARTTLS protocol (-starttls): %s\n", optStartTLS)
+			return 1
+		}
+
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		addrs, code := r.resolveAll(optName)
+		if code != 0 {
+			fmt.Fprintf(os.Stderr, "Unable to resolve %s\n", optName)
+			return code
+		}
+
+		results := make([]certResult, len(addrs))
+		var wg sync.WaitGroup
+		for i, addr := range addrs {
+			wg.Go(func() {
+				results[i].addr = addr
+				results[i].chain, results[i].err = fetchChain(net.JoinHostPort(addr.String(), port),
+					optName, optStartTLS, client.Timeout)
+			})
+		}
+		wg.Wait()
+		if r.ctx.Err() != nil {
+			return exitInterrupted
+		}
+
+		flagged, failed := 0, 0
+		warn := time.Duration(optWarnDays) * 24 * time.Hour
+		for _, res := range results {
+			fmt.Println(net.JoinHostPort(res.addr.String(), port))
+			if res.err != nil {
+				fmt.Printf("  error: %v\n", res.err)
+				failed++
+				continue
+			}
+			for i, cert := range res.chain {
+				printCert(i, cert)
+			}
+			problems := certProblems(optName, res.chain, warn)
+			for _, p := range problems {
+				fmt.Printf("  PROBLEM: %s\n", p)
+			}
+			if len(problems) != 0 {
+				flagged++
+				continue
+			}
+			fmt.Printf("  OK: trusted, valid for %s\n", optName)
+		}
+
+		fmt.Printf("Checked %d addresses: %d flagged, %d unreachable\n", len(results), flagged, failed)
+		switch {
+		case flagged != 0:
+			return exitCheckFailed
+		case failed != 0:
+			return 8
+		}
+		return 0
+	}
+}
+
+// printCert describes the certificate at depth i of a chain
+func printCert(i int, cert *x509.Certificate) {
+
+	fmt.Printf("  %d %s\n", i, cert.Subject)
+	fmt.Printf("    Issuer:  %s\n", cert.Issuer)
+	if sans := certSANs(cert); len(sans) != 0 {
+		fmt.Printf("    SANs:    %s\n", strings.Join(sans, ", "))
+	}
+	left := time.Until(cert.NotAfter)
+	fmt.Printf("    Valid:   %s to %s (%d days left)\n", cert.NotBefore.Format(time.DateOnly),
+		cert.NotAfter.Format(time.DateOnly), int(left.Hours()/24))
+	fmt.Printf("    SHA256:  %x\n", sha256.Sum256(cert.Raw))
+	fmt.Printf("    Pin:     %s\n", base64.StdEncoding.EncodeToString(doh.SPKIHash(cert)))
+}
+
+// certSANs lists the names and addresses a certificate is for
+func certSANs(cert *x509.Certificate) []string {
+	sans := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+// certProblems verifies a chain for name against the system roots, as a
+// browser would, and checks that it is not about to expire
+func certProblems(name string, chain []*x509.Certificate, warn time.Duration) []string {
+
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	// The name and the chain are checked apart, for both to be reported
+	var problems []string
+	if leaf.VerifyHostname(name) != nil {
+		problems = append(problems, fmt.Sprintf("name mismatch: the certificate is not for %s (it is for %s)",
+			name, strings.Join(certSANs(leaf), ", ")))
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{Intermediates: intermediates})
+	var authErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case err == nil:
+	case errors.As(err, &authErr):
+		problems = append(problems, fmt.Sprintf("untrusted issuer %s: self-signed or a TLS intercepting proxy", leaf.Issuer))
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		problems = append(problems, "expired or not yet valid: "+invalidErr.Detail)
+	default:
+		problems = append(problems, err.Error())
+	}
+
+	if left := time.Until(leaf.NotAfter); left > 0 && left < warn {
+		problems = append(problems, fmt.Sprintf("expires in %d days", int(left.Hours()/24)))
+	}
+	return problems
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// maxCNAMEs bounds the CNAME chains -follow-cname chases
+const maxCNAMEs = 8
+
+// cnameChain follows the CNAME records of jdns from name. It returns the
+// names along the chain, name first, the records found at its end and
+// whether the chain loops back on itself.
+func cnameChain(jdns *doh.DNSJ, name string) (chain []string, final []doh.Answer, loop bool) {
+
+	key := func(n string) string { return strings.ToLower(fqdn(n)) }
+	targets := make(map[string]string)
+	for _, a := range jdns.Answers {
+		if a.Type == 5 {
+			targets[key(a.Name)] = a.Data
+		}
+	}
+
+	chain = []string{fqdn(name)}
+	seen := map[string]bool{key(name): true}
+	for {
+		target, ok := targets[key(chain[len(chain)-1])]
+		if !ok {
+			break
+		}
+		chain = append(chain, fqdn(target))
+		if seen[key(target)] {
+			return chain, nil, true
+		}
+		seen[key(target)] = true
+	}
+
+	end := key(chain[len(chain)-1])
+	for _, a := range jdns.Answers {
+		if a.Type != 5 && key(a.Name) == end {
+			final = append(final, a)
+		}
+	}
+	return chain, final, false
+}
+
+// chainString renders a CNAME chain as alias -> alias -> data
+func chainString(chain []string, final []doh.Answer) string {
+	data := make([]string, len(final))
+	for i, a := range final {
+		data[i] = a.Data
+	}
+	end := strings.Join(data, ", ")
+	if end == "" {
+		end = "(nothing)"
+	}
+	return strings.Join(chain, " -> ") + " -> " + end
+}
+
+// follow completes a CNAME chain the resolver left dangling (common with
+// forwarders and split horizons) by querying its end, until records of
+// qtype turn up, an error RCODE, a loop or maxCNAMEs aliases.
+func (r *resolver) follow(name string, qtype string, jdns *doh.DNSJ) (*doh.DNSJ, error) {
+
+	if strings.EqualFold(qtype, "CNAME") {
+		return jdns, nil
+	}
+	merged := *jdns
+	merged.Answers = append([]doh.Answer(nil), jdns.Answers...)
+	followed := 0
+	for {
+		chain, final, loop := cnameChain(&merged, name)
+		switch {
+		case loop:
+			return nil, fmt.Errorf("%s: CNAME loop: %s", name, strings.Join(chain, " -> "))
+		case len(final) != 0 || len(chain) == 1 || merged.Status != 0:
+			return &merged, nil
+		case len(chain) <= followed:
+			// The last answer did not continue the chain
+			return &merged, nil
+		case len(chain) > maxCNAMEs:
+			return nil, fmt.Errorf("%s: CNAME chain longer than %d", name, maxCNAMEs)
+		}
+
+		followed = len(chain)
+		next, err := r.client.Lookup(r.ctx, chain[len(chain)-1], qtype)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("following CNAME", "name", chain[len(chain)-1])
+		merged.Status = next.Status
+		merged.Answers = append(merged.Answers, next.Answers...)
+		if len(next.Answers) == 0 {
+			return &merged, nil
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+)
+
+// ANSI escapes of the text output
+const (
+	ansiReset   = "\x1b[0m"
+	ansiDim     = "\x1b[2m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+	ansiBlue    = "\x1b[34m"
+	ansiMagenta = "\x1b[35m"
+	ansiCyan    = "\x1b[36m"
+)
+
+// typeColors colors the record types in text output: addresses, aliases,
+// mail and services, delegation, text and DNSSEC records each their own
+var typeColors = map[int]string{
+	1: ansiGreen, 28: ansiGreen, // A, AAAA
+	5: ansiCyan, 39: ansiCyan, 12: ansiCyan, // CNAME, DNAME, PTR
+	15: ansiMagenta, 33: ansiMagenta, 35: ansiMagenta, 64: ansiMagenta, 65: ansiMagenta, // MX, SRV, NAPTR, SVCB, HTTPS
+	2: ansiBlue, 6: ansiBlue, 43: ansiBlue, // NS, SOA, DS
+	16: ansiYellow, 99: ansiYellow, 257: ansiYellow, // TXT, SPF, CAA
+	46: ansiDim, 47: ansiDim, 48: ansiDim, 50: ansiDim, // RRSIG, NSEC, DNSKEY, NSEC3
+}
+
+// colorOutput reports whether text output to stdout gets colors: only on a
+// terminal, and not when NO_COLOR is set (https://no-color.org) or the
+// terminal is dumb
+func colorOutput() bool {
+
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// paint wraps s in the escape code when the output is colored
+func (po *printOpts) paint(code string, s string) string {
+	if !po.color || code == "" {
+		return s
+	}
+	return code + s + ansiReset
+}
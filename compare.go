@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// errSystemType is the system resolver declining a record type: Go's
+// net.Resolver only looks up addresses, MX, NS, TXT, SRV, CNAME and PTR
+var errSystemType = errors.New("not supported, only A, AAAA, MX, NS, TXT, SRV, CNAME and PTR (of an address) are")
+
+// systemAnswers resolves name for qtype through the system resolver (the
+// OS stub and the network's DNS, what applications get), with the data in
+// the form of answerValue. No records, or no such name, is an empty answer.
+func systemAnswers(ctx context.Context, name string, qtype string, timeout time.Duration) ([]string, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res := net.DefaultResolver
+
+	var out []string
+	var err error
+	switch qtype {
+	case "A", "AAAA":
+		// Both families at once: one missing is no answer, not an error
+		var addrs []netip.Addr
+		addrs, err = res.LookupNetIP(ctx, "ip", name)
+		for _, a := range addrs {
+			if a = a.Unmap(); a.Is4() == (qtype == "A") {
+				out = append(out, a.String())
+			}
+		}
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = res.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			out = append(out, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		var nss []*net.NS
+		nss, err = res.LookupNS(ctx, name)
+		for _, ns := range nss {
+			out = append(out, ns.Host)
+		}
+	case "TXT":
+		out, err = res.LookupTXT(ctx, name)
+	case "SRV":
+		var srvs []*net.SRV
+		_, srvs, err = res.LookupSRV(ctx, "", "", name)
+		for _, srv := range srvs {
+			out = append(out, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+	case "CNAME":
+		var cname string
+		cname, err = res.LookupCNAME(ctx, name)
+		// The name itself comes back when it is not an alias
+		if err == nil && !strings.EqualFold(strings.TrimSuffix(cname, "."), strings.TrimSuffix(name, ".")) {
+			out = append(out, cname)
+		}
+	case "PTR":
+		if _, perr := netip.ParseAddr(name); perr != nil {
+			return nil, errSystemType
+		}
+		out, err = res.LookupAddr(ctx, name)
+	default:
+		return nil, errSystemType
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	return out, err
+}
+
+// comparable renders record data so that DoH's and the system resolver's
+// forms of the same record are equal: lower case, names fully qualified
+func comparable(qtype string, data string) string {
+
+	switch qtype {
+	case "TXT":
+		return data
+	case "A", "AAAA":
+		if ip, err := netip.ParseAddr(data); err == nil {
+			return ip.Unmap().String()
+		}
+	}
+	fields := strings.Fields(strings.ToLower(data))
+	if n := len(fields); n != 0 && !strings.HasSuffix(fields[n-1], ".") {
+		if _, err := strconv.Atoi(fields[n-1]); err != nil {
+			fields[n-1] += "."
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// compareSystem resolves name for each of types through the system resolver
+// too and prints its answers next to DoH's (from the cache, as looked up
+// already), with a verdict: where they differ, the network's DNS may be
+// filtered, redirected or just answered by location (CDNs).
+func compareSystem(r *resolver, name string, types []string, w io.Writer) {
+
+	for _, t := range types {
+		qname, qtype, err := queryFor(name, t)
+		if err != nil {
+			continue
+		}
+		jdns, err := r.lookup(name, t)
+		if err != nil {
+			continue
+		}
+		code, _ := doh.TypeCode(qtype)
+		qtype = doh.TypeString(int(code))
+
+		var viaDoH []string
+		for _, a := range jdns.Answers {
+			if a.Type == int(code) {
+				viaDoH = append(viaDoH, comparable(qtype, answerValue(a)))
+			}
+		}
+		// PTR lookups go by address, not by the reverse name
+		if qtype == "PTR" {
+			qname = name
+		}
+		system, sysErr := systemAnswers(r.ctx, qname, qtype, r.client.Timeout)
+		for i, data := range system {
+			system[i] = comparable(qtype, data)
+		}
+		slices.Sort(viaDoH)
+		slices.Sort(system)
+		viaDoH, system = slices.Compact(viaDoH), slices.Compact(system)
+
+		fmt.Fprintf(w, "\n;; %s %s: DoH vs system resolver\n", name, qtype)
+		if sysErr != nil {
+			fmt.Fprintf(w, "System resolver: %v\n", sysErr)
+			continue
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "DOH\tSYSTEM")
+		for i := range max(len(viaDoH), len(system), 1) {
+			fmt.Fprintf(tw, "%s\t%s\n", column(viaDoH, i), column(system, i))
+		}
+		tw.Flush()
+
+		switch {
+		case slices.Equal(viaDoH, system):
+			fmt.Fprintln(w, "Verdict: same")
+		case len(system) == 0:
+			fmt.Fprintln(w, "Verdict: different, the system resolver has no answer: the name may be blocked locally")
+		case (qtype == "A" || qtype == "AAAA") && !slices.ContainsFunc(system, func(s string) bool {
+			ip, err := netip.ParseAddr(s)
+			return err != nil || !blackhole(ip) || slices.Contains(viaDoH, s)
+		}):
+			fmt.Fprintln(w, "Verdict: different, the system resolver answers with a sinkhole: the name is blocked locally")
+		case len(viaDoH) == 0:
+			fmt.Fprintln(w, "Verdict: different, only the system resolver answers: a local override or redirection")
+		case !slices.ContainsFunc(system, func(s string) bool { return slices.Contains(viaDoH, s) }):
+			fmt.Fprintln(w, "Verdict: different, nothing in common: redirection, or a CDN answering by location")
+		default:
+			fmt.Fprintln(w, "Verdict: different, partly overlapping: likely a CDN or round robin rotation")
+		}
+	}
+}
+
+// column is the i-th entry of a side by side column, "-" for none
+func column(data []string, i int) string {
+	if i < len(data) {
+		return data[i]
+	}
+	if i == 0 {
+		return "-"
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// commandFlags returns the options of a command, sorted by name
+func commandFlags(c command) (flags []*flag.Flag) {
+	fs, _ := c.setup()
+	fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	return flags
+}
+
+// isBoolFlag reports whether f takes no value, as flag itself tells
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagAbout is the first line of f's usage, for the shells that show one
+func flagAbout(f *flag.Flag) string {
+	about, _, _ := strings.Cut(f.Usage, "\n")
+	return strings.TrimSpace(about)
+}
+
+// completionWords are the values the shells offer after -t (the record
+// type mnemonics) and -s (the preset providers)
+func completionWords() (types []string, providers []string) {
+
+	for _, name := range doh.TypeNames {
+		types = append(types, name)
+	}
+	slices.Sort(types)
+	providers = slices.Sorted(maps.Keys(doh.Presets))
+	return slices.Compact(types), providers
+}
+
+// cmdCompletion prints the completion script of a shell
+func cmdCompletion() (*flag.FlagSet, func(args []string) int) {
+
+	fs := newFlagSet("completion", "h53 completion bash|zsh|fish",
+		"Print a script completing h53 commands, options, record types (-t) and providers (-s):\n"+
+			"  bash: source <(h53 completion bash), or save it to /etc/bash_completion.d/h53\n"+
+			"  zsh:  source <(h53 completion zsh), after compinit\n"+
+			"  fish: h53 completion fish > ~/.config/fish/completions/h53.fish")
+	return fs, func(args []string) int {
+		parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		switch fs.Arg(0) {
+		case "bash":
+			bashCompletion(os.Stdout)
+		case "zsh":
+			// zsh runs bash completion functions, once bashcompinit defines
+			// complete and compgen for it
+			fmt.Fprint(os.Stdout, "autoload -U +X bashcompinit && bashcompinit\n")
+			bashCompletion(os.Stdout)
+		case "fish":
+			fishCompletion(os.Stdout)
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown shell: %s (use bash, zsh or fish)\n", fs.Arg(0))
+			return 1
+		}
+		return 0
+	}
+}
+
+// bashCompletion writes the bash completion function: options per command,
+// -t and -s values (after the last comma of a list too), files otherwise
+func bashCompletion(w io.Writer) {
+
+	types, providers := completionWords()
+	fmt.Fprintf(w, `# h53 bash completion, generated by h53 completion bash
+_h53() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	local commands=%q
+	local cmd=query flags values
+	if [[ $COMP_CWORD -gt 1 && " $commands " == *" ${COMP_WORDS[1]} "* ]]; then
+		cmd=${COMP_WORDS[1]}
+	fi
+	case $prev in
+	-t) values=%q ;;
+	-s) values=%q ;;
+	esac
+	if [[ -n $values ]]; then
+		local last=${cur##*,}
+		COMPREPLY=($(compgen -W "$values" -P "${cur%%"$last"}" -- "$last"))
+		return
+	fi
+	case $cmd in
+`, strings.Join(append(slices.Clone(commandNames), "help"), " "), strings.Join(types, " "), strings.Join(providers, " "))
+
+	for _, name := range commandNames {
+		var all, valued []string
+		for _, f := range commandFlags(commands[name]) {
+			all = append(all, "-"+f.Name)
+			if !isBoolFlag(f) {
+				valued = append(valued, "-"+f.Name)
+			}
+		}
+		fmt.Fprintf(w, "\t%s)\n\t\tflags=%q\n\t\tcase $prev in %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;; esac\n\t\t;;\n",
+			name, strings.Join(all, " "), strings.Join(valued, "|"))
+	}
+	fmt.Fprint(w, `	esac
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	elif [[ $COMP_CWORD -eq 1 || ${COMP_WORDS[1]} == help && $COMP_CWORD -eq 2 ]]; then
+		COMPREPLY=($(compgen -W "$commands" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -o filenames -F _h53 h53
+`)
+}
+
+// fishCompletion writes the fish completions: the commands with their
+// descriptions, then the options of each, described
+func fishCompletion(w io.Writer) {
+
+	quote := func(s string) string {
+		return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", `\'`) + "'"
+	}
+	types, providers := completionWords()
+
+	fmt.Fprint(w, "# h53 fish completion, generated by h53 completion fish\n")
+	for _, name := range commandNames {
+		fmt.Fprintf(w, "complete -c h53 -n __fish_use_subcommand -f -a %s -d %s\n", name, quote(commands[name].about))
+	}
+	fmt.Fprintf(w, "complete -c h53 -n __fish_use_subcommand -f -a help -d %s\n", quote("Show the options of a command"))
+	fmt.Fprintf(w, "complete -c h53 -n '__fish_seen_subcommand_from help' -f -a %s\n", quote(strings.Join(commandNames, " ")))
+
+	for _, name := range commandNames {
+		// query runs when no command is given too
+		cond := "__fish_seen_subcommand_from " + name
+		if name == "query" {
+			others := slices.DeleteFunc(slices.Clone(commandNames), func(n string) bool { return n == "query" })
+			cond = "not __fish_seen_subcommand_from " + strings.Join(others, " ")
+		}
+		for _, f := range commandFlags(commands[name]) {
+			arg := ""
+			switch {
+			case f.Name == "t":
+				arg = " -x -a " + quote(strings.Join(types, " "))
+			case f.Name == "s":
+				arg = " -x -a " + quote(strings.Join(providers, " "))
+			case !isBoolFlag(f):
+				arg = " -r"
+			}
+			fmt.Fprintf(w, "complete -c h53 -n %s -o %s%s -d %s\n", quote(cond), f.Name, arg, quote(flagAbout(f)))
+		}
+	}
+}
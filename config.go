@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// Config file (~/.h53.yaml or -config), a small YAML subset:
+//
+//	# defaults for any command, by flag name or by the long names below
+//	server: google,quad9
+//	fallback: true
+//	timeout: 5
+//	output: json
+//	proxy: socks5h://127.0.0.1:9050
+//
+//	# Authorization for private endpoints, by provider name or host
+//	credentials:
+//	  doh.corp.example:
+//	    token: s3cr3t          # Authorization: Bearer s3cr3t
+//	  https://doh.example/dns-query:
+//	    basic: user:pass       # Authorization: Basic ...
+//
+//	# Records serve answers itself, by name: values comma separated, ttl
+//	# optional (see localZone)
+//	records:
+//	  nas.lab:
+//	    ttl: 60
+//	    A: 192.168.1.10, 192.168.1.11
+//	  www.lab:
+//	    CNAME: nas.lab
+//
+// Options given on the command line or in the environment take precedence.
+// Settings that do not apply to the command being run are ignored.
+
+// configAliases are the long names single letter options go by in the
+// config file and the environment
+var configAliases = map[string]string{
+	"server":         "s",
+	"timeout":        "T",
+	"output":         "o",
+	"type":           "t",
+	"name":           "n",
+	"file":           "f",
+	"debug":          "d",
+	"verbose":        "v",
+	"concurrency":    "c",
+	"request-header": "H",
+	"user-agent":     "A",
+}
+
+// envName is the environment variable for the option called name:
+// H53_ and its long name, upper cased, dashes turned to underscores
+// (-s is H53_SERVER, -cache-file H53_CACHE_FILE).
+func envName(name string) string {
+	for long, short := range configAliases {
+		if short == name {
+			name = long
+			break
+		}
+	}
+	return "H53_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// config is a loaded config file
+type config struct {
+	values map[string]string     // flag name -> value
+	creds  map[string]credential // provider name or host -> credential
+
+	records map[string]map[string]string // name -> type (or TTL) -> data, the records section
+}
+
+// credential authenticates to a private DoH endpoint
+type credential struct {
+	token string // bearer token
+	basic string // user:pass
+}
+
+// header renders the credential as an Authorization header value
+func (c credential) header() string {
+	if c.token != "" {
+		return "Bearer " + c.token
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.basic))
+}
+
+// conf is the config file of this run, loaded by parseArgs
+var conf = &config{}
+
+// auth returns the Authorization header value configured for provider p
+func (c *config) auth(p doh.Provider) string {
+	for _, k := range []string{p.Name, p.URL.String(), p.URL.Host, p.URL.Hostname()} {
+		if cred, ok := c.creds[k]; ok {
+			return cred.header()
+		}
+	}
+	return ""
+}
+
+// parseArgs parses args into fs, then fills in the options not given on
+// the command line from H53_* environment variables (see envName) and after
+// that from the config file. It returns the names of the options set any of
+// these ways, and of those set on the command line.
+func parseArgs(fs *flag.FlagSet, args []string) (set map[string]bool, cli map[string]bool) {
+
+	parseInterspersed(fs, args)
+	cli = visited(fs)
+
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if cli[f.Name] || !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", envName(f.Name), err)
+			os.Exit(1)
+		}
+	})
+	env := visited(fs)
+
+	path := fs.Lookup("config").Value.String()
+	explicit := path != ""
+	if !explicit {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".h53.yaml")
+		}
+	}
+	c, err := loadConfig(path, explicit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config file: %v\n", err)
+		os.Exit(1)
+	}
+	conf = c
+
+	for name, value := range c.values {
+		if env[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			fmt.Fprintf(os.Stderr, "Config file: %s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+	return visited(fs), cli
+}
+
+// parseInterspersed parses args into fs allowing options after the
+// arguments too (h53 rbl 192.0.2.1 -lists ...), as far as a "--". The
+// arguments are left in fs.Args(), in order.
+func parseInterspersed(fs *flag.FlagSet, args []string) {
+
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if len(rest) == 0 || (len(rest) < len(args) && args[len(args)-len(rest)-1] == "--") {
+			positional = append(positional, rest...)
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	fs.Parse(append([]string{"--"}, positional...))
+}
+
+// loadConfig reads the config file at path. A missing file is an error
+// only when it was asked for explicitly.
+func loadConfig(path string, explicit bool) (*config, error) {
+
+	c := &config{values: make(map[string]string), creds: make(map[string]credential),
+		records: make(map[string]map[string]string)}
+	if path == "" {
+		return c, nil
+	}
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) && !explicit {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	// Keys of the enclosing mappings, by indentation
+	type level struct {
+		indent int
+		key    string
+	}
+	var stack []level
+
+	s := bufio.NewScanner(fh)
+	for n := 1; s.Scan(); n++ {
+		line := stripComment(s.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		// A colon only ends the key when followed by a space or the line end,
+		// so URLs work as keys
+		t := strings.TrimSpace(line)
+		var key, value string
+		if i := strings.Index(t, ": "); i >= 0 {
+			key, value = t[:i], t[i+2:]
+		} else if strings.HasSuffix(t, ":") {
+			key = t[:len(t)-1]
+		} else {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, n)
+		}
+		if strings.HasPrefix(key, "- ") {
+			return nil, fmt.Errorf("%s:%d: lists are not supported", path, n)
+		}
+		key, value = unquote(strings.TrimSpace(key)), unquote(strings.TrimSpace(value))
+
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		if value == "" {
+			stack = append(stack, level{indent, key})
+			continue
+		}
+
+		switch {
+		case len(stack) == 0:
+			if alias, ok := configAliases[key]; ok {
+				key = alias
+			}
+			c.values[key] = value
+		case len(stack) == 2 && stack[0].key == "credentials":
+			cred := c.creds[stack[1].key]
+			switch key {
+			case "token":
+				cred.token = value
+			case "basic":
+				cred.basic = value
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown credential %s (token or basic)", path, n, key)
+			}
+			c.creds[stack[1].key] = cred
+		case len(stack) == 2 && stack[0].key == "records":
+			name := strings.ToLower(strings.TrimSuffix(stack[1].key, "."))
+			if c.records[name] == nil {
+				c.records[name] = make(map[string]string)
+			}
+			c.records[name][strings.ToUpper(key)] = value
+		default:
+			return nil, fmt.Errorf("%s:%d: unexpected %s", path, n, key)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// stripComment drops a # comment, unless the # is quoted or part of a word
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquote removes matching single or double quotes around s
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
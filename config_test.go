@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runQuery runs the query command against a JSON DoH server answering
+// every lookup with one A record, returning its standard output
+func runQuery(t *testing.T, args ...string) string {
+
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/dns-json")
+		io.WriteString(w, `{"Status":0,"Question":[{"name":"example.com.","type":1}],`+
+			`"Answer":[{"name":"example.com.","type":1,"TTL":60,"data":"192.0.2.1"}]}`)
+	}))
+	defer srv.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	code := commands["query"].run(append([]string{"-s", srv.URL + "/resolve", "-t", "A", "-n", "example.com", "-o", "csv"}, args...))
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if code != 0 {
+		t.Fatalf("exit %d, output %q", code, out)
+	}
+	return string(out)
+}
+
+// -header is set from the config file and the environment by its own
+// name, not taken for -H (request-header)
+func TestHeaderFromConfigAndEnv(t *testing.T) {
+
+	t.Setenv("HOME", t.TempDir())
+	columns := strings.Join(recordColumns, ",") + "\n"
+
+	if out := runQuery(t); strings.HasPrefix(out, columns) {
+		t.Fatalf("header row without -header: %q", out)
+	}
+
+	path := filepath.Join(t.TempDir(), "h53.yaml")
+	if err := os.WriteFile(path, []byte("header: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if out := runQuery(t, "-config", path); !strings.HasPrefix(out, columns) {
+		t.Errorf("config header: true: no header row in %q", out)
+	}
+
+	t.Setenv("H53_HEADER", "true")
+	if out := runQuery(t); !strings.HasPrefix(out, columns) {
+		t.Errorf("H53_HEADER=true: no header row in %q", out)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// cmdConnect resolves host over DoH and connects to it (see runConnect)
+func cmdConnect() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optTLS bool
+	var optInsecure bool
+	var optCacheFile string
+
+	fs := newFlagSet("connect", "h53 connect [options] host:port",
+		"Resolve host over DoH, then connect to the answer (TLS with SNI for port 443 or -tls).")
+	co.register(fs)
+	fs.BoolVar(&optTLS, "tls", false,
+		"Perform a TLS handshake (default for port 443)")
+	fs.BoolVar(&optInsecure, "insecure", false,
+		"Do not verify the server certificate")
+	fs.StringVar(&optCacheFile, "cache-file", "",
+		"Persist cached answers (TTL honoring) across runs Ex.: h53.cache")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, err := newCache(optCacheFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load cache file: %v\n", err)
+			return 1
+		}
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		_, port, _ := net.SplitHostPort(fs.Arg(0))
+		useTLS := optTLS || port == "443"
+		return exit(store, runConnect(r, fs.Arg(0), useTLS, optInsecure, client.Timeout))
+	}
+}
+
+// addresses extracts the A/AAAA addresses from an answer set, skipping
+// CNAMEs and anything else that is not an address.
+func addresses(jdns *doh.DNSJ) []netip.Addr {
+	var addrs []netip.Addr
+	for _, a := range jdns.Answers {
+		if a.Type != 1 && a.Type != 28 {
+			continue
+		}
+		if ip, err := netip.ParseAddr(a.Data); err == nil {
+			addrs = append(addrs, ip)
+		}
+	}
+	return addrs
+}
+
+// resolveAddrs resolves host to its addresses over DoH, trying A before AAAA.
+// IP literals are returned as is.
+func (r *resolver) resolveAddrs(host string) ([]netip.Addr, int) {
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, 0
+	}
+
+	code := 4
+	for _, qtype := range []string{"A", "AAAA"} {
+		jdns, err := r.lookup(host, qtype)
+		if err != nil {
+			if code = exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+			continue
+		}
+		if addrs := addresses(jdns); len(addrs) != 0 {
+			return addrs, 0
+		}
+	}
+	return nil, code
+}
+
+// runConnect resolves the host of target (host:port) over DoH and opens a TCP
+// connection to the fastest of its addresses (see happyEyeballs), followed by a
+// TLS handshake with SNI set to the original hostname when useTLS is set. It
+// reports each step with its latency: this is the end to end check that a
+// DNS-only block was bypassed.
+func runConnect(r *resolver, target string, useTLS bool, insecure bool, timeout time.Duration) int {
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid target, expected host:port: %v\n", err)
+		return 1
+	}
+
+	start := time.Now()
+	addrs, code := r.resolveAll(host)
+	if code != 0 {
+		fmt.Fprintf(os.Stderr, "Unable to resolve %s\n", host)
+		return code
+	}
+	var list []string
+	for _, a := range addrs {
+		list = append(list, a.String())
+	}
+	fmt.Printf("Resolved %s -> %s in %v\n", host, strings.Join(list, ", "), time.Since(start).Round(time.Millisecond))
+
+	// Happy Eyeballs: every address gets its chance, the fastest wins
+	winner, attempts := happyEyeballs(r.ctx, addrs, port, timeout)
+	for _, a := range attempts {
+		addr := net.JoinHostPort(a.addr.String(), port)
+		switch {
+		case a == winner:
+			fmt.Printf("TCP connect %s ok in %v (%s won, %d of %d addresses tried)\n", addr,
+				a.took.Round(time.Millisecond), family(a.addr), len(attempts), len(addrs))
+		case winner != nil && a.err != nil && r.ctx.Err() == nil && errors.Is(a.err, context.Canceled):
+			fmt.Printf("TCP connect %s cancelled after %v, lost the race\n", addr, a.took.Round(time.Millisecond))
+		case a.err != nil:
+			fmt.Fprintf(os.Stderr, "TCP connect %s failed after %v: %v\n", addr, a.took.Round(time.Millisecond), a.err)
+		default:
+			fmt.Printf("TCP connect %s ok in %v, after the winner\n", addr, a.took.Round(time.Millisecond))
+		}
+	}
+	if winner == nil {
+		if r.ctx.Err() != nil {
+			return exitInterrupted
+		}
+		return 7
+	}
+	conn, addr := winner.conn, net.JoinHostPort(winner.addr.String(), port)
+	defer conn.Close()
+
+	if !useTLS {
+		return 0
+	}
+
+	tc := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: insecure})
+	tc.SetDeadline(time.Now().Add(timeout))
+	start = time.Now()
+	if err = tc.Handshake(); err != nil {
+		fmt.Fprintf(os.Stderr, "TLS handshake with %s (SNI %s) failed: %v\n", addr, host, err)
+		return 8
+	}
+
+	st := tc.ConnectionState()
+	fmt.Printf("TLS handshake ok in %v: %s, %s, ALPN %q\n", time.Since(start).Round(time.Millisecond),
+		tls.VersionName(st.Version), tls.CipherSuiteName(st.CipherSuite), st.NegotiatedProtocol)
+	if len(st.PeerCertificates) != 0 {
+		cert := st.PeerCertificates[0]
+		fmt.Printf("Certificate: %s, issuer %s, SANs %s, expires %s, SHA256 %x\n",
+			cert.Subject, cert.Issuer, strings.Join(cert.DNSNames, ","),
+			cert.NotAfter.Format(time.RFC3339), sha256.Sum256(cert.Raw))
+	}
+	return 0
+}
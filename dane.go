@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// tlsaUsages are the names of the TLSA certificate usages (RFC 7218)
+var tlsaUsages = []string{"PKIX-TA", "PKIX-EE", "DANE-TA", "DANE-EE"}
+
+// starttlsPorts are the protocols spoken in the clear before STARTTLS, by
+// well known port
+var starttlsPorts = map[string]string{"25": "smtp", "587": "smtp", "143": "imap", "110": "pop3"}
+
+// cmdDANE fetches the TLSA records of a service over DoH, connects to it and
+// checks the certificate it presents against them (RFC 6698, RFC 7671).
+func cmdDANE() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optStartTLS string
+
+	fs := newFlagSet("dane", "h53 dane [options] host:port",
+		"Fetch the TLSA records of host:port over DoH and verify the certificate the service presents against them.")
+	co.register(fs)
+	fs.StringVar(&optStartTLS, "starttls", "",
+		"Protocol to upgrade with STARTTLS: smtp, imap, pop3 or none (default: smtp for 25/587, imap for 143, pop3 for 110)")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		host, port, err := net.SplitHostPort(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid target, expected host:port: %v\n", err)
+			return 1
+		}
+		if optStartTLS == "" {
+			optStartTLS = starttlsPorts[port]
+		}
+		switch optStartTLS {
+		case "", "none", "smtp", "imap", "pop3":
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown STARTTLS protocol (-starttls): %s\n", optStartTLS)
+			return 1
+		}
+
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		// TLSA records are only worth something when DNSSEC validated
+		client.DO = true
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		name := fmt.Sprintf("_%s._tcp.%s", port, host)
+		jdns, err := r.lookup(name, "TLSA")
+		if err == nil {
+			err = jdns.Err()
+		}
+		if err != nil {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return code
+			}
+			return exitInterrupted
+		}
+		var records []doh.TLSA
+		for _, a := range jdns.Answers {
+			if t, err := doh.ParseTLSA(a.Data); a.Type == 52 && err == nil {
+				records = append(records, t)
+			}
+		}
+		if len(records) == 0 {
+			fmt.Fprintf(os.Stderr, "No TLSA records at %s\n", name)
+			return 4
+		}
+		fmt.Printf("%s: %d TLSA records\n", name, len(records))
+		if jdns.AD {
+			fmt.Println("DNSSEC: validated (AD)")
+		} else {
+			fmt.Println("DNSSEC: NOT validated, DANE is not to be relied on")
+		}
+
+		addrs, code := r.resolveAddrs(host)
+		if code != 0 {
+			fmt.Fprintf(os.Stderr, "Unable to resolve %s\n", host)
+			return code
+		}
+		addr := net.JoinHostPort(addrs[0].String(), port)
+		chain, err := fetchChain(addr, host, optStartTLS, client.Timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 8
+		}
+		leaf := chain[0]
+		fmt.Printf("Certificate from %s: %s, issuer %s, expires %s, %d in chain\n", addr,
+			leaf.Subject, leaf.Issuer, leaf.NotAfter.Format(time.RFC3339), len(chain))
+
+		matched := false
+		for _, t := range records {
+			ok, why := verifyTLSA(t, host, chain)
+			verdict := "no match"
+			if ok {
+				verdict, matched = "MATCH", true
+			}
+			fmt.Printf("  %d %d %d %x: %s, %s\n", t.Usage, t.Selector, t.MatchingType, t.Data, verdict, why)
+		}
+		switch {
+		case !matched:
+			fmt.Println("DANE: the certificate matches no TLSA record")
+			return exitCheckFailed
+		case !jdns.AD:
+			fmt.Println("DANE: matched, but the TLSA records are not DNSSEC validated")
+			return 6
+		}
+		fmt.Println("DANE: verified")
+		return 0
+	}
+}
+
+// fetchChain connects to addr, upgrades with STARTTLS when starttls names
+// a protocol, and returns the certificates the server presents. Nothing is
+// verified here, that is up to the TLSA records.
+func fetchChain(addr string, host string, starttls string, timeout time.Duration) ([]*x509.Certificate, error) {
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("TCP connect to %s failed: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := startTLS(conn, starttls); err != nil {
+		return nil, fmt.Errorf("STARTTLS (%s) with %s failed: %v", starttls, addr, err)
+	}
+	tc := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s (SNI %s) failed: %v", addr, host, err)
+	}
+	chain := tc.ConnectionState().PeerCertificates
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", addr)
+	}
+	return chain, nil
+}
+
+// startTLS speaks protocol on conn up to the point the server expects the
+// TLS handshake
+func startTLS(conn net.Conn, protocol string) error {
+
+	br := bufio.NewReader(conn)
+	expect := func(prefix string) error {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, prefix) {
+			return fmt.Errorf("unexpected reply: %s", strings.TrimSpace(line))
+		}
+		return nil
+	}
+
+	switch protocol {
+	case "smtp":
+		tp := textproto.NewConn(conn)
+		if _, _, err := tp.ReadResponse(220); err != nil {
+			return err
+		}
+		id, err := tp.Cmd("EHLO h53")
+		if err != nil {
+			return err
+		}
+		tp.StartResponse(id)
+		_, msg, err := tp.ReadResponse(250)
+		tp.EndResponse(id)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(strings.ToUpper(msg), "STARTTLS") {
+			return fmt.Errorf("STARTTLS is not offered")
+		}
+		id, err = tp.Cmd("STARTTLS")
+		if err != nil {
+			return err
+		}
+		tp.StartResponse(id)
+		defer tp.EndResponse(id)
+		_, _, err = tp.ReadResponse(220)
+		return err
+	case "imap":
+		if err := expect("* OK"); err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte("a1 STARTTLS\r\n")); err != nil {
+			return err
+		}
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(line, "a1 ") {
+				if !strings.HasPrefix(line, "a1 OK") {
+					return fmt.Errorf("unexpected reply: %s", strings.TrimSpace(line))
+				}
+				return nil
+			}
+		}
+	case "pop3":
+		if err := expect("+OK"); err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte("STLS\r\n")); err != nil {
+			return err
+		}
+		return expect("+OK")
+	}
+	return nil
+}
+
+// tlsaMatches reports whether cert is the one t describes
+func tlsaMatches(t doh.TLSA, cert *x509.Certificate) bool {
+
+	data := cert.Raw
+	if t.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch t.MatchingType {
+	case 0:
+		return bytes.Equal(data, t.Data)
+	case 1:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], t.Data)
+	case 2:
+		sum := sha512.Sum512(data)
+		return bytes.Equal(sum[:], t.Data)
+	}
+	return false
+}
+
+// verifyTLSA checks chain, leaf first, against one TLSA record according to
+// its certificate usage (RFC 7671 5) and says why it did or did not match
+func verifyTLSA(t doh.TLSA, host string, chain []*x509.Certificate) (bool, string) {
+
+	if t.Usage >= len(tlsaUsages) || t.Selector > 1 || t.MatchingType > 2 {
+		return false, "unusable record (unknown usage, selector or matching type)"
+	}
+	usage := tlsaUsages[t.Usage]
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	pkix := func() ([][]*x509.Certificate, error) {
+		return leaf.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	}
+
+	switch usage {
+	case "DANE-EE":
+		// The key is pinned by DNSSEC alone: names and dates do not matter
+		if tlsaMatches(t, leaf) {
+			return true, usage + ": the server certificate matches"
+		}
+		return false, usage + ": the server certificate differs"
+	case "DANE-TA":
+		for _, c := range chain {
+			if !tlsaMatches(t, c) {
+				continue
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(c)
+			_, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates})
+			if err != nil {
+				return false, fmt.Sprintf("%s: trust anchor %s matches, but %v", usage, c.Subject, err)
+			}
+			return true, fmt.Sprintf("%s: chains to trust anchor %s", usage, c.Subject)
+		}
+		return false, usage + ": no certificate in the chain matches"
+	case "PKIX-EE":
+		if !tlsaMatches(t, leaf) {
+			return false, usage + ": the server certificate differs"
+		}
+		if _, err := pkix(); err != nil {
+			return false, fmt.Sprintf("%s: the server certificate matches, but %v", usage, err)
+		}
+		return true, usage + ": the server certificate matches and is publicly trusted"
+	default: // PKIX-TA
+		verified, err := pkix()
+		if err != nil {
+			return false, fmt.Sprintf("%s: %v", usage, err)
+		}
+		for _, vc := range verified {
+			for _, c := range vc[1:] {
+				if tlsaMatches(t, c) {
+					return true, fmt.Sprintf("%s: publicly trusted, through %s", usage, c.Subject)
+				}
+			}
+		}
+		return false, usage + ": publicly trusted, but no CA in the chain matches"
+	}
+}
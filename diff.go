@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// rrKey identifies an RRset, or the question of a lookup: owner and type
+type rrKey struct {
+	name  string
+	rtype int
+}
+
+func (k rrKey) String() string { return k.name + " " + doh.TypeString(k.rtype) }
+
+// resultSet is what lookups answered, for comparison: the RCODE of each
+// question and the records of each RRset, data to TTL
+type resultSet struct {
+	status map[rrKey]int
+	rrsets map[rrKey]map[string]int
+}
+
+func newResultSet() *resultSet {
+	return &resultSet{status: make(map[rrKey]int), rrsets: make(map[rrKey]map[string]int)}
+}
+
+// add takes in the outcome of one lookup
+func (s *resultSet) add(jdns *doh.DNSJ) {
+	for _, q := range jdns.Questions {
+		s.status[rrKey{fqdn(strings.ToLower(q.Name)), q.Type}] = jdns.Status
+	}
+	for _, a := range jdns.Answers {
+		k := rrKey{fqdn(strings.ToLower(a.Name)), a.Type}
+		if s.rrsets[k] == nil {
+			s.rrsets[k] = make(map[string]int)
+		}
+		s.rrsets[k][a.Data] = a.TTL
+	}
+}
+
+// changes lists what differs from s to o: RCODEs of the questions both
+// asked, records removed (-), added (+), and changed (~) when an RRset
+// swapped one record for another, or, with ttl, kept a record at another TTL
+func (s *resultSet) changes(o *resultSet, ttl bool) []string {
+
+	var out []string
+	for _, k := range sortedRRKeys(s.status) {
+		if n, ok := o.status[k]; ok && n != s.status[k] {
+			out = append(out, fmt.Sprintf("~ %s %s -> %s", k, doh.RcodeString(s.status[k]), doh.RcodeString(n)))
+		}
+	}
+
+	keys := sortedRRKeys(s.rrsets)
+	for k := range o.rrsets {
+		if _, ok := s.rrsets[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.SortStableFunc(keys, compareRRKeys)
+	for _, k := range keys {
+		old, cur := s.rrsets[k], o.rrsets[k]
+		var removed, added []string
+		for d := range old {
+			if _, ok := cur[d]; !ok {
+				removed = append(removed, d)
+			}
+		}
+		for d := range cur {
+			if _, ok := old[d]; !ok {
+				added = append(added, d)
+			}
+		}
+		slices.Sort(removed)
+		slices.Sort(added)
+		if len(removed) == 1 && len(added) == 1 {
+			out = append(out, fmt.Sprintf("~ %s %s -> %s", k, removed[0], added[0]))
+		} else {
+			for _, d := range removed {
+				out = append(out, fmt.Sprintf("- %s %s", k, d))
+			}
+			for _, d := range added {
+				out = append(out, fmt.Sprintf("+ %s %s", k, d))
+			}
+		}
+		if !ttl {
+			continue
+		}
+		for _, d := range slices.Sorted(maps.Keys(old)) {
+			if t, ok := cur[d]; ok && t != old[d] {
+				out = append(out, fmt.Sprintf("~ %s %s TTL %d -> %d", k, d, old[d], t))
+			}
+		}
+	}
+	return out
+}
+
+func compareRRKeys(a, b rrKey) int {
+	if c := strings.Compare(a.name, b.name); c != 0 {
+		return c
+	}
+	return a.rtype - b.rtype
+}
+
+func sortedRRKeys[V any](m map[rrKey]V) []rrKey {
+	keys := make([]rrKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, compareRRKeys)
+	return keys
+}
+
+// readResults loads the responses of a file of -o json output, one JSON
+// object per lookup; error objects are skipped
+func readResults(path string) (*resultSet, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := newResultSet()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for n := 0; ; n++ {
+		var jdns doh.DNSJ
+		err := dec.Decode(&jdns)
+		if errors.Is(err, io.EOF) {
+			if n == 0 {
+				return nil, fmt.Errorf("%s: no lookups", path)
+			}
+			return s, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v (expected h53 -o json output)", path, err)
+		}
+		s.add(&jdns)
+	}
+}
+
+// cmdDiff compares two result sets: two files of saved -o json output, or
+// the answers of now against the last ones in the history file
+func cmdDiff() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optHistory string
+	var optName string
+	var optType string
+	var optTTL bool
+
+	fs := newFlagSet("diff", "h53 diff [options] old.json new.json\n  h53 diff [options] -history path -n name [-t types]",
+		"Compare the answers of two saved h53 -o json outputs, or resolve -n and compare with its last lookup\n"+
+			"in the -history file (which then records this one). Prints the records removed (-), added (+)\n"+
+			"and changed (~), and RCODE changes; exits 9 when anything differs.")
+	co.register(fs)
+	fs.StringVar(&optHistory, "history", "",
+		"History file to compare the current answers with, see h53 history")
+	fs.StringVar(&optName, "n", "",
+		"Name to resolve and compare with its last lookup in -history")
+	fs.StringVar(&optType, "t", "A",
+		"Query types, comma separated Ex.: A,AAAA")
+	fs.BoolVar(&optTTL, "ttl", false,
+		"Report TTL changes too (caches count TTLs down, so they differ between most lookups)")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		var old, cur *resultSet
+		missing := false // a -history lookup had no earlier one
+		switch {
+		case fs.NArg() == 2 && optName == "":
+			var err error
+			if old, err = readResults(fs.Arg(0)); err == nil {
+				cur, err = readResults(fs.Arg(1))
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+
+		case fs.NArg() == 0 && optName != "" && optHistory != "":
+			client, err := co.client(set, 1)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			store, _ := newCache("")
+			r := &resolver{ctx: signalContext(), client: client, cache: store}
+			old, cur = newResultSet(), newResultSet()
+			for _, t := range splitTypes(optType) {
+				name, qtype, err := queryFor(optName, t)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+					return 1
+				}
+				last, err := lastLookup(optHistory, name, qtype)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to read history: %v\n", err)
+					return 1
+				}
+				if r.history == nil {
+					if r.history, err = openHistory(optHistory); err != nil {
+						fmt.Fprintf(os.Stderr, "Unable to open history file: %v\n", err)
+						return 1
+					}
+				}
+				jdns, err := r.lookup(name, qtype)
+				if err != nil {
+					if code := exitCode(err); code != exitInterrupted {
+						fmt.Fprintf(os.Stderr, "%s %s: %v\n", name, qtype, err)
+						return code
+					}
+					return exitInterrupted
+				}
+				// Without a baseline, this lookup becomes the one the next run
+				// compares with
+				if last == nil {
+					fmt.Fprintf(os.Stderr, "No earlier lookup of %s %s in %s, recorded this one\n", fqdn(name), strings.ToUpper(qtype), optHistory)
+					missing = true
+					continue
+				}
+				old.add(last)
+				cur.add(jdns)
+			}
+
+		default:
+			fs.Usage()
+			return 1
+		}
+
+		changes := old.changes(cur, optTTL)
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+		if len(changes) != 0 {
+			return exitCheckFailed
+		}
+		if missing {
+			return 4
+		}
+		return 0
+	}
+}
+
+// lastLookup returns the last lookup of name/qtype the history file at path
+// holds as a response, nil when there is none. Failed lookups are passed
+// over: they answered nothing to compare with.
+func lastLookup(path string, name string, qtype string) (*doh.DNSJ, error) {
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	name, qtype = fqdn(strings.ToLower(name)), strings.ToUpper(qtype)
+	var last *historyEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e historyEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.Name == name && e.Type == qtype && e.Error == "" {
+			last = &e
+		}
+	}
+	if err := sc.Err(); err != nil || last == nil {
+		return nil, err
+	}
+	return last.dnsj()
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// rootAnchors are the DS records of the root key signing keys, KSK-2017 and
+// KSK-2024 (https://data.iana.org/root-anchors/root-anchors.xml)
+const rootAnchors = "20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D," +
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16"
+
+// rrset is the records of one name and type along with their signatures
+type rrset struct {
+	records []doh.Answer
+	sigs    []doh.RRSIG
+}
+
+// signedZone is a zone of the chain of trust and its keys
+type signedZone struct {
+	name string
+	keys []doh.DNSKEY
+}
+
+// cmdDNSSEC follows the chain of trust from the root down to a name: at each
+// zone, the DS records at the parent against the zone's DNSKEYs, and the
+// signatures over both, with a verdict per link
+func cmdDNSSEC() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optAnchor string
+
+	fs := newFlagSet("dnssec", "h53 dnssec [options] name",
+		"Follow the DNSSEC chain of trust from the root to name over DoH: DS digests against DNSKEYs,\n"+
+			"RRSIG signatures and validity windows, with pass or fail per link.")
+	co.register(fs)
+	fs.StringVar(&optAnchor, "anchor", rootAnchors,
+		"Root trust anchors as DS data, comma separated")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		var anchors []doh.DS
+		for _, a := range strings.Split(optAnchor, ",") {
+			ds, err := doh.ParseDS(a)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid trust anchor (-anchor): %v\n", err)
+				return 1
+			}
+			anchors = append(anchors, ds)
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		// The records and signatures are wanted even when they do not validate,
+		// that is the point
+		client.DO, client.CD = true, true
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		name := fqdn(strings.ToLower(strings.TrimSuffix(fs.Arg(0), ".")))
+		labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+		now := time.Now()
+
+		var count [3]int
+		report := func(verdict int, check string, format string, args ...any) {
+			fmt.Printf("  %s  %-6s  %s\n", verdictNames[verdict], check, fmt.Sprintf(format, args...))
+			count[verdict]++
+		}
+		fail := func(err error) int {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return code
+			}
+			return exitInterrupted
+		}
+
+		var chain []string
+		var parent *signedZone
+		insecure := ""
+		for i := len(labels); i >= 0; i-- {
+			zone := fqdn(strings.Join(labels[i:], "."))
+			keys, err := r.signedSet(zone, "DNSKEY")
+			if err != nil {
+				return fail(err)
+			}
+			var ds rrset
+			if parent != nil {
+				if ds, err = r.signedSet(zone, "DS"); err != nil {
+					return fail(err)
+				}
+			}
+			if keys.records == nil && ds.records == nil {
+				// Not a zone, or one without DNSSEC: after a signed parent
+				// without a DS, everything below is insecure
+				if parent != nil && insecure == "" && r.isZone(zone) {
+					insecure = zone
+					fmt.Println(zone)
+					report(checkWarn, "DS", "no DS at %s: an insecure (unsigned) delegation, the chain ends here", parent.name)
+				}
+				continue
+			}
+			if insecure != "" {
+				continue
+			}
+			fmt.Println(zone)
+			chain = append(chain, zone)
+
+			// DS: the trust anchors for the root, else the parent's, signed by it
+			var dsData []doh.DS
+			if parent == nil {
+				dsData = anchors
+			} else {
+				verifySet(report, "DS", ds, parent, now)
+				for _, a := range ds.records {
+					if d, err := doh.ParseDS(a.Data); err == nil {
+						dsData = append(dsData, d)
+					}
+				}
+			}
+
+			z := &signedZone{name: zone}
+			var desc []string
+			for _, a := range keys.records {
+				k, err := doh.ParseDNSKEY(a.Data)
+				if err != nil {
+					continue
+				}
+				z.keys = append(z.keys, k)
+				role := "ZSK"
+				if k.KSK() {
+					role = "KSK"
+				}
+				desc = append(desc, fmt.Sprintf("%d %s %s", k.KeyTag(), role, algorithmName(k.Algorithm)))
+			}
+			if z.keys == nil {
+				report(checkFail, "DNSKEY", "no DNSKEY records, while %s has DS records for the zone", parent.name)
+				parent = z
+				continue
+			}
+			report(checkPass, "DNSKEY", "%d keys: %s", len(z.keys), strings.Join(desc, ", "))
+
+			// The keys the DS records vouch for must sign the DNSKEY set
+			entry := &signedZone{name: zone}
+			for _, d := range dsData {
+				what := "DS"
+				if parent == nil {
+					what = "trust anchor"
+				}
+				i := slices.IndexFunc(z.keys, func(k doh.DNSKEY) bool { return d.Matches(zone, k) })
+				if i < 0 {
+					verdict := checkFail
+					if _, err := (doh.DNSKEY{}).Digest(zone, d.DigestType); err != nil {
+						verdict = checkWarn
+					}
+					report(verdict, "DS", "%s %d %s matches no DNSKEY", what, d.KeyTag, digestName(d.DigestType))
+					continue
+				}
+				report(checkPass, "DS", "%s %d %s matches key %d", what, d.KeyTag, digestName(d.DigestType), z.keys[i].KeyTag())
+				entry.keys = append(entry.keys, z.keys[i])
+			}
+			if entry.keys == nil {
+				report(checkFail, "DS", "no DS record matches a DNSKEY of the zone: the chain of trust is broken")
+			}
+			verifySet(report, "DNSKEY", keys, entry, now)
+			parent = z
+		}
+
+		// The name's own addresses, signed by the zone's keys
+		if parent != nil && insecure == "" {
+			for _, qtype := range []string{"A", "AAAA"} {
+				set, err := r.signedSet(name, qtype)
+				if err != nil {
+					return fail(err)
+				}
+				if set.records != nil {
+					fmt.Println(name)
+					verifySet(report, qtype, set, parent, now)
+					break
+				}
+			}
+		}
+
+		fmt.Printf("Summary: %d pass, %d warn, %d fail\n", count[checkPass], count[checkWarn], count[checkFail])
+		switch {
+		case chain == nil:
+			fmt.Println("Chain of trust: none, no DNSKEY records at the root")
+			return 4
+		case count[checkFail] != 0:
+			fmt.Printf("Chain of trust: BROKEN along %s\n", strings.Join(chain, " -> "))
+			return exitCheckFailed
+		case insecure != "":
+			fmt.Printf("Chain of trust: insecure from %s, secure along %s\n", insecure, strings.Join(chain, " -> "))
+			return 6
+		}
+		fmt.Printf("Chain of trust: secure along %s\n", strings.Join(chain, " -> "))
+		return 0
+	}
+}
+
+// signedSet fetches the records of name and qtype and the signatures over
+// them
+func (r *resolver) signedSet(name string, qtype string) (rrset, error) {
+
+	var set rrset
+	jdns, err := r.lookup(name, qtype)
+	if err == nil && jdns.Status != 3 {
+		err = jdns.Err()
+	}
+	if err != nil {
+		return set, err
+	}
+	code, _ := doh.TypeCode(qtype)
+	for _, a := range jdns.Answers {
+		if fqdn(strings.ToLower(a.Name)) != name {
+			continue
+		}
+		switch a.Type {
+		case int(code):
+			set.records = append(set.records, a)
+		case 46:
+			if s, err := doh.ParseRRSIG(a.Data); err == nil && s.TypeCovered == int(code) {
+				set.sigs = append(set.sigs, s)
+			}
+		}
+	}
+	return set, nil
+}
+
+// isZone reports whether name is the apex of a zone (has its own SOA)
+func (r *resolver) isZone(name string) bool {
+	jdns, err := r.lookup(name, "SOA")
+	if err != nil {
+		return false
+	}
+	for _, a := range jdns.Answers {
+		if a.Type == 6 && fqdn(strings.ToLower(a.Name)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySet reports on the signatures over set made by the keys of signer:
+// pass when one of them verifies and is within its validity window
+func verifySet(report func(int, string, string, ...any), what string, set rrset, signer *signedZone, now time.Time) {
+
+	if set.records == nil {
+		report(checkFail, "RRSIG", "no %s records to verify", what)
+		return
+	}
+	var problems []string
+	for _, s := range set.sigs {
+		if fqdn(strings.ToLower(s.SignerName)) != signer.name {
+			continue
+		}
+		i := slices.IndexFunc(signer.keys, func(k doh.DNSKEY) bool {
+			return k.KeyTag() == s.KeyTag && k.Algorithm == s.Algorithm
+		})
+		switch {
+		case i < 0:
+			problems = append(problems, fmt.Sprintf("signed by key %d, which is not among the trusted keys", s.KeyTag))
+		case now.Before(s.Inception):
+			problems = append(problems, fmt.Sprintf("signature by %d not valid before %s", s.KeyTag, s.Inception.Format(time.RFC3339)))
+		case now.After(s.Expiration):
+			problems = append(problems, fmt.Sprintf("signature by %d EXPIRED %s", s.KeyTag, s.Expiration.Format(time.RFC3339)))
+		default:
+			if err := s.Verify(signer.keys[i], set.records); err != nil {
+				problems = append(problems, fmt.Sprintf("signature by %d: %v", s.KeyTag, err))
+				continue
+			}
+			report(checkPass, "RRSIG", "%s signed by %d (%s), valid until %s", what, s.KeyTag, signer.name,
+				s.Expiration.Format(time.RFC3339))
+			return
+		}
+	}
+	if problems == nil {
+		problems = []string{"no signature by " + signer.name}
+	}
+	report(checkFail, "RRSIG", "%s: %s", what, strings.Join(problems, "; "))
+}
+
+// algorithmName is the mnemonic of a DNSSEC algorithm number
+func algorithmName(alg int) string {
+	if n, ok := doh.AlgorithmNames[alg]; ok {
+		return n
+	}
+	return fmt.Sprintf("algorithm %d", alg)
+}
+
+// digestName is the mnemonic of a DS digest type
+func digestName(t int) string {
+	if n, ok := doh.DigestNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("digest type %d", t)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// cmdDoctor walks through what it takes to reach each provider (system DNS
+// for its name, TLS to its endpoint, a JSON and a wireformat query) and tells
+// which step fails. It exits 0 as long as one provider answers. Given a name
+// (-n), it also compares the system resolver's answers for it with DoH's, to
+// tell whether the local network filters DNS.
+func cmdDoctor() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optName string
+
+	fs := newFlagSet("doctor", "h53 doctor [options]",
+		"Check each provider of -s ("+doh.DefaultChain+" by default) step by step."+
+			"\nWith -n, check whether the system resolver filters that name too.")
+	co.register(fs)
+	fs.StringVar(&optName, "n", "example.com",
+		"Name to test queries with, and to compare system DNS and DoH answers for when given Ex.: blocked.example")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if !set["s"] {
+			co.server = doh.DefaultChain
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+
+		if co.proxy != "" {
+			fmt.Printf("Proxy: %s (TLS check skipped)\n", co.proxy)
+		} else if p := os.Getenv("HTTPS_PROXY"); p != "" {
+			fmt.Printf("Proxy: %s (from HTTPS_PROXY, TLS check skipped)\n", p)
+			co.proxy = p
+		}
+
+		working := 0
+		for _, p := range client.Providers {
+			fmt.Printf("%s\n", p.Name)
+			host, port := p.URL.Hostname(), p.URL.Port()
+			if port == "" {
+				port = "443"
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), client.Timeout)
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			cancel()
+			if err != nil {
+				addrs = doh.BootstrapAddrs[host]
+				if len(addrs) != 0 {
+					check("system DNS", fmt.Errorf("%v (bootstrap addresses will be used)", err))
+				} else {
+					check("system DNS", err)
+				}
+			} else {
+				check("system DNS", nil, addrs...)
+			}
+
+			if co.proxy == "" && p.URL.Scheme == "https" && len(addrs) != 0 {
+				start := time.Now()
+				d := &net.Dialer{Timeout: client.Timeout}
+				// As the queries will: with the -pin, stamp and -cert settings
+				tc := &tls.Config{}
+				if tr, ok := client.HTTP.Transport.(*http.Transport); ok && tr.TLSClientConfig != nil {
+					tc = tr.TLSClientConfig.Clone()
+				}
+				tc.ServerName = host
+				conn, err := tls.DialWithDialer(d, "tcp", net.JoinHostPort(addrs[0], port), tc)
+				if err != nil {
+					check("TLS", err)
+				} else {
+					cs := conn.ConnectionState()
+					conn.Close()
+					check("TLS", nil, tls.VersionName(cs.Version), cs.PeerCertificates[0].Issuer.CommonName,
+						time.Since(start).Round(time.Millisecond).String(),
+						"pin "+base64.StdEncoding.EncodeToString(doh.SPKIHash(cs.PeerCertificates[0])))
+				}
+			}
+
+			ok := false
+			for _, wire := range []bool{false, true} {
+				c := *client
+				c.Providers = []doh.Provider{p}
+				c.Fallback, c.Race, c.Wire = false, false, wire
+				c.Method = "GET"
+				what := "JSON query"
+				if wire {
+					c.Method = "POST"
+					what = "wire query"
+				}
+				start := time.Now()
+				jdns, err := c.Lookup(context.Background(), optName, "A")
+				if err != nil {
+					check(what, err)
+					continue
+				}
+				ok = true
+				check(what, nil, fmt.Sprintf("%s, %d answers", doh.RcodeString(jdns.Status), len(jdns.Answers)),
+					time.Since(start).Round(time.Millisecond).String())
+			}
+			if ok {
+				working++
+			}
+		}
+
+		fmt.Printf("%d of %d providers working\n", working, len(client.Providers))
+		if working == 0 {
+			return 3
+		}
+		if set["n"] && filtering(client, optName) {
+			return exitCheckFailed
+		}
+		return 0
+	}
+}
+
+// filtering resolves name through the system resolver and over DoH and
+// reports whether the answers show the local network filtering DNS: names
+// missing (NXDOMAIN) or sinkholed to private or blackhole addresses, or
+// names that do not exist answered anyway (NXDOMAIN hijacking).
+func filtering(client *doh.Client, name string) bool {
+
+	fmt.Printf("System DNS vs DoH for %s\n", name)
+	aname, _, err := queryFor(name, "A")
+	if err != nil {
+		check("DoH", err)
+		return false
+	}
+	c := *client
+	c.Fallback, c.Race = true, false
+
+	doh4, nx, err := dohAddrs(&c, aname)
+	if err != nil {
+		check("DoH", err)
+		return false
+	}
+	if nx {
+		check("DoH", nil, "NXDOMAIN")
+	} else {
+		check("DoH", nil, addrStrings(doh4)...)
+	}
+
+	sys, sysNX, sysErr := systemAddrs(aname, c.Timeout)
+	filtered := false
+	switch {
+	case sysErr != nil && !nx:
+		// Dropped or refused queries are a way of blocking too
+		check("system DNS", fmt.Errorf("%v, while DoH answers", sysErr))
+		filtered = true
+	case sysErr != nil:
+		check("system DNS", sysErr)
+	case sysNX && !nx:
+		check("system DNS", fmt.Errorf("NXDOMAIN, while the name exists"))
+		filtered = true
+	case sysNX:
+		check("system DNS", nil, "NXDOMAIN")
+	case nx:
+		check("system DNS", fmt.Errorf("%s for a name that does not exist", strings.Join(addrStrings(sys), ", ")))
+		filtered = true
+	default:
+		var bogus []string
+		for _, ip := range sys {
+			if blackhole(ip) && !slices.Contains(doh4, ip) {
+				bogus = append(bogus, ip.String())
+			}
+		}
+		switch {
+		case bogus != nil:
+			check("system DNS", fmt.Errorf("%s, a sinkhole: DoH answers %s", strings.Join(bogus, ", "),
+				strings.Join(addrStrings(doh4), ", ")))
+			filtered = true
+		case !slices.ContainsFunc(sys, func(ip netip.Addr) bool { return slices.Contains(doh4, ip) }):
+			// CDNs answer by resolver location, so this alone proves nothing
+			check("system DNS", nil, strings.Join(addrStrings(sys), ", ")+
+				" (none in common with DoH: a CDN answering by location, or redirection)")
+		default:
+			check("system DNS", nil, addrStrings(sys)...)
+		}
+	}
+
+	// A name that cannot exist shows whether NXDOMAIN answers are rewritten
+	probe := randomLabel() + ".com"
+	if _, probeNX, err := dohAddrs(&c, probe); err == nil && probeNX {
+		hijack, hijackNX, err := systemAddrs(probe, c.Timeout)
+		switch {
+		case err != nil:
+			check("NXDOMAIN", err)
+		case !hijackNX && len(hijack) != 0:
+			check("NXDOMAIN", fmt.Errorf("%s answers %s: NXDOMAIN is hijacked", probe,
+				strings.Join(addrStrings(hijack), ", ")))
+			filtered = true
+		default:
+			check("NXDOMAIN", nil, probe+" does not exist, as it should not")
+		}
+	}
+
+	if filtered {
+		fmt.Printf("The local network appears to filter DNS: use DoH (h53 query, serve) for %s\n", name)
+	} else {
+		fmt.Printf("No sign of DNS filtering for %s\n", name)
+	}
+	return filtered
+}
+
+// dohAddrs resolves name to its A and AAAA addresses over DoH; nx is set
+// for NXDOMAIN
+func dohAddrs(c *doh.Client, name string) (addrs []netip.Addr, nx bool, err error) {
+
+	for _, qtype := range []string{"A", "AAAA"} {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout*time.Duration(len(c.Providers)))
+		jdns, err := c.Lookup(ctx, name, qtype)
+		cancel()
+		if err == nil && jdns.Status != 3 {
+			err = jdns.Err()
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if jdns.Status == 3 {
+			return nil, true, nil
+		}
+		addrs = append(addrs, addresses(jdns)...)
+	}
+	return addrs, false, nil
+}
+
+// systemAddrs resolves name through the system resolver; nx is set when
+// the name does not exist (or has no addresses)
+func systemAddrs(name string, timeout time.Duration) (addrs []netip.Addr, nx bool, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil, true, nil
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs, false, err
+}
+
+// blackhole reports whether ip is an address filtering resolvers answer
+// with in place of the real one: unspecified, loopback, private (RFC 1918,
+// ULA) or link-local
+func blackhole(ip netip.Addr) bool {
+	return ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// addrStrings renders addresses as text
+func addrStrings(addrs []netip.Addr) []string {
+	var s []string
+	for _, ip := range addrs {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+// check prints the outcome of one doctor step
+func check(step string, err error, details ...string) {
+	if err != nil {
+		fmt.Printf("  %-12s FAIL %v\n", step, err)
+		return
+	}
+	fmt.Printf("  %-12s ok   %s\n", step, strings.Join(details, ", "))
+}
@@ -0,0 +1,476 @@
+package doh
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSSEC record data (RFC 4034) and the checks of a chain of trust: key
+// tags, DS digests and RRSIG signatures. Only record sets without names in
+// their data (DNSKEY, DS, A, AAAA) can be rebuilt in canonical form from
+// presentation format, which is what chains of trust are made of.
+
+// AlgorithmNames are the DNSSEC algorithm mnemonics (RFC 8624)
+var AlgorithmNames = map[int]string{
+	5: "RSASHA1", 7: "RSASHA1-NSEC3-SHA1", 8: "RSASHA256", 10: "RSASHA512",
+	13: "ECDSAP256SHA256", 14: "ECDSAP384SHA384", 15: "ED25519", 16: "ED448",
+}
+
+// DigestNames are the DS digest type mnemonics
+var DigestNames = map[int]string{1: "SHA-1", 2: "SHA-256", 4: "SHA-384"}
+
+// DNSKEY is the data of a DNSKEY record
+type DNSKEY struct {
+	Flags     int // 256 zone key, 257 with SEP (key signing key)
+	Protocol  int
+	Algorithm int
+	PublicKey []byte
+}
+
+// KSK reports the Secure Entry Point flag, set on key signing keys
+func (k DNSKEY) KSK() bool { return k.Flags&1 != 0 }
+
+// ParseDNSKEY splits the data of a DNSKEY answer ("257 3 8 AwEAAa...")
+func ParseDNSKEY(data string) (DNSKEY, error) {
+	f := strings.Fields(data)
+	if len(f) < 4 {
+		return DNSKEY{}, fmt.Errorf("not DNSKEY data: %q", data)
+	}
+	var n [3]int
+	for i, bits := range []int{16, 8, 8} {
+		v, err := strconv.ParseUint(f[i], 10, bits)
+		if err != nil {
+			return DNSKEY{}, fmt.Errorf("not DNSKEY data: %q", data)
+		}
+		n[i] = int(v)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.Join(f[3:], ""))
+	if err != nil {
+		return DNSKEY{}, fmt.Errorf("not DNSKEY data: %q", data)
+	}
+	return DNSKEY{Flags: n[0], Protocol: n[1], Algorithm: n[2], PublicKey: key}, nil
+}
+
+// rdata is the wire form of the record data
+func (k DNSKEY) rdata() []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(k.Flags))
+	b = append(b, byte(k.Protocol), byte(k.Algorithm))
+	return append(b, k.PublicKey...)
+}
+
+// KeyTag computes the tag DS and RRSIG records refer to the key by
+// (RFC 4034 Appendix B)
+func (k DNSKEY) KeyTag() int {
+	var ac uint32
+	for i, b := range k.rdata() {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return int(ac & 0xFFFF)
+}
+
+// Digest computes the digest a DS record for the key at owner holds
+// (RFC 4034 5.1.4)
+func (k DNSKEY) Digest(owner string, digestType int) ([]byte, error) {
+	b, err := packName(nil, strings.ToLower(owner))
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, k.rdata()...)
+	switch digestType {
+	case 1:
+		sum := sha1.Sum(b)
+		return sum[:], nil
+	case 2:
+		sum := sha256.Sum256(b)
+		return sum[:], nil
+	case 4:
+		sum := sha512.Sum384(b)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("unsupported digest type %d", digestType)
+}
+
+// DS is the data of a DS record
+type DS struct {
+	KeyTag     int
+	Algorithm  int
+	DigestType int
+	Digest     []byte
+}
+
+// ParseDS splits the data of a DS answer ("20326 8 2 E06D44B8...")
+func ParseDS(data string) (DS, error) {
+	f := strings.Fields(data)
+	if len(f) < 4 {
+		return DS{}, fmt.Errorf("not DS data: %q", data)
+	}
+	var n [3]int
+	for i, bits := range []int{16, 8, 8} {
+		v, err := strconv.ParseUint(f[i], 10, bits)
+		if err != nil {
+			return DS{}, fmt.Errorf("not DS data: %q", data)
+		}
+		n[i] = int(v)
+	}
+	digest, err := hex.DecodeString(strings.Join(f[3:], ""))
+	if err != nil {
+		return DS{}, fmt.Errorf("not DS data: %q", data)
+	}
+	return DS{KeyTag: n[0], Algorithm: n[1], DigestType: n[2], Digest: digest}, nil
+}
+
+// Matches reports whether the DS record is for key, found at owner
+func (d DS) Matches(owner string, key DNSKEY) bool {
+	if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+		return false
+	}
+	digest, err := key.Digest(owner, d.DigestType)
+	return err == nil && bytes.Equal(digest, d.Digest)
+}
+
+func (d DS) rdata() []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(d.KeyTag))
+	b = append(b, byte(d.Algorithm), byte(d.DigestType))
+	return append(b, d.Digest...)
+}
+
+// RRSIG is the data of an RRSIG record
+type RRSIG struct {
+	TypeCovered int
+	Algorithm   int
+	Labels      int
+	OriginalTTL uint32
+	Expiration  time.Time
+	Inception   time.Time
+	KeyTag      int
+	SignerName  string
+	Signature   []byte
+}
+
+// ParseRRSIG splits the data of an RRSIG answer
+// ("DNSKEY 8 0 172800 20240201000000 20240111000000 20326 . base64..."). The
+// times may also be given in seconds since the epoch, as some JSON APIs do.
+func ParseRRSIG(data string) (RRSIG, error) {
+	f := strings.Fields(data)
+	if len(f) < 9 {
+		return RRSIG{}, fmt.Errorf("not RRSIG data: %q", data)
+	}
+	covered, err := TypeCode(f[0])
+	if err != nil {
+		return RRSIG{}, fmt.Errorf("not RRSIG data: %q", data)
+	}
+	var n [3]uint64
+	for i, bits := range []int{8, 8, 32} {
+		if n[i], err = strconv.ParseUint(f[1+i], 10, bits); err != nil {
+			return RRSIG{}, fmt.Errorf("not RRSIG data: %q", data)
+		}
+	}
+	var times [2]time.Time
+	for i := range times {
+		if times[i], err = parseSigTime(f[4+i]); err != nil {
+			return RRSIG{}, fmt.Errorf("not RRSIG data: %q", data)
+		}
+	}
+	tag, err := strconv.ParseUint(f[6], 10, 16)
+	if err != nil {
+		return RRSIG{}, fmt.Errorf("not RRSIG data: %q", data)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.Join(f[8:], ""))
+	if err != nil {
+		return RRSIG{}, fmt.Errorf("not RRSIG data: %q", data)
+	}
+	return RRSIG{TypeCovered: int(covered), Algorithm: int(n[0]), Labels: int(n[1]), OriginalTTL: uint32(n[2]),
+		Expiration: times[0], Inception: times[1], KeyTag: int(tag), SignerName: f[7], Signature: sig}, nil
+}
+
+// parseSigTime reads YYYYMMDDHHmmSS, or seconds since the epoch
+func parseSigTime(s string) (time.Time, error) {
+	if len(s) == 14 {
+		return time.Parse("20060102150405", s)
+	}
+	secs, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(int64(secs), 0).UTC(), nil
+}
+
+// ValidAt reports whether t is within the signature validity window
+func (s RRSIG) ValidAt(t time.Time) bool {
+	return !t.Before(s.Inception) && !t.After(s.Expiration)
+}
+
+// Verify checks the signature over rrset, the records of one name and type
+// as answered, with key (RFC 4034 3.1.8.1, 6.2). The validity window is not
+// checked here, see ValidAt.
+func (s RRSIG) Verify(key DNSKEY, rrset []Answer) error {
+
+	if len(rrset) == 0 {
+		return fmt.Errorf("no records to verify")
+	}
+	owner := strings.ToLower(rrset[0].Name)
+	if !strings.HasSuffix(owner, ".") {
+		owner += "."
+	}
+	if strings.Count(strings.TrimSuffix(owner, "."), ".")+1 > s.Labels && owner != "." {
+		return fmt.Errorf("wildcard expansions are not verified")
+	}
+
+	// RRSIG data without the signature, then the records in canonical order
+	b := binary.BigEndian.AppendUint16(nil, uint16(s.TypeCovered))
+	b = append(b, byte(s.Algorithm), byte(s.Labels))
+	b = binary.BigEndian.AppendUint32(b, s.OriginalTTL)
+	b = binary.BigEndian.AppendUint32(b, uint32(s.Expiration.Unix()))
+	b = binary.BigEndian.AppendUint32(b, uint32(s.Inception.Unix()))
+	b = binary.BigEndian.AppendUint16(b, uint16(s.KeyTag))
+	b, err := packName(b, strings.ToLower(s.SignerName))
+	if err != nil {
+		return err
+	}
+	var rdatas [][]byte
+	for _, a := range rrset {
+		rd, err := canonicalRdata(a)
+		if err != nil {
+			return err
+		}
+		rdatas = append(rdatas, rd)
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	rdatas = slices.CompactFunc(rdatas, bytes.Equal)
+	for _, rd := range rdatas {
+		if b, err = packName(b, owner); err != nil {
+			return err
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(s.TypeCovered))
+		b = binary.BigEndian.AppendUint16(b, classINET)
+		b = binary.BigEndian.AppendUint32(b, s.OriginalTTL)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(rd)))
+		b = append(b, rd...)
+	}
+	return verifySignature(key, s.Signature, b)
+}
+
+// canonicalRdata is the wire form of record data without names in it
+func canonicalRdata(a Answer) ([]byte, error) {
+	switch a.Type {
+	case 1, 28:
+		ip, err := netip.ParseAddr(a.Data)
+		if err != nil {
+			return nil, err
+		}
+		if a.Type == 1 {
+			b := ip.As4()
+			return b[:], nil
+		}
+		b := ip.As16()
+		return b[:], nil
+	case 43:
+		d, err := ParseDS(a.Data)
+		if err != nil {
+			return nil, err
+		}
+		return d.rdata(), nil
+	case 48:
+		k, err := ParseDNSKEY(a.Data)
+		if err != nil {
+			return nil, err
+		}
+		return k.rdata(), nil
+	}
+	return nil, fmt.Errorf("verifying %s records is not supported", TypeString(a.Type))
+}
+
+// verifySignature checks sig over data with key, by key algorithm
+func verifySignature(key DNSKEY, sig []byte, data []byte) error {
+
+	var hash crypto.Hash
+	switch key.Algorithm {
+	case 5, 7:
+		hash = crypto.SHA1
+	case 8, 13:
+		hash = crypto.SHA256
+	case 14:
+		hash = crypto.SHA384
+	case 10:
+		hash = crypto.SHA512
+	case 15:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("malformed Ed25519 key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, sig) {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %d", key.Algorithm)
+	}
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch key.Algorithm {
+	case 13, 14:
+		curve := elliptic.P256()
+		if key.Algorithm == 14 {
+			curve = elliptic.P384()
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(curve, append([]byte{4}, key.PublicKey...))
+		if err != nil {
+			return fmt.Errorf("malformed ECDSA key: %v", err)
+		}
+		if len(sig) != len(key.PublicKey) {
+			return fmt.Errorf("bad signature")
+		}
+		half := len(sig) / 2
+		r, s := new(big.Int).SetBytes(sig[:half]), new(big.Int).SetBytes(sig[half:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	}
+
+	// RSA keys (RFC 3110 2): exponent length, exponent, modulus
+	k := key.PublicKey
+	if len(k) < 3 {
+		return fmt.Errorf("malformed RSA key")
+	}
+	elen := int(k[0])
+	k = k[1:]
+	if elen == 0 {
+		elen = int(binary.BigEndian.Uint16(k))
+		k = k[2:]
+	}
+	if elen > 4 || len(k) <= elen {
+		return fmt.Errorf("malformed RSA key")
+	}
+	var e int
+	for _, b := range k[:elen] {
+		e = e<<8 | int(b)
+	}
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(k[elen:]), E: e}
+	if err := rsa.VerifyPKCS1v15(pub, hash, digest, sig); err != nil {
+		return fmt.Errorf("bad signature")
+	}
+	return nil
+}
+
+// NSEC is the data of an NSEC record (RFC 4034 4): the next name of the
+// zone in canonical order and the types at the record's owner
+type NSEC struct {
+	Next  string
+	Types []string
+}
+
+// ParseNSEC splits the data of an NSEC answer ("www.example.com. A RRSIG NSEC")
+func ParseNSEC(data string) (NSEC, error) {
+	f := strings.Fields(data)
+	if len(f) < 1 {
+		return NSEC{}, fmt.Errorf("not NSEC data: %q", data)
+	}
+	return NSEC{Next: f[0], Types: f[1:]}, nil
+}
+
+// nsec3Hex is the base32 alphabet of NSEC3 hashed owner names
+var nsec3Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// NSEC3 is the data of an NSEC3 record (RFC 5155 3): the next hashed owner
+// name of the zone and the types at the record's owner
+type NSEC3 struct {
+	Algorithm  int
+	Flags      int // 1: opt-out
+	Iterations int
+	Salt       []byte
+	Next       []byte
+	Types      []string
+}
+
+// ParseNSEC3 splits the data of an NSEC3 answer
+// ("1 0 0 - 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR A RRSIG")
+func ParseNSEC3(data string) (NSEC3, error) {
+	f := strings.Fields(data)
+	if len(f) < 5 {
+		return NSEC3{}, fmt.Errorf("not NSEC3 data: %q", data)
+	}
+	var n [3]int
+	for i, bits := range []int{8, 8, 16} {
+		v, err := strconv.ParseUint(f[i], 10, bits)
+		if err != nil {
+			return NSEC3{}, fmt.Errorf("not NSEC3 data: %q", data)
+		}
+		n[i] = int(v)
+	}
+	var salt []byte
+	if f[3] != "-" {
+		var err error
+		if salt, err = hex.DecodeString(f[3]); err != nil {
+			return NSEC3{}, fmt.Errorf("not NSEC3 data: %q", data)
+		}
+	}
+	next, err := nsec3Hex.DecodeString(strings.ToUpper(f[4]))
+	if err != nil {
+		return NSEC3{}, fmt.Errorf("not NSEC3 data: %q", data)
+	}
+	return NSEC3{Algorithm: n[0], Flags: n[1], Iterations: n[2], Salt: salt, Next: next, Types: f[5:]}, nil
+}
+
+// Hash computes the NSEC3 hash of name with the record's parameters
+// (RFC 5155 5), the iterated SHA-1 of its canonical wire form
+func (n NSEC3) Hash(name string) ([]byte, error) {
+	if n.Algorithm != 1 {
+		return nil, fmt.Errorf("unsupported NSEC3 hash algorithm %d", n.Algorithm)
+	}
+	b, err := packName(nil, strings.ToLower(name))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(append(b, n.Salt...))
+	for range n.Iterations {
+		sum = sha1.Sum(append(sum[:], n.Salt...))
+	}
+	return sum[:], nil
+}
+
+// Covers reports whether hash falls strictly between owner, the hashed
+// owner name of the record, and the next one; the last record of the chain
+// wraps around to the first
+func (n NSEC3) Covers(owner []byte, hash []byte) bool {
+	if bytes.Compare(owner, n.Next) < 0 {
+		return bytes.Compare(owner, hash) < 0 && bytes.Compare(hash, n.Next) < 0
+	}
+	return bytes.Compare(owner, hash) < 0 || bytes.Compare(hash, n.Next) < 0
+}
+
+// NSEC3Owner decodes the hash of an NSEC3 record's owner name, its first
+// label
+func NSEC3Owner(owner string) ([]byte, error) {
+	label, _, _ := strings.Cut(owner, ".")
+	return nsec3Hex.DecodeString(strings.ToUpper(label))
+}
+
+// NSEC3Label renders a hash as the label of an NSEC3 owner name
+func NSEC3Label(hash []byte) string {
+	return nsec3Hex.EncodeToString(hash)
+}
@@ -0,0 +1,680 @@
+// Package doh is the DNS over HTTPS client behind h53.
+//
+// It speaks both the JSON API (application/dns-json) popularized by
+// Cloudflare and Google, and RFC 8484 wireformat (application/dns-message),
+// with provider fallback, racing and retries. Responses of either flavor are
+// decoded into the same DNSJ model.
+//
+// NewResolver plugs the client into the standard library, so any Go program
+// can resolve over DoH with a one line change:
+//
+//	c, _ := doh.NewClient("cloudflare")
+//	net.DefaultResolver = doh.NewResolver(c)
+package doh
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+)
+
+type Question struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+}
+
+type Answer struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+	TTL  int    `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type DNSJ struct {
+	Status     int        `json:"Status"`
+	TC         bool       `json:"TC"`
+	RD         bool       `json:"RD"`
+	RA         bool       `json:"RA"`
+	AD         bool       `json:"AD"`
+	CD         bool       `json:"CD"`
+	Questions  []Question `json:"Question"`
+	Answers    []Answer   `json:"Answer"`
+	Authority  []Answer   `json:"Authority,omitempty"`  // SOA of NXDOMAIN/NODATA, referrals
+	Additional []Answer   `json:"Additional,omitempty"` // OPT excluded
+	Comment    Comment    `json:"Comment,omitempty"`    // provider remarks, JSON API only
+
+	AA bool `json:"-"` // Authoritative Answer, known from wireformat responses only
+
+	Provider string        `json:"-"` // the provider that answered, set by Lookup
+	RTT      time.Duration `json:"-"` // how long its answer took, the last try only
+
+	Timing *Timing `json:"Timing,omitempty"` // where the RTT went, set by Lookup
+}
+
+// Comment is the free text remark some JSON API providers add to answers.
+// Google sends a string, Cloudflare a list of strings, which are joined.
+type Comment string
+
+func (c *Comment) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*c = Comment(s)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*c = Comment(strings.Join(list, "; "))
+	return nil
+}
+
+// Client queries DoH providers. The zero value is not usable, start from
+// NewClient and adjust the fields before the first query.
+type Client struct {
+	HTTP      *http.Client
+	Providers []Provider
+	Fallback  bool // on failure or SERVFAIL move on to the next provider
+	Race      bool // ask all providers at once, first usable answer wins
+
+	DO  bool   // DNSSEC OK: ask for RRSIGs
+	CD  bool   // Checking Disabled: skip DNSSEC validation upstream
+	ECS string // EDNS Client Subnet to pass upstream, 0.0.0.0/0 suppresses it
+
+	Wire   bool   // RFC 8484 wireformat instead of the JSON API
+	Method string // GET or POST (wireformat only)
+	ODoH   *ODoH  // send wireformat queries through an Oblivious DoH relay
+
+	Timeout time.Duration // total time allowed per provider, retries included
+	Retries int
+	Backoff time.Duration // base delay, doubled on every retry
+
+	MaxBody int64 // largest response body accepted, decompressed; 0 is DefaultMaxBody
+
+	// Header is sent with every request, replacing the headers of the same
+	// names the client would set; UserAgent, if set, replaces DefaultUserAgent
+	Header    http.Header
+	UserAgent string
+
+	// Front, if set, is the host (host:port) requests connect and do TLS
+	// to, SNI included, while naming the provider in the Host header
+	// (:authority in HTTP/2): domain fronting, for networks that block the
+	// provider's name but not the CDN it shares with the front
+	Front string
+
+	Conns *ConnStats // connections new and reused, nil counts nothing
+
+	Tracer Tracer // spans of lookups, provider attempts and tries, nil traces nothing
+
+	// Observe, if set, is told of every try against a provider: how long
+	// it took and how it failed, nil on success
+	Observe func(provider string, rtt time.Duration, err error)
+
+	// Notices go to Logger at warn level; with Debug, requests, responses and
+	// retries are logged at debug level. Without a Logger, messages are
+	// formatted for Logf; with neither they are discarded.
+	Debug  bool
+	Logger *slog.Logger
+	Logf   func(format string, v ...any) // Deprecated: set Logger
+}
+
+// NewClient returns a client for the comma separated providers (see
+// ParseProviders) with the defaults h53 uses: JSON API over GET, 10s
+// timeout, no retries.
+func NewClient(providers string) (*Client, error) {
+
+	ps, err := ParseProviders(providers)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		HTTP:      &http.Client{Timeout: 10 * time.Second},
+		Providers: ps,
+		Method:    "GET",
+		Timeout:   10 * time.Second,
+		Backoff:   250 * time.Millisecond,
+	}, nil
+}
+
+// log sends a message with key/value attributes to the Logger, or Logf
+func (c *Client) log(level slog.Level, msg string, args ...any) {
+	switch {
+	case c.Logger != nil:
+		c.Logger.Log(context.Background(), level, msg, args...)
+	case c.Logf != nil:
+		var b strings.Builder
+		b.WriteString(msg)
+		for i := 0; i+1 < len(args); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+		}
+		c.Logf("%s", b.String())
+	}
+}
+
+// Error categories: every error from a query matches (errors.Is) one of
+// these, or is a RequestError when the query could not even be built.
+var (
+	ErrTransport  = errors.New("transport failure")  // no HTTP reply: connect, TLS, timeout
+	ErrHTTPStatus = errors.New("HTTP status")        // a reply other than 200 OK
+	ErrDecode     = errors.New("undecodable reply")  // a 200 OK that is not a DNS message
+	ErrRcode      = errors.New("unsuccessful rcode") // a DNS answer with an error RCODE
+)
+
+// RequestError means the HTTP request for a query could not be built
+type RequestError struct {
+	Provider string
+	Err      error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Unable to create a request for %s: %v", e.Provider, e.Err)
+}
+
+func (e *RequestError) Unwrap() error { return e.Err }
+
+// TransportError means no HTTP reply came back from a provider
+type TransportError struct {
+	Provider string
+	Err      error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("Error fetching response from %s: %v", e.Provider, e.Err)
+}
+
+func (e *TransportError) Unwrap() error { return e.Err }
+
+func (e *TransportError) Is(target error) bool { return target == ErrTransport }
+
+// StatusError is a non-200 HTTP reply from a provider
+type StatusError struct {
+	Provider string
+	Status   string
+	Code     int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Provider %s returned HTTP status: %s", e.Provider, e.Status)
+}
+
+func (e *StatusError) Is(target error) bool { return target == ErrHTTPStatus }
+
+// DecodeError means the provider's reply could not be decoded
+type DecodeError struct {
+	Provider string
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Error decoding response from %s: %v. May want to rerun with debug on.", e.Provider, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+func (e *DecodeError) Is(target error) bool { return target == ErrDecode }
+
+// RcodeError is an answer whose RCODE is not NOERROR, see DNSJ.Err
+type RcodeError struct {
+	Name  string
+	Type  string
+	Rcode int
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Name, e.Type, RcodeString(e.Rcode))
+}
+
+func (e *RcodeError) Is(target error) bool { return target == ErrRcode }
+
+// Err returns an RcodeError when the answer's RCODE is not NOERROR. Lookup
+// hands such answers back without error, for their sections may still be of
+// use; callers wanting to treat them as failures call Err.
+func (d *DNSJ) Err() error {
+	if d.Status == 0 {
+		return nil
+	}
+	e := &RcodeError{Rcode: d.Status}
+	if len(d.Questions) != 0 {
+		e.Name, e.Type = d.Questions[0].Name, TypeString(d.Questions[0].Type)
+	}
+	return e
+}
+
+// Lookup resolves name/qtype. With Fallback, a failure or SERVFAIL from one
+// provider moves on to the next one in order; with Race all providers are
+// asked at once and the first usable answer wins.
+func (c *Client) Lookup(ctx context.Context, name string, qtype string) (*DNSJ, error) {
+
+	q := func(ctx context.Context, p Provider) (*DNSJ, error) {
+		ctx, tm := withTimer(ctx, c.Conns)
+		start := time.Now()
+		jdns, err := c.query(ctx, p, name, qtype)
+		if jdns != nil {
+			jdns.Provider, jdns.RTT = p.Name, time.Since(start)
+			jdns.Timing = tm.timing(jdns.RTT)
+		}
+		return jdns, err
+	}
+	ctx, span := StartSpan(c.Tracer, ctx, "doh.lookup", Attr{"dns.question.name", name}, Attr{"dns.question.type", qtype})
+	var jdns *DNSJ
+	var err error
+	if c.Race {
+		jdns, err = race(ctx, c, q)
+	} else {
+		jdns, err = fallback(ctx, c, name, q)
+	}
+	if jdns != nil {
+		span.SetAttr(Attr{"dns.rcode", RcodeString(jdns.Status)}, Attr{"doh.provider", jdns.Provider})
+	}
+	span.End(err)
+	return jdns, err
+}
+
+// Exchange sends a wireformat query message and returns the raw response
+// message, using the same provider fallback/race and retry policy as Lookup.
+func (c *Client) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+
+	q := func(ctx context.Context, p Provider) ([]byte, error) {
+		if c.Conns != nil {
+			ctx, _ = withTimer(ctx, c.Conns)
+		}
+		return c.exchange(ctx, p, msg)
+	}
+	ctx, span := StartSpan(c.Tracer, ctx, "doh.exchange")
+	var resp []byte
+	var err error
+	if c.Race {
+		resp, err = race(ctx, c, q)
+	} else {
+		resp, err = fallback(ctx, c, "wire query", q)
+	}
+	if len(resp) >= 4 {
+		span.SetAttr(Attr{"dns.rcode", RcodeString(int(resp[3] & 0x0F))})
+	}
+	span.End(err)
+	return resp, err
+}
+
+// usable reports whether a query outcome is good enough to stop looking further
+func usable(v any, err error) bool {
+	if err != nil {
+		return false
+	}
+	switch v := v.(type) {
+	case *DNSJ:
+		return v.Status != 2
+	case []byte:
+		return len(v) < 4 || v[3]&0x0F != 2
+	}
+	return true
+}
+
+// fallback asks the providers in order until one gives a usable answer.
+// Without Fallback only the first provider is asked.
+func fallback[T any](ctx context.Context, c *Client, what string,
+	q func(context.Context, Provider) (T, error)) (T, error) {
+
+	providers := c.Providers
+	if !c.Fallback {
+		providers = providers[:1]
+	}
+
+	var v T
+	var err error
+	for i, p := range providers {
+		v, err = attempt(ctx, c, p, q)
+		if usable(v, err) {
+			break
+		}
+		if i < len(providers)-1 {
+			reason := "SERVFAIL"
+			if err != nil {
+				reason = err.Error()
+			}
+			c.log(slog.LevelWarn, "provider failed, falling back", "provider", p.Name, "query", what,
+				"reason", reason, "next", providers[i+1].Name)
+		}
+	}
+	return v, err
+}
+
+// race fires the query at all providers simultaneously and returns the
+// first usable answer, cancelling the requests still in flight. When no
+// provider succeeds the failures are joined together.
+func race[T any](ctx context.Context, c *Client,
+	q func(context.Context, Provider) (T, error)) (T, error) {
+
+	type outcome struct {
+		p   Provider
+		v   T
+		err error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	outcomes := make(chan outcome, len(c.Providers))
+	for _, p := range c.Providers {
+		go func(p Provider) {
+			v, err := attempt(ctx, c, p, q)
+			outcomes <- outcome{p, v, err}
+		}(p)
+	}
+
+	// Without a winner, prefer a SERVFAIL answer over transport failures
+	var answered *outcome
+	var failed []error
+	for range c.Providers {
+		o := <-outcomes
+		if usable(o.v, o.err) {
+			if c.Debug {
+				c.log(slog.LevelDebug, "race won", "provider", o.p.Name)
+			}
+			return o.v, nil
+		}
+		if o.err != nil {
+			failed = append(failed, o.err)
+		} else {
+			answered = &o
+		}
+	}
+	if answered != nil {
+		return answered.v, nil
+	}
+	var zero T
+	return zero, errors.Join(failed...)
+}
+
+// transient reports whether a failed query is worth retrying: transport
+// errors and timeouts, rate limiting (429) and server side (5xx) failures.
+func transient(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code == http.StatusTooManyRequests || se.Code >= 500
+	}
+	var re *RequestError
+	var de *DecodeError
+	return !errors.As(err, &re) && !errors.As(err, &de)
+}
+
+// maxBackoff caps the delay between two retries
+const maxBackoff = 5 * time.Second
+
+// attempt queries provider p, retrying transient failures (see tries), in
+// a span of its own
+func attempt[T any](ctx context.Context, c *Client, p Provider,
+	q func(context.Context, Provider) (T, error)) (T, error) {
+
+	ctx, span := StartSpan(c.Tracer, ctx, "doh.attempt", Attr{"doh.provider", p.Name})
+	v, err := tries(ctx, c, p, q)
+	span.End(err)
+	return v, err
+}
+
+// tries queries provider p, retrying transient failures with exponential
+// backoff and jitter. All tries share one deadline of c.Timeout so the
+// retries never stretch a query beyond it.
+func tries[T any](ctx context.Context, c *Client, p Provider,
+	q func(context.Context, Provider) (T, error)) (T, error) {
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	delay := c.Backoff
+	for n := 0; ; n++ {
+		tctx, span := StartSpan(c.Tracer, ctx, "doh.try", Attr{"doh.provider", p.Name}, Attr{"doh.try", n + 1})
+		start := time.Now()
+		v, err := q(tctx, p)
+		span.End(err)
+		if c.Observe != nil {
+			c.Observe(p.Name, time.Since(start), err)
+		}
+		if err == nil || n >= c.Retries || !transient(err) {
+			return v, err
+		}
+
+		// Full jitter over the upper half of the current backoff window
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) < wait {
+			return v, err
+		}
+		if c.Debug {
+			c.log(slog.LevelDebug, "retrying", "provider", p.Name, "retry", n+1, "of", c.Retries, "wait", wait, "error", err)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return v, err
+		}
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+// do sends req to provider p and returns the body of a 200 reply, dumping
+// both directions when debugging. Responses are asked for gzip compressed
+// and decompressed here, so that MaxBody bounds the body as decoded:
+// larger ones fail as undecodable, before any decoder sees them.
+func (c *Client) do(p Provider, req *http.Request) ([]byte, error) {
+
+	req.Header.Set("Accept-Encoding", "gzip")
+	ua := c.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+	for k, v := range c.Header {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if c.Front != "" {
+		front(req, c.Front)
+	}
+	if c.Debug {
+		if rdump, err := httputil.DumpRequest(req, false); err != nil {
+			c.log(slog.LevelDebug, "unable to dump request", "provider", p.Name, "error", err)
+		} else {
+			c.log(slog.LevelDebug, "request", "provider", p.Name, "dump", string(rdump))
+		}
+	}
+	// Set after the dump so credentials stay out of debug output
+	if p.Auth != "" {
+		req.Header.Set("Authorization", p.Auth)
+	}
+
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, &TransportError{Provider: p.Name, Err: err}
+	}
+	defer res.Body.Close()
+
+	limit := c.MaxBody
+	if limit <= 0 {
+		limit = DefaultMaxBody
+	}
+	body, err := readBody(res, limit)
+	var te *TransportError
+	if errors.As(err, &te) {
+		te.Provider = p.Name
+		return nil, te
+	}
+
+	if c.Debug {
+		if rdump, err := httputil.DumpResponse(res, false); err != nil {
+			c.log(slog.LevelDebug, "unable to dump response", "provider", p.Name, "error", err)
+		} else if res.Header.Get("content-type") == "application/dns-message" {
+			c.log(slog.LevelDebug, "response", "provider", p.Name, "dump", string(rdump), "body", hex.Dump(body))
+		} else {
+			c.log(slog.LevelDebug, "response", "provider", p.Name, "dump", string(rdump), "body", string(body))
+		}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &StatusError{Provider: p.Name, Status: res.Status, Code: res.StatusCode}
+	}
+	if err != nil {
+		return nil, &DecodeError{Provider: p.Name, Err: err}
+	}
+	return body, nil
+}
+
+// front points req at the front host, keeping the provider as its Host.
+// A front without a port takes the provider URL's.
+func front(req *http.Request, host string) {
+
+	req.Host = req.URL.Host
+	u := *req.URL
+	u.Host = host
+	if u.Port() == "" && req.URL.Port() != "" {
+		u.Host = net.JoinHostPort(host, req.URL.Port())
+	}
+	req.URL = &u
+}
+
+// DefaultUserAgent identifies the client to providers unless UserAgent
+// says otherwise, rather than Go's generic one
+const DefaultUserAgent = "h53 (+https://github.com/dsnezhkov/h53)"
+
+// DefaultMaxBody is the largest response body a Client accepts unless
+// MaxBody says otherwise: a 64KiB DNS message runs larger as JSON
+const DefaultMaxBody = 256 << 10
+
+// readBody reads the body of res, gunzipping it as its Content-Encoding
+// says, up to limit bytes decoded. Failing reads come back as
+// TransportError, bodies that are corrupt or too large as plain errors.
+func readBody(res *http.Response, limit int64) ([]byte, error) {
+
+	if res.ContentLength > limit {
+		return nil, fmt.Errorf("response body of %d bytes exceeds the limit of %d bytes", res.ContentLength, limit)
+	}
+	var r io.Reader = res.Body
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	var ce flate.CorruptInputError
+	switch {
+	case errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.As(err, &ce):
+		return nil, err
+	case err != nil:
+		return nil, &TransportError{Err: err}
+	case int64(len(body)) > limit:
+		return nil, fmt.Errorf("response body exceeds the limit of %d bytes", limit)
+	}
+	return body, nil
+}
+
+// query issues a single DoH query for name/qtype against provider p, over
+// the JSON API or, with Wire, RFC 8484 wireformat.
+func (c *Client) query(ctx context.Context, p Provider, name string, qtype string) (*DNSJ, error) {
+
+	if c.Wire || c.ODoH != nil {
+		t, err := TypeCode(qtype)
+		if err != nil {
+			return nil, &RequestError{Provider: p.Name, Err: err}
+		}
+		// Message ID 0 as RFC 8484 4.1 recommends, for cache friendliness
+		msg, err := PackQuery(&WireQuery{Name: name, Type: t, DO: c.DO, CD: c.CD, ECS: c.ECS})
+		if err != nil {
+			return nil, &RequestError{Provider: p.Name, Err: err}
+		}
+		if msg, err = c.exchange(ctx, p, msg); err != nil {
+			return nil, err
+		}
+		jdns, err := UnpackMsg(msg)
+		if err != nil {
+			return nil, &DecodeError{Provider: p.Name, Err: err}
+		}
+		return jdns, nil
+	}
+
+	u := *p.URL
+	q := u.Query()
+	q.Set("name", name)
+	q.Set("type", qtype)
+	if c.DO {
+		q.Set("do", "1")
+	}
+	if c.CD {
+		q.Set("cd", "1")
+	}
+	if c.ECS != "" {
+		q.Set("edns_client_subnet", c.ECS)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, &RequestError{Provider: p.Name, Err: err}
+	}
+	req.Header.Set("accept", "application/dns-json")
+
+	body, err := c.do(p, req)
+	if err != nil {
+		return nil, err
+	}
+
+	jdns := new(DNSJ)
+	if err = json.Unmarshal(body, jdns); err != nil {
+		return nil, &DecodeError{Provider: p.Name, Err: err}
+	}
+	expandGeneric(jdns.Answers)
+	expandGeneric(jdns.Authority)
+	expandGeneric(jdns.Additional)
+	return jdns, nil
+}
+
+// exchange sends a wireformat message to provider p, either base64url
+// encoded in the dns parameter (GET) or as the body (POST), or through the
+// ODoH relay.
+func (c *Client) exchange(ctx context.Context, p Provider, msg []byte) ([]byte, error) {
+
+	if c.ODoH != nil {
+		return c.odohExchange(ctx, p, msg)
+	}
+
+	u := *p.WireURL
+	var req *http.Request
+	var err error
+	if c.Method == "GET" {
+		q := u.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(msg))
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(msg))
+		if err == nil {
+			req.Header.Set("content-type", "application/dns-message")
+		}
+	}
+	if err != nil {
+		return nil, &RequestError{Provider: p.Name, Err: err}
+	}
+	req.Header.Set("accept", "application/dns-message")
+
+	return c.do(p, req)
+}
@@ -0,0 +1,48 @@
+package doh
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExchangeSkipsServfail(t *testing.T) {
+
+	// Providers answering every query with rcode
+	server := func(rcode int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			query, _ := io.ReadAll(req.Body)
+			resp, err := Reply(query, rcode, false)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(resp)
+		}))
+	}
+	failing, working := server(2), server(0)
+	defer failing.Close()
+	defer working.Close()
+
+	query, err := PackQuery(&WireQuery{ID: 1, Name: "example.com", Type: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, race := range []bool{false, true} {
+		c, err := NewClient(failing.URL + "/dns-query," + working.URL + "/dns-query")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Method, c.Fallback, c.Race = "POST", true, race
+		resp, err := c.Exchange(context.Background(), query)
+		if err != nil {
+			t.Fatalf("race %v: %v", race, err)
+		}
+		if rcode := resp[3] & 0x0F; rcode != 0 {
+			t.Errorf("race %v: answered %s, want the next provider's NOERROR", race, RcodeString(int(rcode)))
+		}
+	}
+}
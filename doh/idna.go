@@ -0,0 +1,221 @@
+package doh
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Internationalized domain names: labels outside ASCII travel as punycode
+// (RFC 3492) behind the xn-- ACE prefix. Labels are lowercased before
+// encoding; the rest of the UTS 46 mapping (width folding, NFC) is left to
+// the user's input method.
+
+const (
+	pcBase        = 36
+	pcTMin        = 1
+	pcTMax        = 26
+	pcSkew        = 38
+	pcDamp        = 700
+	pcInitialBias = 72
+	pcInitialN    = 128
+	acePrefix     = "xn--"
+)
+
+var errPunycode = errors.New("invalid punycode")
+
+// ToASCII converts the non-ASCII labels of name to their xn-- form. ASCII
+// labels are left as they are.
+func ToASCII(name string) (string, error) {
+
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		if isASCII(l) {
+			continue
+		}
+		if !utf8.ValidString(l) {
+			return "", errors.New("name is not valid UTF-8")
+		}
+		enc, err := punyEncode(strings.ToLower(l))
+		if err != nil {
+			return "", err
+		}
+		labels[i] = acePrefix + enc
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// ToUnicode converts the xn-- labels of name back to Unicode. Labels that do
+// not decode are left as they are.
+func ToUnicode(name string) string {
+
+	if !strings.Contains(strings.ToLower(name), acePrefix) {
+		return name
+	}
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		if len(l) <= len(acePrefix) || !strings.EqualFold(l[:len(acePrefix)], acePrefix) {
+			continue
+		}
+		if dec, err := punyDecode(strings.ToLower(l[len(acePrefix):])); err == nil {
+			labels[i] = dec
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// adapt is the bias adaptation function of RFC 3492 6.1
+func adapt(delta int, points int, first bool) int {
+	if first {
+		delta /= pcDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((pcBase-pcTMin)*pcTMax)/2 {
+		delta /= pcBase - pcTMin
+		k += pcBase
+	}
+	return k + (pcBase-pcTMin+1)*delta/(delta+pcSkew)
+}
+
+// threshold is t(k) of RFC 3492 6.2
+func threshold(k int, bias int) int {
+	switch {
+	case k <= bias:
+		return pcTMin
+	case k >= bias+pcTMax:
+		return pcTMax
+	}
+	return k - bias
+}
+
+func encodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func decodeDigit(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	}
+	return 0, false
+}
+
+// punyEncode is the punycode encoding of RFC 3492 6.3
+func punyEncode(s string) (string, error) {
+
+	input := []rune(s)
+	var out []byte
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := pcInitialN, 0, pcInitialBias
+	for h := basic; h < len(input); {
+		m := int(utf8.MaxRune) + 1
+		for _, r := range input {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+		for _, r := range input {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := pcBase; ; k += pcBase {
+				t := threshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, encodeDigit(t+(q-t)%(pcBase-t)))
+				q = (q - t) / (pcBase - t)
+			}
+			out = append(out, encodeDigit(q))
+			bias = adapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	if len(out) > 63-len(acePrefix) {
+		return "", errors.New("label too long once punycode encoded")
+	}
+	return string(out), nil
+}
+
+// punyDecode is the punycode decoding of RFC 3492 6.2
+func punyDecode(s string) (string, error) {
+
+	var out []rune
+	pos := 0
+	if b := strings.LastIndexByte(s, '-'); b >= 0 {
+		for i := 0; i < b; i++ {
+			if s[i] >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+			out = append(out, rune(s[i]))
+		}
+		pos = b + 1
+	}
+
+	n, i, bias := pcInitialN, 0, pcInitialBias
+	for pos < len(s) {
+		oldi, w := i, 1
+		for k := pcBase; ; k += pcBase {
+			if pos >= len(s) {
+				return "", errPunycode
+			}
+			d, ok := decodeDigit(s[pos])
+			pos++
+			if !ok || d > (1<<30-i)/w {
+				return "", errPunycode
+			}
+			i += d * w
+			t := threshold(k, bias)
+			if d < t {
+				break
+			}
+			w *= pcBase - t
+		}
+		bias = adapt(i-oldi, len(out)+1, oldi == 0)
+		n += i / (len(out) + 1)
+		i %= len(out) + 1
+		if n > utf8.MaxRune || n < pcInitialN {
+			return "", errPunycode
+		}
+		out = append(out[:i], append([]rune{rune(n)}, out[i:]...)...)
+		i++
+	}
+	return string(out), nil
+}
@@ -0,0 +1,198 @@
+package doh
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TypeNames maps RR type codes to their mnemonics: the IANA registry,
+// obsolete and experimental types included, as of 2025. Types assigned since
+// still work as TYPEnnn or plain numbers.
+// See: https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-4
+var TypeNames = map[int]string{
+	1:     "A",
+	2:     "NS",
+	3:     "MD",
+	4:     "MF",
+	5:     "CNAME",
+	6:     "SOA",
+	7:     "MB",
+	8:     "MG",
+	9:     "MR",
+	10:    "NULL",
+	11:    "WKS",
+	12:    "PTR",
+	13:    "HINFO",
+	14:    "MINFO",
+	15:    "MX",
+	16:    "TXT",
+	17:    "RP",
+	18:    "AFSDB",
+	19:    "X25",
+	20:    "ISDN",
+	21:    "RT",
+	22:    "NSAP",
+	23:    "NSAP-PTR",
+	24:    "SIG",
+	25:    "KEY",
+	26:    "PX",
+	27:    "GPOS",
+	28:    "AAAA",
+	29:    "LOC",
+	30:    "NXT",
+	31:    "EID",
+	32:    "NIMLOC",
+	33:    "SRV",
+	34:    "ATMA",
+	35:    "NAPTR",
+	36:    "KX",
+	37:    "CERT",
+	38:    "A6",
+	39:    "DNAME",
+	40:    "SINK",
+	41:    "OPT",
+	42:    "APL",
+	43:    "DS",
+	44:    "SSHFP",
+	45:    "IPSECKEY",
+	46:    "RRSIG",
+	47:    "NSEC",
+	48:    "DNSKEY",
+	49:    "DHCID",
+	50:    "NSEC3",
+	51:    "NSEC3PARAM",
+	52:    "TLSA",
+	53:    "SMIMEA",
+	55:    "HIP",
+	56:    "NINFO",
+	57:    "RKEY",
+	58:    "TALINK",
+	59:    "CDS",
+	60:    "CDNSKEY",
+	61:    "OPENPGPKEY",
+	62:    "CSYNC",
+	63:    "ZONEMD",
+	64:    "SVCB",
+	65:    "HTTPS",
+	66:    "DSYNC",
+	67:    "HHIT",
+	68:    "BRID",
+	99:    "SPF",
+	100:   "UINFO",
+	101:   "UID",
+	102:   "GID",
+	103:   "UNSPEC",
+	104:   "NID",
+	105:   "L32",
+	106:   "L64",
+	107:   "LP",
+	108:   "EUI48",
+	109:   "EUI64",
+	128:   "NXNAME",
+	249:   "TKEY",
+	250:   "TSIG",
+	251:   "IXFR",
+	252:   "AXFR",
+	253:   "MAILB",
+	254:   "MAILA",
+	255:   "ANY",
+	256:   "URI",
+	257:   "CAA",
+	258:   "AVC",
+	259:   "DOA",
+	260:   "AMTRELAY",
+	261:   "RESINFO",
+	262:   "WALLET",
+	263:   "CLA",
+	264:   "IPN",
+	32768: "TA",
+	32769: "DLV",
+}
+
+// RcodeNames maps DNS response codes to their symbolic names.
+// See: https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-6
+var RcodeNames = map[int]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+// TypeString returns the mnemonic for an RR type, or the RFC 3597 TYPEnnn form
+func TypeString(t int) string {
+	if n, ok := TypeNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// RcodeString returns the symbolic name of a response code, or RCODEnn
+func RcodeString(rc int) string {
+	if n, ok := RcodeNames[rc]; ok {
+		return n
+	}
+	return fmt.Sprintf("RCODE%d", rc)
+}
+
+// TypeCode parses a query type given as mnemonic (AAAA), RFC 3597 form
+// (TYPE28) or plain number (28).
+func TypeCode(s string) (uint16, error) {
+
+	u := strings.ToUpper(strings.TrimSpace(s))
+	for code, name := range TypeNames {
+		if name == u {
+			return uint16(code), nil
+		}
+	}
+	u = strings.TrimPrefix(u, "TYPE")
+	n, err := strconv.ParseUint(u, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown query type: %s", s)
+	}
+	return uint16(n), nil
+}
+
+// CheckName reports why name cannot be a DNS query name, if it cannot: an
+// empty label, a label over 63 or a name over 253 bytes, or characters other
+// than letters, digits, hyphens and underscores (a lone * is fine too). One
+// trailing dot is allowed. Names must be ASCII, see ToASCII.
+func CheckName(name string) error {
+
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if name == "." {
+		return nil
+	}
+	trimmed := strings.TrimSuffix(name, ".")
+	if len(trimmed) > 253 {
+		return fmt.Errorf("name is %d bytes long, the limit is 253", len(trimmed))
+	}
+	for _, l := range strings.Split(trimmed, ".") {
+		if l == "" {
+			return fmt.Errorf("empty label in %q", name)
+		}
+		if len(l) > 63 {
+			return fmt.Errorf("label %q is %d bytes long, the limit is 63", l, len(l))
+		}
+		if l == "*" {
+			continue
+		}
+		for _, c := range l {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+			default:
+				return fmt.Errorf("character %q is not allowed in label %q", c, l)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hpke"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Oblivious DoH (RFC 9230). Queries are HPKE encrypted for the provider
+// (the target) and sent through a relay: the relay sees who asks but not
+// what, the target sees what but not who.
+
+const (
+	odohVersion      = 0x0001
+	odohTypeQuery    = 0x01
+	odohTypeResponse = 0x02
+	odohContentType  = "application/oblivious-dns-message"
+	odohConfigPath   = "/.well-known/odohconfigs"
+	odohPadTo        = 128 // plaintext queries are padded to a multiple of this
+)
+
+// ODoH routes a client's wireformat queries through Relay. Target public
+// keys are fetched from the providers on first use and kept.
+type ODoH struct {
+	Relay      *url.URL
+	RelayStamp *Stamp // set when the relay was given as a DNS stamp
+
+	mu      sync.Mutex
+	configs map[string]*odohConfig // by provider name
+}
+
+// NewODoH returns ODoH settings for the relay URL or sdns:// relay stamp
+func NewODoH(relay string) (*ODoH, error) {
+	if strings.HasPrefix(relay, "sdns://") {
+		st, err := ParseStamp(relay)
+		if err != nil {
+			return nil, err
+		}
+		if st.Proto != StampODoHRelay {
+			return nil, fmt.Errorf("not an ODoH relay stamp")
+		}
+		u, err := parseDoHURL(st.URL())
+		if err != nil {
+			return nil, err
+		}
+		return &ODoH{Relay: u, RelayStamp: st}, nil
+	}
+	u, err := parseDoHURL(relay)
+	if err != nil {
+		return nil, err
+	}
+	return &ODoH{Relay: u}, nil
+}
+
+// odohConfig is a target's ObliviousDoHConfigContents (RFC 9230 4)
+type odohConfig struct {
+	raw    []byte // serialized contents, the key ID is derived from them
+	kem    hpke.KEM
+	kdf    hpke.KDF
+	aead   hpke.AEAD
+	pub    hpke.PublicKey
+	hash   func() hash.Hash // of the KDF
+	keyLen int              // Nk of the AEAD
+}
+
+// keyID identifies the target key a query is encrypted for (RFC 9230 6.2)
+func (oc *odohConfig) keyID() ([]byte, error) {
+	prk, err := hkdf.Extract(oc.hash, oc.raw, nil)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Expand(oc.hash, prk, "odoh key id", oc.hash().Size())
+}
+
+// parseODoHConfigs picks the first config of a supported suite from an
+// ObliviousDoHConfigs structure. Only AES-GCM AEADs are available in the
+// standard library, ChaCha20Poly1305 configs are skipped.
+func parseODoHConfigs(b []byte) (*odohConfig, error) {
+
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return nil, errors.New("malformed ODoH configs")
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		version, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			break
+		}
+		contents := b[4 : 4+n]
+		b = b[4+n:]
+		if version != odohVersion || len(contents) < 8 {
+			continue
+		}
+		if oc, err := newODoHConfig(contents); err == nil {
+			return oc, nil
+		}
+	}
+	return nil, errors.New("no supported ODoH config")
+}
+
+func newODoHConfig(contents []byte) (*odohConfig, error) {
+
+	kemID := binary.BigEndian.Uint16(contents)
+	kdfID := binary.BigEndian.Uint16(contents[2:])
+	aeadID := binary.BigEndian.Uint16(contents[4:])
+	n := int(binary.BigEndian.Uint16(contents[6:]))
+	if len(contents) != 8+n {
+		return nil, errors.New("malformed ODoH config")
+	}
+
+	oc := &odohConfig{raw: contents}
+	switch kdfID {
+	case 0x0001:
+		oc.hash = sha256.New
+	case 0x0002:
+		oc.hash = sha512.New384
+	case 0x0003:
+		oc.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported KDF %#04x", kdfID)
+	}
+	switch aeadID {
+	case 0x0001:
+		oc.keyLen = 16
+	case 0x0002:
+		oc.keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported AEAD %#04x", aeadID)
+	}
+
+	var err error
+	if oc.kem, err = hpke.NewKEM(kemID); err != nil {
+		return nil, err
+	}
+	if oc.kdf, err = hpke.NewKDF(kdfID); err != nil {
+		return nil, err
+	}
+	if oc.aead, err = hpke.NewAEAD(aeadID); err != nil {
+		return nil, err
+	}
+	if oc.pub, err = oc.kem.NewPublicKey(contents[8:]); err != nil {
+		return nil, err
+	}
+	return oc, nil
+}
+
+// odohConfig returns the target config of provider p, fetching it on first use
+func (c *Client) odohConfig(ctx context.Context, p Provider) (*odohConfig, error) {
+
+	o := c.ODoH
+	o.mu.Lock()
+	oc := o.configs[p.Name]
+	o.mu.Unlock()
+	if oc != nil {
+		return oc, nil
+	}
+
+	u := *p.WireURL
+	u.Path, u.RawQuery = odohConfigPath, ""
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, &RequestError{Provider: p.Name, Err: err}
+	}
+	body, err := c.do(p, req)
+	if err != nil {
+		return nil, err
+	}
+	if oc, err = parseODoHConfigs(body); err != nil {
+		return nil, &DecodeError{Provider: p.Name, Err: err}
+	}
+
+	o.mu.Lock()
+	if o.configs == nil {
+		o.configs = make(map[string]*odohConfig)
+	}
+	o.configs[p.Name] = oc
+	o.mu.Unlock()
+	return oc, nil
+}
+
+// forget drops the cached config of p, after the target rejected it
+func (o *ODoH) forget(p Provider) {
+	o.mu.Lock()
+	delete(o.configs, p.Name)
+	o.mu.Unlock()
+}
+
+// lengthPrefixed appends b with its two byte length
+func lengthPrefixed(dst []byte, b []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(b)))
+	return append(dst, b...)
+}
+
+// odohExchange sends msg to provider p through the relay (RFC 9230 6)
+func (c *Client) odohExchange(ctx context.Context, p Provider, msg []byte) ([]byte, error) {
+
+	oc, err := c.odohConfig(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := oc.keyID()
+	if err != nil {
+		return nil, &RequestError{Provider: p.Name, Err: err}
+	}
+
+	// ObliviousDoHMessagePlaintext: message and zero padding
+	pad := (odohPadTo - len(msg)%odohPadTo) % odohPadTo
+	plain := lengthPrefixed(nil, msg)
+	plain = lengthPrefixed(plain, make([]byte, pad))
+
+	enc, sender, err := hpke.NewSender(oc.pub, oc.kdf, oc.aead, []byte("odoh query"))
+	if err != nil {
+		return nil, &RequestError{Provider: p.Name, Err: err}
+	}
+	aad := lengthPrefixed([]byte{odohTypeQuery}, keyID)
+	ct, err := sender.Seal(aad, plain)
+	if err != nil {
+		return nil, &RequestError{Provider: p.Name, Err: err}
+	}
+	query := lengthPrefixed([]byte{odohTypeQuery}, keyID)
+	query = lengthPrefixed(query, append(enc, ct...))
+
+	// The relay learns the target from the targethost/targetpath parameters
+	u := *c.ODoH.Relay
+	q := u.Query()
+	q.Set("targethost", p.WireURL.Host)
+	q.Set("targetpath", p.WireURL.EscapedPath())
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(query))
+	if err != nil {
+		return nil, &RequestError{Provider: p.Name, Err: err}
+	}
+	req.Header.Set("content-type", odohContentType)
+	req.Header.Set("accept", odohContentType)
+
+	body, err := c.do(p, req)
+	if err != nil {
+		// 401: the target no longer has the key, refetch next time
+		var se *StatusError
+		if errors.As(err, &se) && se.Code == http.StatusUnauthorized {
+			c.ODoH.forget(p)
+		}
+		return nil, err
+	}
+
+	resp, err := oc.open(sender, plain, body)
+	if err != nil {
+		return nil, &DecodeError{Provider: p.Name, Err: err}
+	}
+	return resp, nil
+}
+
+// open decrypts an ObliviousDoHMessage response (RFC 9230 6.3, 6.4)
+func (oc *odohConfig) open(sender *hpke.Sender, plain []byte, body []byte) ([]byte, error) {
+
+	field := func(b []byte) ([]byte, []byte, error) {
+		if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+			return nil, nil, errors.New("malformed ODoH response")
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		return b[2 : 2+n], b[2+n:], nil
+	}
+	if len(body) < 1 || body[0] != odohTypeResponse {
+		return nil, errors.New("not an ODoH response")
+	}
+	nonce, rest, err := field(body[1:])
+	if err != nil {
+		return nil, err
+	}
+	ct, _, err := field(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := sender.Export("odoh response", oc.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(oc.hash, secret, lengthPrefixed(plain, nonce))
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Expand(oc.hash, prk, "odoh key", oc.keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hkdf.Expand(oc.hash, prk, "odoh nonce", gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	rplain, err := gcm.Open(nil, iv, ct, lengthPrefixed([]byte{odohTypeResponse}, nonce))
+	if err != nil {
+		return nil, err
+	}
+	msg, _, err := field(rplain)
+	return msg, err
+}
@@ -0,0 +1,162 @@
+package doh
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Provider is a DoH endpoint. URL serves the JSON (application/dns-json) API,
+// WireURL the RFC 8484 (application/dns-message) one; for user supplied
+// endpoints both are the same.
+type Provider struct {
+	Name    string
+	URL     *url.URL
+	WireURL *url.URL
+	Auth    string // Authorization header value for private endpoints, if any
+	Stamp   *Stamp // set when the provider was given as a DNS stamp
+}
+
+// Endpoints are the JSON and wireformat URLs of a preset provider
+type Endpoints struct {
+	JSON string
+	Wire string
+}
+
+// Presets are the well known public DoH endpoints, selectable by name
+var Presets = map[string]Endpoints{
+	"cloudflare": {"https://cloudflare-dns.com/dns-query", "https://cloudflare-dns.com/dns-query"},
+	"google":     {"https://dns.google/resolve", "https://dns.google/dns-query"},
+	"quad9":      {"https://dns.quad9.net:5053/dns-query", "https://dns.quad9.net/dns-query"},
+	"nextdns":    {"https://dns.nextdns.io/dns-query", "https://dns.nextdns.io/dns-query"},
+	"adguard":    {"https://dns.adguard-dns.com/resolve", "https://dns.adguard-dns.com/dns-query"},
+}
+
+// ProfilePresets are the per-profile (configuration ID) endpoints of the
+// filtering presets; %s is replaced by the profile
+var ProfilePresets = map[string]Endpoints{
+	"nextdns": {"https://dns.nextdns.io/%s", "https://dns.nextdns.io/%s"},
+	"adguard": {"https://d.adguard-dns.com/resolve/%s", "https://d.adguard-dns.com/dns-query/%s"},
+}
+
+// BootstrapAddrs are the well known addresses of the preset endpoints. They let
+// a client reach a provider when the system resolver cannot (or must not) resolve
+// the provider's own name. TLS still verifies against the hostname.
+var BootstrapAddrs = map[string][]string{
+	"cloudflare-dns.com":  {"1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001"},
+	"dns.google":          {"8.8.8.8", "8.8.4.4", "2001:4860:4860::8888", "2001:4860:4860::8844"},
+	"dns.quad9.net":       {"9.9.9.9", "149.112.112.112", "2620:fe::fe", "2620:fe::9"},
+	"dns.adguard-dns.com": {"94.140.14.14", "94.140.15.15", "2a10:50c0::ad1:ff", "2a10:50c0::ad2:ff"},
+}
+
+// DefaultChain is the provider order used for fallback and race when no
+// providers are given explicitly
+const DefaultChain = "cloudflare,google,quad9"
+
+// ParseProviders turns a comma separated list of preset names, DoH URLs
+// and/or sdns:// DNS stamps into an ordered provider list.
+func ParseProviders(s string) ([]Provider, error) {
+
+	var ps []Provider
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if strings.HasPrefix(item, "sdns://") {
+			p, err := stampProvider(item)
+			if err != nil {
+				return nil, err
+			}
+			ps = append(ps, p)
+			continue
+		}
+
+		ep, ok := Presets[strings.ToLower(item)]
+		if !ok {
+			ep = Endpoints{item, item}
+		}
+		u, err := parseDoHURL(ep.JSON)
+		if err != nil {
+			return nil, fmt.Errorf("unknown provider or invalid DoH URL: %s", item)
+		}
+		wu, err := parseDoHURL(ep.Wire)
+		if err != nil {
+			return nil, fmt.Errorf("unknown provider or invalid DoH URL: %s", item)
+		}
+
+		// Presets go by their canonical (lower case) name, which
+		// ApplyProfile and the config's credentials look them up by
+		name := strings.ToLower(item)
+		if !ok {
+			name = u.Host + u.Path
+		}
+		ps = append(ps, Provider{Name: name, URL: u, WireURL: wu})
+	}
+
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("no providers given")
+	}
+	return ps, nil
+}
+
+// ApplyProfile points the NextDNS and AdGuard presets among ps at the
+// endpoints of profile, so their filtering settings apply. It fails when
+// none of ps takes a profile.
+func ApplyProfile(ps []Provider, profile string) error {
+
+	if profile == "" || strings.ContainsAny(profile, "/?#") {
+		return fmt.Errorf("invalid profile: %q", profile)
+	}
+	applied := false
+	for i, p := range ps {
+		ep, ok := ProfilePresets[p.Name]
+		if !ok {
+			continue
+		}
+		u, err := parseDoHURL(fmt.Sprintf(ep.JSON, url.PathEscape(profile)))
+		if err != nil {
+			return err
+		}
+		wu, err := parseDoHURL(fmt.Sprintf(ep.Wire, url.PathEscape(profile)))
+		if err != nil {
+			return err
+		}
+		ps[i].URL, ps[i].WireURL = u, wu
+		applied = true
+	}
+	if !applied {
+		return fmt.Errorf("none of the providers takes a profile (nextdns, adguard do)")
+	}
+	return nil
+}
+
+// stampProvider is the provider a DoH or ODoH target stamp describes.
+// Stamped servers speak RFC 8484 only, both URLs are the same.
+func stampProvider(s string) (Provider, error) {
+	st, err := ParseStamp(s)
+	if err != nil {
+		return Provider{}, err
+	}
+	if st.Proto == StampODoHRelay {
+		return Provider{}, fmt.Errorf("ODoH relay stamp given as a provider, use it as the relay")
+	}
+	u, err := parseDoHURL(st.URL())
+	if err != nil {
+		return Provider{}, fmt.Errorf("DNS stamp: %v", err)
+	}
+	return Provider{Name: u.Host + u.Path, URL: u, WireURL: u, Stamp: st}, nil
+}
+
+// parseDoHURL accepts absolute http(s) URLs only
+func parseDoHURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("not an http(s) URL: %s", raw)
+	}
+	return u, nil
+}
@@ -0,0 +1,23 @@
+package doh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyProfileMixedCase(t *testing.T) {
+
+	for _, server := range []string{"nextdns", "NextDNS", "ADGUARD"} {
+		ps, err := ParseProviders(server)
+		if err != nil {
+			t.Fatalf("%s: %v", server, err)
+		}
+		if err := ApplyProfile(ps, "abc123"); err != nil {
+			t.Errorf("-s %s -profile abc123: %v", server, err)
+			continue
+		}
+		if got := ps[0].URL.String(); !strings.Contains(got, "abc123") {
+			t.Errorf("-s %s -profile abc123: URL %s without the profile", server, got)
+		}
+	}
+}
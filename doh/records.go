@@ -0,0 +1,246 @@
+package doh
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Structured forms of record data, for the types whose presentation format
+// packs several fields into Answer.Data.
+
+// MX is the data of an MX record
+type MX struct {
+	Preference int
+	Exchange   string
+}
+
+// ParseMX splits the data of an MX answer ("10 mx1.example.com.")
+func ParseMX(data string) (MX, error) {
+	f := strings.Fields(data)
+	if len(f) != 2 {
+		return MX{}, fmt.Errorf("not MX data: %q", data)
+	}
+	pref, err := strconv.ParseUint(f[0], 10, 16)
+	if err != nil {
+		return MX{}, fmt.Errorf("not MX data: %q", data)
+	}
+	return MX{Preference: int(pref), Exchange: f[1]}, nil
+}
+
+// SRV is the data of an SRV record (RFC 2782)
+type SRV struct {
+	Priority int
+	Weight   int
+	Port     int
+	Target   string
+}
+
+// ParseSRV splits the data of an SRV answer ("10 60 5060 sip.example.com.")
+func ParseSRV(data string) (SRV, error) {
+	f := strings.Fields(data)
+	if len(f) != 4 {
+		return SRV{}, fmt.Errorf("not SRV data: %q", data)
+	}
+	var n [3]int
+	for i := range n {
+		v, err := strconv.ParseUint(f[i], 10, 16)
+		if err != nil {
+			return SRV{}, fmt.Errorf("not SRV data: %q", data)
+		}
+		n[i] = int(v)
+	}
+	return SRV{Priority: n[0], Weight: n[1], Port: n[2], Target: f[3]}, nil
+}
+
+// Fields is the SRV data in presentation format, one string per field
+func (s SRV) Fields() []string {
+	return []string{strconv.Itoa(s.Priority), strconv.Itoa(s.Weight), strconv.Itoa(s.Port), s.Target}
+}
+
+// NAPTR is the data of a NAPTR record (RFC 3403)
+type NAPTR struct {
+	Order       int
+	Preference  int
+	Flags       string
+	Services    string
+	Regexp      string
+	Replacement string
+}
+
+// ParseNAPTR splits the data of a NAPTR answer
+// (`100 10 "U" "E2U+sip" "!^.*$!sip:info@example.com!" .`)
+func ParseNAPTR(data string) (NAPTR, error) {
+	f := svcbFields(data)
+	if len(f) != 6 {
+		return NAPTR{}, fmt.Errorf("not NAPTR data: %q", data)
+	}
+	var n [2]int
+	for i := range n {
+		v, err := strconv.ParseUint(f[i], 10, 16)
+		if err != nil {
+			return NAPTR{}, fmt.Errorf("not NAPTR data: %q", data)
+		}
+		n[i] = int(v)
+	}
+	return NAPTR{Order: n[0], Preference: n[1], Flags: unquoteText(f[2]), Services: unquoteText(f[3]),
+		Regexp: unquoteText(f[4]), Replacement: f[5]}, nil
+}
+
+// Fields is the NAPTR data in presentation format, one string per field
+func (n NAPTR) Fields() []string {
+	return []string{strconv.Itoa(n.Order), strconv.Itoa(n.Preference), quoteText(n.Flags),
+		quoteText(n.Services), quoteText(n.Regexp), n.Replacement}
+}
+
+// unquoteText undoes the quotes and the \X and \DDD escapes of a
+// character-string
+func unquoteText(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i+2 < len(s) {
+			if v, err := strconv.ParseUint(s[i:i+3], 10, 8); err == nil {
+				b = append(b, byte(v))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// quoteText renders s as a quoted character-string
+func quoteText(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// ParseTXT splits the data of a TXT answer into its character-strings,
+// unquoted. Data some servers send without quotes is one string.
+func ParseTXT(data string) []string {
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, `"`) {
+		return []string{data}
+	}
+	var parts []string
+	for _, f := range svcbFields(data) {
+		parts = append(parts, unquoteText(f))
+	}
+	return parts
+}
+
+// JoinTXT is the value of a TXT answer: its character-strings, which hold
+// at most 255 bytes each, concatenated (RFC 7208 3.3)
+func JoinTXT(data string) string {
+	return strings.Join(ParseTXT(data), "")
+}
+
+// QuoteTXT returns the data of a TXT answer in master file form: as it is
+// when quoted, else (as some servers send it) as one quoted string
+func QuoteTXT(data string) string {
+	if strings.HasPrefix(strings.TrimSpace(data), `"`) {
+		return data
+	}
+	return quoteText(data)
+}
+
+// CAA is the data of a CAA record (RFC 8659)
+type CAA struct {
+	Flags int
+	Tag   string
+	Value string
+}
+
+// Critical reports the issuer critical flag: a CA that does not know the
+// tag must not issue
+func (c CAA) Critical() bool { return c.Flags&128 != 0 }
+
+// ParseCAA splits the data of a CAA answer (`0 issue "letsencrypt.org"`)
+func ParseCAA(data string) (CAA, error) {
+	f := svcbFields(data)
+	if len(f) < 2 {
+		return CAA{}, fmt.Errorf("not CAA data: %q", data)
+	}
+	flags, err := strconv.ParseUint(f[0], 10, 8)
+	if err != nil {
+		return CAA{}, fmt.Errorf("not CAA data: %q", data)
+	}
+	var value string
+	if len(f) > 2 {
+		value = unquoteText(strings.Join(f[2:], " "))
+	}
+	return CAA{Flags: int(flags), Tag: strings.ToLower(f[1]), Value: value}, nil
+}
+
+// TLSA is the data of a TLSA record (RFC 6698)
+type TLSA struct {
+	Usage        int // 0 PKIX-TA, 1 PKIX-EE, 2 DANE-TA, 3 DANE-EE
+	Selector     int // 0 full certificate, 1 SubjectPublicKeyInfo
+	MatchingType int // 0 exact, 1 SHA-256, 2 SHA-512
+	Data         []byte
+}
+
+// ParseTLSA splits the data of a TLSA answer ("3 1 1 2bb1...")
+func ParseTLSA(data string) (TLSA, error) {
+	f := strings.Fields(data)
+	if len(f) < 4 {
+		return TLSA{}, fmt.Errorf("not TLSA data: %q", data)
+	}
+	var n [3]int
+	for i := range n {
+		v, err := strconv.ParseUint(f[i], 10, 8)
+		if err != nil {
+			return TLSA{}, fmt.Errorf("not TLSA data: %q", data)
+		}
+		n[i] = int(v)
+	}
+	b, err := hex.DecodeString(strings.Join(f[3:], ""))
+	if err != nil {
+		return TLSA{}, fmt.Errorf("not TLSA data: %q", data)
+	}
+	return TLSA{Usage: n[0], Selector: n[1], MatchingType: n[2], Data: b}, nil
+}
+
+// SOA is the data of a SOA record (RFC 1035 3.3.13)
+type SOA struct {
+	MName   string // primary nameserver
+	RName   string // responsible mailbox, @ as the first dot
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32 // negative caching TTL (RFC 2308)
+}
+
+// ParseSOA splits the data of a SOA answer
+// ("ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 3600")
+func ParseSOA(data string) (SOA, error) {
+	f := strings.Fields(data)
+	if len(f) != 7 {
+		return SOA{}, fmt.Errorf("not SOA data: %q", data)
+	}
+	var n [5]uint32
+	for i := range n {
+		v, err := strconv.ParseUint(f[2+i], 10, 32)
+		if err != nil {
+			return SOA{}, fmt.Errorf("not SOA data: %q", data)
+		}
+		n[i] = uint32(v)
+	}
+	return SOA{MName: f[0], RName: f[1], Serial: n[0], Refresh: n[1], Retry: n[2], Expire: n[3], Minimum: n[4]}, nil
+}
+
+// SerialBefore reports whether serial a is older than b in RFC 1982 serial
+// number arithmetic, where serials wrap around
+func SerialBefore(a uint32, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
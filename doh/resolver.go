@@ -0,0 +1,124 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// NewResolver returns a *net.Resolver that sends every query through c.
+// The stub resolver in package net still builds the queries (search domains,
+// A/AAAA pairs, retries); only the transport is swapped for DoH.
+func NewResolver(c *Client) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &bridgeConn{ctx: ctx, client: c}, nil
+		},
+	}
+}
+
+// dohAddr is the address reported by bridge connections
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return "doh" }
+
+var errBridgeClosed = errors.New("doh: use of closed bridge connection")
+
+// bridgeConn is an in-memory net.Conn between the net package's stub resolver
+// and a DoH client. It does not implement net.PacketConn, so the stub speaks
+// TCP framing to it: each message is preceded by a two byte length. Written
+// queries are exchanged over DoH right away and the framed responses queued
+// for Read.
+type bridgeConn struct {
+	ctx    context.Context
+	client *Client
+
+	mu       sync.Mutex
+	wbuf     bytes.Buffer // partial outgoing frames
+	rbuf     bytes.Buffer // framed responses not read yet
+	deadline time.Time
+	closed   bool
+}
+
+func (b *bridgeConn) Write(p []byte) (int, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, errBridgeClosed
+	}
+	b.wbuf.Write(p)
+
+	for b.wbuf.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(b.wbuf.Bytes()))
+		if b.wbuf.Len() < 2+n {
+			break
+		}
+		query := make([]byte, n)
+		copy(query, b.wbuf.Bytes()[2:2+n])
+		b.wbuf.Next(2 + n)
+
+		resp, err := b.exchange(query)
+		if err != nil {
+			return 0, err
+		}
+		binary.Write(&b.rbuf, binary.BigEndian, uint16(len(resp)))
+		b.rbuf.Write(resp)
+	}
+	return len(p), nil
+}
+
+// exchange forwards one query honoring the dial context and deadline. The
+// response carries the query's ID since DoH servers may rewrite it.
+func (b *bridgeConn) exchange(query []byte) ([]byte, error) {
+
+	ctx := b.ctx
+	if !b.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, b.deadline)
+		defer cancel()
+	}
+
+	resp, err := b.client.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) >= 2 && len(query) >= 2 {
+		copy(resp[:2], query[:2])
+	}
+	return resp, nil
+}
+
+func (b *bridgeConn) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, errBridgeClosed
+	}
+	return b.rbuf.Read(p)
+}
+
+func (b *bridgeConn) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *bridgeConn) SetDeadline(t time.Time) error {
+	b.mu.Lock()
+	b.deadline = t
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *bridgeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (b *bridgeConn) SetWriteDeadline(t time.Time) error { return b.SetDeadline(t) }
+func (b *bridgeConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (b *bridgeConn) RemoteAddr() net.Addr               { return dohAddr{} }
@@ -0,0 +1,152 @@
+package doh
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// DNS stamps (https://dnscrypt.info/stamps-specifications), the sdns://
+// strings curated resolver lists publish. Only the DoH flavors are of use
+// here: DoH servers, ODoH targets and ODoH relays.
+
+// Stamp protocol identifiers
+const (
+	StampDoH        = 0x02
+	StampODoHTarget = 0x05
+	StampODoHRelay  = 0x85
+)
+
+// Stamp properties
+const (
+	StampDNSSEC   = 1 << 0 // the server validates DNSSEC
+	StampNoLog    = 1 << 1 // the server keeps no logs
+	StampNoFilter = 1 << 2 // the server does not filter or block
+)
+
+// Stamp is a decoded DNS stamp
+type Stamp struct {
+	Proto     byte
+	Props     uint64
+	Addr      string   // IP address (and port) of the server, may be empty
+	Hashes    [][]byte // SHA-256 of TBS certificates, one must be in the chain
+	Host      string   // hostname (and port) used for SNI and Host
+	Path      string
+	Bootstrap []string // resolvers to find Host with, informative
+}
+
+// URL is the https URL of the stamp's endpoint
+func (s *Stamp) URL() string {
+	return "https://" + s.Host + s.Path
+}
+
+// IP is the address of the server without the port, or "" when the
+// stamp does not carry one
+func (s *Stamp) IP() string {
+	a := s.Addr
+	if h, _, err := net.SplitHostPort(a); err == nil {
+		a = h
+	}
+	a = strings.Trim(a, "[]")
+	if ip, err := netip.ParseAddr(a); err == nil {
+		return ip.String()
+	}
+	return ""
+}
+
+var errStamp = errors.New("malformed DNS stamp")
+
+// stampReader walks the binary form of a stamp
+type stampReader struct {
+	b   []byte
+	err error
+}
+
+// lp reads a length prefixed string
+func (r *stampReader) lp() []byte {
+	if r.err != nil || len(r.b) < 1 || len(r.b) < 1+int(r.b[0]) {
+		r.err = errStamp
+		return nil
+	}
+	v := r.b[1 : 1+int(r.b[0])]
+	r.b = r.b[1+int(r.b[0]):]
+	return v
+}
+
+// vlp reads a variable length set of length prefixed strings: the high bit
+// of a length byte says another element follows.
+func (r *stampReader) vlp() [][]byte {
+	var vs [][]byte
+	for r.err == nil {
+		if len(r.b) < 1 {
+			r.err = errStamp
+			return nil
+		}
+		more := r.b[0]&0x80 != 0
+		n := int(r.b[0] &^ 0x80)
+		if len(r.b) < 1+n {
+			r.err = errStamp
+			return nil
+		}
+		if n > 0 {
+			vs = append(vs, r.b[1:1+n])
+		}
+		r.b = r.b[1+n:]
+		if !more {
+			break
+		}
+	}
+	return vs
+}
+
+// ParseStamp decodes an sdns:// DoH, ODoH target or ODoH relay stamp
+func ParseStamp(s string) (*Stamp, error) {
+
+	enc, ok := strings.CutPrefix(s, "sdns://")
+	if !ok {
+		return nil, fmt.Errorf("not a DNS stamp: %s", s)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(enc, "="))
+	if err != nil || len(b) < 1 {
+		return nil, errStamp
+	}
+
+	st := &Stamp{Proto: b[0]}
+	r := &stampReader{b: b[1:]}
+	if st.Proto != StampDoH && st.Proto != StampODoHTarget && st.Proto != StampODoHRelay {
+		return nil, fmt.Errorf("unsupported DNS stamp protocol %#02x (DoH, ODoH only)", st.Proto)
+	}
+	if len(r.b) < 8 {
+		return nil, errStamp
+	}
+	st.Props = binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+
+	if st.Proto != StampODoHTarget {
+		st.Addr = string(r.lp())
+		st.Hashes = r.vlp()
+	}
+	st.Host = string(r.lp())
+	st.Path = string(r.lp())
+	if st.Proto != StampODoHTarget && r.err == nil && len(r.b) > 0 {
+		for _, ip := range r.vlp() {
+			st.Bootstrap = append(st.Bootstrap, string(ip))
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if st.Host == "" || !strings.HasPrefix(st.Path, "/") {
+		return nil, errStamp
+	}
+	for _, h := range st.Hashes {
+		if len(h) != 32 {
+			return nil, fmt.Errorf("DNS stamp certificate hash is not SHA-256")
+		}
+	}
+	return st, nil
+}
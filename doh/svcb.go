@@ -0,0 +1,187 @@
+package doh
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// SVCB and HTTPS records (RFC 9460). The SvcParams are rendered as
+// key=value pairs the way dig and zone files show them, e.g.
+//
+//	1 . alpn="h3,h2" ipv4hint=104.16.132.229,104.16.133.229 ech=AEX+DQBB...
+
+// SvcParamKeys (RFC 9460 14.3.2)
+var svcParamKeys = map[int]string{
+	0: "mandatory",
+	1: "alpn",
+	2: "no-default-alpn",
+	3: "port",
+	4: "ipv4hint",
+	5: "ech",
+	6: "ipv6hint",
+	7: "dohpath",
+}
+
+func svcParamKey(k int) string {
+	if s, ok := svcParamKeys[k]; ok {
+		return s
+	}
+	return "key" + strconv.Itoa(k)
+}
+
+// svcbText renders SVCB/HTTPS record data: priority, target and params
+func svcbText(r *rdataReader) (string, error) {
+
+	parts := []string{strconv.Itoa(r.u16()), r.name()}
+	for r.err == nil && r.off < len(r.rd) {
+		key := r.u16()
+		val := r.bytes(r.u16())
+		if r.err != nil {
+			break
+		}
+		v, err := svcParamValue(key, val)
+		if err != nil {
+			return "", err
+		}
+		if v == "" && key == 2 {
+			parts = append(parts, svcParamKey(key))
+			continue
+		}
+		parts = append(parts, svcParamKey(key)+"="+v)
+	}
+	return strings.Join(parts, " "), r.err
+}
+
+// svcParamValue renders the value of a single SvcParam
+func svcParamValue(key int, val []byte) (string, error) {
+
+	switch key {
+	case 0: // mandatory: list of keys
+		if len(val)%2 != 0 {
+			return "", errTruncatedMsg
+		}
+		var keys []string
+		for i := 0; i < len(val); i += 2 {
+			keys = append(keys, svcParamKey(int(val[i])<<8|int(val[i+1])))
+		}
+		return strings.Join(keys, ","), nil
+	case 1: // alpn: list of character-strings
+		var ids []string
+		for len(val) > 0 {
+			n := int(val[0])
+			if 1+n > len(val) {
+				return "", errTruncatedMsg
+			}
+			// Commas inside an id are escaped (RFC 9460 A.1)
+			id := strings.ReplaceAll(string(val[1:1+n]), ",", `\,`)
+			ids = append(ids, id)
+			val = val[1+n:]
+		}
+		return quoteString([]byte(strings.Join(ids, ","))), nil
+	case 2: // no-default-alpn: no value
+		if len(val) != 0 {
+			return "", errTruncatedMsg
+		}
+		return "", nil
+	case 3: // port
+		if len(val) != 2 {
+			return "", errTruncatedMsg
+		}
+		return strconv.Itoa(int(val[0])<<8 | int(val[1])), nil
+	case 4, 6: // ipv4hint, ipv6hint
+		size := 4
+		if key == 6 {
+			size = 16
+		}
+		if len(val) == 0 || len(val)%size != 0 {
+			return "", errTruncatedMsg
+		}
+		var addrs []string
+		for i := 0; i < len(val); i += size {
+			a, _ := netip.AddrFromSlice(val[i : i+size])
+			addrs = append(addrs, a.String())
+		}
+		return strings.Join(addrs, ","), nil
+	case 5: // ech: ECHConfigList
+		return base64.StdEncoding.EncodeToString(val), nil
+	case 7: // dohpath
+		return quoteString(val), nil
+	}
+	return quoteString(val), nil
+}
+
+// expandGeneric renders answers the provider returned in the RFC 3597
+// \# generic form (as the JSON APIs do for HTTPS and SVCB) in presentation
+// format, when h53 knows the type. Anything it cannot decode is left as is.
+func expandGeneric(answers []Answer) {
+	for i := range answers {
+		a := &answers[i]
+		f := strings.Fields(a.Data)
+		if len(f) < 2 || f[0] != `\#` {
+			continue
+		}
+		n, err := strconv.Atoi(f[1])
+		if err != nil {
+			continue
+		}
+		rdata, err := hex.DecodeString(strings.Join(f[2:], ""))
+		if err != nil || len(rdata) != n {
+			continue
+		}
+		rr := &wireRR{rtype: uint16(a.Type), rdata: rdata}
+		if s, err := rdataText(rdata, rr); err == nil {
+			a.Data = s
+		}
+	}
+}
+
+// SvcParams splits the data of an SVCB or HTTPS answer, as rendered by h53,
+// into priority, target and the key=value params in wire order. Quoted
+// values are returned as they appear, quotes included.
+func SvcParams(data string) (priority int, target string, params [][2]string, err error) {
+
+	f := svcbFields(data)
+	if len(f) < 2 {
+		return 0, "", nil, fmt.Errorf("not SVCB data: %q", data)
+	}
+	if priority, err = strconv.Atoi(f[0]); err != nil {
+		return 0, "", nil, fmt.Errorf("not SVCB data: %q", data)
+	}
+	for _, kv := range f[2:] {
+		k, v, _ := strings.Cut(kv, "=")
+		params = append(params, [2]string{k, v})
+	}
+	return priority, f[1], params, nil
+}
+
+// svcbFields splits on spaces outside of quoted strings
+func svcbFields(s string) []string {
+	var f []string
+	var cur strings.Builder
+	quoted, escaped := false, false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ' ' && !quoted:
+			if cur.Len() > 0 {
+				f = append(f, cur.String())
+				cur.Reset()
+			}
+			continue
+		}
+		cur.WriteRune(c)
+	}
+	if cur.Len() > 0 {
+		f = append(f, cur.String())
+	}
+	return f
+}
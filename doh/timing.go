@@ -0,0 +1,167 @@
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Timing breaks down how long a lookup took on the wire, per net/http/httptrace:
+// the phases of setting up a connection (zero when an idle one was reused),
+// the provider's time to the first byte of the response once the request
+// was written, and the total. With ODoH, the phases are those of the last
+// request to the relay.
+type Timing struct {
+	DNS     time.Duration // resolving the provider's host name
+	Connect time.Duration // TCP connect
+	TLS     time.Duration // TLS handshake
+	TTFB    time.Duration // request written to first response byte
+	Total   time.Duration // query to decoded response, the last try only
+	Reused  bool          // an idle connection was reused
+	Proto   string        // protocol negotiated with TLS ALPN (h2, http/1.1)
+}
+
+// String is the one line summary of verbose text output
+func (t Timing) String() string {
+
+	ms := func(d time.Duration) string { return fmt.Sprintf("%.1fms", float64(d.Microseconds())/1000) }
+	parts := []string{}
+	if t.Reused {
+		parts = append(parts, "reused connection")
+	} else {
+		if t.DNS != 0 {
+			parts = append(parts, "dns "+ms(t.DNS))
+		}
+		parts = append(parts, "connect "+ms(t.Connect))
+		if t.TLS != 0 {
+			parts = append(parts, "tls "+ms(t.TLS))
+		}
+	}
+	parts = append(parts, "ttfb "+ms(t.TTFB), "total "+ms(t.Total))
+	if t.Proto != "" {
+		parts = append(parts, t.Proto)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// MarshalJSON gives the durations in milliseconds
+func (t Timing) MarshalJSON() ([]byte, error) {
+
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	return json.Marshal(struct {
+		DNS     float64 `json:"dns_ms"`
+		Connect float64 `json:"connect_ms"`
+		TLS     float64 `json:"tls_ms"`
+		TTFB    float64 `json:"ttfb_ms"`
+		Total   float64 `json:"total_ms"`
+		Reused  bool    `json:"reused"`
+		Proto   string  `json:"proto,omitempty"`
+	}{ms(t.DNS), ms(t.Connect), ms(t.TLS), ms(t.TTFB), ms(t.Total), t.Reused, t.Proto})
+}
+
+// ConnStats counts the connections requests went out on: new ones, and idle
+// ones reused, which skip the DNS, TCP and TLS setup
+type ConnStats struct {
+	New, Reused atomic.Int64
+}
+
+// String summarizes the counts Ex.: 2 new, 98 reused (98% reuse)
+func (s *ConnStats) String() string {
+	n, r := s.New.Load(), s.Reused.Load()
+	pct := int64(0)
+	if n+r != 0 {
+		pct = r * 100 / (n + r)
+	}
+	return fmt.Sprintf("%d new, %d reused (%d%% reuse)", n, r, pct)
+}
+
+// timer collects the httptrace events of the requests made with its context
+type timer struct {
+	mu                            sync.Mutex
+	t                             Timing
+	dnsStart, connStart, tlsStart time.Time
+	wrote                         time.Time
+}
+
+// withTimer returns ctx with a trace that records into the returned timer,
+// and counts connections in stats if not nil. Connection phases add up, the
+// dialer may try several addresses.
+func withTimer(ctx context.Context, stats *ConnStats) (context.Context, *timer) {
+
+	tm := &timer{}
+	since := func(start time.Time) time.Duration {
+		if start.IsZero() {
+			return 0
+		}
+		return time.Since(start)
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			tm.mu.Lock()
+			tm.dnsStart = time.Now()
+			tm.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			tm.mu.Lock()
+			tm.t.DNS += since(tm.dnsStart)
+			tm.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			tm.mu.Lock()
+			tm.connStart = time.Now()
+			tm.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			tm.mu.Lock()
+			tm.t.Connect += since(tm.connStart)
+			tm.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			tm.mu.Lock()
+			tm.tlsStart = time.Now()
+			tm.mu.Unlock()
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, _ error) {
+			tm.mu.Lock()
+			tm.t.TLS += since(tm.tlsStart)
+			tm.t.Proto = cs.NegotiatedProtocol
+			tm.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if stats != nil && info.Reused {
+				stats.Reused.Add(1)
+			} else if stats != nil {
+				stats.New.Add(1)
+			}
+			tm.mu.Lock()
+			tm.t.Reused = info.Reused
+			tm.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			tm.mu.Lock()
+			tm.wrote = time.Now()
+			tm.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			tm.mu.Lock()
+			tm.t.TTFB = since(tm.wrote)
+			tm.mu.Unlock()
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace), tm
+}
+
+// timing returns what was recorded, with total as the Total
+func (tm *timer) timing(total time.Duration) *Timing {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	t := tm.t
+	t.Total = total
+	return &t
+}
@@ -0,0 +1,37 @@
+package doh
+
+import "context"
+
+// Tracer starts the spans of a Client's work, for distributed tracing: one
+// per Lookup or Exchange, one per provider asked (fallbacks and races show
+// as siblings) and one per try of each (retries). Implementations adapt it
+// to a tracing library, taking the parent span from ctx.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attr) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	SetAttr(attrs ...Attr)
+	End(err error) // err marks the span failed, nil succeeded
+}
+
+// Attr is a span attribute; values are strings, ints or bools
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// StartSpan starts a span with t, which may be nil: the span then records
+// nothing
+func StartSpan(t Tracer, ctx context.Context, name string, attrs ...Attr) (context.Context, Span) {
+	if t == nil {
+		return ctx, noSpan{}
+	}
+	return t.Start(ctx, name, attrs...)
+}
+
+type noSpan struct{}
+
+func (noSpan) SetAttr(...Attr) {}
+func (noSpan) End(error)       {}
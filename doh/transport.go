@@ -0,0 +1,212 @@
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+// TransportOptions describes how connections to the DoH providers are made
+type TransportOptions struct {
+	MaxIdlePerHost int
+	IdleTimeout    time.Duration // how long idle connections are kept, zero keeps the default (90s)
+	HTTP2Only      bool          // speak HTTP/2 only: h2 over TLS, prior knowledge h2c over http://
+	Proxy          string        // http(s):// or socks5(h):// proxy URL, empty honors HTTP(S)_PROXY
+
+	// Bootstrap addresses per provider hostname. Pinned hosts are always
+	// dialed by address; Fallback hosts only when the system resolver fails.
+	Pinned   map[string][]string
+	Fallback map[string][]string
+
+	// CertHashes per provider hostname: SHA-256 digests of TBS certificates
+	// (as DNS stamps carry them), one of which must be in the chain
+	CertHashes map[string][][]byte
+
+	// SPKIPins are SHA-256 digests of SubjectPublicKeyInfo; when set, every
+	// provider must present a certificate with one of these keys in its chain
+	SPKIPins [][]byte
+
+	// Phase timeouts, zero keeps the defaults: DialTimeout bounds the TCP
+	// connect, TLSTimeout the handshake, ReadTimeout the wait for the response
+	// headers once the query is sent. The overall deadline is the Client's.
+	DialTimeout time.Duration
+	TLSTimeout  time.Duration
+	ReadTimeout time.Duration
+
+	// ClientCert authenticates h53 to providers that require mutual TLS
+	ClientCert *tls.Certificate
+
+	// Network restricts connections to "tcp4" or "tcp6", empty allows both.
+	// Local are the source addresses to bind, tried in order until one can
+	// reach the provider (an interface's IPv4 and IPv6 addresses, say).
+	Network string
+	Local   []netip.Addr
+}
+
+// NewTransport builds an HTTP transport for talking to DoH providers
+func NewTransport(o *TransportOptions) (*http.Transport, error) {
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxIdleConnsPerHost = o.MaxIdlePerHost
+	tr.MaxIdleConns = max(tr.MaxIdleConns, o.MaxIdlePerHost)
+	if o.IdleTimeout > 0 {
+		tr.IdleConnTimeout = o.IdleTimeout
+	}
+	if o.HTTP2Only {
+		tr.Protocols = new(http.Protocols)
+		tr.Protocols.SetHTTP2(true)
+		tr.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if o.DialTimeout > 0 || o.Network != "" || len(o.Local) != 0 {
+		tr.DialContext = o.dial
+	}
+	if o.TLSTimeout > 0 {
+		tr.TLSHandshakeTimeout = o.TLSTimeout
+	}
+	tr.ResponseHeaderTimeout = o.ReadTimeout
+
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https, socks5 or socks5h)", u.Scheme)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("proxy URL has no host: %s", o.Proxy)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+
+	if len(o.Pinned) != 0 || len(o.Fallback) != 0 {
+		tr.DialContext = bootstrapDialer(o)
+	}
+	if len(o.CertHashes) != 0 || len(o.SPKIPins) != 0 {
+		tr.TLSClientConfig = &tls.Config{VerifyConnection: o.verifyConnection}
+	}
+	if o.ClientCert != nil {
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.Certificates = []tls.Certificate{*o.ClientCert}
+	}
+	return tr, nil
+}
+
+// dialer is the net.Dialer for provider connections
+func (o *TransportOptions) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if o.DialTimeout > 0 {
+		d.Timeout = o.DialTimeout
+	}
+	return d
+}
+
+// dial connects to a provider (or proxy) over the Network and from the
+// Local addresses of the options
+func (o *TransportOptions) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	d := o.dialer()
+	if o.Network != "" && network == "tcp" {
+		network = o.Network
+	}
+	if len(o.Local) == 0 {
+		return d.DialContext(ctx, network, addr)
+	}
+	var err error
+	for _, a := range o.Local {
+		d.LocalAddr = &net.TCPAddr{IP: a.AsSlice(), Zone: a.Zone()}
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// SPKIHash is the pin of a certificate: the SHA-256 of its public key info
+func SPKIHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// chainHas reports whether any certificate of the chain hashes (by hash)
+// to one of want
+func chainHas(chain []*x509.Certificate, hash func(*x509.Certificate) []byte, want [][]byte) bool {
+	for _, cert := range chain {
+		h := hash(cert)
+		for _, w := range want {
+			if bytes.Equal(h, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyConnection runs after the regular certificate verification and
+// checks the chain against the DNS stamp hashes and the SPKI pins.
+func (o *TransportOptions) verifyConnection(cs tls.ConnectionState) error {
+
+	tbs := func(cert *x509.Certificate) []byte {
+		sum := sha256.Sum256(cert.RawTBSCertificate)
+		return sum[:]
+	}
+	if want, ok := o.CertHashes[cs.ServerName]; ok && !chainHas(cs.PeerCertificates, tbs, want) {
+		return fmt.Errorf("no certificate of %s matches the DNS stamp hashes", cs.ServerName)
+	}
+	if len(o.SPKIPins) != 0 && !chainHas(cs.PeerCertificates, SPKIHash, o.SPKIPins) {
+		return fmt.Errorf("public key of %s does not match the pin (%s presented), possible TLS interception",
+			cs.ServerName, base64.StdEncoding.EncodeToString(SPKIHash(cs.PeerCertificates[0])))
+	}
+	return nil
+}
+
+// bootstrapDialer returns a DialContext that connects to provider hosts by
+// their bootstrap addresses, avoiding the chicken-and-egg dependency on the
+// (possibly blocked) system resolver. The request URL keeps the hostname, so
+// SNI, the Host header and certificate verification are unaffected.
+func bootstrapDialer(o *TransportOptions) func(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	dialAddrs := func(ctx context.Context, network string, addrs []string, port string) (net.Conn, error) {
+		var err error
+		for _, a := range addrs {
+			var conn net.Conn
+			if conn, err = o.dial(ctx, network, net.JoinHostPort(a, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if addrs, ok := o.Pinned[host]; ok {
+			return dialAddrs(ctx, network, addrs, port)
+		}
+
+		conn, err := o.dial(ctx, network, addr)
+		var dnsErr *net.DNSError
+		if addrs, ok := o.Fallback[host]; ok && errors.As(err, &dnsErr) {
+			return dialAddrs(ctx, network, addrs, port)
+		}
+		return conn, err
+	}
+}
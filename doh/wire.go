@@ -0,0 +1,697 @@
+package doh
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// RFC 1035 wire format support for the RFC 8484 (application/dns-message)
+// DoH transport. Queries are packed from name/type/options and responses are
+// unpacked into the same DNSJ model the JSON API produces, with record data
+// rendered in presentation (zone file) format.
+
+// Header flag bits (RFC 1035 4.1.1, RFC 4035 3.2)
+const (
+	flagQR = 1 << 15
+	flagAA = 1 << 10
+	flagTC = 1 << 9
+	flagRD = 1 << 8
+	flagRA = 1 << 7
+	flagAD = 1 << 5
+	flagCD = 1 << 4
+)
+
+const (
+	typeOPT   = 41
+	classINET = 1
+	ednsDO    = 1 << 15 // DNSSEC OK bit in the OPT TTL field
+	ednsECS   = 8       // EDNS Client Subnet option code (RFC 7871)
+	ednsSize  = 4096    // advertised UDP payload size
+)
+
+var errTruncatedMsg = errors.New("dns message truncated")
+
+// WireQuery holds what goes into an outgoing query message
+type WireQuery struct {
+	ID   uint16
+	Name string
+	Type uint16
+	DO   bool   // DNSSEC OK
+	CD   bool   // Checking Disabled
+	ECS  string // client subnet prefix, empty for none
+
+	NoRecurse bool // RD clear, for queries to authoritative servers
+}
+
+// packName appends name in uncompressed label form
+func packName(b []byte, name string) ([]byte, error) {
+
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("name too long: %s", name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid label in name: %s", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// PackQuery builds a query message with an EDNS0 OPT record carrying the
+// DO bit and client subnet as requested.
+func PackQuery(q *WireQuery) ([]byte, error) {
+
+	flags := uint16(flagRD)
+	if q.NoRecurse {
+		flags = 0
+	}
+	if q.CD {
+		flags |= flagCD
+	}
+
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], q.ID)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], 1)  // QDCOUNT
+	binary.BigEndian.PutUint16(b[10:], 1) // ARCOUNT: OPT
+
+	b, err := packName(b, q.Name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, q.Type)
+	b = binary.BigEndian.AppendUint16(b, classINET)
+
+	// OPT pseudo-RR: root name, type, UDP size as class, flags in TTL
+	var ttl uint32
+	if q.DO {
+		ttl = ednsDO
+	}
+	var opts []byte
+	if q.ECS != "" {
+		if opts, err = packECS(q.ECS); err != nil {
+			return nil, err
+		}
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, typeOPT)
+	b = binary.BigEndian.AppendUint16(b, ednsSize)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(opts)))
+	return append(b, opts...), nil
+}
+
+// packECS encodes an EDNS Client Subnet option for prefix (RFC 7871 6)
+func packECS(prefix string) ([]byte, error) {
+
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	p = p.Masked()
+
+	family := uint16(1)
+	addr := p.Addr().AsSlice()
+	if p.Addr().Is6() {
+		family = 2
+	}
+	addr = addr[:(p.Bits()+7)/8]
+
+	b := binary.BigEndian.AppendUint16(nil, ednsECS)
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(addr)))
+	b = binary.BigEndian.AppendUint16(b, family)
+	b = append(b, byte(p.Bits()), 0)
+	return append(b, addr...), nil
+}
+
+// unpackName reads a possibly compressed name at off, returning it in
+// fqdn form and the offset just past it in the original position.
+func unpackName(msg []byte, off int) (string, int, error) {
+
+	var sb strings.Builder
+	end := -1
+	for hops := 0; ; hops++ {
+		if off >= len(msg) || hops > 127 {
+			return "", 0, errTruncatedMsg
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				if sb.Len() == 0 {
+					return ".", end, nil
+				}
+				return sb.String(), end, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, errTruncatedMsg
+			}
+			sb.WriteString(escapeLabel(msg[off+1 : off+1+c]))
+			sb.WriteByte('.')
+			off += 1 + c
+		case 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errTruncatedMsg
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			return "", 0, fmt.Errorf("bad label type in name")
+		}
+	}
+}
+
+// escapeLabel renders a label in presentation format (RFC 4343 2.1)
+func escapeLabel(l []byte) string {
+	var sb strings.Builder
+	for _, c := range l {
+		switch {
+		case c == '.' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < '!' || c > '~':
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// wireRR is a decoded resource record
+type wireRR struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	rdata []byte
+	off   int // offset of rdata within the message, for compressed names
+}
+
+// unpackRR reads one resource record at off
+func unpackRR(msg []byte, off int) (*wireRR, int, error) {
+
+	name, off, err := unpackName(msg, off)
+	if err != nil {
+		return nil, 0, err
+	}
+	if off+10 > len(msg) {
+		return nil, 0, errTruncatedMsg
+	}
+	rr := &wireRR{
+		name:  name,
+		rtype: binary.BigEndian.Uint16(msg[off:]),
+		class: binary.BigEndian.Uint16(msg[off+2:]),
+		ttl:   binary.BigEndian.Uint32(msg[off+4:]),
+	}
+	n := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+n > len(msg) {
+		return nil, 0, errTruncatedMsg
+	}
+	rr.rdata = msg[off : off+n]
+	rr.off = off
+	return rr, off + n, nil
+}
+
+// UnpackMsg decodes a response message into the DNSJ model
+func UnpackMsg(msg []byte) (*DNSJ, error) {
+
+	if len(msg) < 12 {
+		return nil, errTruncatedMsg
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+
+	jdns := &DNSJ{
+		Status: int(flags & 0x0F),
+		AA:     flags&flagAA != 0,
+		TC:     flags&flagTC != 0,
+		RD:     flags&flagRD != 0,
+		RA:     flags&flagRA != 0,
+		AD:     flags&flagAD != 0,
+		CD:     flags&flagCD != 0,
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := unpackName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, errTruncatedMsg
+		}
+		jdns.Questions = append(jdns.Questions, Question{
+			Name: name,
+			Type: int(binary.BigEndian.Uint16(msg[next:])),
+		})
+		off = next + 4
+	}
+
+	for section := 1; section < 4; section++ {
+		for i := 0; i < counts[section]; i++ {
+			rr, next, err := unpackRR(msg, off)
+			if err != nil {
+				return nil, err
+			}
+			off = next
+			if rr.rtype == typeOPT {
+				// Extended RCODE lives in the upper 8 bits of the OPT TTL
+				jdns.Status |= int(rr.ttl>>24) << 4
+				continue
+			}
+			a := Answer{
+				Name: rr.name,
+				Type: int(rr.rtype),
+				TTL:  int(rr.ttl),
+				Data: rdataString(msg, rr),
+			}
+			switch section {
+			case 1:
+				jdns.Answers = append(jdns.Answers, a)
+			case 2:
+				jdns.Authority = append(jdns.Authority, a)
+			case 3:
+				jdns.Additional = append(jdns.Additional, a)
+			}
+		}
+	}
+	return jdns, nil
+}
+
+// rdataString renders record data in presentation format. Types without a
+// dedicated renderer, or malformed data, use the RFC 3597 \# generic form.
+func rdataString(msg []byte, rr *wireRR) string {
+	if s, err := rdataText(msg, rr); err == nil {
+		return s
+	}
+	return fmt.Sprintf("\\# %d %x", len(rr.rdata), rr.rdata)
+}
+
+// rdataReader walks record data, remembering the first decode error
+type rdataReader struct {
+	msg  []byte
+	rd   []byte
+	off  int // position within rd
+	base int // offset of rd within msg
+	err  error
+}
+
+func (r *rdataReader) need(n int) bool {
+	if r.err == nil && r.off+n > len(r.rd) {
+		r.err = errTruncatedMsg
+	}
+	return r.err == nil
+}
+
+func (r *rdataReader) u8() int {
+	if !r.need(1) {
+		return 0
+	}
+	r.off++
+	return int(r.rd[r.off-1])
+}
+
+func (r *rdataReader) u16() int {
+	if !r.need(2) {
+		return 0
+	}
+	r.off += 2
+	return int(binary.BigEndian.Uint16(r.rd[r.off-2:]))
+}
+
+func (r *rdataReader) u32() uint32 {
+	if !r.need(4) {
+		return 0
+	}
+	r.off += 4
+	return binary.BigEndian.Uint32(r.rd[r.off-4:])
+}
+
+func (r *rdataReader) bytes(n int) []byte {
+	if !r.need(n) {
+		return nil
+	}
+	r.off += n
+	return r.rd[r.off-n : r.off]
+}
+
+func (r *rdataReader) rest() []byte {
+	return r.bytes(len(r.rd) - r.off)
+}
+
+func (r *rdataReader) name() string {
+	if r.err != nil {
+		return ""
+	}
+	name, end, err := unpackName(r.msg, r.base+r.off)
+	if err != nil {
+		r.err = err
+		return ""
+	}
+	r.off = end - r.base
+	return name
+}
+
+// str reads a <character-string> and renders it quoted
+func (r *rdataReader) str() string {
+	return quoteString(r.bytes(r.u8()))
+}
+
+func (r *rdataReader) done() bool {
+	return r.err == nil && r.off >= len(r.rd)
+}
+
+// quoteString renders a character-string in quotes, escaping as needed
+func quoteString(b []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range b {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// typeBitmap renders an NSEC/NSEC3 type bitmap (RFC 4034 4.1.2)
+func typeBitmap(b []byte) (string, error) {
+	var types []string
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return "", errTruncatedMsg
+		}
+		window, n := int(b[0]), int(b[1])
+		for i, octet := range b[2 : 2+n] {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, TypeString(window*256+i*8+bit))
+				}
+			}
+		}
+		b = b[2+n:]
+	}
+	return strings.Join(types, " "), nil
+}
+
+// sigTime renders an RRSIG timestamp as YYYYMMDDHHmmSS
+func sigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+// rdataText renders the record data of the types h53 knows about
+func rdataText(msg []byte, rr *wireRR) (string, error) {
+
+	r := &rdataReader{msg: msg, rd: rr.rdata, base: rr.off}
+	var s string
+
+	switch rr.rtype {
+	case 1: // A
+		if len(rr.rdata) != 4 {
+			return "", errTruncatedMsg
+		}
+		return netip.AddrFrom4([4]byte(rr.rdata)).String(), nil
+	case 28: // AAAA
+		if len(rr.rdata) != 16 {
+			return "", errTruncatedMsg
+		}
+		return netip.AddrFrom16([16]byte(rr.rdata)).String(), nil
+	case 2, 5, 12, 39: // NS, CNAME, PTR, DNAME
+		s = r.name()
+	case 15: // MX
+		s = fmt.Sprintf("%d %s", r.u16(), r.name())
+	case 16, 99: // TXT, SPF
+		var parts []string
+		for r.err == nil && r.off < len(rr.rdata) {
+			parts = append(parts, r.str())
+		}
+		s = strings.Join(parts, " ")
+	case 13: // HINFO
+		s = r.str() + " " + r.str()
+	case 6: // SOA
+		s = fmt.Sprintf("%s %s %d %d %d %d %d", r.name(), r.name(),
+			r.u32(), r.u32(), r.u32(), r.u32(), r.u32())
+	case 33: // SRV
+		s = fmt.Sprintf("%d %d %d %s", r.u16(), r.u16(), r.u16(), r.name())
+	case 35: // NAPTR
+		s = fmt.Sprintf("%d %d %s %s %s %s", r.u16(), r.u16(), r.str(), r.str(), r.str(), r.name())
+	case 257: // CAA
+		flags := r.u8()
+		tag := string(r.bytes(r.u8()))
+		s = fmt.Sprintf("%d %s %s", flags, tag, quoteString(r.rest()))
+	case 43: // DS
+		s = fmt.Sprintf("%d %d %d %s", r.u16(), r.u8(), r.u8(), strings.ToUpper(hex.EncodeToString(r.rest())))
+	case 48: // DNSKEY
+		s = fmt.Sprintf("%d %d %d %s", r.u16(), r.u8(), r.u8(), base64.StdEncoding.EncodeToString(r.rest()))
+	case 46: // RRSIG
+		covered, alg, labels, ottl := r.u16(), r.u8(), r.u8(), r.u32()
+		exp, inc, tag := r.u32(), r.u32(), r.u16()
+		signer := r.name()
+		s = fmt.Sprintf("%s %d %d %d %s %s %d %s %s", TypeString(covered), alg, labels, ottl,
+			sigTime(exp), sigTime(inc), tag, signer, base64.StdEncoding.EncodeToString(r.rest()))
+	case 47: // NSEC
+		next := r.name()
+		types, err := typeBitmap(r.rest())
+		if err != nil {
+			return "", err
+		}
+		s = strings.TrimSpace(next + " " + types)
+	case 50: // NSEC3
+		alg, flags, iter := r.u8(), r.u8(), r.u16()
+		salt := hex.EncodeToString(r.bytes(r.u8()))
+		if salt == "" {
+			salt = "-"
+		}
+		next := base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(r.bytes(r.u8()))
+		types, err := typeBitmap(r.rest())
+		if err != nil {
+			return "", err
+		}
+		s = strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s", alg, flags, iter, salt, next, types))
+	case 52: // TLSA
+		s = fmt.Sprintf("%d %d %d %x", r.u8(), r.u8(), r.u8(), r.rest())
+	case 44: // SSHFP
+		s = fmt.Sprintf("%d %d %x", r.u8(), r.u8(), r.rest())
+	case 64, 65: // SVCB, HTTPS
+		var err error
+		if s, err = svcbText(r); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("no renderer for type %d", rr.rtype)
+	}
+
+	if !r.done() {
+		return "", errTruncatedMsg
+	}
+	return s, nil
+}
+
+// questionEnd returns the offset just past the question section of msg
+func questionEnd(msg []byte) (int, error) {
+	if len(msg) < 12 {
+		return 0, errTruncatedMsg
+	}
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		_, next, err := unpackName(msg, off)
+		if err != nil {
+			return 0, err
+		}
+		if next+4 > len(msg) {
+			return 0, errTruncatedMsg
+		}
+		off = next + 4
+	}
+	return off, nil
+}
+
+// Reply builds an answerless response to query carrying rcode: what a
+// server sends when it cannot forward a query (SERVFAIL) or the answer does
+// not fit (with tc set).
+func Reply(query []byte, rcode int, tc bool) ([]byte, error) {
+
+	end, err := questionEnd(query)
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte(nil), query[:end]...)
+	// Keep the opcode, RD and CD of the query
+	flags := binary.BigEndian.Uint16(query[2:])&(0x7800|flagRD|flagCD) | flagQR | flagRA | uint16(rcode&0x0F)
+	if tc {
+		flags |= flagTC
+	}
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	for i := 6; i < 12; i++ {
+		msg[i] = 0
+	}
+	return msg, nil
+}
+
+// AppendAnswer adds a record to a response built by Reply, which has no
+// records after the answer section: how a server answers for itself,
+// without asking anyone.
+func AppendAnswer(msg []byte, name string, rtype uint16, ttl uint32, rdata []byte) ([]byte, error) {
+
+	if len(msg) < 12 || len(rdata) > 0xFFFF {
+		return nil, errTruncatedMsg
+	}
+	msg, err := packName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = binary.BigEndian.AppendUint16(msg, classINET)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	msg = append(msg, rdata...)
+	binary.BigEndian.PutUint16(msg[6:], binary.BigEndian.Uint16(msg[6:])+1)
+	return msg, nil
+}
+
+// PackRdata encodes record data given in presentation format (as in
+// Answer.Data) for the types a local zone needs: A, AAAA, CNAME, NS, PTR,
+// MX, SRV and TXT.
+func PackRdata(rtype uint16, data string) ([]byte, error) {
+
+	data = strings.TrimSpace(data)
+	bad := fmt.Errorf("not %s data: %q", TypeString(int(rtype)), data)
+	switch TypeString(int(rtype)) {
+	case "A", "AAAA":
+		ip, err := netip.ParseAddr(data)
+		if err != nil || ip.Is4() != (rtype == 1) {
+			return nil, bad
+		}
+		return ip.AsSlice(), nil
+	case "CNAME", "NS", "PTR":
+		if strings.ContainsAny(data, " \t") {
+			return nil, bad
+		}
+		return packName(nil, data)
+	case "MX":
+		mx, err := ParseMX(data)
+		if err != nil {
+			return nil, err
+		}
+		return packName(binary.BigEndian.AppendUint16(nil, uint16(mx.Preference)), mx.Exchange)
+	case "SRV":
+		srv, err := ParseSRV(data)
+		if err != nil {
+			return nil, err
+		}
+		b := binary.BigEndian.AppendUint16(nil, uint16(srv.Priority))
+		b = binary.BigEndian.AppendUint16(b, uint16(srv.Weight))
+		b = binary.BigEndian.AppendUint16(b, uint16(srv.Port))
+		return packName(b, srv.Target)
+	case "TXT":
+		var b []byte
+		for _, s := range ParseTXT(data) {
+			// Longer strings are split, each holds at most 255 bytes
+			for {
+				n := min(len(s), 255)
+				b = append(append(b, byte(n)), s[:n]...)
+				if s = s[n:]; s == "" {
+					break
+				}
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("%s records are not supported", TypeString(int(rtype)))
+}
+
+// UDPSize returns the largest UDP response the sender of query accepts: the
+// EDNS payload size (RFC 6891 6.2.3), or 512 without EDNS.
+func UDPSize(query []byte) int {
+	if opt := queryOPT(query); opt != nil {
+		return max(512, int(opt.class))
+	}
+	return 512
+}
+
+// DNSSECOK reports whether query sets the DO bit (RFC 3225), asking for the
+// DNSSEC records along with the answer
+func DNSSECOK(query []byte) bool {
+	opt := queryOPT(query)
+	return opt != nil && opt.ttl&ednsDO != 0
+}
+
+// queryOPT returns the OPT pseudo-record of query, nil without EDNS
+func queryOPT(query []byte) *wireRR {
+
+	off, err := questionEnd(query)
+	if err != nil {
+		return nil
+	}
+	records := 0
+	for i := 6; i < 12; i += 2 {
+		records += int(binary.BigEndian.Uint16(query[i:]))
+	}
+	for i := 0; i < records; i++ {
+		rr, next, err := unpackRR(query, off)
+		if err != nil {
+			break
+		}
+		if rr.rtype == typeOPT {
+			return rr
+		}
+		off = next
+	}
+	return nil
+}
+
+// RewriteTTLs returns a copy of msg with the TTL of every record replaced by
+// ttl(old), as a cache ages the answers it hands out. OPT records keep
+// theirs, the field holds EDNS flags there.
+func RewriteTTLs(msg []byte, ttl func(uint32) uint32) ([]byte, error) {
+
+	off, err := questionEnd(msg)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(nil), msg...)
+	records := 0
+	for i := 6; i < 12; i += 2 {
+		records += int(binary.BigEndian.Uint16(msg[i:]))
+	}
+	for i := 0; i < records; i++ {
+		rr, next, err := unpackRR(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if rr.rtype != typeOPT {
+			// type, class, TTL, rdata length, then rdata
+			binary.BigEndian.PutUint32(out[rr.off-6:], ttl(rr.ttl))
+		}
+		off = next
+	}
+	return out, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// origin is where an address is routed from, per Team Cymru's IP to ASN
+// mapping (https://www.team-cymru.com/ip-asn-mapping)
+type origin struct {
+	ASN      string `json:"asn"`
+	ASName   string `json:"as_name,omitempty"`
+	Prefix   string `json:"prefix"`
+	Country  string `json:"country,omitempty"`
+	Registry string `json:"registry,omitempty"`
+}
+
+// String is the annotation of an address in text output
+func (o origin) String() string {
+	s := "AS" + o.ASN
+	if o.Country != "" {
+		s += " " + o.Country
+	}
+	if o.ASName != "" {
+		s += fmt.Sprintf(" %q", o.ASName)
+	}
+	return s
+}
+
+// cymruFields splits a Team Cymru TXT answer ("15169 | 8.8.8.0/24 | US |
+// arin | 2014-03-14") into its fields
+func cymruFields(data string) []string {
+	f := strings.Split(doh.JoinTXT(data), "|")
+	for i := range f {
+		f[i] = strings.TrimSpace(f[i])
+	}
+	return f
+}
+
+// origin looks up the origin AS of addr, then the AS's name, with TXT
+// queries to Team Cymru's zones, over DoH like any other lookup. The most
+// specific announced prefix wins; a multi-origin prefix gives its first AS.
+func (r *resolver) origin(addr netip.Addr) (*origin, error) {
+
+	zone := "origin.asn.cymru.com"
+	if !addr.Is4() {
+		zone = "origin6.asn.cymru.com"
+	}
+	jdns, err := r.lookup(rblName(addr.String(), zone), "TXT")
+	if err == nil && jdns.Status != 3 {
+		err = jdns.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var o *origin
+	bits := -1
+	for _, a := range jdns.Answers {
+		f := cymruFields(a.Data)
+		if a.Type != 16 || len(f) < 4 {
+			continue
+		}
+		asns := strings.Fields(f[0])
+		p, err := netip.ParsePrefix(f[1])
+		if err != nil || len(asns) == 0 || p.Bits() <= bits {
+			continue
+		}
+		bits = p.Bits()
+		o = &origin{ASN: asns[0], Prefix: f[1], Country: f[2], Registry: f[3]}
+	}
+	if o == nil {
+		return nil, nil
+	}
+
+	// "15169 | US | arin | 2000-03-30 | GOOGLE - Google LLC, US"
+	if jdns, err := r.lookup("AS"+o.ASN+".asn.cymru.com", "TXT"); err == nil {
+		for _, a := range jdns.Answers {
+			if f := cymruFields(a.Data); a.Type == 16 && len(f) >= 5 {
+				o.ASName = f[4]
+				break
+			}
+		}
+	}
+	return o, nil
+}
+
+// origins maps the addresses among the answers of jdns to their origin.
+// Addresses that are not routed on the Internet (private, loopback, ...) are
+// not looked up, and failed lookups leave the address out.
+func (r *resolver) origins(jdns *doh.DNSJ) map[string]origin {
+
+	out := make(map[string]origin)
+	for _, a := range jdns.Answers {
+		if a.Type != 1 && a.Type != 28 {
+			continue
+		}
+		ip, err := netip.ParseAddr(a.Data)
+		if _, ok := out[a.Data]; ok || err != nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			continue
+		}
+		o, err := r.origin(ip.Unmap())
+		if err != nil {
+			slog.Debug("origin lookup failed", "address", ip, "error", err)
+		}
+		if o != nil {
+			out[a.Data] = *o
+		}
+	}
+	return out
+}
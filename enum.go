@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// cmdEnum tries the words of a wordlist as subdomains of a domain and prints
+// the names that exist as they are found
+func cmdEnum() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optWordlist string
+	var optConcurrency int
+
+	fs := newFlagSet("enum", "h53 enum [options] -w wordlist domain",
+		"Find subdomains of domain by resolving each word of -w under it over DoH, skipping wildcard answers.")
+	co.register(fs)
+	fs.StringVar(&optWordlist, "w", "",
+		"Wordlist, one label per line; - reads standard input Ex.: subdomains.txt")
+	fs.IntVar(&optConcurrency, "c", 16,
+		"Lookups in flight at once")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 || optWordlist == "" {
+			fs.Usage()
+			return 1
+		}
+		if optConcurrency < 1 {
+			fmt.Fprint(os.Stderr, "Concurrency (-c) must be at least 1.\n")
+			return 1
+		}
+		fh := os.Stdin
+		if optWordlist != "-" {
+			f, err := os.Open(optWordlist)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to open wordlist: %v\n", err)
+				return 1
+			}
+			defer f.Close()
+			fh = f
+		}
+		words, err := readNames(fh)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read wordlist: %v\n", err)
+			return 1
+		}
+
+		client, err := co.client(set, optConcurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+		domain := strings.Trim(fs.Arg(0), ".")
+
+		wildcard, err := r.wildcardAnswers(domain, "")
+		if err != nil {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "Wildcard probe: %v\n", err)
+				return code
+			}
+			return exitInterrupted
+		}
+		if wildcard != nil {
+			fmt.Fprintf(os.Stderr, "Wildcard: *.%s answers %s, names answering the same are skipped\n",
+				domain, strings.Join(wildcard, ", "))
+		}
+
+		var mu sync.Mutex // serializes output and the counters
+		found, failed, done := 0, 0, 0
+
+		jobs := make(chan string)
+		var wg sync.WaitGroup
+		for range optConcurrency {
+			wg.Go(func() {
+				for word := range jobs {
+					name := word + "." + domain
+					data, exists, err := r.probe(name)
+					mu.Lock()
+					switch {
+					case err != nil:
+						if exitCode(err) != exitInterrupted {
+							failed++
+							done++
+							fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+						}
+					case exists && (wildcard == nil || !subset(data, wildcard)):
+						found++
+						done++
+						fmt.Printf("%s %s\n", name, strings.Join(data, ", "))
+					default:
+						done++
+					}
+					mu.Unlock()
+				}
+			})
+		}
+
+	feed:
+		for _, w := range words {
+			select {
+			case jobs <- strings.Trim(w, "."):
+			case <-r.ctx.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+
+		fmt.Fprintf(os.Stderr, "Found %d names, %d of %d words tried", found, done, len(words))
+		if failed != 0 {
+			fmt.Fprintf(os.Stderr, ", %d lookups failed", failed)
+		}
+		fmt.Fprintln(os.Stderr)
+		switch {
+		case r.ctx.Err() != nil:
+			return exitInterrupted
+		case found == 0:
+			return 4
+		}
+		return 0
+	}
+}
+
+// probe resolves name: the data of its A answer, else of its AAAA answer,
+// and whether the name exists at all. A name without addresses may still
+// exist (NODATA), holding other records or names below it.
+func (r *resolver) probe(name string) ([]string, bool, error) {
+
+	for _, qtype := range []string{"A", "AAAA"} {
+		jdns, err := r.lookup(name, qtype)
+		if err == nil && jdns.Status != 3 {
+			err = jdns.Err()
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if jdns.Status == 3 {
+			return nil, false, nil
+		}
+		if data := answerData(jdns); len(data) != 0 {
+			return data, true, nil
+		}
+	}
+	return []string{"(no address)"}, true, nil
+}
+
+// answerData lists the data of the answers, the CNAMEs on the way
+// included, sorted
+func answerData(jdns *doh.DNSJ) []string {
+	var data []string
+	for _, a := range jdns.Answers {
+		data = append(data, a.Data)
+	}
+	slices.Sort(data)
+	return data
+}
+
+// subset reports whether every element of a is in b
+func subset(a []string, b []string) bool {
+	for _, s := range a {
+		if !slices.Contains(b, s) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// expectation is one -expect: an address, a prefix the addresses must be
+// in, or a regular expression the whole record data must match
+type expectation struct {
+	text   string
+	addr   netip.Addr
+	prefix netip.Prefix
+	re     *regexp.Regexp
+}
+
+// parseExpectation reads an -expect value: addresses and CIDR prefixes
+// as such, anything else as a regular expression
+func parseExpectation(s string) (*expectation, error) {
+
+	e := &expectation{text: s}
+	if a, err := netip.ParseAddr(s); err == nil {
+		e.addr = a.Unmap()
+		return e, nil
+	}
+	if p, err := netip.ParsePrefix(s); err == nil {
+		e.prefix = p.Masked()
+		return e, nil
+	}
+	if _, err := regexp.Compile(s); err != nil {
+		return nil, err
+	}
+	e.re = regexp.MustCompile("^(?:" + s + ")$")
+	return e, nil
+}
+
+// match reports whether a record's data (as -o short prints it) meets e;
+// names match with or without their final dot
+func (e *expectation) match(data string) bool {
+
+	switch {
+	case e.addr.IsValid():
+		a, err := netip.ParseAddr(data)
+		return err == nil && a.Unmap() == e.addr
+	case e.prefix.IsValid():
+		a, err := netip.ParseAddr(data)
+		return err == nil && e.prefix.Contains(a.Unmap())
+	}
+	return e.re.MatchString(strings.TrimSuffix(data, ".")) || e.re.MatchString(data)
+}
+
+// unmet lists how the answers of the type asked for fall short of the
+// expectations: each must be met by one record at least, and each record
+// must meet one of them. Records of the CNAME chain leading there are not
+// held against the answer.
+func unmet(jdns *doh.DNSJ, expect []*expectation) []string {
+
+	qtype := 0
+	if len(jdns.Questions) != 0 {
+		qtype = jdns.Questions[0].Type
+	}
+	met := make([]bool, len(expect))
+	var out []string
+	for _, a := range jdns.Answers {
+		if a.Type != qtype && qtype != 255 {
+			continue
+		}
+		data, ok := answerValue(a), false
+		for i, e := range expect {
+			if e.match(data) {
+				met[i], ok = true, true
+			}
+		}
+		if !ok {
+			out = append(out, fmt.Sprintf("unexpected %s %s", doh.TypeString(a.Type), data))
+		}
+	}
+	for i, e := range expect {
+		if !met[i] {
+			out = append(out, "expected "+e.text+", not in the answer")
+		}
+	}
+	return out
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// attemptDelay is the Connection Attempt Delay of RFC 8305: how long an
+// attempt runs alone before the next address is tried alongside it
+const attemptDelay = 250 * time.Millisecond
+
+// dialAttempt is the outcome of connecting to one address
+type dialAttempt struct {
+	addr netip.Addr
+	conn net.Conn
+	err  error
+	took time.Duration // from the start of this attempt
+}
+
+// family names the address family of a, as reports show it
+func family(a netip.Addr) string {
+	if a.Is4() {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// resolveAll resolves host to all its addresses over DoH, IPv6 and IPv4,
+// looking up AAAA and A at once. IP literals are returned as is.
+func (r *resolver) resolveAll(host string) ([]netip.Addr, int) {
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, 0
+	}
+
+	var wg sync.WaitGroup
+	found := make([][]netip.Addr, 2)
+	codes := make([]int, 2)
+	for i, qtype := range []string{"AAAA", "A"} {
+		wg.Go(func() {
+			jdns, err := r.lookup(host, qtype)
+			if err != nil {
+				codes[i] = exitCode(err)
+				if codes[i] != exitInterrupted {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				}
+				return
+			}
+			found[i] = addresses(jdns)
+		})
+	}
+	wg.Wait()
+
+	if addrs := append(found[0], found[1]...); len(addrs) != 0 {
+		return addrs, 0
+	}
+	for _, code := range codes {
+		if code != 0 {
+			return nil, code
+		}
+	}
+	return nil, 4
+}
+
+// interleave orders addresses for Happy Eyeballs (RFC 8305 section 4):
+// alternating families, IPv6 first, each family in its answer order
+func interleave(addrs []netip.Addr) []netip.Addr {
+
+	var v6, v4 []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() || a.Is4In6() {
+			v4 = append(v4, a.Unmap())
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	out := make([]netip.Addr, 0, len(addrs))
+	for i := range max(len(v6), len(v4)) {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// happyEyeballs connects to port on the first of addrs to answer (RFC 8305):
+// the addresses are tried in interleaved order, each attempt given
+// attemptDelay to connect before the next one starts alongside it, sooner
+// when it fails. The winner's connection is returned with every attempt in
+// the order they ended; the losers are closed. All attempts share timeout.
+func happyEyeballs(ctx context.Context, addrs []netip.Addr, port string, timeout time.Duration) (*dialAttempt, []*dialAttempt) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addrs = interleave(addrs)
+	results := make(chan *dialAttempt, len(addrs))
+	next, pending := 0, 0
+	launch := func() {
+		a := addrs[next]
+		next, pending = next+1, pending+1
+		go func() {
+			start := time.Now()
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(a.String(), port))
+			results <- &dialAttempt{addr: a, conn: conn, err: err, took: time.Since(start)}
+		}()
+	}
+
+	var done []*dialAttempt
+	var winner *dialAttempt
+	launch()
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			done = append(done, res)
+			if res.err == nil && winner == nil {
+				winner = res
+				cancel()
+				continue
+			}
+			if res.conn != nil {
+				res.conn.Close() // connected too, but after the winner
+			}
+			if winner == nil && next < len(addrs) {
+				launch()
+				timer.Reset(attemptDelay)
+			}
+		case <-timer.C:
+			if winner == nil && next < len(addrs) {
+				launch()
+				timer.Reset(attemptDelay)
+			}
+		}
+	}
+	return winner, done
+}
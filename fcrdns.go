@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// cmdFCrDNS checks forward-confirmed reverse DNS: the addresses of a host
+// reverse resolve (PTR) to names that resolve back to the same addresses,
+// as mail servers and Kerberos expect
+func cmdFCrDNS() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+
+	fs := newFlagSet("fcrdns", "h53 fcrdns [options] host|address ...",
+		"Resolve hosts to addresses, the addresses to PTR names and those back to addresses over DoH, reporting mismatches.")
+	co.register(fs)
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() == 0 {
+			fs.Usage()
+			return 1
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		code := 0
+		fail := func(err error) {
+			if code == 0 || code == exitCheckFailed {
+				code = exitCode(err)
+			}
+		}
+		for _, target := range fs.Args() {
+			fmt.Println(target)
+
+			// An address starts the round trip at its PTR records
+			host := strings.TrimSuffix(target, ".")
+			var addrs []netip.Addr
+			if ip, perr := netip.ParseAddr(target); perr == nil {
+				host, addrs = "", []netip.Addr{ip.Unmap()}
+			} else if addrs, err = r.forwardAddrs(host); err != nil {
+				if exitCode(err) == exitInterrupted {
+					return exitInterrupted
+				}
+				fmt.Printf("  error: %v\n", err)
+				fail(err)
+				continue
+			}
+			if len(addrs) == 0 {
+				fmt.Println("  no A or AAAA records: MISMATCH")
+				if code == 0 {
+					code = exitCheckFailed
+				}
+				continue
+			}
+
+			confirmed := 0
+			for _, addr := range addrs {
+				ok, msg, err := r.fcrdns(addr, host)
+				if err != nil {
+					if exitCode(err) == exitInterrupted {
+						return exitInterrupted
+					}
+					fmt.Printf("  %s: error: %v\n", addr, err)
+					fail(err)
+					continue
+				}
+				verdict := "MISMATCH"
+				if ok {
+					verdict = "OK"
+					confirmed++
+				}
+				fmt.Printf("  %s: %s: %s\n", addr, msg, verdict)
+			}
+			fmt.Printf("Forward-confirmed %d of %d addresses\n", confirmed, len(addrs))
+			if confirmed != len(addrs) && code == 0 {
+				code = exitCheckFailed
+			}
+		}
+		return code
+	}
+}
+
+// forwardAddrs resolves host to all its addresses, A and AAAA
+func (r *resolver) forwardAddrs(host string) ([]netip.Addr, error) {
+
+	var addrs []netip.Addr
+	for _, qtype := range []string{"A", "AAAA"} {
+		jdns, err := r.lookup(host, qtype)
+		if err == nil && jdns.Status != 3 {
+			err = jdns.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addresses(jdns) {
+			addrs = append(addrs, ip.Unmap())
+		}
+	}
+	return addrs, nil
+}
+
+// fcrdns reverse resolves addr and forward resolves each PTR name found,
+// reporting whether one of them leads back to addr. With host set, a
+// confirmed name other than host is pointed out: the round trip holds, but
+// through another name.
+func (r *resolver) fcrdns(addr netip.Addr, host string) (bool, string, error) {
+
+	names, err := r.ptrNames(addr)
+	if err != nil {
+		return false, "", err
+	}
+	if len(names) == 0 {
+		return false, "no PTR record", nil
+	}
+
+	var found []string
+	for _, name := range names {
+		back, err := r.forwardAddrs(strings.TrimSuffix(name, "."))
+		if err != nil {
+			return false, "", err
+		}
+		if slices.Contains(back, addr) {
+			msg := "PTR " + name + " resolves back"
+			if host != "" && !strings.EqualFold(strings.TrimSuffix(name, "."), host) {
+				msg += " (a name other than " + host + ")"
+			}
+			return true, msg, nil
+		}
+		var s []string
+		for _, ip := range back {
+			s = append(s, ip.String())
+		}
+		if s == nil {
+			s = []string{"nothing"}
+		}
+		found = append(found, fmt.Sprintf("PTR %s resolves to %s", name, strings.Join(s, ", ")))
+	}
+	return false, strings.Join(found, "; "), nil
+}
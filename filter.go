@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// blockTTL is the TTL of the answers serve makes up for blocked names
+const blockTTL = 60
+
+// hostsAliases are the names hosts files map to themselves, not blocked
+var hostsAliases = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// domainSet is a list of names: exact ones, and *.zone wildcards that
+// stand for the zone and every name below it
+type domainSet struct {
+	exact, wildcard map[string]bool
+}
+
+// load adds the names of a hosts file (0.0.0.0 ads.example.com) or a
+// domain list (one per line, *.example.com for a zone) to d, returning how
+// many it had. # starts a comment.
+func (d *domainSet) load(path string) (int, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if d.exact == nil {
+		d.exact, d.wildcard = make(map[string]bool), make(map[string]bool)
+	}
+
+	n := 0
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(strings.ToLower(text))
+		if len(fields) == 0 {
+			continue
+		}
+		// Hosts format: an address, then the names mapped to it
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			fields = fields[1:]
+		} else if len(fields) > 1 {
+			return n, fmt.Errorf("%s:%d: expected a name, or an address and names", path, line)
+		}
+		for _, name := range fields {
+			name = strings.TrimSuffix(name, ".")
+			switch {
+			case hostsAliases[name]:
+			case strings.HasPrefix(name, "*."):
+				d.wildcard[name[2:]] = true
+				n++
+			default:
+				d.exact[name] = true
+				n++
+			}
+		}
+	}
+	return n, sc.Err()
+}
+
+// match reports whether name is on the list, as itself or below a wildcard
+func (d *domainSet) match(name string) bool {
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if d.exact[name] {
+		return true
+	}
+	for zone := name; zone != ""; {
+		if d.wildcard[zone] {
+			return true
+		}
+		_, zone, _ = strings.Cut(zone, ".")
+	}
+	return false
+}
+
+// filter is serve's blocklist: names on it are answered locally, NXDOMAIN
+// or the unspecified address, unless the allowlist lets them through
+type filter struct {
+	block, allow domainSet
+	zero         bool // 0.0.0.0 and :: answers instead of NXDOMAIN
+}
+
+// newFilter loads the -blocklist and -allowlist files, nil without any
+// blocklist. answer is -block-answer: nxdomain or zero.
+func newFilter(blocklists []string, allowlists []string, answer string) (*filter, error) {
+
+	if answer != "nxdomain" && answer != "zero" {
+		return nil, fmt.Errorf("-block-answer: expected nxdomain or zero, not %q", answer)
+	}
+	if len(blocklists) == 0 {
+		return nil, nil
+	}
+	f := &filter{zero: answer == "zero"}
+	for _, path := range blocklists {
+		n, err := f.block.load(path)
+		if err != nil {
+			return nil, fmt.Errorf("-blocklist: %w", err)
+		}
+		slog.Info("blocklist loaded", "path", path, "names", n)
+	}
+	for _, path := range allowlists {
+		n, err := f.allow.load(path)
+		if err != nil {
+			return nil, fmt.Errorf("-allowlist: %w", err)
+		}
+		slog.Info("allowlist loaded", "path", path, "names", n)
+	}
+	return f, nil
+}
+
+// reply is the local answer to query when its name is blocked, nil when
+// it is to be forwarded. A nil filter blocks nothing.
+func (f *filter) reply(query []byte) []byte {
+
+	if f == nil {
+		return nil
+	}
+	q, err := doh.UnpackMsg(query)
+	if err != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	name, qtype := q.Questions[0].Name, q.Questions[0].Type
+	if !f.block.match(name) || f.allow.match(name) {
+		return nil
+	}
+	slog.Debug("blocked", "name", name, "type", doh.TypeString(qtype))
+
+	if !f.zero {
+		resp, _ := doh.Reply(query, 3, false)
+		return resp
+	}
+	// Other types get NODATA: the name exists, with none of those
+	resp, err := doh.Reply(query, 0, false)
+	switch {
+	case err != nil:
+	case qtype == 1:
+		resp, err = doh.AppendAnswer(resp, name, 1, blockTTL, netip.IPv4Unspecified().AsSlice())
+	case qtype == 28:
+		resp, err = doh.AppendAnswer(resp, name, 28, blockTTL, netip.IPv6Unspecified().AsSlice())
+	}
+	if err != nil {
+		return nil
+	}
+	return resp
+}
@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// flightGroup coalesces concurrent calls for the same key into one (the
+// singleflight pattern): the first caller runs the call, those arriving
+// while it is in flight wait for it and share its result. The zero value
+// is ready to use.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flight[T]
+}
+
+// flight is a call in progress, or done once ready is closed
+type flight[T any] struct {
+	ready chan struct{}
+	val   T
+	err   error
+}
+
+// do runs fn for key, unless a call for key is in flight already, in which
+// case it waits for that one's result. shared tells the callers that got a
+// result they did not run fn for.
+func (g *flightGroup[T]) do(key string, fn func() (T, error)) (val T, err error, shared bool) {
+
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-f.ready
+		return f.val, f.err, true
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flight[T])
+	}
+	f := &flight[T]{ready: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	// Later callers start a call of their own
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(f.ready)
+	}()
+	f.val, f.err = fn()
+	return f.val, f.err, false
+}
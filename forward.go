@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// forwardRules route the queries for some zones to plain DNS servers
+// instead of the providers: the intranet names only the corporate DNS
+// knows. A rule covers the zone and every name below it; the longest zone
+// matching a name wins.
+type forwardRules map[string]netip.AddrPort
+
+// add parses rules of -forward, comma separated: zone=address, the
+// address with a port when not 53 (corp.example=10.0.0.53,
+// *.lab=[fd00::53]:5353)
+func (f forwardRules) add(rules string) error {
+
+	for _, rule := range strings.Split(rules, ",") {
+		zone, server, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		zone = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(zone), "*."), "."))
+		if !ok || zone == "" {
+			return fmt.Errorf("expected zone=address, not %q", rule)
+		}
+		server = strings.TrimSpace(server)
+		ap, err := netip.ParseAddrPort(server)
+		if err != nil {
+			ip, perr := netip.ParseAddr(server)
+			if perr != nil {
+				return fmt.Errorf("%s: not an address or address:port: %q", zone, server)
+			}
+			ap = netip.AddrPortFrom(ip, 53)
+		}
+		f[zone] = ap
+	}
+	return nil
+}
+
+// match returns the server for the question of query, if a rule covers it
+func (f forwardRules) match(query []byte) (netip.AddrPort, bool) {
+
+	if len(f) == 0 {
+		return netip.AddrPort{}, false
+	}
+	q, err := doh.UnpackMsg(query)
+	if err != nil || len(q.Questions) != 1 {
+		return netip.AddrPort{}, false
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Questions[0].Name, "."))
+	for zone, more := name, true; more; _, zone, more = strings.Cut(zone, ".") {
+		if server, ok := f[zone]; ok {
+			return server, true
+		}
+	}
+	return netip.AddrPort{}, false
+}
+
+// forward sends query to server over plain DNS, UDP and then TCP when the
+// answer is truncated, under an ID of its own (answer puts the client's back)
+func forward(ctx context.Context, server netip.AddrPort, query []byte) ([]byte, error) {
+
+	if len(query) < 12 {
+		return nil, fmt.Errorf("query too short")
+	}
+	id := uint16(rand.Uint32())
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, query[2:]...)
+
+	reply, err := directExchange(ctx, "udp", server, id, msg)
+	if err == nil && len(reply) > 2 && reply[2]&0x02 != 0 {
+		reply, err = directExchange(ctx, "tcp", server, id, msg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("forwarding to %s: %w", server, err)
+	}
+	return reply, nil
+}
@@ -0,0 +1,3 @@
+module github.com/dsnezhkov/h53
+
+go 1.26
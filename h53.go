@@ -10,205 +10,361 @@
 // 			https://developers.cloudflare.com/1.1.1.1/dns-over-https/json-format/
 //
 // Usage:
+//  h53 [query] [options] -n name
+//  h53 <command> [options]
+//
+// Commands:
+//  query      Resolve names over DoH (the default)
+//  connect    Resolve over DoH, then open a TCP/TLS connection
+//  probe      Resolve over DoH, then send an HTTP(S) request to every address
+//  cert       Show and check the TLS certificate every address of a name presents
+//  serve      Answer local DNS (UDP/TCP) queries over DoH
+//  monitor    Watch a list of records, POST changes to a webhook
+//  bench      Measure provider latency
+//  cache      Inspect a -cache-file, flush names from it or clear it
+//  doctor     Check connectivity to the DoH providers
+//  spf        Expand an SPF record, count its DNS lookups, flatten it
+//  mailcheck  Audit the MX, SPF, DMARC and DKIM records of a domain
+//  caa        Find the CAA records that apply to a domain, as CAs do
+//  dane       Verify a service's certificate against its TLSA (DANE) records
+//  rbl        Check addresses against DNS blocklists
+//  enum       Find subdomains from a wordlist
+//  takeover   Find dangling CNAMEs open to subdomain takeover
+//  sweep      Reverse resolve every address of a CIDR range
+//  fcrdns     Check forward-confirmed reverse DNS (A -> PTR -> A)
+//  propagate  Compare the answers of many public resolvers
+//  soa        Compare the SOA serials of a zone's nameservers
+//  zonecheck  Check a zone's delegation: NS sets, glue, lame servers
+//  dnssec     Follow the DNSSEC chain of trust from the root to a name
+//  rrsig      Check when a zone's RRSIG signatures expire
+//  walk       Enumerate a signed zone from its NSEC/NSEC3 chain
+//  hosts-sync Keep a block of /etc/hosts in line with DoH answers
+//  history    Search the lookups recorded with -history
+//  diff       Compare two saved -o json outputs, or answers with the last recorded
+//  snapshot   Save the answers of a list of names, or compare with a saved snapshot
+//  completion Print a bash, zsh or fish completion script
+//
+// Run h53 help <command> for its options.
+//
+// Query options:
+//  -4    Reach the providers over IPv4 only
+//  -6    Reach the providers over IPv6 only
+//  -A string
+//        User-Agent sent to the providers Ex.: 'Mozilla/5.0 (X11; Linux x86_64) ...' (default "h53 (+https://github.com/dsnezhkov/h53)")
+//  -H value
+//        Header to send to the providers, repeatable; an empty value removes one Ex.: -H 'X-Client-Id: 42'
 //  -T int
 //        Query Timeout (sec.) Ex.: 10 (default 10)
-//  -d    Debug Lookups
+//  -ascii
+//        Show internationalized names in their xn-- (punycode) form, not in Unicode
+//  -auth-basic string
+//        Basic auth user:pass sent to the providers, overrides config file credentials
+//  -auth-token string
+//        Bearer token sent to the providers (Authorization header), overrides config file credentials
+//  -backoff duration
+//        Initial retry delay, doubled (with jitter) on each retry Ex.: 500ms (default 250ms)
+//  -bind string
+//        Source address of provider connections, or an interface to take it from Ex.: 192.0.2.10, eth1
+//  -bootstrap
+//        Reach preset providers by their well known IPs, never asking the system resolver
+//        (by default the IPs are only used when system resolution fails)
+//  -bootstrap-ip string
+//        Pin the address(es) of the first -s provider, comma separated Ex.: 1.1.1.1,1.0.0.1
+//  -c int
+//        Concurrent lookups in batch mode Ex.: 32 (default 1)
+//  -cache-file string
+//        Persist cached answers (TTL honoring) across runs Ex.: h53.cache
+//  -cd
+//        Checking Disabled: ask the resolver not to validate DNSSEC
+//  -cert string
+//        Client certificate (PEM) for providers requiring mutual TLS Ex.: client.crt
+//  -compare-system
+//        Resolve the name with the system resolver too and show both answers side by side, same or different
+//  -config string
+//        Config file with option defaults and credentials (default ~/.h53.yaml)
+//  -connect-timeout duration
+//        Time allowed to connect (TCP) to a provider, within -T Ex.: 2s
+//  -d    Debug Lookups: log requests, responses and retries (same as -log-level debug)
+//  -detect-wildcard
+//        Probe random names in the parent zone and flag answers its wildcard would give any name
+//  -do
+//        DNSSEC OK: request DNSSEC records (RRSIG) along with the answer
+//  -ecs string
+//        EDNS Client Subnet to send upstream Ex.: 198.51.100.0/24 (0.0.0.0/0 opts out of subnet leakage)
+//  -enrich
+//        Annotate answer addresses with their origin AS, AS name and country (Team Cymru lookups, over DoH)
+//  -expect value
+//        Exit 0 only if the answer is as expected, 9 otherwise; repeat for each record. An address, a CIDR
+//        prefix or a regular expression of the whole record data Ex.: -expect 93.184.216.34 -expect 2606:2800::/32
+//  -f string
+//        File with Query Names, one per line. Ex.: names.txt
+//  -fallback
+//        On failure or SERVFAIL retry against the next provider (cloudflare,google,quad9 unless -s is set)
+//  -follow-cname
+//        Query the end of CNAME chains the resolver did not complete, until an answer, a loop or 8 aliases
+//  -front string
+//        Domain fronting: connect and do TLS (SNI) to this host, sending the provider's name only in the
+//        Host header, inside TLS; the provider must share a CDN with it Ex.: www.example-cdn.com
+//  -grep string
+//        Only show answers whose data matches this regular expression Ex.: ^google-site-verification=
+//  -header
+//        Print the column names first (-o csv)
+//  -history string
+//        Record every lookup (answers, RCODE, provider, latency) to this file, see h53 history Ex.: ~/.h53_history
+//  -http2
+//        Only speak HTTP/2 with providers (h2c with prior knowledge for http:// URLs), fail otherwise
+//  -i    Interactive: read lookups (Ex.: A example.com) and commands (server, verbose, history) at a prompt
+//  -idle-timeout duration
+//        How long an idle provider connection is kept for reuse Ex.: 5m (default 1m30s)
+//  -key string
+//        Private key (PEM) of -cert (default: read from the -cert file)
+//  -log-file string
+//        Append log messages to this file instead of stderr Ex.: h53.log
+//  -log-format string
+//        Log format: text (key=value) or json (default "text")
+//  -log-level string
+//        Log messages of this level and above: debug, info, warn or error (default "info")
+//  -max-idle-conns int
+//        Idle connections kept open per provider for reuse (default: one per concurrent lookup)
+//  -max-response int
+//        Largest provider response accepted, in bytes once decompressed; larger ones fail as undecodable (default 262144)
+//  -method string
+//        HTTP method: GET or POST. POST implies -wire and is the -wire default,
+//        it keeps query names out of URL logs
 //  -n string
-//        Query Name Ex.: example.com
+//        Query Name Ex.: example.com (use - to read names from stdin)
+//  -o string
+//        Output format: text, json, jsonl, csv, dig, short, hosts, zone, template (see -tpl) (default "text")
+//  -odoh
+//        Oblivious DoH (RFC 9230): encrypt queries for -target and send them through -relay
+//  -otlp string
+//        OpenTelemetry collector to export traces of the lookups to (OTLP/HTTP) Ex.: http://127.0.0.1:4318
+//  -pin string
+//        SHA-256 of the provider's public key (SPKI), base64 or hex, comma separated;
+//        connections presenting other keys fail (see h53 doctor for the current pin)
+//  -profile string
+//        NextDNS or AdGuard DNS profile (configuration ID) for the nextdns/adguard providers Ex.: abc123
+//  -proxy string
+//        Proxy for DoH requests Ex.: socks5h://127.0.0.1:9050, http://proxy:3128 (default: HTTP(S)_PROXY env)
+//  -ptr
+//        Reverse resolve answer addresses (PTR) and show the names next to them
+//  -race
+//        Query all providers in parallel and use the fastest good answer (cloudflare,google,quad9 unless -s is set)
+//  -read-timeout duration
+//        Time allowed for a provider to answer once the query is sent, within -T Ex.: 5s
+//  -relay string
+//        ODoH relay (proxy) URL Ex.: https://odoh-relay.example/proxy
+//  -require-ad
+//        Exit non-zero (6) when the answer is not DNSSEC validated (AD bit)
+//  -resolve-mx
+//        Resolve the addresses (A, AAAA) of MX exchanges too
+//  -resolve-srv
+//        Resolve the addresses (A, AAAA) of SRV targets too
+//  -retries int
+//        Retries per provider on transport errors, timeouts, HTTP 429/5xx (all within -T)
+//  -s string
+//        DoH provider: cloudflare, google, quad9, nextdns, adguard, a JSON API URL or an sdns:// DNS stamp.
+//        Comma separated list sets the -fallback order / -race set Ex.: google,https://doh.example/dns-query (default "cloudflare")
+//  -scan string
+//        After the lookup, TCP connect to these ports of every answer address and print an
+//        open/closed/filtered matrix (exit code 7 when none is open) Ex.: 80,443,22 or 8000-8010
+//  -scan-concurrency int
+//        Connects of -scan in flight at once (default 32)
+//  -scan-timeout duration
+//        Time allowed for each connect of -scan; ports not answering by then are filtered (default 2s)
+//  -serve-stale duration
+//        Answer from expired cache entries, up to this long past their TTL, when the providers fail (RFC 8767) Ex.: 24h
+//  -short
+//        Print only the record data, one per line (same as -o short)
+//  -stream
+//        Stream batch results as they complete instead of in input order
 //  -t string
 //        Query Type (either a numeric value or text) Ex: A, AAAA.
+//        Several types may be comma separated Ex: A,AAAA,MX.
 //        Note: list of types can be found here: https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-4
+//        Defaults to PTR when the name is an IPv4/IPv6 literal.
+//  -target string
+//        ODoH target, in place of -s Ex.: https://odoh.cloudflare-dns.com/dns-query
+//  -tls-timeout duration
+//        Time allowed for the TLS handshake with a provider, within -T Ex.: 3s
+//  -tpl string
+//        Go template rendering each answer (-o template) Ex.: '{{.Name}} {{type .Type}} {{.Data}}'.
+//        Fields: .Name .Type .TTL .Data .Value .Query .Response; functions: type rcode join upper lower json
+//  -trace
+//        Resolve iteratively from the root servers, asking each zone's nameservers directly (port 53), like dig +trace
 //  -v    Display Verbose processing
+//  -watch duration
+//        Re-resolve every interval, flagging answer changes, until interrupted Ex.: 30s
+//  -wire
+//        Use RFC 8484 wireformat (application/dns-message) instead of the JSON API
 //
 // Examples:
 // 		h53 -t MX -n ibm.com  -v
-//				0: ibm.com. - 129.42.38.10
+//				1  ibm.com.  3600  MX  10 mx0a-001b2d01.pphosted.com.
 //		h53 -t A -n tencent.com
-//0: tencent.com. - 113.105.73.141
-//1: tencent.com. - 113.105.73.142
-//2: tencent.com. - 113.105.73.148
-//3: tencent.com. - 113.107.238.11
-//4: tencent.com. - 113.107.238.12
-//5: tencent.com. - 113.107.238.14
-//6: tencent.com. - 113.107.238.15
-//7: tencent.com. - 113.107.238.27
-//8: tencent.com. - 119.147.33.33
-//9: tencent.com. - 119.147.33.36
-//10: tencent.com. - 119.147.253.23
-//11: tencent.com. - 119.147.253.25
-//12: tencent.com. - 183.56.150.142
-//13: tencent.com. - 183.56.150.144
-//14: tencent.com. - 183.56.150.146
-//15: tencent.com. - 183.56.150.155
+//		 0  tencent.com.  600  A  113.105.73.141
+//		 1  tencent.com.  600  A  113.105.73.142
+//		 2  tencent.com.  600  A  113.105.73.148
+//		 3  tencent.com.  600  A  113.107.238.11
+//		 4  tencent.com.  600  A  113.107.238.12
+//		 5  tencent.com.  600  A  113.107.238.14
+//		 6  tencent.com.  600  A  113.107.238.15
+//		 7  tencent.com.  600  A  113.107.238.27
+//		 8  tencent.com.  600  A  119.147.33.33
+//		 9  tencent.com.  600  A  119.147.33.36
+//		10  tencent.com.  600  A  119.147.253.23
+//		11  tencent.com.  600  A  119.147.253.25
+//		12  tencent.com.  600  A  183.56.150.142
+//		13  tencent.com.  600  A  183.56.150.144
+//		14  tencent.com.  600  A  183.56.150.146
+//		15  tencent.com.  600  A  183.56.150.155
 //
 // 		h53 -t A -n ibm.com  -d -v
 // 		h53 -t A -n ibm.com
+// 		h53 -t A,AAAA,MX -n example.com
+// 		h53 -t A -n example.com -s google
+// 		h53 -t A -n example.com -fallback
+// 		h53 -t A -n example.com -race
+// 		h53 -t A -n example.com -do -require-ad
+// 		h53 -n 1.1.1.1
+// 		h53 -t A -f names.txt
+// 		cat names.txt | h53 -t A -n -
+// 		h53 -t A -f names.txt -c 64 -stream
+// 		h53 -t A -n example.com -o json | jq -r '.Answer[].data'
+// 		h53 -t MX -n example.com -o dig
+// 		h53 -t A -n example.com -short
+// 		h53 serve -listen 127.0.0.1:5353
+// 		h53 doctor
 
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"log"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"io"
 	"os"
-	"time"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-type Question struct {
-	Name string `json:"name"`
-	Type int    `json:"type"`
-}
-
-type Answer struct {
-	Name string `json:"name"`
-	Type int    `json:"type"`
-	TTL  int    `json:"TTL"`
-	Data string `json:"data"`
+// command is a subcommand. setup defines its options, without doing
+// anything else, and returns them with the function running it: that
+// parses args into them and returns the exit code. Completion scripts are
+// made from the options alone.
+type command struct {
+	setup func() (*flag.FlagSet, func(args []string) int)
+	about string
 }
 
-type DNSJ struct {
-	Status    int        `json:"Status"`
-	TC        bool       `json:"TC"`
-	RD        bool       `json:"RD"`
-	RA        bool       `json:"RA"`
-	AD        bool       `json:"AD"`
-	CD        bool       `json:"CD"`
-	Questions []Question `json:"Question"`
-	Answers   []Answer   `json:"Answer"`
+// run runs c with args
+func (c command) run(args []string) int {
+	_, run := c.setup()
+	return run(args)
 }
 
-func main() {
-
-	// Options
-	var optType string
-	var optName string
-	var optTimeout int
-	var optVerbose bool
-	var optDebug bool
-
-	flag.BoolVar(&optDebug, "d", false,
-		"Debug Lookups")
-	flag.BoolVar(&optVerbose, "v", false,
-		"Display Verbose processing")
-	flag.StringVar(&optType, "t", "",
-		"Query Type (either a numeric value or text) Ex: A, AAAA. "+
-			"\nNote: list of types can be found here: https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-4 ")
-	flag.StringVar(&optName, "n", "",
-		"Query Name Ex.: example.com")
-	flag.IntVar(&optTimeout, "T", 10,
-		"Query Timeout (sec.) Ex.: 10")
-
-	flag.Parse()
-
-	flagset := make(map[string]bool)
-	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
+// commands are the h53 subcommands. Without one (options straight away)
+// h53 runs query, as it always has.
+var commands map[string]command
 
-	if !flagset["t"] || !flagset["n"] {
-		fmt.Fprint(os.Stderr, "Query Type (-t) or Name (-d) is NOT set.\n")
-		os.Exit(1)
-	}
-
-	// Client
-	var rdump []byte
-	var u url.URL
-
-	c := http.Client{Timeout: time.Duration(optTimeout) * time.Second}
-
-	u.Scheme = "https"
-	u.Host = "cloudflare-dns.com"
-	u.Path = "dns-query"
-
-	q := u.Query()
-	q.Set("name", optName)
-	q.Set("type", optType)
-	u.RawQuery = q.Encode()
-
-	if flagset["d"] {
-		log.Printf("Host: %s, Query: %s\n", u.Host, u.RawQuery)
+func init() {
+	commands = map[string]command{
+		"query":      {cmdQuery, "Resolve names over DoH (the default)"},
+		"connect":    {cmdConnect, "Resolve over DoH, then open a TCP/TLS connection"},
+		"probe":      {cmdProbe, "Resolve over DoH, then send an HTTP(S) request to every address"},
+		"cert":       {cmdCert, "Show and check the TLS certificate every address of a name presents"},
+		"serve":      {cmdServe, "Answer local DNS (UDP/TCP) queries over DoH"},
+		"monitor":    {cmdMonitor, "Watch a list of records, POST changes to a webhook"},
+		"bench":      {cmdBench, "Measure provider latency"},
+		"cache":      {cmdCache, "Inspect a -cache-file, flush names from it or clear it"},
+		"doctor":     {cmdDoctor, "Check connectivity to the DoH providers"},
+		"spf":        {cmdSPF, "Expand an SPF record, count its DNS lookups, flatten it"},
+		"dane":       {cmdDANE, "Verify a service's certificate against its TLSA (DANE) records"},
+		"takeover":   {cmdTakeover, "Find dangling CNAMEs open to subdomain takeover"},
+		"sweep":      {cmdSweep, "Reverse resolve every address of a CIDR range"},
+		"fcrdns":     {cmdFCrDNS, "Check forward-confirmed reverse DNS (A -> PTR -> A)"},
+		"propagate":  {cmdPropagate, "Compare the answers of many public resolvers"},
+		"soa":        {cmdSOA, "Compare the SOA serials of a zone's nameservers"},
+		"zonecheck":  {cmdZonecheck, "Check a zone's delegation: NS sets, glue, lame servers"},
+		"dnssec":     {cmdDNSSEC, "Follow the DNSSEC chain of trust from the root to a name"},
+		"rrsig":      {cmdRRSIG, "Check when a zone's RRSIG signatures expire"},
+		"walk":       {cmdWalk, "Enumerate a signed zone from its NSEC/NSEC3 chain"},
+		"hosts-sync": {cmdHostsSync, "Keep a block of /etc/hosts in line with DoH answers"},
+		"history":    {cmdHistory, "Search the lookups recorded with -history"},
+		"diff":       {cmdDiff, "Compare two saved -o json outputs, or answers with the last recorded"},
+		"snapshot":   {cmdSnapshot, "Save the answers of a list of names, or compare with a saved snapshot"},
+		"completion": {cmdCompletion, "Print a bash, zsh or fish completion script"},
+		"enum":       {cmdEnum, "Find subdomains from a wordlist"},
+		"rbl":        {cmdRBL, "Check addresses against DNS blocklists"},
+		"caa":        {cmdCAA, "Find the CAA records that apply to a domain, as CAs do"},
+		"mailcheck":  {cmdMailcheck, "Audit the MX, SPF, DMARC and DKIM records of a domain"},
 	}
+}
 
-	req, err := http.NewRequest("GET", u.String(), nil)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to create a GET request: %v\n", err)
-		os.Exit(2)
+func main() {
 
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		os.Exit(shutdown(commands["query"].run(args)))
 	}
-	req.Header.Set("accept", "application/dns-json")
-
-	if flagset["d"] {
-		rdump, err = httputil.DumpRequest(req, true)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to dump outgoing request: %v\n", err)
-		} else {
-			fmt.Printf("[DEBUG:REQUEST] \n%s\n", rdump)
+	if args[0] == "help" {
+		if len(args) > 1 {
+			if c, ok := commands[args[1]]; ok {
+				os.Exit(c.run([]string{"-h"}))
+			}
 		}
-
+		usage(os.Stdout)
+		os.Exit(0)
 	}
-
-	res, err := c.Do(req)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error fetching response from the provider: %v", err)
-		os.Exit(3)
+	c, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+		usage(os.Stderr)
+		os.Exit(1)
 	}
+	os.Exit(shutdown(c.run(args[1:])))
+}
 
-	defer res.Body.Close()
+// commandNames lists the subcommands in the order usage shows them
+var commandNames = []string{"query", "connect", "probe", "cert", "serve", "monitor", "bench", "cache", "doctor", "spf", "mailcheck", "caa", "dane", "rbl", "enum", "takeover", "sweep", "fcrdns", "propagate", "soa", "zonecheck", "dnssec", "rrsig", "walk", "hosts-sync", "history", "diff", "snapshot", "completion"}
 
-	if flagset["d"] {
-		rdump, _ = httputil.DumpResponse(res, true)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to dump outgoing request: %v\n", err)
-		} else {
-			fmt.Printf("[DEBUG:RESPONSE] \n%s\n", rdump)
-		}
+// usage prints the command synopsis and the list of subcommands
+func usage(w io.Writer) {
+	fmt.Fprint(w, "Usage:\n  h53 [query] [options] -n name\n  h53 <command> [options]\n\nCommands:\n")
+	width := 0
+	for _, name := range commandNames {
+		width = max(width, len(name))
 	}
-
-	// Parse response
-	jdns := new(DNSJ)
-	err = json.NewDecoder(res.Body).Decode(jdns)
-	if err != nil {
-		fmt.Fprintf(os.Stderr,
-			"Error decoding response from cf: %v. May want to rerun with debug on.", err)
-		os.Exit(4)
+	for _, name := range commandNames {
+		fmt.Fprintf(w, "  %-*s %s\n", width, name, commands[name].about)
 	}
+	fmt.Fprint(w, "\nRun h53 help <command> for its options.\n")
+}
 
-	if jdns.Status != 0 {
-		fmt.Printf("Unsuccessful DNS Return code: %d", jdns.Status)
-		fmt.Printf("See: %s to determine the cause",
-			"https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-6")
-	}
-	if flagset["v"] {
-		fmt.Printf("Status: %d, TC: %t, RD: %t RA: %t, AD: %t, CD: %t\n",
-			jdns.Status, jdns.TC, jdns.RD, jdns.RA, jdns.AD, jdns.CD)
+// exitInterrupted is the exit code after SIGINT/SIGTERM, as shells report it
+const exitInterrupted = 130
 
-		fmt.Printf("Questions: %d\n", len(jdns.Questions))
-		if len(jdns.Questions) != 0 {
-			for i, a := range jdns.Questions {
-				fmt.Printf("%d: Name: %s Type: %d \n", i+1, a.Name, a.Type)
-			}
-		}
-		fmt.Printf("Answers: %d\n", len(jdns.Answers))
+// exitCheckFailed is the exit code of the checking commands (spf, mailcheck,
+// caa, dane, rbl, ...) when what they check is found wrong, as opposed to
+// failing to check it
+const exitCheckFailed = 9
 
-		if len(jdns.Answers) != 0 {
-			for i, a := range jdns.Answers {
-				fmt.Printf("%d: %s - %s \n", i+1, a.Name, a.Data)
-			}
-		} else {
-			fmt.Println("NOT FOUND")
-			os.Exit(4)
-		}
-	} else {
-		if len(jdns.Answers) != 0 {
-			for i, a := range jdns.Answers {
-				fmt.Printf("%d: %s - %s \n", i, a.Name, a.Data)
-			}
-		} else {
-			fmt.Println("NOT FOUND")
-			os.Exit(4)
-		}
-	}
+// signalContext returns a context cancelled by the first SIGINT or SIGTERM,
+// for commands to wind down with. A second signal kills the process as usual.
+func signalContext() context.Context {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx
+}
 
+// exit persists the cache and returns code, for commands to finish with
+func exit(store *cache, code int) int {
+	if err := store.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to save cache file: %v\n", err)
+	}
+	return code
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// The commands list lines up however long the names, completion and
+// hosts-sync the longest
+func TestUsageAligned(t *testing.T) {
+
+	var b bytes.Buffer
+	usage(&b)
+	_, list, _ := strings.Cut(b.String(), "Commands:\n")
+	list, _, _ = strings.Cut(list, "\n\n")
+
+	column := -1
+	for _, line := range strings.Split(list, "\n") {
+		name := strings.Fields(line)[0]
+		about := commands[name].about
+		at := strings.Index(line, about)
+		if at < 0 || at <= len("  "+name) {
+			t.Errorf("%s: description runs into the name: %q", name, line)
+			continue
+		}
+		if column < 0 {
+			column = at
+		} else if at != column {
+			t.Errorf("%s: description at column %d, not %d: %q", name, at, column, line)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// historyEntry is one lookup as the history file keeps it, a line of JSON
+type historyEntry struct {
+	Time     time.Time    `json:"time"`
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Rcode    string       `json:"rcode,omitempty"`
+	Answers  []doh.Answer `json:"answers,omitempty"`
+	Provider string       `json:"provider,omitempty"`
+	RTT      float64      `json:"rtt_ms,omitempty"`
+	Error    string       `json:"error,omitempty"` // the lookup failed, there is no RCODE
+}
+
+// newHistoryEntry is the entry of a lookup of name/qtype, answered with jdns
+// or failed with err
+func newHistoryEntry(name string, qtype string, jdns *doh.DNSJ, err error) *historyEntry {
+
+	e := &historyEntry{Time: time.Now().UTC(), Name: fqdn(strings.ToLower(name)), Type: strings.ToUpper(qtype)}
+	if jdns != nil {
+		e.Rcode = doh.RcodeString(jdns.Status)
+		e.Answers = jdns.Answers
+		e.Provider = jdns.Provider
+		e.RTT = float64(jdns.RTT.Microseconds()) / 1000
+	}
+	if err != nil {
+		e.Error, e.Provider = err.Error(), errorProvider(err)
+	}
+	return e
+}
+
+// dnsj rebuilds the response the entry recorded, for comparison with
+// another: the question, RCODE and answers
+func (e *historyEntry) dnsj() (*doh.DNSJ, error) {
+
+	t, err := doh.TypeCode(e.Type)
+	if err != nil {
+		return nil, err
+	}
+	jdns := &doh.DNSJ{Questions: []doh.Question{{Name: e.Name, Type: int(t)}}, Answers: e.Answers}
+	for code, n := range doh.RcodeNames {
+		if n == e.Rcode {
+			jdns.Status = code
+		}
+	}
+	return jdns, nil
+}
+
+// history records lookups to a JSON Lines file, appending one line per
+// lookup so concurrent runs can share the file
+type history struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// openHistory opens the history file at path for appending, creating it
+func openHistory(path string) (*history, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &history{f: f}, nil
+}
+
+// record appends the outcome of a lookup of name/qtype that went to a
+// provider. Failures to write are logged, not fatal to the lookup.
+func (h *history) record(name string, qtype string, jdns *doh.DNSJ, err error) {
+
+	line, _ := json.Marshal(newHistoryEntry(name, qtype, jdns, err))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.f.Write(append(line, '\n')); err != nil {
+		slog.Warn("unable to record history", "error", err)
+	}
+}
+
+// cmdHistory searches the lookups query recorded with -history
+func cmdHistory() (*flag.FlagSet, func(args []string) int) {
+
+	var optHistory string
+	var optSince time.Duration
+	var optName string
+	var optType string
+	var optOutput string
+
+	fs := newFlagSet("history", "h53 history -history path [options]",
+		"Search the lookups recorded by h53 -history, oldest first: when each name was resolved,\n"+
+			"to what, by which provider and how fast.")
+	fs.StringVar(&optHistory, "history", "",
+		"History file, as given to h53 -history Ex.: ~/.h53_history")
+	fs.DurationVar(&optSince, "since", 0,
+		"Only lookups in this past period Ex.: 24h")
+	fs.StringVar(&optName, "name", "",
+		"Only lookups of this name or names under it Ex.: example.com")
+	fs.StringVar(&optType, "t", "",
+		"Only lookups of this type Ex.: AAAA")
+	fs.StringVar(&optOutput, "o", "text",
+		"Output format: text or jsonl")
+	return fs, func(args []string) int {
+		parseArgs(fs, args)
+
+		if optHistory == "" || optSince < 0 || fs.NArg() != 0 {
+			fs.Usage()
+			return 1
+		}
+		if optOutput != "text" && optOutput != "jsonl" {
+			fmt.Fprintf(os.Stderr, "Unknown output format (-o): %s\n", optOutput)
+			return 1
+		}
+		var zone string
+		if optName != "" {
+			aname, err := doh.ToASCII(strings.TrimSuffix(optName, "."))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid name %s: %v\n", optName, err)
+				return 1
+			}
+			zone = fqdn(strings.ToLower(aname))
+		}
+		var since time.Time
+		if optSince > 0 {
+			since = time.Now().Add(-optSince)
+		}
+
+		f, err := os.Open(optHistory)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open history: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		if optOutput == "text" {
+			fmt.Fprintln(tw, "TIME\tNAME\tTYPE\tRCODE\tPROVIDER\tRTT\tANSWERS")
+		}
+		found := 0
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			var e historyEntry
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				continue // a line cut short by a crash, say
+			}
+			if e.Time.Before(since) || (zone != "" && !inZone(e.Name, zone)) ||
+				(optType != "" && !strings.EqualFold(e.Type, optType)) {
+				continue
+			}
+			found++
+			if optOutput == "jsonl" {
+				fmt.Println(sc.Text())
+				continue
+			}
+			rcode, rtt, data := e.Rcode, fmt.Sprintf("%.1fms", e.RTT), []string{}
+			if e.Error != "" {
+				rcode, rtt, data = "-", "-", []string{e.Error}
+			}
+			for _, a := range e.Answers {
+				data = append(data, answerValue(a))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.DateTime), e.Name, e.Type,
+				rcode, e.Provider, rtt, strings.Join(data, ", "))
+		}
+		if err := sc.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read history: %v\n", err)
+			return 1
+		}
+		if optOutput == "text" && found != 0 {
+			tw.Flush()
+		}
+		if found == 0 {
+			return 4
+		}
+		return 0
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// The markers of the block of the hosts file hosts-sync manages; the rest
+// of the file is left alone
+const (
+	hostsBegin = "# BEGIN h53 hosts-sync (managed, do not edit)"
+	hostsEnd   = "# END h53 hosts-sync"
+)
+
+// cmdHostsSync keeps a block of the hosts file in line with what DoH
+// answers for a list of names, re-resolving as the answers' TTLs run out:
+// programs that use the system resolver then reach names it blocks
+func cmdHostsSync() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optFile string
+	var optHosts string
+	var optMinInterval time.Duration
+	var optOnce bool
+	var optRemove bool
+
+	fs := newFlagSet("hosts-sync", "h53 hosts-sync [options] -f names.txt",
+		"Resolve the names of -f (lines of: name [types], types default to A) and write their addresses\n"+
+			"to a managed block of the hosts file, re-resolving when the answers' TTLs run out.")
+	co.register(fs)
+	fs.StringVar(&optFile, "f", "",
+		"File with names, one per line Ex.: example.com A,AAAA")
+	fs.StringVar(&optHosts, "hosts", "/etc/hosts",
+		"Hosts file to maintain")
+	fs.DurationVar(&optMinInterval, "min-interval", time.Minute,
+		"Shortest time between updates, however low the TTLs")
+	fs.BoolVar(&optOnce, "once", false,
+		"Update the hosts file once and exit")
+	fs.BoolVar(&optRemove, "remove", false,
+		"Remove the managed block from the hosts file and exit")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if optRemove {
+			if err := writeHostsBlock(optHosts, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			fmt.Printf("Removed the h53 block from %s\n", optHosts)
+			return 0
+		}
+		if optFile == "" || optMinInterval <= 0 {
+			fs.Usage()
+			return 1
+		}
+		targets, err := readTargets(optFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read names: %v\n", err)
+			return 1
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		ctx := signalContext()
+
+		entries := make([][]string, len(targets)) // hosts lines, by target
+		var written []string
+		for {
+			now := time.Now()
+			wait := time.Duration(0)
+			code := 0
+			for i, t := range targets {
+				jdns, err := client.Lookup(ctx, t.name, t.qtype)
+				if ctx.Err() != nil {
+					return 0
+				}
+				// A lookup that failed keeps the entries it had: a transient
+				// error should not make the names unreachable. An error RCODE
+				// is an answer, the entries go.
+				if err == nil {
+					err = jdns.Err()
+				}
+				if err != nil {
+					slog.Warn("lookup failed", "name", t.name, "type", t.qtype, "error", err)
+					if code == 0 {
+						code = exitCode(err)
+					}
+				}
+				if jdns == nil {
+					continue
+				}
+				entries[i] = nil
+				for _, a := range jdns.Answers {
+					if a.Type == 1 || a.Type == 28 {
+						entries[i] = append(entries[i], hostsLine(a.Data, t.name))
+						if ttl := time.Duration(a.TTL) * time.Second; wait == 0 || ttl < wait {
+							wait = ttl
+						}
+					}
+				}
+			}
+
+			lines := []string{}
+			for _, e := range entries {
+				lines = append(lines, e...)
+			}
+			if strings.Join(lines, "\n") != strings.Join(written, "\n") || written == nil {
+				if err := writeHostsBlock(optHosts, lines); err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+					return 1
+				}
+				written = lines
+				fmt.Printf("%s %s: %d entries\n", now.Format(time.RFC3339), optHosts, len(lines))
+			}
+			if optOnce {
+				return code
+			}
+
+			select {
+			case <-time.After(max(wait, optMinInterval)):
+			case <-ctx.Done():
+				return 0
+			}
+		}
+	}
+}
+
+// writeHostsBlock replaces the managed block of the hosts file at path with
+// lines, appending the block when there is none; nil lines remove it. The
+// file is rewritten in place, as hosts files are often bind mounts (in
+// containers) that cannot be renamed over.
+func writeHostsBlock(path string, lines []string) error {
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var kept [][]byte
+	inBlock := false
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		switch strings.TrimSpace(string(line)) {
+		case hostsBegin:
+			inBlock = true
+			continue
+		case hostsEnd:
+			inBlock = false
+			continue
+		}
+		if !inBlock && len(line) != 0 {
+			kept = append(kept, line)
+		}
+	}
+
+	var b bytes.Buffer
+	for _, line := range kept {
+		b.Write(line)
+	}
+	if b.Len() != 0 && !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	if lines != nil {
+		b.WriteString(hostsBegin + "\n")
+		for _, l := range lines {
+			b.WriteString(l + "\n")
+		}
+		b.WriteString(hostsEnd + "\n")
+	}
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	return os.WriteFile(path, b.Bytes(), mode)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// localTTL is the TTL of config records without one of their own
+const localTTL = 300
+
+// localChase is how many CNAMEs of the local zone an answer follows
+const localChase = 8
+
+// localRR is a record of the config's records section, ready to answer with
+type localRR struct {
+	rtype uint16
+	ttl   uint32
+	data  string // presentation form, the target of a CNAME
+	rdata []byte
+}
+
+// localZone is the records section of the config file: names serve
+// answers authoritatively, without asking the providers, for the lab and
+// internal names public DoH cannot know (split horizon). *.zone stands for
+// the names below zone that are not listed themselves.
+type localZone map[string][]localRR
+
+// newLocalZone compiles the config's records, nil when there are none
+func newLocalZone(records map[string]map[string]string) (localZone, error) {
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+	z := make(localZone)
+	for name, fields := range records {
+		ttl := uint64(localTTL)
+		if v, ok := fields["TTL"]; ok {
+			var err error
+			if ttl, err = strconv.ParseUint(v, 10, 31); err != nil {
+				return nil, fmt.Errorf("records: %s: invalid ttl %q", name, v)
+			}
+		}
+		for _, t := range sortedKeys(fields) {
+			if t == "TTL" {
+				continue
+			}
+			rtype, err := doh.TypeCode(t)
+			if err != nil {
+				return nil, fmt.Errorf("records: %s: %w", name, err)
+			}
+			// TXT data may hold commas of its own
+			values := []string{fields[t]}
+			if t != "TXT" {
+				values = strings.Split(fields[t], ",")
+			}
+			if t == "CNAME" && len(values) > 1 {
+				return nil, fmt.Errorf("records: %s: a name has at most one CNAME", name)
+			}
+			for _, v := range values {
+				rdata, err := doh.PackRdata(rtype, v)
+				if err != nil {
+					return nil, fmt.Errorf("records: %s: %w", name, err)
+				}
+				z[name] = append(z[name], localRR{rtype, uint32(ttl), strings.TrimSpace(v), rdata})
+			}
+		}
+		if _, ok := fields["CNAME"]; ok && len(z[name]) > 1 {
+			return nil, fmt.Errorf("records: %s: a CNAME cannot have other records", name)
+		}
+	}
+	slog.Info("local records loaded", "names", len(z))
+	return z, nil
+}
+
+// find returns the records of name, or of the closest wildcard above it
+func (z localZone) find(name string) ([]localRR, bool) {
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if rrs, ok := z[name]; ok {
+		return rrs, true
+	}
+	for _, zone, found := strings.Cut(name, "."); found; _, zone, found = strings.Cut(zone, ".") {
+		if rrs, ok := z["*."+zone]; ok {
+			return rrs, true
+		}
+	}
+	return nil, false
+}
+
+// reply is the authoritative answer to query when its name is in the zone:
+// its records of the type, or NODATA, CNAMEs followed as far as the zone
+// goes. nil means the name is not local and the query is to be forwarded.
+func (z localZone) reply(query []byte) []byte {
+
+	if z == nil {
+		return nil
+	}
+	q, err := doh.UnpackMsg(query)
+	if err != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	name, qtype := q.Questions[0].Name, uint16(q.Questions[0].Type)
+	rrs, ok := z.find(name)
+	if !ok {
+		return nil
+	}
+	resp, err := doh.Reply(query, 0, false)
+	if err != nil {
+		return nil
+	}
+	resp[2] |= 0x04 // AA: the answer is ours, not hearsay
+
+	owner := name
+	for range localChase {
+		var cname string
+		for _, rr := range rrs {
+			switch {
+			case rr.rtype == qtype:
+				resp, err = doh.AppendAnswer(resp, owner, rr.rtype, rr.ttl, rr.rdata)
+			case rr.rtype == 5:
+				resp, err = doh.AppendAnswer(resp, owner, rr.rtype, rr.ttl, rr.rdata)
+				cname = rr.data
+			}
+			if err != nil {
+				return nil
+			}
+		}
+		// Targets outside the zone are left for the client to look up
+		if cname == "" || qtype == 5 {
+			break
+		}
+		if rrs, ok = z.find(cname); !ok {
+			break
+		}
+		owner = cname
+	}
+	slog.Debug("answered locally", "name", name, "type", doh.TypeString(int(qtype)))
+	return resp
+}
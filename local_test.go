@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// A CNAME is alone at its name: the error tells a second CNAME from
+// records of other types beside it
+func TestLocalZoneCNAMEErrors(t *testing.T) {
+
+	for _, tc := range []struct {
+		fields map[string]string
+		want   string
+	}{
+		{map[string]string{"CNAME": "a.example.com,b.example.com"}, "at most one CNAME"},
+		{map[string]string{"CNAME": "a.example.com", "A": "192.0.2.1"}, "cannot have other records"},
+		{map[string]string{"CNAME": "a.example.com", "TTL": "60"}, ""},
+	} {
+		_, err := newLocalZone(map[string]map[string]string{"www.lab": tc.fields})
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%v: %v", tc.fields, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%v: error %v, want %q", tc.fields, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// setupLogging points the default logger (slog, which the log package
+// follows too) at -log-file, stderr by default, in -log-format, filtering
+// below -log-level; -d lowers the level to debug. Diagnostics go through
+// it; what a command reports as its result stays on stdout/stderr.
+func (o *clientOpts) setupLogging() error {
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.logLevel)); err != nil {
+		return fmt.Errorf("Invalid log level (-log-level): %s (use debug, info, warn or error)", o.logLevel)
+	}
+	if o.debug {
+		level = slog.LevelDebug
+	}
+
+	var w io.Writer = os.Stderr
+	if o.logFile != "" {
+		f, err := os.OpenFile(o.logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("Unable to open log file (-log-file): %v", err)
+		}
+		w = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch o.logFormat {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("Unknown log format (-log-format): %s (use text or json)", o.logFormat)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// resolver bundles the state shared by all lookups of a run: the DoH client
+// and the answer cache.
+type resolver struct {
+	ctx    context.Context // cancelled when the run is interrupted
+	client *doh.Client
+	cache  *cache
+
+	followCNAME bool // complete dangling CNAME chains (see follow)
+	resolveMX   bool // resolve MX exchanges too (see addTargets)
+	resolveSRV  bool // resolve SRV targets too
+
+	detectWildcard bool // check answers against the parent zone's wildcard (see wildcardOf)
+	enrich         bool // look up the origin AS of answer addresses (see origins)
+	reversePTR     bool // reverse resolve answer addresses (see ptrs)
+
+	history *history // records the lookups that go to a provider, if set
+
+	flights flightGroup[*doh.DNSJ] // lookups in flight, by key
+}
+
+// key is the cache key for name/qtype under the client's DNSSEC/ECS options
+func (r *resolver) key(name string, qtype string) string {
+	k := cacheKey(name, qtype)
+	if r.client.DO {
+		k += "+do"
+	}
+	if r.client.CD {
+		k += "+cd"
+	}
+	if r.client.ECS != "" {
+		k += "+ecs=" + r.client.ECS
+	}
+	return k
+}
+
+// errInterrupted is the lookup error after SIGINT/SIGTERM
+var errInterrupted = errors.New("interrupted")
+
+// inputError is a lookup refused before anything was sent: no type for a
+// name, say
+type inputError struct{ err error }
+
+func (e *inputError) Error() string { return e.err.Error() }
+
+// lookup resolves name/qtype, answering from the cache when a fresh entry
+// exists, or a stale one when the providers fail (see cache.stale). IP
+// literals are looked up by their reverse name (see queryFor).
+// Errors are left to the caller to report (see report, exitCode).
+func (r *resolver) lookup(name string, qtype string) (*doh.DNSJ, error) {
+
+	name, qtype, err := queryFor(name, qtype)
+	if err != nil {
+		return nil, &inputError{err}
+	}
+
+	ctx, span := doh.StartSpan(r.client.Tracer, r.ctx, "h53.lookup",
+		doh.Attr{Key: "dns.question.name", Value: name}, doh.Attr{Key: "dns.question.type", Value: qtype})
+	if jdns, ok := r.cache.get(r.key(name, qtype)); ok {
+		slog.Debug("cache hit", "name", name, "type", qtype)
+		span.SetAttr(doh.Attr{Key: "h53.cache_hit", Value: true})
+		span.End(nil)
+		return r.addTargets(jdns), nil
+	}
+	span.SetAttr(doh.Attr{Key: "h53.cache_hit", Value: false})
+	defer func() { span.End(err) }()
+
+	// Identical lookups at once (a batch of names sharing MX hosts, say) go
+	// to the providers once, the others wait for that one's answer
+	key := r.key(name, qtype)
+	jdns, err, shared := r.flights.do(key, func() (*doh.DNSJ, error) {
+		jdns, err := r.client.Lookup(ctx, name, qtype)
+		if err == nil && r.followCNAME {
+			jdns, err = r.follow(name, qtype, jdns)
+		}
+		if r.history != nil && r.ctx.Err() == nil {
+			r.history.record(name, qtype, jdns, err)
+		}
+		if err == nil {
+			r.cache.put(key, jdns)
+		}
+		return jdns, err
+	})
+	if shared {
+		slog.Debug("coalesced with a lookup in flight", "name", name, "type", qtype)
+		span.SetAttr(doh.Attr{Key: "h53.coalesced", Value: true})
+	}
+	if err != nil {
+		if r.ctx.Err() != nil {
+			return nil, errInterrupted
+		}
+		// Better an expired answer than none while the providers are down
+		// (RFC 8767), unless the query itself was at fault
+		var re *doh.RequestError
+		if stale, ok := r.cache.stale(key); ok && !errors.As(err, &re) {
+			slog.Warn("providers failed, answering stale", "name", name, "type", qtype, "error", err)
+			return r.addTargets(stale), nil
+		}
+		return nil, err
+	}
+	return r.addTargets(jdns), nil
+}
+
+// exitCode maps a lookup error to the exit code h53 has always used for it:
+// 1 for bad input, 2 when the request could not be built, 4 for undecodable
+// replies and 3 for everything that went wrong on the way (transport, HTTP
+// status). Error RCODEs exit 10+RCODE, as unsuccessful answers do.
+func exitCode(err error) int {
+	var ie *inputError
+	var re *doh.RequestError
+	var rce *doh.RcodeError
+	switch {
+	case errors.As(err, &rce):
+		return exitRcode + rce.Rcode
+	case errors.Is(err, errInterrupted):
+		return exitInterrupted
+	case errors.As(err, &ie):
+		return 1
+	case errors.As(err, &re):
+		return 2
+	case errors.Is(err, doh.ErrDecode):
+		return 4
+	}
+	return 3
+}
+
+// errorCategory names the class of a lookup error, for scripts to branch on
+func errorCategory(err error) string {
+	var ie *inputError
+	var re *doh.RequestError
+	switch {
+	case errors.As(err, &ie):
+		return "input"
+	case errors.As(err, &re):
+		return "request"
+	case errors.Is(err, doh.ErrTransport):
+		return "transport"
+	case errors.Is(err, doh.ErrHTTPStatus):
+		return "http_status"
+	case errors.Is(err, doh.ErrDecode):
+		return "decode"
+	case errors.Is(err, doh.ErrRcode):
+		return "rcode"
+	}
+	return "other"
+}
+
+// errorProvider is the provider a lookup error came from, if it says
+func errorProvider(err error) string {
+	var te *doh.TransportError
+	var se *doh.StatusError
+	var de *doh.DecodeError
+	var re *doh.RequestError
+	switch {
+	case errors.As(err, &te):
+		return te.Provider
+	case errors.As(err, &se):
+		return se.Provider
+	case errors.As(err, &de):
+		return de.Provider
+	case errors.As(err, &re):
+		return re.Provider
+	}
+	return ""
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// defaultSelectors are DKIM selectors common mail services publish keys
+// under; a domain's own selector is only known from its signed mail
+const defaultSelectors = "default,google,selector1,selector2,k1,k2,s1,s2,dkim,mail"
+
+// Verdicts of a mailcheck finding, worst last
+const (
+	checkPass = iota
+	checkWarn
+	checkFail
+)
+
+var verdictNames = []string{"PASS", "WARN", "FAIL"}
+
+// finding is one line of the mailcheck report
+type finding struct {
+	verdict int
+	check   string
+	msg     string
+}
+
+// cmdMailcheck audits the mail posture of a domain: MX, SPF, DMARC and DKIM
+func cmdMailcheck() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optSelectors string
+
+	fs := newFlagSet("mailcheck", "h53 mailcheck [options] domain",
+		"Check the MX, SPF, DMARC and DKIM records of domain over DoH and rate each pass, warn or fail.")
+	co.register(fs)
+	fs.StringVar(&optSelectors, "selectors", defaultSelectors,
+		"DKIM selectors to look for, comma separated")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		domain := strings.TrimSuffix(fs.Arg(0), ".")
+		var findings []finding
+		for _, check := range []func(*resolver, string) ([]finding, error){
+			checkMX,
+			checkSPF,
+			checkDMARC,
+			func(r *resolver, domain string) ([]finding, error) {
+				return checkDKIM(r, domain, strings.Split(optSelectors, ","))
+			},
+		} {
+			f, err := check(r, domain)
+			if err != nil {
+				if code := exitCode(err); code != exitInterrupted {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+					return code
+				}
+				return exitInterrupted
+			}
+			findings = append(findings, f...)
+		}
+
+		var count [3]int
+		fmt.Println(domain)
+		for _, f := range findings {
+			fmt.Printf("  %s  %-5s  %s\n", verdictNames[f.verdict], f.check, f.msg)
+			count[f.verdict]++
+		}
+		fmt.Printf("Summary: %d pass, %d warn, %d fail\n", count[checkPass], count[checkWarn], count[checkFail])
+		if count[checkFail] != 0 {
+			return exitCheckFailed
+		}
+		return 0
+	}
+}
+
+// txtRecords fetches the TXT values of name, none for NXDOMAIN
+func txtRecords(r *resolver, name string) ([]string, error) {
+	jdns, err := r.lookup(name, "TXT")
+	if err != nil {
+		return nil, err
+	}
+	if jdns.Status != 3 {
+		if err := jdns.Err(); err != nil {
+			return nil, err
+		}
+	}
+	var values []string
+	for _, a := range jdns.Answers {
+		if a.Type == 16 {
+			values = append(values, doh.JoinTXT(a.Data))
+		}
+	}
+	return values, nil
+}
+
+// checkMX looks for MX records and the addresses of their exchanges
+func checkMX(r *resolver, domain string) ([]finding, error) {
+
+	jdns, err := r.lookup(domain, "MX")
+	if err != nil {
+		return nil, err
+	}
+	if jdns.Status != 0 {
+		return []finding{{checkFail, "MX", fmt.Sprintf("%s: %s", domain, doh.RcodeString(jdns.Status))}}, nil
+	}
+
+	var mxs []doh.MX
+	for _, a := range sortAnswers(jdns).Answers {
+		if mx, err := doh.ParseMX(a.Data); a.Type == 15 && err == nil {
+			mxs = append(mxs, mx)
+		}
+	}
+	switch {
+	case len(mxs) == 0:
+		return []finding{{checkFail, "MX", "no MX records, mail goes to the domain's A/AAAA if any"}}, nil
+	case len(mxs) == 1 && mxs[0].Exchange == ".":
+		return []finding{{checkPass, "MX", "null MX (RFC 7505): the domain accepts no mail"}}, nil
+	}
+
+	var fs []finding
+	var names []string
+	for _, mx := range mxs {
+		names = append(names, fmt.Sprintf("%s (%d)", mx.Exchange, mx.Preference))
+		addrs, code := r.resolveAddrs(mx.Exchange)
+		if code == exitInterrupted {
+			return nil, errInterrupted
+		}
+		if len(addrs) == 0 {
+			fs = append(fs, finding{checkFail, "MX", mx.Exchange + " has no address"})
+		}
+	}
+	verdict := checkPass
+	if len(mxs) == 1 {
+		verdict = checkWarn
+	}
+	return append([]finding{{verdict, "MX", fmt.Sprintf("%d exchanges: %s", len(mxs), strings.Join(names, ", "))}},
+		fs...), nil
+}
+
+// checkSPF expands the SPF record (see spfWalker) and rates its all term
+func checkSPF(r *resolver, domain string) ([]finding, error) {
+
+	s := &spfWalker{r: r, out: io.Discard, stack: make(map[string]bool)}
+	found, err := s.expand(domain)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return []finding{{checkFail, "SPF", "no SPF record, anyone may send as " + domain}}, nil
+	}
+
+	var fs []finding
+	for _, p := range s.problems {
+		fs = append(fs, finding{checkFail, "SPF", "permerror: " + p})
+	}
+	lookups := fmt.Sprintf("%d of %d DNS lookups", s.lookups, spfMaxLookups)
+	switch all := strings.ToLower(s.all); {
+	case all == "-all" || all == "~all":
+		fs = append(fs, finding{checkPass, "SPF", all + ", " + lookups})
+	case all == "all" || all == "+all":
+		fs = append(fs, finding{checkFail, "SPF", "+all lets anyone send as " + domain})
+	case all == "?all":
+		fs = append(fs, finding{checkWarn, "SPF", "?all is neutral, unlisted senders are not rejected"})
+	default:
+		fs = append(fs, finding{checkWarn, "SPF", "no all term, unlisted senders are neutral"})
+	}
+	if s.lookups > spfMaxLookups-2 && s.lookups <= spfMaxLookups {
+		fs = append(fs, finding{checkWarn, "SPF", lookups + ", close to the limit"})
+	}
+	return fs, nil
+}
+
+// checkDMARC looks for a DMARC policy (RFC 7489) at _dmarc.domain
+func checkDMARC(r *resolver, domain string) ([]finding, error) {
+
+	name := "_dmarc." + domain
+	values, err := txtRecords(r, name)
+	if err != nil {
+		return nil, err
+	}
+	var records []string
+	for _, v := range values {
+		if hasPrefixFold(v, "v=DMARC1") {
+			records = append(records, v)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return []finding{{checkFail, "DMARC", "no DMARC record at " + name}}, nil
+	case 1:
+	default:
+		return []finding{{checkFail, "DMARC", fmt.Sprintf("%d DMARC records at %s, receivers ignore them all", len(records), name)}}, nil
+	}
+
+	tags := make(map[string]string)
+	for _, t := range strings.Split(records[0], ";") {
+		if k, v, ok := strings.Cut(t, "="); ok {
+			tags[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+		}
+	}
+	var fs []finding
+	switch p := strings.ToLower(tags["p"]); p {
+	case "reject", "quarantine":
+		fs = append(fs, finding{checkPass, "DMARC", "p=" + p})
+	case "none":
+		fs = append(fs, finding{checkWarn, "DMARC", "p=none only monitors, failing mail is delivered"})
+	default:
+		fs = append(fs, finding{checkFail, "DMARC", "no valid p= policy: " + records[0]})
+	}
+	if strings.ToLower(tags["sp"]) == "none" {
+		fs = append(fs, finding{checkWarn, "DMARC", "sp=none, subdomains are not protected"})
+	}
+	if pct, err := strconv.Atoi(tags["pct"]); err == nil && pct < 100 {
+		fs = append(fs, finding{checkWarn, "DMARC", fmt.Sprintf("pct=%d, the policy applies to part of the mail only", pct)})
+	}
+	if tags["rua"] == "" {
+		fs = append(fs, finding{checkWarn, "DMARC", "no rua=, no aggregate reports are sent"})
+	}
+	return fs, nil
+}
+
+// checkDKIM looks for DKIM keys (RFC 6376) under the given selectors and
+// rates their strength
+func checkDKIM(r *resolver, domain string, selectors []string) ([]finding, error) {
+
+	var fs []finding
+	for _, sel := range selectors {
+		sel = strings.TrimSpace(sel)
+		if sel == "" {
+			continue
+		}
+		values, err := txtRecords(r, sel+"._domainkey."+domain)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			if !strings.Contains(v, "p=") {
+				continue
+			}
+			verdict, msg := rateDKIM(v)
+			fs = append(fs, finding{verdict, "DKIM", sel + ": " + msg})
+		}
+	}
+	if len(fs) == 0 {
+		fs = append(fs, finding{checkWarn, "DKIM", "no key under the selectors tried (-selectors)"})
+	}
+	return fs, nil
+}
+
+// rateDKIM rates a DKIM key record: RSA keys under 1024 bits fail, under
+// 2048 bits warn, an empty p= is a revoked key
+func rateDKIM(record string) (int, string) {
+
+	tags := make(map[string]string)
+	for _, t := range strings.Split(record, ";") {
+		if k, v, ok := strings.Cut(t, "="); ok {
+			tags[strings.ToLower(strings.TrimSpace(k))] = strings.Join(strings.Fields(v), "")
+		}
+	}
+	if tags["p"] == "" {
+		return checkWarn, "key revoked (empty p=)"
+	}
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return checkFail, "p= is not base64"
+	}
+
+	switch k := strings.ToLower(tags["k"]); k {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			if pub, err = x509.ParsePKCS1PublicKey(der); err != nil {
+				return checkFail, "unreadable RSA key"
+			}
+		}
+		rk, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return checkFail, "k=rsa but not an RSA key"
+		}
+		bits := rk.N.BitLen()
+		switch {
+		case bits < 1024:
+			return checkFail, fmt.Sprintf("RSA %d bits, too weak to be trusted", bits)
+		case bits < 2048:
+			return checkWarn, fmt.Sprintf("RSA %d bits, 2048 recommended", bits)
+		}
+		return checkPass, fmt.Sprintf("RSA %d bits", bits)
+	case "ed25519":
+		if len(der) != 32 {
+			return checkFail, "unreadable Ed25519 key"
+		}
+		return checkPass, "Ed25519"
+	default:
+		return checkWarn, "unknown key type k=" + k
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// latencyBuckets are the upper bounds (seconds) of the upstream latency
+// histograms, Prometheus' defaults
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations into latencyBuckets (not cumulative; the
+// exposition adds them up)
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// metrics are the counters serve and monitor expose on -metrics, in the
+// Prometheus text format
+type metrics struct {
+	mu        sync.Mutex
+	queries   map[[2]string]uint64  // by type, rcode
+	errors    map[[2]string]uint64  // by provider, error category
+	latencies map[string]*histogram // by provider
+	refused   map[string]uint64     // by reason (see acl.check)
+	blocked   uint64                // queries answered by the blocklist
+	coalesced uint64                // queries that shared an upstream query in flight
+	cache     *cache                // nil when the command has none
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		queries:   make(map[[2]string]uint64),
+		errors:    make(map[[2]string]uint64),
+		latencies: make(map[string]*histogram),
+		refused:   make(map[string]uint64),
+	}
+}
+
+// query counts a query answered (or attempted, rcode "error") by type; nil
+// metrics count nothing
+func (m *metrics) query(qtype string, rcode string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.queries[[2]string{qtype, rcode}]++
+	m.mu.Unlock()
+}
+
+// refuse counts a query the acl turned away, for reason; nil metrics count
+// nothing
+func (m *metrics) refuse(reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.refused[reason]++
+	m.mu.Unlock()
+}
+
+// block counts a query answered by the blocklist; nil metrics count nothing
+func (m *metrics) block() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.blocked++
+	m.mu.Unlock()
+}
+
+// coalesce counts a query answered by an identical one's upstream query;
+// nil metrics count nothing
+func (m *metrics) coalesce() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.coalesced++
+	m.mu.Unlock()
+}
+
+// observe records one try against a provider; it is the doh.Client's
+// Observe hook
+func (m *metrics) observe(provider string, rtt time.Duration, err error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.latencies[provider]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latencies[provider] = h
+	}
+	s := rtt.Seconds()
+	if i, _ := slices.BinarySearch(latencyBuckets, s); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += s
+	if err != nil {
+		m.errors[[2]string{provider, errorCategory(err)}]++
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *metrics) write(w io.Writer) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprint(w, "# HELP h53_queries_total Queries by type and response code.\n# TYPE h53_queries_total counter\n")
+	for _, k := range sortedKeys(m.queries) {
+		fmt.Fprintf(w, "h53_queries_total{type=%s,rcode=%s} %d\n", promLabel(k[0]), promLabel(k[1]), m.queries[k])
+	}
+
+	fmt.Fprint(w, "# HELP h53_upstream_errors_total Failed tries against DoH providers, by error category.\n# TYPE h53_upstream_errors_total counter\n")
+	for _, k := range sortedKeys(m.errors) {
+		fmt.Fprintf(w, "h53_upstream_errors_total{provider=%s,category=%s} %d\n", promLabel(k[0]), promLabel(k[1]), m.errors[k])
+	}
+
+	fmt.Fprint(w, "# HELP h53_upstream_latency_seconds Time taken by tries against DoH providers.\n# TYPE h53_upstream_latency_seconds histogram\n")
+	for _, p := range sortedKeys(m.latencies) {
+		h := m.latencies[p]
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "h53_upstream_latency_seconds_bucket{provider=%s,le=\"%s\"} %d\n", promLabel(p),
+				strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "h53_upstream_latency_seconds_bucket{provider=%s,le=\"+Inf\"} %d\n", promLabel(p), h.count)
+		fmt.Fprintf(w, "h53_upstream_latency_seconds_sum{provider=%s} %g\n", promLabel(p), h.sum)
+		fmt.Fprintf(w, "h53_upstream_latency_seconds_count{provider=%s} %d\n", promLabel(p), h.count)
+	}
+
+	fmt.Fprint(w, "# HELP h53_refused_total Queries turned away by -allow, -deny or -rate-limit, by reason.\n# TYPE h53_refused_total counter\n")
+	for _, r := range sortedKeys(m.refused) {
+		fmt.Fprintf(w, "h53_refused_total{reason=%s} %d\n", promLabel(r), m.refused[r])
+	}
+
+	fmt.Fprint(w, "# HELP h53_blocked_total Queries for blocklisted names, answered locally.\n# TYPE h53_blocked_total counter\n")
+	fmt.Fprintf(w, "h53_blocked_total %d\n", m.blocked)
+
+	fmt.Fprint(w, "# HELP h53_coalesced_total Queries that shared an identical one's upstream query.\n# TYPE h53_coalesced_total counter\n")
+	fmt.Fprintf(w, "h53_coalesced_total %d\n", m.coalesced)
+
+	if m.cache != nil {
+		hits, misses := m.cache.hits.Load(), m.cache.misses.Load()
+		ratio := 0.0
+		if hits+misses != 0 {
+			ratio = float64(hits) / float64(hits+misses)
+		}
+		fmt.Fprint(w, "# HELP h53_cache_hits_total Lookups answered from the cache.\n# TYPE h53_cache_hits_total counter\n")
+		fmt.Fprintf(w, "h53_cache_hits_total %d\n", hits)
+		fmt.Fprint(w, "# HELP h53_cache_misses_total Lookups the cache could not answer.\n# TYPE h53_cache_misses_total counter\n")
+		fmt.Fprintf(w, "h53_cache_misses_total %d\n", misses)
+		fmt.Fprint(w, "# HELP h53_cache_stale_total Lookups answered from expired entries, the providers failing.\n# TYPE h53_cache_stale_total counter\n")
+		fmt.Fprintf(w, "h53_cache_stale_total %d\n", m.cache.staleHits.Load())
+		fmt.Fprint(w, "# HELP h53_cache_prefetch_total Popular entries refreshed ahead of their expiry.\n# TYPE h53_cache_prefetch_total counter\n")
+		fmt.Fprintf(w, "h53_cache_prefetch_total %d\n", m.cache.prefetches.Load())
+		fmt.Fprint(w, "# HELP h53_cache_hit_ratio Share of lookups answered from the cache.\n# TYPE h53_cache_hit_ratio gauge\n")
+		fmt.Fprintf(w, "h53_cache_hit_ratio %g\n", ratio)
+	}
+}
+
+// sortedKeys returns the keys of m in order, for a stable exposition
+func sortedKeys[K [2]string | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b K) int { return strings.Compare(fmt.Sprint(a), fmt.Sprint(b)) })
+	return keys
+}
+
+// promLabel quotes a label value as the exposition format wants it
+func promLabel(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// serveMetrics serves m on addr under /metrics, in the background. Only
+// failing to listen is reported; the server lives as long as the process.
+func serveMetrics(addr string, m *metrics) error {
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m)
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// rcodeOf is the RCODE label of a lookup's outcome, "error" when there
+// was no answer at all
+func rcodeOf(jdns *doh.DNSJ) string {
+	if jdns == nil {
+		return "error"
+	}
+	return doh.RcodeString(jdns.Status)
+}
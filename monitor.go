@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// monitorTarget is one name/type pair under watch, with what was last seen
+type monitorTarget struct {
+	name    string
+	qtype   string
+	last    *doh.DNSJ
+	maxTTL  int       // highest answer TTL seen so far
+	settled time.Time // the first answer's TTL ran out, maxTTL is the zone's TTL
+	seen    time.Time // when last got, its TTL counting down from then
+
+	checked time.Time       // when the last check ran
+	err     error           // the last check failed
+	changed time.Time       // when the last change was seen
+	rtts    []time.Duration // latency of the recent lookups, oldest first
+}
+
+// ttlSlack is how far (seconds) an answer TTL may be off the one expected
+// before it is flagged: lookups take time, TTLs are whole seconds
+const ttlSlack = 5
+
+// monitorRTTs is how many latencies a target keeps, for the dashboard
+const monitorRTTs = 30
+
+// monitorEvent is what the webhook receives when a target changes
+type monitorEvent struct {
+	Time  time.Time `json:"time"`
+	Name  string    `json:"name"`
+	Type  string    `json:"type"`
+	Event string    `json:"event"` // rcode, answer or ttl
+	Info  string    `json:"info"`
+	Old   *doh.DNSJ `json:"old"`
+	New   *doh.DNSJ `json:"new"`
+}
+
+// cmdMonitor watches the name/type pairs of a file and reports changes of
+// RCODE, answer set or TTL, to stdout and optionally to a webhook.
+func cmdMonitor() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optFile string
+	var optInterval time.Duration
+	var optWebhook string
+	var optMetrics string
+	var optTUI bool
+
+	fs := newFlagSet("monitor", "h53 monitor [options] -f targets.txt",
+		"Re-resolve the targets of -f (lines of: name [types], types default to A) every -interval\n"+
+			"and report RCODE, answer set and TTL changes, POSTing them as JSON to -webhook.\n"+
+			"Once the first answer expired, TTL anomalies are flagged too: a TTL above the highest\n"+
+			"seen (the zone raised it), or, while the last answer has not run out, one off what is\n"+
+			"left of its TTL, lower (the zone lowered it) or higher (the cache was reset).")
+	co.register(fs)
+	fs.StringVar(&optFile, "f", "",
+		"File with targets, one per line Ex.: example.com A,AAAA")
+	fs.DurationVar(&optInterval, "interval", time.Minute,
+		"Time between checks")
+	fs.StringVar(&optWebhook, "webhook", "",
+		"URL to POST change events to Ex.: https://hooks.example/dns")
+	fs.StringVar(&optMetrics, "metrics", "",
+		"Address to serve Prometheus metrics on, at /metrics Ex.: 127.0.0.1:9153")
+	fs.BoolVar(&optTUI, "tui", false,
+		"Full-screen dashboard of the targets: answers, TTLs counting down, latency sparklines, changes highlighted")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if optFile == "" || optInterval <= 0 {
+			fs.Usage()
+			return 1
+		}
+		targets, err := readTargets(optFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read targets: %v\n", err)
+			return 1
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		var m *metrics
+		if optMetrics != "" {
+			m = newMetrics()
+			client.Observe = m.observe
+			if err := serveMetrics(optMetrics, m); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to serve metrics: %v\n", err)
+				return 1
+			}
+		}
+		hook := &http.Client{Timeout: client.Timeout}
+		ctx := signalContext()
+
+		// The dashboard is redrawn every second, for the TTLs to count down
+		var dash *dashboard
+		var tick <-chan time.Time
+		if optTUI {
+			if !isTerminal() {
+				fmt.Fprint(os.Stderr, "The dashboard (-tui) needs a terminal.\n")
+				return 1
+			}
+			dash = &dashboard{targets: targets, interval: optInterval, provider: providerNames(client)}
+			dash.open()
+			defer dash.close()
+			dash.draw()
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			for _, t := range targets {
+				evs := t.check(ctx, client, m)
+				if t.err != nil && ctx.Err() == nil && dash == nil {
+					fmt.Printf("%s %s %s: ERROR %v\n", t.checked.Format(time.RFC3339), t.name, t.qtype, t.err)
+				}
+				for _, ev := range evs {
+					if dash != nil {
+						dash.event(ev)
+					} else {
+						fmt.Printf("%s %s %s: %s %s\n", ev.Time.Format(time.RFC3339), ev.Name, ev.Type,
+							strings.ToUpper(ev.Event), ev.Info)
+					}
+					if optWebhook != "" {
+						if err := postEvent(hook, optWebhook, ev); err != nil {
+							slog.Error("webhook failed", "url", optWebhook, "error", err)
+						}
+					}
+				}
+				if dash != nil {
+					dash.draw()
+				}
+			}
+			next := time.After(optInterval)
+		wait:
+			for {
+				select {
+				case <-next:
+					break wait
+				case <-tick:
+					dash.draw()
+				case <-ctx.Done():
+					return 0
+				}
+			}
+		}
+	}
+}
+
+// readTargets parses a targets file. Blank lines and # comments are skipped.
+func readTargets(path string) ([]*monitorTarget, error) {
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	lines, err := readNames(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*monitorTarget
+	for _, line := range lines {
+		f := strings.Fields(line)
+		types := "A"
+		if len(f) > 1 {
+			types = strings.Join(f[1:], ",")
+		}
+		for _, t := range splitTypes(types) {
+			name, qtype, err := queryFor(f[0], t)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, &monitorTarget{name: name, qtype: strings.ToUpper(qtype)})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets in %s", path)
+	}
+	return targets, nil
+}
+
+// check resolves the target once and returns the changes since the last
+// check. The first check only sets the baseline. Lookup errors are kept in
+// t.err and do not replace the baseline. Outcomes are counted in m, if not nil.
+func (t *monitorTarget) check(ctx context.Context, c *doh.Client, m *metrics) []*monitorEvent {
+
+	now := time.Now()
+	jdns, err := c.Lookup(ctx, t.name, t.qtype)
+	if ctx.Err() != nil {
+		return nil
+	}
+	m.query(t.qtype, rcodeOf(jdns))
+	t.checked, t.err = now, err
+	if err != nil {
+		return nil
+	}
+	t.rtts = append(t.rtts, jdns.RTT)
+	if len(t.rtts) > monitorRTTs {
+		t.rtts = t.rtts[1:]
+	}
+
+	old := t.last
+	t.last = jdns
+	seen := t.seen
+	t.seen = now
+	if old == nil {
+		t.maxTTL = answerTTL(jdns)
+		t.settled = now.Add(time.Duration(t.maxTTL) * time.Second)
+		return nil
+	}
+
+	event := func(kind string, info string) *monitorEvent {
+		return &monitorEvent{Time: now, Name: t.name, Type: t.qtype, Event: kind, Info: info, Old: old, New: jdns}
+	}
+	var evs []*monitorEvent
+	if old.Status != jdns.Status {
+		evs = append(evs, event("rcode",
+			fmt.Sprintf("%s (was %s)", doh.RcodeString(jdns.Status), doh.RcodeString(old.Status))))
+	}
+	was, cur := newAnswerSet(old), newAnswerSet(jdns)
+	if !slices.Equal(was.data, cur.data) {
+		evs = append(evs, event("answer", fmt.Sprintf("%s (was %s)", cur, was)))
+	}
+	if info := t.ttlAnomaly(old, jdns, now.Sub(seen), now); info != "" {
+		evs = append(evs, event("ttl", info))
+	}
+	if evs != nil {
+		t.changed = now
+	}
+	return evs
+}
+
+// answerTTL is the highest answer TTL of jdns
+func answerTTL(jdns *doh.DNSJ) int {
+	ttl := 0
+	for _, a := range jdns.Answers {
+		ttl = max(ttl, a.TTL)
+	}
+	return ttl
+}
+
+// ttlAnomaly tells what is wrong with the TTL of jdns, got elapsed after
+// old, if anything. Caches count TTLs down, so until old's runs out the
+// answer is expected to come with what is left of it, and never above the
+// zone's TTL (the highest seen). Until the first answer expired, that is
+// not known yet, and answers of different providers come from different
+// caches: neither is compared.
+func (t *monitorTarget) ttlAnomaly(old *doh.DNSJ, jdns *doh.DNSJ, elapsed time.Duration, now time.Time) string {
+
+	was, ttl := answerTTL(old), answerTTL(jdns)
+	highest := t.maxTTL
+	t.maxTTL = max(t.maxTTL, ttl)
+	if now.Before(t.settled) || old.Provider != jdns.Provider || len(old.Answers) == 0 || len(jdns.Answers) == 0 {
+		return ""
+	}
+
+	left := was - int(elapsed.Seconds())
+	switch {
+	case ttl > highest:
+		return fmt.Sprintf("%d (highest seen %d)", ttl, highest)
+	case left <= ttlSlack:
+		// Expired in between: a fresh copy, anything up to the zone's TTL
+	case ttl < left-ttlSlack:
+		return fmt.Sprintf("%d, expected about %d (counting down from %d): lowered", ttl, left, was)
+	case ttl > left+ttlSlack:
+		return fmt.Sprintf("%d, expected about %d (counting down from %d): reset before it ran out", ttl, left, was)
+	}
+	return ""
+}
+
+// postEvent sends ev as JSON to url
+func postEvent(c *http.Client, url string, ev *monitorEvent) error {
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+func TestTTLAnomaly(t *testing.T) {
+
+	answer := func(provider string, ttl int) *doh.DNSJ {
+		return &doh.DNSJ{Provider: provider, Answers: []doh.Answer{{TTL: ttl}}}
+	}
+	now := time.Now()
+	for _, tc := range []struct {
+		old, cur *doh.DNSJ
+		elapsed  time.Duration
+		want     string // in the event, "" for none
+	}{
+		{answer("a", 300), answer("a", 270), 30 * time.Second, ""},
+		{answer("a", 300), answer("a", 268), 30 * time.Second, ""},
+		{answer("a", 300), answer("a", 60), 30 * time.Second, "lowered"},
+		{answer("a", 300), answer("a", 290), 100 * time.Second, "reset"},
+		{answer("a", 300), answer("a", 600), 30 * time.Second, "highest seen 300"},
+		{answer("a", 20), answer("a", 250), 30 * time.Second, ""},
+		{answer("a", 300), answer("b", 60), 30 * time.Second, ""},
+	} {
+		m := &monitorTarget{maxTTL: 300, settled: now.Add(-time.Minute)}
+		got := m.ttlAnomaly(tc.old, tc.cur, tc.elapsed, now)
+		if tc.want == "" && got != "" || !strings.Contains(got, tc.want) {
+			t.Errorf("%d after %d, %s later: %q, want %q", tc.cur.Answers[0].TTL, tc.old.Answers[0].TTL, tc.elapsed, got, tc.want)
+		}
+	}
+
+	// Until the first answer expired, nothing is compared
+	m := &monitorTarget{maxTTL: 300, settled: now.Add(time.Minute)}
+	if got := m.ttlAnomaly(answer("a", 300), answer("a", 60), 30*time.Second, now); got != "" {
+		t.Errorf("unsettled: %q", got)
+	}
+}
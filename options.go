@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// clientOpts are the options every command that talks to a DoH provider
+// shares: which providers, how to reach them and what to ask for.
+type clientOpts struct {
+	timeout     int
+	server      string
+	fallback    bool
+	race        bool
+	do          bool
+	cd          bool
+	ecs         string
+	retries     int
+	backoff     time.Duration
+	proxy       string
+	bootstrap   bool
+	bootstrapIP string
+	wire        bool
+	method      string
+	odoh        bool
+	relay       string
+	target      string
+	pin         string
+	cert        string
+	key         string
+	authToken   string
+	authBasic   string
+	profile     string
+	connTimeout time.Duration
+	tlsTimeout  time.Duration
+	readTimeout time.Duration
+	maxIdle     int
+	maxResponse int64
+	headers     http.Header
+	userAgent   string
+	front       string
+	ipv4        bool
+	ipv6        bool
+	bind        string
+	idleTimeout time.Duration
+	http2       bool
+	otlp        string
+	logLevel    string
+	logFormat   string
+	logFile     string
+	debug       bool
+}
+
+// register defines the client options on fs
+func (o *clientOpts) register(fs *flag.FlagSet) {
+	fs.BoolVar(&o.debug, "d", false,
+		"Debug Lookups: log requests, responses and retries (same as -log-level debug)")
+	fs.StringVar(&o.logLevel, "log-level", "info",
+		"Log messages of this level and above: debug, info, warn or error")
+	fs.StringVar(&o.logFormat, "log-format", "text",
+		"Log format: text (key=value) or json")
+	fs.StringVar(&o.logFile, "log-file", "",
+		"Append log messages to this file instead of stderr Ex.: h53.log")
+	fs.IntVar(&o.timeout, "T", 10,
+		"Query Timeout (sec.) Ex.: 10")
+	fs.DurationVar(&o.connTimeout, "connect-timeout", 0,
+		"Time allowed to connect (TCP) to a provider, within -T Ex.: 2s")
+	fs.DurationVar(&o.tlsTimeout, "tls-timeout", 0,
+		"Time allowed for the TLS handshake with a provider, within -T Ex.: 3s")
+	fs.DurationVar(&o.readTimeout, "read-timeout", 0,
+		"Time allowed for a provider to answer once the query is sent, within -T Ex.: 5s")
+	fs.IntVar(&o.maxIdle, "max-idle-conns", 0,
+		"Idle connections kept open per provider for reuse (default: one per concurrent lookup)")
+	fs.Func("H", "Header to send to the providers, repeatable; an empty value removes one Ex.: -H 'X-Client-Id: 42'",
+		func(h string) error {
+			k, v, ok := strings.Cut(h, ":")
+			if k = strings.TrimSpace(k); !ok || k == "" || strings.ContainsAny(k, " \t") {
+				return fmt.Errorf("expected Name: value")
+			}
+			if o.headers == nil {
+				o.headers = make(http.Header)
+			}
+			if v = strings.TrimSpace(v); v == "" {
+				o.headers[http.CanonicalHeaderKey(k)] = nil
+			} else {
+				o.headers.Add(k, v)
+			}
+			return nil
+		})
+	fs.BoolVar(&o.ipv4, "4", false,
+		"Reach the providers over IPv4 only")
+	fs.BoolVar(&o.ipv6, "6", false,
+		"Reach the providers over IPv6 only")
+	fs.StringVar(&o.bind, "bind", "",
+		"Source address of provider connections, or an interface to take it from Ex.: 192.0.2.10, eth1")
+	fs.StringVar(&o.front, "front", "",
+		"Domain fronting: connect and do TLS (SNI) to this host, sending the provider's name only in the\n"+
+			"Host header, inside TLS; the provider must share a CDN with it Ex.: www.example-cdn.com")
+	fs.StringVar(&o.userAgent, "A", doh.DefaultUserAgent,
+		"User-Agent sent to the providers Ex.: 'Mozilla/5.0 (X11; Linux x86_64) ...'")
+	fs.Int64Var(&o.maxResponse, "max-response", doh.DefaultMaxBody,
+		"Largest provider response accepted, in bytes once decompressed; larger ones fail as undecodable")
+	fs.DurationVar(&o.idleTimeout, "idle-timeout", 90*time.Second,
+		"How long an idle provider connection is kept for reuse Ex.: 5m")
+	fs.BoolVar(&o.http2, "http2", false,
+		"Only speak HTTP/2 with providers (h2c with prior knowledge for http:// URLs), fail otherwise")
+	fs.StringVar(&o.otlp, "otlp", "",
+		"OpenTelemetry collector to export traces of the lookups to (OTLP/HTTP) Ex.: http://127.0.0.1:4318")
+	fs.StringVar(&o.server, "s", "cloudflare",
+		"DoH provider: cloudflare, google, quad9, nextdns, adguard, a JSON API URL or an sdns:// DNS stamp. "+
+			"\nComma separated list sets the -fallback order / -race set Ex.: google,https://doh.example/dns-query")
+	fs.BoolVar(&o.fallback, "fallback", false,
+		"On failure or SERVFAIL retry against the next provider ("+doh.DefaultChain+" unless -s is set)")
+	fs.BoolVar(&o.race, "race", false,
+		"Query all providers in parallel and use the fastest good answer ("+doh.DefaultChain+" unless -s is set)")
+	fs.BoolVar(&o.do, "do", false,
+		"DNSSEC OK: request DNSSEC records (RRSIG) along with the answer")
+	fs.BoolVar(&o.cd, "cd", false,
+		"Checking Disabled: ask the resolver not to validate DNSSEC")
+	fs.StringVar(&o.ecs, "ecs", "",
+		"EDNS Client Subnet to send upstream Ex.: 198.51.100.0/24 (0.0.0.0/0 opts out of subnet leakage)")
+	fs.IntVar(&o.retries, "retries", 0,
+		"Retries per provider on transport errors, timeouts, HTTP 429/5xx (all within -T)")
+	fs.DurationVar(&o.backoff, "backoff", 250*time.Millisecond,
+		"Initial retry delay, doubled (with jitter) on each retry Ex.: 500ms")
+	fs.StringVar(&o.proxy, "proxy", "",
+		"Proxy for DoH requests Ex.: socks5h://127.0.0.1:9050, http://proxy:3128 (default: HTTP(S)_PROXY env)")
+	fs.BoolVar(&o.bootstrap, "bootstrap", false,
+		"Reach preset providers by their well known IPs, never asking the system resolver "+
+			"\n(by default the IPs are only used when system resolution fails)")
+	fs.StringVar(&o.bootstrapIP, "bootstrap-ip", "",
+		"Pin the address(es) of the first -s provider, comma separated Ex.: 1.1.1.1,1.0.0.1")
+	fs.BoolVar(&o.wire, "wire", false,
+		"Use RFC 8484 wireformat (application/dns-message) instead of the JSON API")
+	fs.StringVar(&o.method, "method", "",
+		"HTTP method: GET or POST. POST implies -wire and is the -wire default, "+
+			"\nit keeps query names out of URL logs")
+	fs.BoolVar(&o.odoh, "odoh", false,
+		"Oblivious DoH (RFC 9230): encrypt queries for -target and send them through -relay")
+	fs.StringVar(&o.relay, "relay", "",
+		"ODoH relay (proxy) URL Ex.: https://odoh-relay.example/proxy")
+	fs.StringVar(&o.target, "target", "",
+		"ODoH target, in place of -s Ex.: https://odoh.cloudflare-dns.com/dns-query")
+	fs.StringVar(&o.pin, "pin", "",
+		"SHA-256 of the provider's public key (SPKI), base64 or hex, comma separated; "+
+			"\nconnections presenting other keys fail (see h53 doctor for the current pin)")
+	fs.StringVar(&o.cert, "cert", "",
+		"Client certificate (PEM) for providers requiring mutual TLS Ex.: client.crt")
+	fs.StringVar(&o.key, "key", "",
+		"Private key (PEM) of -cert (default: read from the -cert file)")
+	fs.StringVar(&o.authToken, "auth-token", "",
+		"Bearer token sent to the providers (Authorization header), overrides config file credentials")
+	fs.StringVar(&o.authBasic, "auth-basic", "",
+		"Basic auth user:pass sent to the providers, overrides config file credentials")
+	fs.StringVar(&o.profile, "profile", "",
+		"NextDNS or AdGuard DNS profile (configuration ID) for the nextdns/adguard providers Ex.: abc123")
+}
+
+// client validates the options and builds the DoH client. set holds the
+// flags given on the command line; workers sizes the idle connection pool.
+func (o *clientOpts) client(set map[string]bool, workers int) (*doh.Client, error) {
+
+	if err := o.setupLogging(); err != nil {
+		return nil, err
+	}
+	if o.retries < 0 || o.backoff <= 0 {
+		return nil, fmt.Errorf("Retries (-retries) must not be negative and backoff (-backoff) must be positive")
+	}
+	if o.connTimeout < 0 || o.tlsTimeout < 0 || o.readTimeout < 0 {
+		return nil, fmt.Errorf("Timeouts (-connect-timeout, -tls-timeout, -read-timeout) must not be negative")
+	}
+	var network string
+	switch {
+	case o.ipv4 && o.ipv6:
+		return nil, fmt.Errorf("-4 and -6 are mutually exclusive")
+	case o.ipv4:
+		network = "tcp4"
+	case o.ipv6:
+		network = "tcp6"
+	}
+	local, err := bindAddrs(o.bind, network)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid source (-bind): %v", err)
+	}
+	if o.front != "" {
+		if u, err := url.Parse("//" + o.front); err != nil || u.Host != o.front || u.Hostname() == "" {
+			return nil, fmt.Errorf("Invalid front (-front): %s (expected host or host:port)", o.front)
+		}
+	}
+	if o.maxResponse <= 0 {
+		return nil, fmt.Errorf("Response size limit (-max-response) must be positive")
+	}
+	if o.maxIdle < 0 || o.idleTimeout <= 0 {
+		return nil, fmt.Errorf("Idle connections (-max-idle-conns) must not be negative and -idle-timeout must be positive")
+	}
+	if o.maxIdle > 0 {
+		workers = o.maxIdle
+	}
+
+	method := strings.ToUpper(o.method)
+	wire := o.wire
+	switch method {
+	case "":
+		method = "GET"
+		if wire {
+			method = "POST"
+		}
+	case "POST":
+		wire = true
+	case "GET":
+	default:
+		return nil, fmt.Errorf("Unsupported method (-method): %s", o.method)
+	}
+
+	server := o.server
+	if (o.fallback || o.race) && !set["s"] {
+		server = doh.DefaultChain
+	}
+	var odoh *doh.ODoH
+	if o.odoh {
+		if o.relay == "" || o.target == "" {
+			return nil, fmt.Errorf("Oblivious DoH (-odoh) needs -relay and -target")
+		}
+		var err error
+		if odoh, err = doh.NewODoH(o.relay); err != nil {
+			return nil, fmt.Errorf("Invalid relay (-relay): %v", err)
+		}
+		server, wire, method = o.target, true, "POST"
+	} else if o.relay != "" || o.target != "" {
+		return nil, fmt.Errorf("-relay and -target only apply with -odoh")
+	}
+	providers, err := doh.ParseProviders(server)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid provider (-s): %v", err)
+	}
+	if o.profile != "" {
+		if err := doh.ApplyProfile(providers, o.profile); err != nil {
+			return nil, fmt.Errorf("Invalid profile (-profile): %v", err)
+		}
+	}
+	var auth string
+	switch {
+	case o.authToken != "" && o.authBasic != "":
+		return nil, fmt.Errorf("-auth-token and -auth-basic are mutually exclusive")
+	case o.authToken != "":
+		auth = credential{token: o.authToken}.header()
+	case o.authBasic != "":
+		if !strings.Contains(o.authBasic, ":") {
+			return nil, fmt.Errorf("Invalid basic auth (-auth-basic): expected user:pass")
+		}
+		auth = credential{basic: o.authBasic}.header()
+	}
+	for i := range providers {
+		providers[i].Auth = auth
+		if auth == "" {
+			providers[i].Auth = conf.auth(providers[i])
+		}
+	}
+
+	// DNS stamps: the servers speak RFC 8484 only, and carry the address to
+	// reach them by and the certificates to expect
+	stamps := make(map[string]*doh.Stamp)
+	for _, p := range providers {
+		if p.Stamp != nil {
+			stamps[p.URL.Hostname()] = p.Stamp
+		}
+	}
+	if odoh != nil && odoh.RelayStamp != nil {
+		stamps[odoh.Relay.Hostname()] = odoh.RelayStamp
+	}
+	if len(stamps) != 0 && o.method == "" {
+		wire, method = true, "POST"
+	}
+
+	// Bootstrap: known provider addresses, pinned with -bootstrap/-bootstrap-ip
+	pinned := make(map[string][]string)
+	fallback := doh.BootstrapAddrs
+	if o.bootstrap {
+		for host, addrs := range doh.BootstrapAddrs {
+			pinned[host] = addrs
+		}
+		fallback = nil
+	}
+	if o.bootstrapIP != "" {
+		var addrs []string
+		for _, a := range strings.Split(o.bootstrapIP, ",") {
+			ip, err := netip.ParseAddr(strings.TrimSpace(a))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid bootstrap address (-bootstrap-ip): %v", err)
+			}
+			addrs = append(addrs, ip.String())
+		}
+		pinned[providers[0].URL.Hostname()] = addrs
+	}
+	certHashes := make(map[string][][]byte)
+	for host, st := range stamps {
+		if ip := st.IP(); ip != "" && pinned[host] == nil {
+			pinned[host] = []string{ip}
+		}
+		if len(st.Hashes) != 0 {
+			certHashes[host] = st.Hashes
+		}
+	}
+
+	pins, err := parsePins(o.pin)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pin (-pin): %v", err)
+	}
+	var clientCert *tls.Certificate
+	if o.cert != "" {
+		key := o.key
+		if key == "" {
+			key = o.cert
+		}
+		cert, err := tls.LoadX509KeyPair(o.cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client certificate (-cert, -key): %v", err)
+		}
+		clientCert = &cert
+	} else if o.key != "" {
+		return nil, fmt.Errorf("-key only applies with -cert")
+	}
+
+	// Shared across all lookups so connections are reused.
+	// Keep enough idle connections around for every worker.
+	tr, err := doh.NewTransport(&doh.TransportOptions{
+		MaxIdlePerHost: workers,
+		IdleTimeout:    o.idleTimeout,
+		HTTP2Only:      o.http2,
+		Proxy:          o.proxy,
+		Pinned:         pinned,
+		Fallback:       fallback,
+		CertHashes:     certHashes,
+		SPKIPins:       pins,
+		ClientCert:     clientCert,
+		DialTimeout:    o.connTimeout,
+		TLSTimeout:     o.tlsTimeout,
+		ReadTimeout:    o.readTimeout,
+		Network:        network,
+		Local:          local,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set up transport: %v", err)
+	}
+
+	ecs := o.ecs
+	if ecs != "" {
+		prefix, err := netip.ParsePrefix(ecs)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client subnet (-ecs): %v", err)
+		}
+		ecs = prefix.Masked().String()
+	}
+
+	if o.otlp != "" && tracer == nil {
+		if tracer, err = newOTLPTracer(o.otlp); err != nil {
+			return nil, fmt.Errorf("Invalid collector (-otlp): %v", err)
+		}
+	}
+
+	timeout := time.Duration(o.timeout) * time.Second
+	client := &doh.Client{
+		HTTP:      &http.Client{Transport: tr, Timeout: timeout},
+		Providers: providers,
+		Fallback:  o.fallback,
+		Race:      o.race,
+		DO:        o.do,
+		CD:        o.cd,
+		ECS:       ecs,
+		Wire:      wire,
+		Method:    method,
+		ODoH:      odoh,
+		Timeout:   timeout,
+		Retries:   o.retries,
+		Backoff:   o.backoff,
+		MaxBody:   o.maxResponse,
+		Header:    o.headers,
+		UserAgent: o.userAgent,
+		Front:     o.front,
+		Conns:     new(doh.ConnStats),
+		Debug:     o.debug,
+		Logger:    slog.Default(),
+	}
+	if tracer != nil {
+		client.Tracer = tracer
+	}
+	return client, nil
+}
+
+// bindAddrs resolves a -bind value to the source addresses to try: the
+// address given, or the addresses of the interface of that name, IPv4
+// first. Only those of the network's family (tcp4, tcp6) are kept.
+func bindAddrs(spec string, network string) ([]netip.Addr, error) {
+
+	if spec == "" {
+		return nil, nil
+	}
+	var addrs []netip.Addr
+	if a, err := netip.ParseAddr(spec); err == nil {
+		addrs = append(addrs, a.Unmap())
+	} else {
+		ifi, err := net.InterfaceByName(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s is neither an address nor an interface", spec)
+		}
+		ifaddrs, err := ifi.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, ia := range ifaddrs {
+			// Link-local addresses only reach the link, not a provider
+			if p, err := netip.ParsePrefix(ia.String()); err == nil && !p.Addr().IsLinkLocalUnicast() {
+				addrs = append(addrs, p.Addr().Unmap())
+			}
+		}
+		slices.SortStableFunc(addrs, func(a, b netip.Addr) int {
+			if a.Is4() == b.Is4() {
+				return 0
+			}
+			if a.Is4() {
+				return -1
+			}
+			return 1
+		})
+	}
+
+	addrs = slices.DeleteFunc(addrs, func(a netip.Addr) bool {
+		return network == "tcp4" && !a.Is4() || network == "tcp6" && a.Is4()
+	})
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s has no address to reach the providers by over %s", spec, map[string]string{
+			"tcp4": "IPv4", "tcp6": "IPv6", "": "IP"}[network])
+	}
+	return addrs, nil
+}
+
+// parsePins decodes comma separated SHA-256 pins, in base64 (optionally
+// prefixed sha256// as curl takes them) or hex
+func parsePins(s string) ([][]byte, error) {
+	var pins [][]byte
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimPrefix(strings.TrimSpace(p), "sha256//")
+		if p == "" {
+			continue
+		}
+		pin, err := hex.DecodeString(p)
+		if err != nil {
+			pin, err = base64.StdEncoding.DecodeString(p)
+		}
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("not a SHA-256 hash: %s", p)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// newFlagSet creates the flag set of a command; synopsis and about make
+// up its usage text, ahead of the option defaults.
+func newFlagSet(name string, synopsis string, about string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.String("config", "", "Config file with option defaults and credentials (default ~/.h53.yaml)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  %s\n\n", synopsis)
+		if about != "" {
+			fmt.Fprintf(fs.Output(), "%s\n\n", about)
+		}
+		fmt.Fprint(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// visited returns the names of the flags set on the command line
+func visited(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// otlpInterval is how often finished spans are sent to the collector
+const otlpInterval = 5 * time.Second
+
+// tracer is the OTLP exporter of the run, set up by -otlp; shutdown flushes it
+var tracer *otlpTracer
+
+// otlpTracer is a doh.Tracer exporting spans to an OpenTelemetry collector
+// over OTLP/HTTP, JSON encoded, in batches
+type otlpTracer struct {
+	endpoint string // the collector's /v1/traces URL
+	http     *http.Client
+
+	mu    sync.Mutex
+	spans []*otlpSpan // finished, not exported yet
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// otlpSpan is a span in the making
+type otlpSpan struct {
+	t               *otlpTracer
+	traceID, spanID string
+	parentID        string
+	name            string
+	start, end      time.Time
+	attrs           []doh.Attr
+	err             error
+}
+
+type spanKey struct{}
+
+// newOTLPTracer starts exporting to the collector at endpoint, its base URL
+// (/v1/traces is added) or the full traces URL
+func newOTLPTracer(endpoint string) (*otlpTracer, error) {
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("not an http(s) URL: %s", endpoint)
+	}
+	if !strings.HasSuffix(u.Path, "/v1/traces") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/traces"
+	}
+	t := &otlpTracer{
+		endpoint: u.String(),
+		http:     &http.Client{Timeout: 10 * time.Second},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(t.done)
+		tick := time.NewTicker(otlpInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				t.report(t.flush())
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t, nil
+}
+
+// Start begins a span, the child of the span in ctx if any
+func (t *otlpTracer) Start(ctx context.Context, name string, attrs ...doh.Attr) (context.Context, doh.Span) {
+
+	s := &otlpSpan{t: t, spanID: randomHex(8), name: name, start: time.Now(), attrs: attrs}
+	if parent, ok := ctx.Value(spanKey{}).(*otlpSpan); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *otlpSpan) SetAttr(attrs ...doh.Attr) {
+	s.t.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.t.mu.Unlock()
+}
+
+func (s *otlpSpan) End(err error) {
+	s.t.mu.Lock()
+	s.end, s.err = time.Now(), err
+	s.t.spans = append(s.t.spans, s)
+	s.t.mu.Unlock()
+}
+
+// flush sends the finished spans to the collector
+func (t *otlpTracer) flush() error {
+
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	type kv = map[string]any
+	var out []kv
+	for _, s := range spans {
+		var attrs []kv
+		for _, a := range s.attrs {
+			attrs = append(attrs, kv{"key": a.Key, "value": otlpValue(a.Value)})
+		}
+		js := kv{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              1, // internal
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs,
+		}
+		if s.parentID != "" {
+			js["parentSpanId"] = s.parentID
+		}
+		if s.err != nil {
+			js["status"] = kv{"code": 2, "message": s.err.Error()}
+		}
+		out = append(out, js)
+	}
+	body, err := json.Marshal(kv{"resourceSpans": []kv{{
+		"resource": kv{"attributes": []kv{
+			{"key": "service.name", "value": otlpValue("h53")},
+		}},
+		"scopeSpans": []kv{{
+			"scope": kv{"name": "github.com/dsnezhkov/h53"},
+			"spans": out,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	res, err := t.http.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", t.endpoint, res.Status)
+	}
+	return nil
+}
+
+func (t *otlpTracer) report(err error) {
+	if err != nil {
+		slog.Warn("unable to export traces", "error", err)
+	}
+}
+
+// otlpValue is the OTLP AnyValue of an attribute value
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	}
+	return map[string]any{"stringValue": fmt.Sprint(v)}
+}
+
+// randomHex returns n random bytes in hex, for trace and span IDs
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// shutdown exports the spans left, if tracing, and passes the exit code on
+func shutdown(code int) int {
+	if tracer != nil {
+		close(tracer.stop)
+		<-tracer.done
+		tracer.report(tracer.flush())
+	}
+	return code
+}
@@ -0,0 +1,755 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// printOpts carries the presentation switches shared by all printers
+type printOpts struct {
+	verbose   bool
+	batch     bool
+	multi     bool                // several query types per name
+	dnssec    bool                // report the DNSSEC validation state
+	requireAD bool                // unvalidated answers are an error
+	jsonErr   bool                // report lookup errors as JSON objects, in line with the answers
+	ascii     bool                // keep xn-- names as they are, no Unicode
+	grep      *regexp.Regexp      // only show answers whose data matches
+	wildcard  string              // the wildcard (*.zone) the answers match, per lookup
+	origins   map[string]origin   // origin AS of the answer addresses, per lookup
+	ptrs      map[string][]string // names the answer addresses reverse resolve to, per lookup
+	tpl       *template.Template  // -o template: rendering of each answer
+	color     bool                // ANSI colors in text output
+	expect    []*expectation      // what the answers must be (-expect)
+}
+
+// printer renders one decoded response to w and returns the exit code
+// the lookup should contribute (0 on success, 4 when nothing was found).
+type printer func(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int
+
+// printers maps -o format names to their renderers
+var printers = map[string]printer{
+	"text":  printText,
+	"json":  printJSON,
+	"dig":   printDig,
+	"short": printShort,
+	"hosts": printHosts,
+	"zone":  printZone,
+	"csv":   printCSV,
+	"jsonl": printJSONL,
+
+	"template": printTemplate,
+}
+
+// exitRcode is added to the RCODE of an unsuccessful answer to make the
+// exit code: NXDOMAIN exits 13, SERVFAIL 12, REFUSED 15
+const exitRcode = 10
+
+// emit renders jdns with render and applies the exit code policy shared
+// by all formats: an error RCODE exits 10+RCODE, and with -require-ad an
+// answer lacking the AD bit exits 6.
+func emit(w io.Writer, name string, jdns *doh.DNSJ, render printer, po *printOpts) int {
+
+	if !po.ascii {
+		jdns = unicodeNames(jdns)
+	}
+	jdns = sortAnswers(jdns)
+	if po.grep != nil {
+		jdns = grepAnswers(jdns, po.grep)
+	}
+	code := render(w, name, jdns, po)
+	if jdns.Status != 0 && code != 5 {
+		return exitRcode + jdns.Status
+	}
+	if code == 0 && po.requireAD && !jdns.AD {
+		fmt.Fprintf(os.Stderr, "%s: answer is NOT DNSSEC validated (AD bit not set)\n", name)
+		code = 6
+	}
+	if code == 0 && po.expect != nil {
+		for _, u := range unmet(jdns, po.expect) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, u)
+			code = exitCheckFailed
+		}
+	}
+	return code
+}
+
+// sortAnswers returns jdns with its MX records in order of preference, the
+// order mail is delivered in, SRV records by priority then heaviest weight
+// first and NAPTR records by order then preference, the order clients try
+// them in. Other records keep the order they came in.
+func sortAnswers(jdns *doh.DNSJ) *doh.DNSJ {
+
+	rank := func(a doh.Answer) []int {
+		switch a.Type {
+		case 15:
+			if mx, err := doh.ParseMX(a.Data); err == nil {
+				return []int{mx.Preference}
+			}
+		case 33:
+			if srv, err := doh.ParseSRV(a.Data); err == nil {
+				return []int{srv.Priority, -srv.Weight}
+			}
+		case 35:
+			if n, err := doh.ParseNAPTR(a.Data); err == nil {
+				return []int{n.Order, n.Preference}
+			}
+		}
+		return nil
+	}
+	c := *jdns
+	c.Answers = slices.Clone(jdns.Answers)
+	slices.SortStableFunc(c.Answers, func(a, b doh.Answer) int {
+		ra, rb := rank(a), rank(b)
+		if a.Type != b.Type || ra == nil || rb == nil {
+			return 0
+		}
+		return slices.Compare(ra, rb)
+	})
+	return &c
+}
+
+// grepAnswers returns jdns with only the answers whose data, the joined
+// value for TXT, matches re
+func grepAnswers(jdns *doh.DNSJ, re *regexp.Regexp) *doh.DNSJ {
+	c := *jdns
+	c.Answers = nil
+	for _, a := range jdns.Answers {
+		if re.MatchString(answerValue(a)) {
+			c.Answers = append(c.Answers, a)
+		}
+	}
+	return &c
+}
+
+// answerValue is the data of a as scripts want it: TXT and SPF strings
+// joined and unquoted, anything else as it is
+func answerValue(a doh.Answer) string {
+	if a.Type == 16 || a.Type == 99 {
+		return doh.JoinTXT(a.Data)
+	}
+	return a.Data
+}
+
+// targetHost is the host an MX or SRV answer points at, or ""
+func targetHost(a doh.Answer) string {
+	switch a.Type {
+	case 15:
+		if mx, err := doh.ParseMX(a.Data); err == nil {
+			return mx.Exchange
+		}
+	case 33:
+		if srv, err := doh.ParseSRV(a.Data); err == nil {
+			return srv.Target
+		}
+	}
+	return ""
+}
+
+// alignFields renders the data of SRV and NAPTR answers with each field
+// padded to the widest of its column among the answers of the same type, so
+// priorities, ports and targets line up. Other answers get "".
+func alignFields(answers []doh.Answer) []string {
+
+	fields := make([][]string, len(answers))
+	widths := make(map[int][]int) // by type
+	for i, a := range answers {
+		switch a.Type {
+		case 33:
+			if srv, err := doh.ParseSRV(a.Data); err == nil {
+				fields[i] = srv.Fields()
+			}
+		case 35:
+			if n, err := doh.ParseNAPTR(a.Data); err == nil {
+				fields[i] = n.Fields()
+			}
+		}
+		if fields[i] == nil {
+			continue
+		}
+		w := widths[a.Type]
+		if w == nil {
+			w = make([]int, len(fields[i]))
+			widths[a.Type] = w
+		}
+		for j, f := range fields[i] {
+			w[j] = max(w[j], len(f))
+		}
+	}
+
+	out := make([]string, len(answers))
+	for i, f := range fields {
+		if f == nil {
+			continue
+		}
+		w := widths[answers[i].Type]
+		var b strings.Builder
+		for j, v := range f[:len(f)-1] {
+			fmt.Fprintf(&b, "%-*s ", w[j], v)
+		}
+		b.WriteString(f[len(f)-1])
+		out[i] = b.String()
+	}
+	return out
+}
+
+// targetAddrs returns the addresses the additional section holds for host
+func targetAddrs(jdns *doh.DNSJ, host string) []string {
+	var addrs []string
+	for _, a := range jdns.Additional {
+		if (a.Type == 1 || a.Type == 28) && strings.EqualFold(fqdn(a.Name), fqdn(host)) {
+			addrs = append(addrs, a.Data)
+		}
+	}
+	return addrs
+}
+
+// unicodeNames returns a copy of jdns with the xn-- labels of owner names,
+// and of the names in record data, shown in Unicode
+func unicodeNames(jdns *doh.DNSJ) *doh.DNSJ {
+
+	c := *jdns
+	c.Questions = append([]doh.Question(nil), jdns.Questions...)
+	for i := range c.Questions {
+		c.Questions[i].Name = doh.ToUnicode(c.Questions[i].Name)
+	}
+	section := func(rrs []doh.Answer) []doh.Answer {
+		out := append([]doh.Answer(nil), rrs...)
+		for i := range out {
+			out[i].Name = doh.ToUnicode(out[i].Name)
+			switch out[i].Type {
+			case 13, 16, 99, 257: // HINFO, TXT, SPF, CAA: text, not names
+				continue
+			}
+			f := strings.Split(out[i].Data, " ")
+			for j := range f {
+				f[j] = doh.ToUnicode(f[j])
+			}
+			out[i].Data = strings.Join(f, " ")
+		}
+		return out
+	}
+	c.Answers = section(jdns.Answers)
+	c.Authority = section(jdns.Authority)
+	c.Additional = section(jdns.Additional)
+	return &c
+}
+
+// lookupError is the JSON form of a failed lookup, for -o json
+type lookupError struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Error struct {
+		Category   string `json:"category"` // input, request, transport, http_status, decode, rcode
+		Provider   string `json:"provider,omitempty"`
+		HTTPStatus int    `json:"http_status,omitempty"`
+		Rcode      string `json:"rcode,omitempty"`
+		Message    string `json:"message"`
+	} `json:"error"`
+}
+
+// report prints a failed lookup of name/qtype, to stderr or with jsonErr as
+// a lookupError document on w, and returns the exit code for it. Interrupted
+// lookups are not reported.
+func report(w io.Writer, name string, qtype string, err error, po *printOpts) int {
+
+	code := exitCode(err)
+	if code == exitInterrupted {
+		return code
+	}
+	if !po.jsonErr {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return code
+	}
+
+	le := &lookupError{Name: name, Type: strings.ToUpper(qtype)}
+	le.Error.Category = errorCategory(err)
+	le.Error.Provider = errorProvider(err)
+	le.Error.Message = err.Error()
+	var se *doh.StatusError
+	if errors.As(err, &se) {
+		le.Error.HTTPStatus = se.Code
+	}
+	var rce *doh.RcodeError
+	if errors.As(err, &rce) {
+		le.Error.Rcode = doh.RcodeString(rce.Rcode)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(le)
+	return code
+}
+
+// printText renders a decoded response as indexed text lines, aligned in
+// columns and colored on a terminal (see colorOutput). In batch mode
+// NOT FOUND lines carry the queried name so the output stays attributable per line.
+func printText(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int {
+
+	// Label each type group when several types were asked for
+	if po.multi {
+		qtype := "?"
+		if len(jdns.Questions) != 0 {
+			qtype = doh.TypeString(jdns.Questions[0].Type)
+		}
+		fmt.Fprintf(w, ";; %s %s\n", name, qtype)
+	}
+
+	if jdns.Status != 0 {
+		rcode := fmt.Sprintf("Unsuccessful DNS Return code: %s (%d)", doh.RcodeString(jdns.Status), jdns.Status)
+		if jdns.Status == 2 || jdns.Status == 3 {
+			rcode = po.paint(ansiRed, rcode)
+		}
+		fmt.Fprintln(w, rcode)
+		fmt.Fprintf(w, "See: %s to determine the cause\n",
+			"https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-6")
+	}
+	if po.verbose {
+		fmt.Fprintf(w, "Status: %s, TC: %t, RD: %t RA: %t, AD: %t, CD: %t\n",
+			doh.RcodeString(jdns.Status), jdns.TC, jdns.RD, jdns.RA, jdns.AD, jdns.CD)
+		if jdns.Timing != nil {
+			fmt.Fprintf(w, "Timing (%s): %s\n", jdns.Provider, jdns.Timing)
+		}
+
+		fmt.Fprintf(w, "Questions: %d\n", len(jdns.Questions))
+		if len(jdns.Questions) != 0 {
+			for i, a := range jdns.Questions {
+				fmt.Fprintf(w, "%d: Name: %s Type: %s \n", i+1, a.Name, doh.TypeString(a.Type))
+			}
+		}
+		fmt.Fprintf(w, "Answers: %d\n", len(jdns.Answers))
+	}
+
+	if len(jdns.Answers) == 0 {
+		if po.batch {
+			fmt.Fprintf(w, "%s: NOT FOUND\n", name)
+		} else {
+			fmt.Fprintln(w, "NOT FOUND")
+		}
+		if po.verbose {
+			printSections(w, jdns, po)
+		}
+		return 4
+	}
+
+	// Verbose listings are 1-based, matching the Questions block
+	base := 0
+	if po.verbose {
+		base = 1
+	}
+	columns := alignFields(jdns.Answers)
+	cols := newTextColumns(jdns.Answers, base)
+	for i, a := range jdns.Answers {
+		data := a.Data
+		switch {
+		case columns[i] != "":
+			data = columns[i]
+		case a.Type == 16 || a.Type == 99:
+			data = strconv.Quote(answerValue(a))
+		}
+		if host := targetHost(a); host != "" {
+			if addrs := targetAddrs(jdns, host); len(addrs) != 0 {
+				data += " -> " + strings.Join(addrs, ", ")
+			}
+		}
+		if names, ok := po.ptrs[a.Data]; ok && (a.Type == 1 || a.Type == 28) {
+			data += " (" + strings.Join(names, ", ") + ")"
+		}
+		if o, ok := po.origins[a.Data]; ok && (a.Type == 1 || a.Type == 28) {
+			data += " [" + o.String() + "]"
+		}
+		cols.line(w, i+base, a, data, po)
+		if po.verbose && (a.Type == 64 || a.Type == 65) {
+			printSvcParams(w, a.Data)
+		}
+	}
+	if po.wildcard != "" {
+		fmt.Fprintf(w, "Wildcard: %s answers the same, these may be wildcard artifacts\n", po.wildcard)
+	}
+	if len(jdns.Questions) != 0 {
+		if chain, final, _ := cnameChain(jdns, jdns.Questions[0].Name); len(chain) > 1 {
+			fmt.Fprintf(w, "CNAME chain: %s\n", chainString(chain, final))
+		}
+	}
+	if po.verbose {
+		printSections(w, jdns, po)
+	}
+
+	if po.dnssec {
+		if jdns.AD {
+			fmt.Fprintln(w, "DNSSEC: validated (AD)")
+		} else {
+			fmt.Fprintln(w, "DNSSEC: NOT validated")
+		}
+	}
+	return 0
+}
+
+// printSections lists the authority and additional records and the
+// provider's comment, for verbose text output
+func printSections(w io.Writer, jdns *doh.DNSJ, po *printOpts) {
+	for _, s := range []struct {
+		title string
+		rrs   []doh.Answer
+	}{
+		{"Authority", jdns.Authority}, {"Additional", jdns.Additional},
+	} {
+		if len(s.rrs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s: %d\n", s.title, len(s.rrs))
+		cols := newTextColumns(s.rrs, 1)
+		for i, a := range s.rrs {
+			cols.line(w, i+1, a, a.Data, po)
+		}
+	}
+	if jdns.Comment != "" {
+		fmt.Fprintf(w, "Comment: %s\n", jdns.Comment)
+	}
+}
+
+// textColumns are the widths of the columns of text record lines, over the
+// records of one listing, so that the lines align
+type textColumns struct {
+	index, name, ttl, rtype int
+}
+
+func newTextColumns(rrs []doh.Answer, base int) textColumns {
+
+	c := textColumns{index: len(strconv.Itoa(len(rrs) - 1 + base))}
+	for _, a := range rrs {
+		c.name = max(c.name, utf8.RuneCountInString(a.Name))
+		c.ttl = max(c.ttl, len(strconv.Itoa(a.TTL)))
+		c.rtype = max(c.rtype, len(doh.TypeString(a.Type)))
+	}
+	return c
+}
+
+// line writes one record: index, owner, TTL (dimmed), type (colored by
+// type) and data. Padding goes on before the colors, which take no room.
+func (c textColumns) line(w io.Writer, i int, a doh.Answer, data string, po *printOpts) {
+
+	name := a.Name + strings.Repeat(" ", c.name-utf8.RuneCountInString(a.Name))
+	ttl := po.paint(ansiDim, fmt.Sprintf("%*d", c.ttl, a.TTL))
+	rtype := po.paint(typeColors[a.Type], fmt.Sprintf("%-*s", c.rtype, doh.TypeString(a.Type)))
+	fmt.Fprintf(w, "%*d  %s  %s  %s  %s\n", c.index, i, name, ttl, rtype, data)
+}
+
+// printShort prints just the record data, one per line, for use in scripts.
+// Nothing is printed when there is no answer; the exit code tells.
+func printShort(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int {
+	if len(jdns.Answers) == 0 {
+		return 4
+	}
+	for _, a := range jdns.Answers {
+		fmt.Fprintln(w, answerValue(a))
+	}
+	if po.wildcard != "" {
+		fmt.Fprintf(os.Stderr, "%s: %s answers the same, these may be wildcard artifacts\n", name, po.wildcard)
+	}
+	return 0
+}
+
+// printHosts prints the addresses of the answer as hosts file lines for
+// name, the name asked for rather than the end of a CNAME chain, since that
+// is the name programs will look up. Nothing else is printed.
+func printHosts(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int {
+	found := 0
+	for _, a := range jdns.Answers {
+		if a.Type == 1 || a.Type == 28 {
+			fmt.Fprintln(w, hostsLine(a.Data, name))
+			found++
+		}
+	}
+	if found == 0 {
+		return 4
+	}
+	return 0
+}
+
+// hostsLine is the hosts(5) line mapping name to addr; the name is in its
+// xn-- form, which is all resolvers reading the file match
+func hostsLine(addr string, name string) string {
+	if aname, err := doh.ToASCII(name); err == nil {
+		name = aname
+	}
+	return addr + "\t" + strings.TrimSuffix(name, ".")
+}
+
+// printSvcParams lists the parts of an SVCB/HTTPS record one per line
+func printSvcParams(w io.Writer, data string) {
+	prio, target, params, err := doh.SvcParams(data)
+	if err != nil {
+		return
+	}
+	mode := "ServiceMode"
+	if prio == 0 {
+		mode = "AliasMode"
+	}
+	fmt.Fprintf(w, "   priority: %d (%s)\n", prio, mode)
+	fmt.Fprintf(w, "   target: %s\n", target)
+	for _, p := range params {
+		if p[1] == "" {
+			fmt.Fprintf(w, "   %s\n", p[0])
+			continue
+		}
+		fmt.Fprintf(w, "   %s: %s\n", p[0], strings.Trim(p[1], `"`))
+	}
+}
+
+// printJSON emits the full decoded response as an indented JSON document,
+// one document per lookup, so batch output can be consumed by jq as a stream.
+func printJSON(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int {
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	var v any = jdns
+	if po.wildcard != "" || po.origins != nil || po.ptrs != nil {
+		v = struct {
+			*doh.DNSJ
+			Wildcard string              `json:"Wildcard,omitempty"`
+			Origins  map[string]origin   `json:"Origins,omitempty"`
+			PTR      map[string][]string `json:"PTR,omitempty"`
+		}{jdns, po.wildcard, po.origins, po.ptrs}
+	}
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode response for %s: %v\n", name, err)
+		return 5
+	}
+
+	if len(jdns.Answers) == 0 {
+		return 4
+	}
+	return 0
+}
+
+// printDig renders the response in the section layout of dig(1):
+// a HEADER with status and flags, then QUESTION and ANSWER sections
+// with class, TTL and type mnemonics.
+func printDig(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int {
+
+	flags := []string{"qr"}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{jdns.TC, "tc"}, {jdns.RD, "rd"}, {jdns.RA, "ra"}, {jdns.AD, "ad"}, {jdns.CD, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+
+	fmt.Fprintf(w, "; <<>> h53 <<>> %s\n", name)
+	fmt.Fprintf(w, ";; ->>HEADER<<- opcode: QUERY, status: %s\n", doh.RcodeString(jdns.Status))
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(jdns.Questions), len(jdns.Answers), len(jdns.Authority), len(jdns.Additional))
+	if jdns.Comment != "" {
+		fmt.Fprintf(w, ";; COMMENT: %s\n", jdns.Comment)
+	}
+	if po.wildcard != "" {
+		fmt.Fprintf(w, ";; WARNING: %s answers the same, these may be wildcard artifacts\n", po.wildcard)
+	}
+
+	if len(jdns.Questions) != 0 {
+		fmt.Fprintf(w, "\n;; QUESTION SECTION:\n")
+		for _, q := range jdns.Questions {
+			fmt.Fprintf(w, ";%s\t\tIN\t%s\n", fqdn(q.Name), doh.TypeString(q.Type))
+		}
+	}
+
+	for _, s := range []struct {
+		title string
+		rrs   []doh.Answer
+	}{
+		{"ANSWER", jdns.Answers}, {"AUTHORITY", jdns.Authority}, {"ADDITIONAL", jdns.Additional},
+	} {
+		if len(s.rrs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n;; %s SECTION:\n", s.title)
+		for _, a := range s.rrs {
+			fmt.Fprintf(w, "%s\t%d\tIN\t%s\t%s", fqdn(a.Name), a.TTL, doh.TypeString(a.Type), a.Data)
+			if a.Type == 1 || a.Type == 28 {
+				var notes []string
+				if names, ok := po.ptrs[a.Data]; ok {
+					notes = append(notes, strings.Join(names, ", "))
+				}
+				if o, ok := po.origins[a.Data]; ok {
+					notes = append(notes, o.String()+" "+o.Prefix)
+				}
+				if notes != nil {
+					fmt.Fprintf(w, "\t; %s", strings.Join(notes, " "))
+				}
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	fmt.Fprintln(w)
+
+	if len(jdns.Answers) == 0 {
+		return 4
+	}
+	return 0
+}
+
+// printZone renders the answers as master file records (RFC 1035 5.1),
+// one "name TTL IN TYPE data" line each, ready to paste into a zone file.
+// An unsuccessful answer is noted in a comment, which zone files allow.
+func printZone(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int {
+	if jdns.Status != 0 {
+		fmt.Fprintf(w, "; %s: %s\n", fqdn(name), doh.RcodeString(jdns.Status))
+	}
+	if len(jdns.Answers) == 0 {
+		return 4
+	}
+	for _, a := range jdns.Answers {
+		data := a.Data
+		if a.Type == 16 || a.Type == 99 {
+			data = doh.QuoteTXT(data)
+		}
+		fmt.Fprintf(w, "%s\t%d\tIN\t%s\t%s\n", fqdn(a.Name), a.TTL, doh.TypeString(a.Type), data)
+	}
+	return 0
+}
+
+// recordRow is one answer as a flat record, for -o csv and -o jsonl; the
+// field order is the column order and does not change. A lookup without
+// answers is one row with no TTL or data, and its status.
+type recordRow struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	TTL      *int    `json:"ttl"`
+	Data     string  `json:"data"`
+	Provider string  `json:"provider"`
+	RTT      float64 `json:"rtt_ms"`
+	Status   string  `json:"status"`
+}
+
+// recordColumns is the header row of -o csv
+var recordColumns = []string{"name", "type", "ttl", "data", "provider", "rtt_ms", "status"}
+
+// recordRows flattens jdns into rows
+func recordRows(name string, jdns *doh.DNSJ) []recordRow {
+
+	base := recordRow{Name: fqdn(name), Provider: jdns.Provider,
+		RTT: float64(jdns.RTT.Microseconds()) / 1000, Status: doh.RcodeString(jdns.Status)}
+	if len(jdns.Questions) != 0 {
+		base.Type = doh.TypeString(jdns.Questions[0].Type)
+	}
+	if len(jdns.Answers) == 0 {
+		return []recordRow{base}
+	}
+	rows := make([]recordRow, len(jdns.Answers))
+	for i, a := range jdns.Answers {
+		rows[i] = base
+		rows[i].Name, rows[i].Type, rows[i].Data = fqdn(a.Name), doh.TypeString(a.Type), answerValue(a)
+		rows[i].TTL = &a.TTL
+	}
+	return rows
+}
+
+// printCSV renders the answers as CSV records (RFC 4180), in the columns
+// of recordColumns; -header prints those first, once per run
+func printCSV(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int {
+
+	cw := csv.NewWriter(w)
+	for _, r := range recordRows(name, jdns) {
+		ttl := ""
+		if r.TTL != nil {
+			ttl = strconv.Itoa(*r.TTL)
+		}
+		cw.Write([]string{r.Name, r.Type, ttl, r.Data, r.Provider, strconv.FormatFloat(r.RTT, 'f', -1, 64), r.Status})
+	}
+	cw.Flush()
+	if len(jdns.Answers) == 0 {
+		return 4
+	}
+	return 0
+}
+
+// printJSONL renders the answers as JSON Lines, one recordRow object per
+// line, for data pipelines
+func printJSONL(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int {
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, r := range recordRows(name, jdns) {
+		if err := enc.Encode(r); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to encode response for %s: %v\n", name, err)
+			return 5
+		}
+	}
+	if len(jdns.Answers) == 0 {
+		return 4
+	}
+	return 0
+}
+
+// templateAnswer is what an -o template template sees of each answer: the
+// record (.Name, .Type, .TTL, .Data), its .Value as -o short prints it, the
+// .Query name asked for and the whole .Response
+type templateAnswer struct {
+	doh.Answer
+	Value    string
+	Query    string
+	Response *doh.DNSJ
+}
+
+// templateFuncs are the functions templates may call besides the builtins
+var templateFuncs = template.FuncMap{
+	"type":  doh.TypeString,
+	"rcode": doh.RcodeString,
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// parseTemplate compiles a -tpl template. Each answer's rendering ends
+// with a newline, added when the template has none.
+func parseTemplate(text string) (*template.Template, error) {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return template.New("tpl").Funcs(templateFuncs).Parse(text)
+}
+
+// printTemplate renders each answer with the -tpl template, docker and
+// kubectl style
+func printTemplate(w io.Writer, name string, jdns *doh.DNSJ, po *printOpts) int {
+	for _, a := range jdns.Answers {
+		err := po.tpl.Execute(w, templateAnswer{Answer: a, Value: answerValue(a), Query: name, Response: jdns})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Template (-tpl) failed for %s: %v\n", name, err)
+			return 5
+		}
+	}
+	if len(jdns.Answers) == 0 {
+		return 4
+	}
+	return 0
+}
+
+// fqdn returns name with a trailing dot, as zone-file style output expects
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// probeResult is the outcome of an HTTP request to one address of a name
+type probeResult struct {
+	addr     netip.Addr
+	status   string
+	location string // where a redirect points
+	took     time.Duration
+	cert     *x509.Certificate
+	err      error
+}
+
+// cmdProbe resolves a name over DoH and sends an HTTP(S) request to every
+// address it has, as the name: whether the site is reachable when only its
+// DNS is blocked, and whether each address serves it.
+func cmdProbe() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optName string
+	var optPort int
+	var optPath string
+	var optHTTP bool
+	var optInsecure bool
+
+	fs := newFlagSet("probe", "h53 probe [options] -n name",
+		"Resolve name over DoH, then send an HTTP(S) request to each of its addresses with name as Host and SNI.")
+	co.register(fs)
+	fs.StringVar(&optName, "n", "",
+		"Name to resolve and probe Ex.: example.com")
+	fs.IntVar(&optPort, "port", 443,
+		"Port to connect to")
+	fs.StringVar(&optPath, "path", "/",
+		"Path (and query) to request")
+	fs.BoolVar(&optHTTP, "http", false,
+		"Plain HTTP instead of HTTPS (default for port 80)")
+	fs.BoolVar(&optInsecure, "insecure", false,
+		"Do not verify the server certificates")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if optName == "" || fs.NArg() != 0 {
+			fs.Usage()
+			return 1
+		}
+		if optPort < 1 || optPort > 65535 {
+			fmt.Fprintf(os.Stderr, "Invalid port (-port): %d\n", optPort)
+			return 1
+		}
+		if !strings.HasPrefix(optPath, "/") {
+			optPath = "/" + optPath
+		}
+		u, err := probeURL(optName, optPort, optPath, optHTTP || optPort == 80)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid path (-path): %v\n", err)
+			return 1
+		}
+
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		addrs, code := r.resolveAll(optName)
+		if code != 0 {
+			fmt.Fprintf(os.Stderr, "Unable to resolve %s\n", optName)
+			return code
+		}
+
+		results := make([]probeResult, len(addrs))
+		var wg sync.WaitGroup
+		for i, addr := range addrs {
+			wg.Go(func() {
+				results[i] = probe(r.ctx, addr, strconv.Itoa(optPort), u, optInsecure, client.Timeout, client.UserAgent)
+			})
+		}
+		wg.Wait()
+		if r.ctx.Err() != nil {
+			return exitInterrupted
+		}
+
+		fmt.Printf("GET %s\n", u)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ADDRESS\tSTATUS\tTIME\tCERTIFICATE")
+		reached := 0
+		for _, res := range results {
+			if res.err != nil {
+				fmt.Fprintf(tw, "%s\terror\t%v\t%v\n", res.addr, res.took.Round(time.Millisecond), res.err)
+				continue
+			}
+			reached++
+			status := res.status
+			if res.location != "" {
+				status += " -> " + res.location
+			}
+			cert := "-"
+			if res.cert != nil {
+				cert = fmt.Sprintf("%s (issuer %s, expires %s)", res.cert.Subject, res.cert.Issuer, res.cert.NotAfter.Format(time.DateOnly))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", res.addr, status, res.took.Round(time.Millisecond), cert)
+		}
+		tw.Flush()
+		fmt.Printf("Reached %s at %d of %d addresses\n", optName, reached, len(addrs))
+		if reached == 0 {
+			return 7
+		}
+		return 0
+	}
+}
+
+// probeURL is the URL requested of every address, the port left out when
+// it is the scheme's default so the Host header is the bare name
+func probeURL(name string, port int, path string, plain bool) (*url.URL, error) {
+
+	scheme, host := "https", name
+	if plain {
+		scheme = "http"
+	}
+	if (plain && port != 80) || (!plain && port != 443) {
+		host = net.JoinHostPort(name, strconv.Itoa(port))
+	}
+	return url.Parse(scheme + "://" + host + path)
+}
+
+// probe requests u from the server at addr, whatever the name resolves to
+// elsewhere: the connection goes to addr, Host and SNI carry the name.
+// Redirects are reported, not followed.
+func probe(ctx context.Context, addr netip.Addr, port string, u *url.URL, insecure bool, timeout time.Duration, ua string) probeResult {
+
+	target := net.JoinHostPort(addr.String(), port)
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, target)
+			},
+			TLSClientConfig:   &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: insecure},
+			ForceAttemptHTTP2: true,
+			DisableKeepAlives: true,
+		},
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res := probeResult{addr: addr}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	req.Header.Set("User-Agent", ua)
+
+	start := time.Now()
+	resp, err := hc.Do(req)
+	res.took = time.Since(start)
+	if err != nil {
+		// The URL is the same for every address, the reason is what differs
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		res.err = err
+		return res
+	}
+	resp.Body.Close()
+
+	res.status = resp.Status
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		res.location = resp.Header.Get("Location")
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) != 0 {
+		res.cert = resp.TLS.PeerCertificates[0]
+	}
+	return res
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// propagateResolvers are the public resolvers propagate asks unless -s is
+// given: the presets and DoH services run in other parts of the world, whose
+// caches fill independently. All of them speak RFC 8484, not all the JSON API.
+var propagateResolvers = []struct {
+	name     string
+	provider string
+}{
+	{"Cloudflare", "cloudflare"},
+	{"Google", "google"},
+	{"Quad9", "quad9"},
+	{"AdGuard", "adguard"},
+	{"NextDNS", "nextdns"},
+	{"OpenDNS", "https://doh.opendns.com/dns-query"},
+	{"Control D", "https://freedns.controld.com/p0"},
+	{"Mullvad (SE)", "https://dns.mullvad.net/dns-query"},
+	{"DNS.SB (DE)", "https://doh.dns.sb/dns-query"},
+	{"SWITCH (CH)", "https://dns.switch.ch/dns-query"},
+	{"CIRA Shield (CA)", "https://private.canadianshield.cira.ca/dns-query"},
+	{"IIJ (JP)", "https://public.dns.iij.jp/dns-query"},
+	{"AliDNS (CN)", "https://dns.alidns.com/dns-query"},
+	{"DNSPod (CN)", "https://doh.pub/dns-query"},
+}
+
+// propagateResult is what one resolver answered
+type propagateResult struct {
+	provider string
+	answer   string // rcode and data, what resolvers are compared by
+	ttl      int    // lowest TTL of the answer, -1 without one
+	err      error
+}
+
+// cmdPropagate asks many public resolvers the same question at once and
+// compares their answers, to follow a change as it propagates through their
+// caches
+func cmdPropagate() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optName string
+	var optType string
+	var optExpect string
+
+	fs := newFlagSet("propagate", "h53 propagate [options] -n name",
+		"Query "+fmt.Sprint(len(propagateResolvers))+" public resolvers (or those of -s) in parallel and compare their answers,"+
+			"\nflagging those still serving other (stale) data.")
+	co.register(fs)
+	fs.StringVar(&optName, "n", "",
+		"Query Name Ex.: example.com")
+	fs.StringVar(&optType, "t", "A",
+		"Query Type Ex.: AAAA")
+	fs.StringVar(&optExpect, "expect", "",
+		"The data after the change, comma separated; resolvers answering otherwise are stale"+
+			"\n(default: resolvers differing from the most common answer are) Ex.: 192.0.2.1,192.0.2.2")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if optName == "" {
+			fs.Usage()
+			return 1
+		}
+		name, qtype, err := queryFor(optName, optType)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+
+		code, _ := doh.TypeCode(qtype)
+
+		var names []string
+		if !set["s"] {
+			var ps []string
+			for _, p := range propagateResolvers {
+				names = append(names, p.name)
+				ps = append(ps, p.provider)
+			}
+			co.server = strings.Join(ps, ",")
+			if !set["wire"] && !set["method"] {
+				co.wire = true
+			}
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		ctx := signalContext()
+
+		results := make([]propagateResult, len(client.Providers))
+		var wg sync.WaitGroup
+		for i, p := range client.Providers {
+			if names != nil {
+				p.Name = names[i]
+			}
+			// One provider per lookup, no fallback hiding a stale one
+			c := *client
+			c.Providers = []doh.Provider{p}
+			c.Fallback, c.Race = false, false
+			wg.Go(func() {
+				res := propagateResult{provider: p.Name, ttl: -1}
+				jdns, err := c.Lookup(ctx, name, qtype)
+				if err != nil {
+					res.err = err
+					results[i] = res
+					return
+				}
+				// The records asked for, the CNAMEs on the way are not compared
+				var data []string
+				for _, a := range jdns.Answers {
+					if a.Type != int(code) {
+						continue
+					}
+					data = append(data, a.Data)
+					if res.ttl < 0 || a.TTL < res.ttl {
+						res.ttl = a.TTL
+					}
+				}
+				slices.Sort(data)
+				switch {
+				case data != nil:
+					res.answer = strings.Join(data, ", ")
+				case jdns.Status == 0:
+					res.answer = "NODATA"
+				default:
+					res.answer = doh.RcodeString(jdns.Status)
+				}
+				results[i] = res
+			})
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+
+		// The answer after the change: as given, else the most common one
+		want := ""
+		if optExpect != "" {
+			var data []string
+			for _, d := range strings.Split(optExpect, ",") {
+				if d = strings.TrimSpace(d); d != "" {
+					data = append(data, d)
+				}
+			}
+			slices.Sort(data)
+			want = strings.Join(data, ", ")
+		} else {
+			counts := make(map[string]int)
+			for _, res := range results {
+				if res.err == nil {
+					counts[res.answer]++
+				}
+			}
+			for _, res := range results {
+				if res.err == nil && counts[res.answer] > counts[want] {
+					want = res.answer
+				}
+			}
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "RESOLVER\tSTATE\tTTL\tANSWER")
+		current, stale, failed := 0, 0, 0
+		for _, res := range results {
+			switch {
+			case res.err != nil:
+				failed++
+				fmt.Fprintf(tw, "%s\terror\t-\t%v\n", res.provider, res.err)
+			case res.answer == want:
+				current++
+				fmt.Fprintf(tw, "%s\tok\t%s\t%s\n", res.provider, ttlString(res.ttl), res.answer)
+			default:
+				stale++
+				fmt.Fprintf(tw, "%s\tSTALE\t%s\t%s\n", res.provider, ttlString(res.ttl), res.answer)
+			}
+		}
+		tw.Flush()
+
+		if failed == len(results) {
+			fmt.Printf("All %d resolvers failed\n", failed)
+			return 3
+		}
+		fmt.Printf("%d of %d resolvers answer %s", current, len(results), want)
+		if stale != 0 {
+			fmt.Printf(", %d still serve other data", stale)
+		}
+		if failed != 0 {
+			fmt.Printf(", %d failed", failed)
+		}
+		fmt.Println()
+		if stale != 0 {
+			return exitCheckFailed
+		}
+		return 0
+	}
+}
+
+// ttlString renders a TTL, - for none
+func ttlString(ttl int) string {
+	if ttl < 0 {
+		return "-"
+	}
+	return fmt.Sprint(ttl)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// cmdQuery resolves one name (-n), or a batch of names (-f, -n -), for one
+// or more query types and prints the answers.
+func cmdQuery() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optType string
+	var optName string
+	var optFile string
+	var optConcurrency int
+	var optStream bool
+	var optOutput string
+	var optShort bool
+	var optRequireAD bool
+	var optCacheFile string
+	var optVerbose bool
+	var optWatch time.Duration
+	var optFollow bool
+	var optASCII bool
+	var optResolveMX bool
+	var optResolveSRV bool
+	var optGrep string
+	var optWildcard bool
+	var optTrace bool
+	var optEnrich bool
+	var optPTR bool
+	var optHeader bool
+	var optTemplate string
+	var optHistory string
+	var optExpect []*expectation
+	var optInteractive bool
+	var optScan string
+	var optScanTimeout time.Duration
+	var optScanConcurrency int
+	var optCompareSystem bool
+	var optServeStale time.Duration
+
+	// The usage of query is h53's own, with its options
+	fs := newFlagSet("query", "", "")
+	fs.Usage = func() {
+		usage(os.Stderr)
+		fmt.Fprint(os.Stderr, "\nQuery options:\n")
+		fs.PrintDefaults()
+	}
+
+	co.register(fs)
+	fs.BoolVar(&optInteractive, "i", false,
+		"Interactive: read lookups (Ex.: A example.com) and commands (server, verbose, history) at a prompt")
+	fs.BoolVar(&optVerbose, "v", false,
+		"Display Verbose processing")
+	fs.StringVar(&optType, "t", "",
+		"Query Type (either a numeric value or text) Ex: A, AAAA. "+
+			"\nSeveral types may be comma separated Ex: A,AAAA,MX. "+
+			"\nNote: list of types can be found here: https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-4 "+
+			"\nDefaults to PTR when the name is an IPv4/IPv6 literal.")
+	fs.StringVar(&optName, "n", "",
+		"Query Name Ex.: example.com (use - to read names from stdin)")
+	fs.StringVar(&optFile, "f", "",
+		"File with Query Names, one per line. Ex.: names.txt")
+	fs.IntVar(&optConcurrency, "c", 1,
+		"Concurrent lookups in batch mode Ex.: 32")
+	fs.BoolVar(&optStream, "stream", false,
+		"Stream batch results as they complete instead of in input order")
+	fs.StringVar(&optOutput, "o", "text",
+		"Output format: text, json, jsonl, csv, dig, short, hosts, zone, template (see -tpl)")
+	fs.StringVar(&optTemplate, "tpl", "",
+		"Go template rendering each answer (-o template) Ex.: '{{.Name}} {{type .Type}} {{.Data}}'.\n"+
+			"Fields: .Name .Type .TTL .Data .Value .Query .Response; functions: type rcode join upper lower json")
+	fs.BoolVar(&optHeader, "header", false,
+		"Print the column names first (-o csv)")
+	fs.BoolVar(&optShort, "short", false,
+		"Print only the record data, one per line (same as -o short)")
+	fs.BoolVar(&optRequireAD, "require-ad", false,
+		"Exit non-zero (6) when the answer is not DNSSEC validated (AD bit)")
+	fs.Func("expect", "Exit 0 only if the answer is as expected, 9 otherwise; repeat for each record. An address, a CIDR\n"+
+		"prefix or a regular expression of the whole record data Ex.: -expect 93.184.216.34 -expect 2606:2800::/32",
+		func(s string) error {
+			e, err := parseExpectation(s)
+			optExpect = append(optExpect, e)
+			return err
+		})
+	fs.StringVar(&optHistory, "history", "",
+		"Record every lookup (answers, RCODE, provider, latency) to this file, see h53 history Ex.: ~/.h53_history")
+	fs.StringVar(&optCacheFile, "cache-file", "",
+		"Persist cached answers (TTL honoring) across runs Ex.: h53.cache")
+	fs.DurationVar(&optServeStale, "serve-stale", 0,
+		"Answer from expired cache entries, up to this long past their TTL, when the providers fail (RFC 8767) Ex.: 24h")
+	fs.DurationVar(&optWatch, "watch", 0,
+		"Re-resolve every interval, flagging answer changes, until interrupted Ex.: 30s")
+	fs.BoolVar(&optFollow, "follow-cname", false,
+		"Query the end of CNAME chains the resolver did not complete, until an answer, a loop or 8 aliases")
+	fs.BoolVar(&optASCII, "ascii", false,
+		"Show internationalized names in their xn-- (punycode) form, not in Unicode")
+	fs.BoolVar(&optResolveMX, "resolve-mx", false,
+		"Resolve the addresses (A, AAAA) of MX exchanges too")
+	fs.BoolVar(&optResolveSRV, "resolve-srv", false,
+		"Resolve the addresses (A, AAAA) of SRV targets too")
+	fs.BoolVar(&optWildcard, "detect-wildcard", false,
+		"Probe random names in the parent zone and flag answers its wildcard would give any name")
+	fs.BoolVar(&optTrace, "trace", false,
+		"Resolve iteratively from the root servers, asking each zone's nameservers directly (port 53), like dig +trace")
+	fs.BoolVar(&optEnrich, "enrich", false,
+		"Annotate answer addresses with their origin AS, AS name and country (Team Cymru lookups, over DoH)")
+	fs.BoolVar(&optPTR, "ptr", false,
+		"Reverse resolve answer addresses (PTR) and show the names next to them")
+	fs.StringVar(&optGrep, "grep", "",
+		"Only show answers whose data matches this regular expression Ex.: ^google-site-verification=")
+	fs.StringVar(&optScan, "scan", "",
+		"After the lookup, TCP connect to these ports of every answer address and print an\n"+
+			"open/closed/filtered matrix (exit code 7 when none is open) Ex.: 80,443,22 or 8000-8010")
+	fs.DurationVar(&optScanTimeout, "scan-timeout", 2*time.Second,
+		"Time allowed for each connect of -scan; ports not answering by then are filtered")
+	fs.IntVar(&optScanConcurrency, "scan-concurrency", 32,
+		"Connects of -scan in flight at once")
+	fs.BoolVar(&optCompareSystem, "compare-system", false,
+		"Resolve the name with the system resolver too and show both answers side by side, same or different")
+	return fs, func(args []string) int {
+		flagset, cli := parseArgs(fs, args)
+
+		if optInteractive && (flagset["n"] || flagset["f"] || optWatch > 0 || optTrace) {
+			fmt.Fprint(os.Stderr, "Interactive mode (-i) reads names at its prompt, not from -n/-f, -watch or -trace.\n")
+			return 1
+		}
+		if !flagset["n"] && !flagset["f"] && !optInteractive {
+			fmt.Fprint(os.Stderr, "Query Name (-n/-f) is NOT set.\n")
+			return 1
+		}
+
+		if optConcurrency < 1 {
+			fmt.Fprint(os.Stderr, "Concurrency (-c) must be at least 1.\n")
+			return 1
+		}
+
+		if optWatch < 0 || optWatch > 0 && (flagset["f"] || optName == "-") {
+			fmt.Fprint(os.Stderr, "Watch (-watch) takes a positive interval and a single name (-n).\n")
+			return 1
+		}
+
+		if optTrace && (flagset["f"] || optName == "-" || optWatch > 0 || strings.Contains(optType, ",")) {
+			fmt.Fprint(os.Stderr, "Trace (-trace) takes a single name (-n) and type (-t).\n")
+			return 1
+		}
+
+		if optCompareSystem && (flagset["f"] || optName == "-" || optWatch > 0 || optTrace || optInteractive) {
+			fmt.Fprint(os.Stderr, "-compare-system takes a single name (-n).\n")
+			return 1
+		}
+		var ports []int
+		if optScan != "" {
+			if flagset["f"] || optName == "-" || optWatch > 0 || optTrace || optInteractive {
+				fmt.Fprint(os.Stderr, "Scan (-scan) takes a single name (-n).\n")
+				return 1
+			}
+			if optScanTimeout <= 0 || optScanConcurrency < 1 {
+				fmt.Fprint(os.Stderr, "-scan-timeout and -scan-concurrency must be positive.\n")
+				return 1
+			}
+			var err error
+			if ports, err = parsePorts(optScan); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid ports (-scan): %v\n", err)
+				return 1
+			}
+		}
+
+		if optShort {
+			if cli["o"] && optOutput != "short" {
+				fmt.Fprint(os.Stderr, "-short and -o are mutually exclusive.\n")
+				return 1
+			}
+			optOutput = "short"
+		}
+		if optTemplate != "" {
+			if cli["o"] && optOutput != "template" {
+				fmt.Fprint(os.Stderr, "-tpl and -o are mutually exclusive.\n")
+				return 1
+			}
+			optOutput = "template"
+		}
+		render, ok := printers[optOutput]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown output format (-o): %s\n", optOutput)
+			return 1
+		}
+		if optHeader && optOutput != "csv" {
+			fmt.Fprint(os.Stderr, "-header goes with -o csv.\n")
+			return 1
+		}
+		po := &printOpts{
+			verbose:   optVerbose,
+			dnssec:    co.do || co.cd || optRequireAD,
+			requireAD: optRequireAD,
+			jsonErr:   optOutput == "json",
+			ascii:     optASCII,
+			color:     optOutput == "text" && colorOutput(),
+			expect:    optExpect,
+		}
+		if optOutput == "template" {
+			if optTemplate == "" {
+				fmt.Fprint(os.Stderr, "-o template needs a template (-tpl).\n")
+				return 1
+			}
+			var err error
+			if po.tpl, err = parseTemplate(optTemplate); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid template (-tpl): %v\n", err)
+				return 1
+			}
+		}
+		if optGrep != "" {
+			var err error
+			if po.grep, err = regexp.Compile(optGrep); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid pattern (-grep): %v\n", err)
+				return 1
+			}
+		}
+
+		client, err := co.client(flagset, optConcurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, err := newCache(optCacheFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load cache file: %v\n", err)
+			return 1
+		}
+		store.maxStale = optServeStale
+		r := &resolver{ctx: signalContext(), client: client, cache: store,
+			followCNAME: optFollow, resolveMX: optResolveMX, resolveSRV: optResolveSRV,
+			detectWildcard: optWildcard, enrich: optEnrich, reversePTR: optPTR}
+		if optHistory != "" {
+			if r.history, err = openHistory(optHistory); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to open history file: %v\n", err)
+				return 1
+			}
+		}
+
+		types := splitTypes(optType)
+		po.multi = len(types) > 1
+
+		if optInteractive {
+			return exit(store, repl(r, &co, optType, render, po))
+		}
+		if optWatch > 0 {
+			return watch(r, optName, types, optWatch)
+		}
+		if optTrace {
+			return trace(r, optName, types[0])
+		}
+		if optHeader {
+			fmt.Println(strings.Join(recordColumns, ","))
+		}
+
+		if !flagset["f"] && optName != "-" {
+			var code int
+			if !po.multi {
+				if jdns, err := r.lookup(optName, types[0]); err != nil {
+					code = report(os.Stdout, optName, types[0], err, po)
+				} else {
+					code = emit(os.Stdout, optName, jdns, render, r.annotate(po, optName, types[0], jdns))
+				}
+			} else {
+				// Several types: query them all at once, output grouped by type
+				code = runBatch(r, []string{optName}, types, len(types), false, render, po)
+				connStats(client, optVerbose)
+			}
+			// Comparisons and scans stay out of machine readable output
+			w := os.Stdout
+			if optOutput != "text" {
+				w = os.Stderr
+			}
+			if optCompareSystem {
+				compareSystem(r, optName, types, w)
+			}
+			if ports != nil && code == 0 {
+				code = scan(r, optName, types, ports, optScanTimeout, optScanConcurrency, w)
+			}
+			return exit(store, code)
+		}
+
+		// Batch
+		var names []string
+
+		if flagset["f"] {
+			fh, ferr := os.Open(optFile)
+			if ferr != nil {
+				fmt.Fprintf(os.Stderr, "Unable to open names file: %v\n", ferr)
+				return 1
+			}
+			names, err = readNames(fh)
+			fh.Close()
+		} else {
+			names, err = readNames(os.Stdin)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read names: %v\n", err)
+			return 1
+		}
+
+		po.batch = true
+		code := runBatch(r, names, types, optConcurrency, optStream, render, po)
+		connStats(client, optVerbose)
+		return exit(store, code)
+	}
+}
+
+// connStats reports, with -v, how many connections a batch opened and how
+// many lookups reused one: churn shows as new connections
+func connStats(client *doh.Client, verbose bool) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, ";; Connections: %s\n", client.Conns)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// defaultLists are the DNS blocklists rbl checks unless told otherwise
+const defaultLists = "zen.spamhaus.org,bl.spamcop.net,b.barracudacentral.org"
+
+// rblResult is the verdict of one blocklist on one address or domain
+type rblResult struct {
+	list   string
+	codes  []string // the A records of a listing, 127.0.0.x
+	reason string   // the TXT record of a listing
+	err    error
+}
+
+// cmdRBL looks addresses (or domains, for domain lists such as
+// dbl.spamhaus.org) up in DNS blocklists (RFC 5782), all lists at once.
+func cmdRBL() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optLists string
+
+	fs := newFlagSet("rbl", "h53 rbl [options] address|domain ...",
+		"Check addresses (or domains) against DNS blocklists over DoH, all lists in parallel.")
+	co.register(fs)
+	fs.StringVar(&optLists, "lists", defaultLists,
+		"Blocklists to check, comma separated Ex.: zen.spamhaus.org,bl.spamcop.net")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() == 0 {
+			fs.Usage()
+			return 1
+		}
+		var lists []string
+		for _, l := range strings.Split(optLists, ",") {
+			if l = strings.Trim(strings.TrimSpace(l), "."); l != "" {
+				lists = append(lists, l)
+			}
+		}
+		if len(lists) == 0 {
+			fmt.Fprint(os.Stderr, "No blocklists (-lists) to check.\n")
+			return 1
+		}
+
+		client, err := co.client(set, len(lists))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		width := 0
+		for _, l := range lists {
+			width = max(width, len(l))
+		}
+
+		code := 0
+		for _, target := range fs.Args() {
+			results := make([]rblResult, len(lists))
+			var wg sync.WaitGroup
+			for i, list := range lists {
+				wg.Go(func() { results[i] = r.rblCheck(target, list) })
+			}
+			wg.Wait()
+
+			fmt.Println(target)
+			listed := 0
+			for _, res := range results {
+				switch {
+				case res.err != nil:
+					ec := exitCode(res.err)
+					if ec == exitInterrupted {
+						return exitInterrupted
+					}
+					fmt.Printf("  %-*s  error   %v\n", width, res.list, res.err)
+					if code == 0 {
+						code = ec
+					}
+				case res.codes == nil:
+					fmt.Printf("  %-*s  clean\n", width, res.list)
+				default:
+					listed++
+					fmt.Printf("  %-*s  LISTED  %s", width, res.list, strings.Join(res.codes, ", "))
+					if res.reason != "" {
+						fmt.Printf("  %q", res.reason)
+					}
+					fmt.Println()
+				}
+			}
+			fmt.Printf("Listed on %d of %d lists\n", listed, len(lists))
+			if listed != 0 {
+				code = exitCheckFailed
+			}
+		}
+		return code
+	}
+}
+
+// rblName is the name to query list for target: the address reversed the
+// way in-addr.arpa and ip6.arpa names are, a domain as it is
+func rblName(target string, list string) string {
+	if rname, ok := reverseName(target); ok {
+		rname = strings.TrimSuffix(rname, ".in-addr.arpa")
+		return strings.TrimSuffix(rname, ".ip6.arpa") + "." + list
+	}
+	return strings.TrimSuffix(target, ".") + "." + list
+}
+
+// rblCheck looks target up in list. NXDOMAIN means not listed; a listing
+// is an A record in 127.0.0.0/8 and usually a TXT record saying why.
+func (r *resolver) rblCheck(target string, list string) rblResult {
+
+	res := rblResult{list: list}
+	name := rblName(target, list)
+	jdns, err := r.lookup(name, "A")
+	if err == nil && jdns.Status != 3 {
+		err = jdns.Err()
+	}
+	if err != nil {
+		res.err = err
+		return res
+	}
+
+	for _, ip := range addresses(jdns) {
+		// Spamhaus answers 127.255.255.x when it refuses to: queries through
+		// public resolvers, over the limit or malformed
+		if ip.Is4() && netip.MustParsePrefix("127.255.255.0/24").Contains(ip) {
+			res.err = fmt.Errorf("%s refused the query (%s), public resolvers may not be allowed", list, ip)
+			return res
+		}
+		// Listings are in 127.0.0.0/8; anything else comes from a dead list
+		// domain or from answers being rewritten on the way
+		if !ip.IsLoopback() {
+			res.err = fmt.Errorf("%s answered %s, not a blocklist code: the list may be defunct", list, ip)
+			return res
+		}
+		res.codes = append(res.codes, ip.String())
+	}
+	if res.codes == nil {
+		return res
+	}
+
+	if txt, err := r.lookup(name, "TXT"); err == nil {
+		var reasons []string
+		for _, a := range txt.Answers {
+			if a.Type == 16 {
+				reasons = append(reasons, doh.JoinTXT(a.Data))
+			}
+		}
+		res.reason = strings.Join(reasons, "; ")
+	}
+	return res
+}
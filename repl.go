@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// replHelp lists the commands of the interactive prompt
+const replHelp = `  [type] name [type]   Look a name up Ex.: A example.com, example.com MX, 192.0.2.1
+  server provider      Switch providers, as -s takes them Ex.: server google
+  verbose [on|off]     Toggle verbose output (-v)
+  history              List this session's lookups
+  !n                   Repeat lookup n of the history
+  help                 Show this help
+  quit                 Leave (or Ctrl-D)
+`
+
+// repl reads lookups and commands from stdin until EOF, quit or an
+// interrupt, resolving through one client so its connections stay open
+// between lookups. The prompt is shown only when stdin is a terminal;
+// commands may as well be piped in.
+func repl(r *resolver, co *clientOpts, qtype string, render printer, po *printOpts) int {
+
+	prompt := ""
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		prompt = "h53> "
+		fmt.Fprintf(os.Stderr, "h53 interactive, provider %s; help lists the commands\n", providerNames(r.client))
+	}
+
+	// Lines are read apart so an interrupt ends the session at the prompt
+	// too, not only during a lookup
+	lines := make(chan string)
+	go func() {
+		in := bufio.NewScanner(os.Stdin)
+		for in.Scan() {
+			lines <- in.Text()
+		}
+		close(lines)
+	}()
+
+	var past []string // the lookups of the session, as typed
+	for {
+		fmt.Fprint(os.Stderr, prompt)
+		var line string
+		var ok bool
+		select {
+		case line, ok = <-lines:
+		case <-r.ctx.Done():
+		}
+		if !ok || r.ctx.Err() != nil {
+			if prompt != "" {
+				fmt.Fprintln(os.Stderr)
+			}
+			return 0
+		}
+		line = strings.TrimSpace(line)
+		if n, ok := strings.CutPrefix(line, "!"); ok {
+			i, err := strconv.Atoi(n)
+			if err != nil || i < 1 || i > len(past) {
+				fmt.Fprintf(os.Stderr, "No lookup %s in the history\n", n)
+				continue
+			}
+			line = past[i-1]
+			fmt.Fprintln(os.Stderr, line)
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+
+		switch strings.ToLower(f[0]) {
+		case "quit", "exit":
+			return 0
+		case "help", "?":
+			fmt.Fprint(os.Stderr, replHelp)
+			continue
+		case "history":
+			for i, l := range past {
+				fmt.Printf("%4d  %s\n", i+1, l)
+			}
+			continue
+		case "verbose":
+			switch {
+			case len(f) == 1:
+				po.verbose = !po.verbose
+			case f[1] == "on" || f[1] == "off":
+				po.verbose = f[1] == "on"
+			default:
+				fmt.Fprintln(os.Stderr, "Usage: verbose [on|off]")
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Verbose %s\n", map[bool]string{true: "on", false: "off"}[po.verbose])
+			continue
+		case "server":
+			if len(f) != 2 {
+				fmt.Fprintln(os.Stderr, "Usage: server provider")
+				continue
+			}
+			// A new client for the new providers; the cache goes with the
+			// old ones, its answers came from them
+			opts := *co
+			opts.server = f[1]
+			client, err := opts.client(map[string]bool{"s": true}, 1)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				continue
+			}
+			*co = opts
+			r.client, r.cache = client, nil
+			r.cache, _ = newCache("")
+			fmt.Fprintf(os.Stderr, "Provider %s\n", providerNames(client))
+			continue
+		}
+
+		name, types := f[0], qtype
+		switch {
+		case len(f) > 2:
+			fmt.Fprintln(os.Stderr, "Usage: [type] name [type] (help lists the commands)")
+			continue
+		case len(f) == 2 && isType(f[0]):
+			name, types = f[1], f[0]
+		case len(f) == 2:
+			types = f[1]
+		}
+		if _, ok := reverseName(name); !ok && types == "" {
+			types = "A" // the prompt's default; IP literals go on to PTR
+		}
+		past = append(past, line)
+		for _, t := range splitTypes(types) {
+			if jdns, err := r.lookup(name, t); err != nil {
+				report(os.Stdout, name, t, err, po)
+			} else {
+				emit(os.Stdout, name, jdns, render, r.annotate(po, name, t, jdns))
+			}
+		}
+	}
+}
+
+// isType reports whether s names query types (one or comma separated),
+// telling "A example.com" from "example.com A"
+func isType(s string) bool {
+	for _, t := range splitTypes(s) {
+		if _, err := doh.TypeCode(t); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// providerNames lists the providers of c, as prompts show them
+func providerNames(c *doh.Client) string {
+	names := make([]string, len(c.Providers))
+	for i, p := range c.Providers {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// reverseName builds the in-addr.arpa / ip6.arpa name for an IP literal.
+// ok is false when s is not an IP address.
+func reverseName(s string) (name string, ok bool) {
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+
+	var labels []string
+	if addr.Is4() {
+		b := addr.As4()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%d", b[i]))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa", true
+	}
+
+	// IPv6: one label per nibble, least significant first
+	b := addr.As16()
+	for i := len(b) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x", b[i]&0x0f), fmt.Sprintf("%x", b[i]>>4))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa", true
+}
+
+// queryFor resolves the effective query name and type for a user supplied name.
+// IP literals are turned into reverse names and default to PTR when no type was given;
+// internationalized names are converted to their xn-- form. Names and types
+// are checked here, so mistakes are reported before anything is sent.
+func queryFor(name string, qtype string) (string, string, error) {
+
+	if qtype != "" {
+		code, err := doh.TypeCode(qtype)
+		if err != nil {
+			return "", "", fmt.Errorf("%v (use a mnemonic such as A, AAAA, MX or a number)", err)
+		}
+		// RFC 6895 3.1: type 0 is reserved, no resolver answers it
+		if code == 0 {
+			return "", "", fmt.Errorf("query type %s is reserved (use a mnemonic such as A, AAAA, MX or a number)", qtype)
+		}
+	}
+
+	if rname, ok := reverseName(name); ok {
+		if qtype == "" {
+			qtype = "PTR"
+		}
+		return rname, qtype, nil
+	}
+
+	if qtype == "" {
+		return "", "", fmt.Errorf("query type (-t) is NOT set for %s", name)
+	}
+	aname, err := doh.ToASCII(name)
+	if err == nil {
+		err = doh.CheckName(aname)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("invalid name %s: %v", name, err)
+	}
+	return aname, qtype, nil
+}
+
+// ptrs maps the addresses among the answers of jdns to the names they
+// reverse resolve to, looked up concurrently. Addresses without PTR records,
+// or whose lookup failed, are left out.
+func (r *resolver) ptrs(jdns *doh.DNSJ) map[string][]string {
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	out := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, a := range jdns.Answers {
+		ip, err := netip.ParseAddr(a.Data)
+		if (a.Type != 1 && a.Type != 28) || err != nil || seen[a.Data] {
+			continue
+		}
+		seen[a.Data] = true
+		wg.Go(func() {
+			names, err := r.ptrNames(ip.Unmap())
+			if err != nil {
+				slog.Debug("PTR lookup failed", "address", ip, "error", err)
+			}
+			if names != nil {
+				mu.Lock()
+				out[a.Data] = names
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return out
+}
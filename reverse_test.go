@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestQueryForRejectsReservedType(t *testing.T) {
+
+	for _, qtype := range []string{"0", "TYPE0", "type0"} {
+		if _, _, err := queryFor("example.com", qtype); err == nil {
+			t.Errorf("type %s accepted", qtype)
+		}
+	}
+	for _, qtype := range []string{"A", "TYPE1", "65535"} {
+		if _, _, err := queryFor("example.com", qtype); err != nil {
+			t.Errorf("type %s: %v", qtype, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// rrsigTypes are the RRsets a signed zone cannot do without: when their
+// signatures expire, validating resolvers fail the whole zone
+const rrsigTypes = "SOA,NS,DNSKEY,DS,MX,A,AAAA"
+
+// cmdRRSIG reports when the signatures over a zone's critical RRsets expire
+// and fails when the soonest is within -window, for cron or monitoring
+// systems to catch a stalled signer before resolvers start failing the zone
+func cmdRRSIG() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optTypes string
+	var optWindow time.Duration
+
+	fs := newFlagSet("rrsig", "h53 rrsig [options] zone",
+		"Report the expiration of the RRSIGs over the zone's critical RRsets, exit 9 when the soonest\n"+
+			"is within -window (or past).")
+	co.register(fs)
+	fs.StringVar(&optTypes, "t", rrsigTypes,
+		"RRsets (types) to check, comma separated")
+	fs.DurationVar(&optWindow, "window", 7*24*time.Hour,
+		"Fail when a signature expires within this duration Ex.: 72h")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		// Checking disabled, or a validating resolver answers SERVFAIL instead
+		// of the expired signatures
+		client.DO, client.CD = true, true
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+		zone := fqdn(strings.ToLower(strings.TrimSuffix(fs.Arg(0), ".")))
+		now := time.Now()
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TYPE\tSTATE\tEXPIRES\tLEFT\tKEY")
+		var soonest doh.RRSIG
+		soonestType := ""
+		signed, unsigned := 0, 0
+		for _, qtype := range strings.Split(optTypes, ",") {
+			qtype = strings.ToUpper(strings.TrimSpace(qtype))
+			if _, err := doh.TypeCode(qtype); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			set, err := r.signedSet(zone, qtype)
+			if err != nil {
+				if code := exitCode(err); code != exitInterrupted {
+					fmt.Fprintf(os.Stderr, "%s %s: %v\n", zone, qtype, err)
+					return code
+				}
+				return exitInterrupted
+			}
+			if set.records == nil {
+				continue
+			}
+			if set.sigs == nil {
+				unsigned++
+				fmt.Fprintf(tw, "%s\tUNSIGNED\t-\t-\t-\n", qtype)
+				continue
+			}
+			// One good signature is enough for a resolver: the RRset lasts as
+			// long as the last of them
+			last := set.sigs[0]
+			for _, s := range set.sigs[1:] {
+				if s.Expiration.After(last.Expiration) {
+					last = s
+				}
+			}
+			state := "ok"
+			left := last.Expiration.Sub(now)
+			switch {
+			case left <= 0:
+				state = "EXPIRED"
+			case left <= optWindow:
+				state = "SOON"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", qtype, state, last.Expiration.Format(time.RFC3339), daysLeft(left), last.KeyTag)
+			if signed == 0 || last.Expiration.Before(soonest.Expiration) {
+				soonest, soonestType = last, qtype
+			}
+			signed++
+		}
+		tw.Flush()
+
+		if signed == 0 {
+			fmt.Printf("No RRSIG records for %s: the zone is not signed\n", zone)
+			return 4
+		}
+		left := soonest.Expiration.Sub(now)
+		switch {
+		case left <= 0:
+			fmt.Printf("EXPIRED: the %s signature of %s expired %s ago\n", soonestType, zone, daysLeft(-left))
+		case left <= optWindow:
+			fmt.Printf("EXPIRING: the %s signature of %s expires in %s, within %s\n", soonestType, zone, daysLeft(left), daysLeft(optWindow))
+		default:
+			fmt.Printf("OK: the soonest signature of %s, over %s, expires in %s\n", zone, soonestType, daysLeft(left))
+		}
+		if unsigned != 0 {
+			fmt.Printf("%d RRsets have no signature\n", unsigned)
+		}
+		if left <= optWindow || unsigned != 0 {
+			return exitCheckFailed
+		}
+		return 0
+	}
+}
+
+// daysLeft renders a duration in days and hours, the scale of signature
+// validity periods
+func daysLeft(d time.Duration) string {
+	d = d.Round(time.Hour)
+	if days := int(d / (24 * time.Hour)); days != 0 {
+		return fmt.Sprintf("%dd%dh", days, int(d%(24*time.Hour)/time.Hour))
+	}
+	return fmt.Sprintf("%dh", int(d/time.Hour))
+}
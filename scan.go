@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// scanMaxPorts caps how many ports -scan takes, it is not a port scanner
+// for whole ranges
+const scanMaxPorts = 1024
+
+// parsePorts parses the -scan list: ports and ranges, comma separated
+// (80,443,8000-8010), in the order given, without repeats
+func parsePorts(spec string) ([]int, error) {
+
+	var ports []int
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		lo, hi, isRange := strings.Cut(p, "-")
+		first, err := strconv.Atoi(lo)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(hi)
+		}
+		if err != nil || first < 1 || last > 65535 || first > last {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		for port := first; port <= last; port++ {
+			if !slices.Contains(ports, port) {
+				ports = append(ports, port)
+			}
+		}
+		if len(ports) > scanMaxPorts {
+			return nil, fmt.Errorf("more than %d ports", scanMaxPorts)
+		}
+	}
+	return ports, nil
+}
+
+// portState names what a TCP connect to a port ran into: open (connected),
+// closed (refused), filtered (no answer in time) or unreachable
+func portState(err error) string {
+
+	var ne net.Error
+	switch {
+	case err == nil:
+		return "open"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "closed"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return "filtered"
+	}
+	return "unreachable"
+}
+
+// scanPorts connects to every port of every address, workers at a time,
+// each attempt given timeout. The states are by address, then by port.
+func scanPorts(ctx context.Context, addrs []netip.Addr, ports []int, timeout time.Duration, workers int) [][]string {
+
+	states := make([][]string, len(addrs))
+	for i := range states {
+		states[i] = make([]string, len(ports))
+	}
+
+	type probe struct{ a, p int }
+	jobs := make(chan probe)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			d := net.Dialer{Timeout: timeout}
+			for j := range jobs {
+				conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addrs[j.a].String(), strconv.Itoa(ports[j.p])))
+				if err == nil {
+					conn.Close()
+				}
+				states[j.a][j.p] = portState(err)
+			}
+		})
+	}
+
+feed:
+	for a := range addrs {
+		for p := range ports {
+			select {
+			case jobs <- probe{a, p}:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return states
+}
+
+// printScan writes the address by port matrix of a scan and returns how
+// many ports were found open
+func printScan(w io.Writer, addrs []netip.Addr, ports []int, states [][]string) int {
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "ADDRESS")
+	for _, p := range ports {
+		fmt.Fprintf(tw, "\t%d", p)
+	}
+	fmt.Fprintln(tw)
+	open := 0
+	for i, a := range addrs {
+		fmt.Fprint(tw, a)
+		for _, s := range states[i] {
+			if s == "open" {
+				open++
+			}
+			fmt.Fprintf(tw, "\t%s", s)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	return open
+}
+
+// scan probes ports on the addresses name resolved to for types, as looked
+// up already (the answers come from the cache), and prints the matrix. It
+// returns 7 when no port of any address is open.
+func scan(r *resolver, name string, types []string, ports []int, timeout time.Duration, workers int, w io.Writer) int {
+
+	var addrs []netip.Addr
+	for _, qtype := range types {
+		jdns, err := r.lookup(name, qtype)
+		if err != nil {
+			continue
+		}
+		for _, a := range addresses(jdns) {
+			if a = a.Unmap(); !slices.Contains(addrs, a) {
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		fmt.Fprintf(os.Stderr, "No addresses to scan in the answers for %s\n", name)
+		return 7
+	}
+
+	states := scanPorts(r.ctx, addrs, ports, timeout, workers)
+	if r.ctx.Err() != nil {
+		return exitInterrupted
+	}
+	fmt.Fprintln(w)
+	if printScan(w, addrs, ports, states) == 0 {
+		return 7
+	}
+	return 0
+}
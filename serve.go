@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// tcpIdle is how long a TCP client may stay silent between queries
+const tcpIdle = 30 * time.Second
+
+// staleAfter is how long a query waits for the providers before it is
+// answered stale, when it can be: the client response timer of RFC 8767
+const staleAfter = 1800 * time.Millisecond
+
+// cmdServe runs a local DNS server that forwards every query over DoH, so
+// programs without DoH support (or the system resolver) can use it too.
+func cmdServe() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optListen string
+	var optMetrics string
+	var optCacheFile string
+	var optServeStale time.Duration
+	var optAdmin string
+	var optPrefetch int
+	var optMinTTL, optMaxTTL time.Duration
+	var optAllow, optDeny string
+	var optRateLimit float64
+	var optBlocklists, optAllowlists []string
+	var optBlockAnswer string
+	forwards := make(forwardRules)
+
+	fs := newFlagSet("serve", "h53 serve [options]",
+		"Answer DNS queries on -listen (UDP and TCP) by forwarding them over DoH.")
+	co.register(fs)
+	fs.StringVar(&optListen, "listen", "127.0.0.1:5353",
+		"Address to serve DNS on, UDP and TCP Ex.: 127.0.0.1:53")
+	fs.StringVar(&optAllow, "allow", "",
+		"Answer only clients of these addresses or CIDRs, comma separated; others are REFUSED\n"+
+			"(default all) Ex.: 127.0.0.1,192.168.1.0/24")
+	fs.StringVar(&optDeny, "deny", "",
+		"REFUSE clients of these addresses or CIDRs, comma separated, even if allowed Ex.: 192.168.1.66")
+	fs.Float64Var(&optRateLimit, "rate-limit", 0,
+		"Queries a second each client may send, those beyond dropped (0: no limit) Ex.: 20")
+	fs.Func("blocklist", "Answer the names of this hosts file or domain list (*.example.com for a zone) locally,\n"+
+		"instead of asking the providers; repeatable Ex.: -blocklist ads.txt",
+		func(path string) error {
+			optBlocklists = append(optBlocklists, path)
+			return nil
+		})
+	fs.Func("allowlist", "Forward the names of this hosts file or domain list even if blocklisted; repeatable Ex.: -allowlist ok.txt",
+		func(path string) error {
+			optAllowlists = append(optAllowlists, path)
+			return nil
+		})
+	fs.StringVar(&optBlockAnswer, "block-answer", "nxdomain",
+		"Answer to blocked names: nxdomain, or zero for 0.0.0.0 and :: (NODATA for other types)")
+	fs.Func("forward", "Forward the queries for a zone (and the names below it) to a plain DNS server over UDP,\n"+
+		"not the providers: zone=address[:port], comma separated or repeated Ex.: corp.example=10.0.0.53",
+		forwards.add)
+	fs.StringVar(&optMetrics, "metrics", "",
+		"Address to serve Prometheus metrics on, at /metrics Ex.: 127.0.0.1:9153")
+	fs.StringVar(&optCacheFile, "cache-file", "",
+		"Persist cached answers (TTL honoring) across runs Ex.: h53.cache")
+	fs.DurationVar(&optServeStale, "serve-stale", 0,
+		"Answer from expired cache entries, up to this long past their TTL, while the providers fail\n"+
+			"or are slow (RFC 8767), refreshing them in the background Ex.: 24h")
+	fs.IntVar(&optPrefetch, "prefetch-threshold", 0,
+		"Refresh cache entries answered from at least this many times when in the last 10% of their TTL,\n"+
+			"so popular names never wait for the providers (0: never) Ex.: 3")
+	fs.DurationVar(&optMinTTL, "min-ttl", 0,
+		"Raise the TTLs of answers served and cached to at least this Ex.: 1m")
+	fs.DurationVar(&optMaxTTL, "max-ttl", 0,
+		"Lower the TTLs of answers served and cached to at most this Ex.: 24h")
+	fs.StringVar(&optAdmin, "admin", "",
+		"Address to serve the cache admin endpoint on: GET /cache, /cache/stats, DELETE /cache[/name]\n"+
+			"(unauthenticated, keep it on loopback) Ex.: 127.0.0.1:9154")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		client, err := co.client(set, 16)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		clients, err := newACL(optAllow, optDeny, optRateLimit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		local, err := newLocalZone(conf.records)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Config file: %v\n", err)
+			return 1
+		}
+		blocked, err := newFilter(optBlocklists, optAllowlists, optBlockAnswer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, err := newCache(optCacheFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load cache file: %v\n", err)
+			return 1
+		}
+		if optMinTTL < 0 || optMaxTTL < 0 || optMaxTTL > 0 && optMinTTL > optMaxTTL {
+			fmt.Fprint(os.Stderr, "-min-ttl and -max-ttl must not be negative, nor -min-ttl above -max-ttl.\n")
+			return 1
+		}
+		store.maxStale = optServeStale
+		store.minTTL, store.maxTTL = int(optMinTTL.Seconds()), int(optMaxTTL.Seconds())
+		srv := &server{client: client, cache: store, prefetch: optPrefetch, acl: clients, local: local, filter: blocked,
+			forward: forwards}
+		if optMetrics != "" {
+			srv.metrics = newMetrics()
+			srv.metrics.cache = store
+			client.Observe = srv.metrics.observe
+			if err := serveMetrics(optMetrics, srv.metrics); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to serve metrics: %v\n", err)
+				return 1
+			}
+			slog.Info("serving metrics", "url", "http://"+optMetrics+"/metrics")
+		}
+
+		if optAdmin != "" {
+			if err := serveAdmin(optAdmin, store); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to serve the admin endpoint: %v\n", err)
+				return 1
+			}
+			slog.Info("serving cache admin", "url", "http://"+optAdmin+"/cache")
+		}
+
+		pc, err := net.ListenPacket("udp", optListen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to listen: %v\n", err)
+			return 1
+		}
+		ln, err := net.Listen("tcp", optListen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to listen: %v\n", err)
+			return 1
+		}
+		slog.Info("serving DNS", "listen", optListen, "transports", "udp,tcp")
+		if ap, err := netip.ParseAddrPort(optListen); (err != nil || !ap.Addr().IsLoopback()) && optAllow == "" {
+			slog.Warn("answering any client that reaches -listen, restrict them with -allow")
+		}
+
+		ctx := signalContext()
+		errc := make(chan error, 2)
+		go func() { errc <- srv.serveUDP(pc) }()
+		go func() { errc <- srv.serveTCP(ln) }()
+		select {
+		case err = <-errc:
+			slog.Error("server stopped", "error", err)
+			return exit(store, 3)
+		case <-ctx.Done():
+		}
+
+		// Stop taking queries, let those being resolved get their answer
+		pc.Close()
+		ln.Close()
+		srv.drain()
+		slog.Info("server stopped", "connections_new", client.Conns.New.Load(), "connections_reused", client.Conns.Reused.Load())
+		return exit(store, 0)
+	}
+}
+
+// server forwards wireformat queries to the DoH client
+type server struct {
+	client  *doh.Client
+	cache   *cache    // responses, by question (see msgKey)
+	metrics *metrics  // nil without -metrics
+	acl     *acl      // nil without -allow, -deny and -rate-limit
+	local   localZone // the config's records, answered before anything else
+	filter  *filter   // nil without -blocklist
+	forward forwardRules
+
+	prefetch int // hits that make an entry worth refreshing before it expires (-prefetch-threshold)
+
+	flights flightGroup[[]byte] // upstream queries in flight, by msgKey
+
+	mu       sync.Mutex
+	draining bool
+	inflight sync.WaitGroup // queries being answered
+}
+
+// begin registers a query about to be answered, unless the server is
+// shutting down. end must follow when it returns true.
+func (s *server) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+func (s *server) end() { s.inflight.Done() }
+
+// drain refuses new queries and waits for those in flight
+func (s *server) drain() {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	s.inflight.Wait()
+}
+
+// answer resolves one query message. Upstream failures are answered with
+// SERVFAIL; nil means the query was too mangled to answer at all.
+func (s *server) answer(query []byte, from net.Addr) []byte {
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.client.Timeout)
+	defer cancel()
+	ctx, span := doh.StartSpan(s.client.Tracer, ctx, "h53.serve", doh.Attr{Key: "client.address", Value: from.String()})
+	defer span.End(nil)
+
+	// Denied clients learn so, those over their rate get nothing back: no
+	// reply to amplify with spoofed sources
+	switch reason := s.acl.check(clientAddr(from)); reason {
+	case "":
+	case "denied":
+		s.metrics.refuse(reason)
+		slog.Debug("client denied", "client", from)
+		resp, _ := doh.Reply(query, 5, false)
+		return resp
+	default:
+		s.metrics.refuse(reason)
+		slog.Debug("client over its rate limit", "client", from)
+		return nil
+	}
+
+	var err error
+	key := msgKey(query)
+	resp := s.local.reply(query)
+	if resp == nil {
+		if resp = s.filter.reply(query); resp != nil {
+			s.metrics.block()
+		}
+	}
+	answered := resp != nil
+	if !answered && key != "" {
+		resp, answered = s.cache.getMsg(key, false)
+		if answered && s.cache.prefetchDue(key, s.prefetch) {
+			s.refresh(query, key)
+		}
+	}
+	if !answered {
+		resp, err = s.resolve(ctx, query, key, from)
+	}
+	if err != nil {
+		slog.Warn("upstream failed, answering SERVFAIL", "client", from, "error", err)
+		resp, err = doh.Reply(query, 2, false)
+		if err != nil {
+			return nil
+		}
+	}
+	// DoH servers may rewrite the ID, the client expects its own back
+	if len(resp) >= 2 && len(query) >= 2 {
+		copy(resp[:2], query[:2])
+	}
+	if s.metrics != nil && len(resp) >= 4 {
+		qtype := "?"
+		if q, err := doh.UnpackMsg(query); err == nil && len(q.Questions) != 0 {
+			qtype = doh.TypeString(q.Questions[0].Type)
+		}
+		s.metrics.query(qtype, doh.RcodeString(int(resp[3]&0x0F)))
+	}
+	slog.Debug("answered", "client", from, "query_bytes", len(query), "answer_bytes", len(resp))
+	return resp
+}
+
+// msgKey is the cache key of a query message: its question, and the bits
+// that change the answer. Queries of more than one question go uncached ("").
+func msgKey(query []byte) string {
+
+	q, err := doh.UnpackMsg(query)
+	if err != nil || len(q.Questions) != 1 {
+		return ""
+	}
+	k := cacheKey(q.Questions[0].Name, doh.TypeString(q.Questions[0].Type)) + "+msg"
+	if doh.DNSSECOK(query) {
+		k += "+do"
+	}
+	if q.CD {
+		k += "+cd"
+	}
+	return k
+}
+
+// resolve forwards query to the providers, unless the same is being asked
+// already, and caches the response. While they fail (SERVFAIL included),
+// or take longer than staleAfter, it answers from an expired entry if the
+// cache keeps one (-serve-stale); the lookup then goes on in the background
+// and refreshes the entry when it succeeds.
+func (s *server) resolve(ctx context.Context, query []byte, key string, from net.Addr) ([]byte, error) {
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// Not bound to ctx: the lookup outlives an answer given stale
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.client.Timeout)
+		defer cancel()
+		exchange := func() ([]byte, error) { return s.exchange(ctx, query, key) }
+		if key == "" {
+			resp, err := exchange()
+			done <- result{resp, err}
+			return
+		}
+		// Clients asking the same at once get one upstream query between
+		// them, each a copy of its answer (answer rewrites the ID)
+		resp, err, shared := s.flights.do(key, exchange)
+		if shared {
+			s.metrics.coalesce()
+		}
+		done <- result{bytes.Clone(resp), err}
+	}()
+
+	var slow <-chan time.Time
+	if key != "" && s.cache.maxStale > 0 {
+		slow = time.After(staleAfter)
+	}
+	for {
+		select {
+		case res := <-done:
+			servfail := len(res.resp) >= 4 && res.resp[3]&0x0F == 2
+			if (res.err != nil || servfail) && key != "" {
+				if stale, ok := s.cache.getMsg(key, true); ok {
+					reason := "SERVFAIL"
+					if res.err != nil {
+						reason = res.err.Error()
+					}
+					slog.Warn("upstream failed, answering stale", "client", from, "reason", reason)
+					return stale, nil
+				}
+			}
+			return res.resp, res.err
+		case <-slow:
+			if stale, ok := s.cache.getMsg(key, true); ok {
+				slog.Info("upstream slow, answering stale while refreshing", "client", from)
+				return stale, nil
+			}
+			slow = nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// exchange forwards query to the providers, or the server of its zone
+// (-forward), and caches the response under key, unless "" or truncated.
+// Its TTLs come back within -min-ttl and -max-ttl, as when answered from
+// the cache.
+func (s *server) exchange(ctx context.Context, query []byte, key string) ([]byte, error) {
+
+	var resp []byte
+	var err error
+	if server, ok := s.forward.match(query); ok {
+		resp, err = forward(ctx, server, query)
+	} else {
+		resp, err = s.client.Exchange(ctx, query)
+	}
+	if err == nil {
+		resp = s.cache.clampMsg(resp)
+	}
+	if err == nil && key != "" {
+		if jdns, uerr := doh.UnpackMsg(resp); uerr == nil && !jdns.TC {
+			s.cache.putMsg(key, resp, jdns)
+		}
+	}
+	return resp, err
+}
+
+// refresh looks up query again in the background to replace its cache
+// entry before it expires (see prefetchDue). Shutdown waits for it, as for
+// the queries being answered.
+func (s *server) refresh(query []byte, key string) {
+
+	if !s.begin() {
+		return
+	}
+	go func() {
+		defer s.end()
+		ctx, cancel := context.WithTimeout(context.Background(), s.client.Timeout)
+		defer cancel()
+		_, err, _ := s.flights.do(key, func() ([]byte, error) { return s.exchange(ctx, query, key) })
+		if err != nil {
+			slog.Warn("prefetch failed", "key", key, "error", err)
+			return
+		}
+		s.cache.prefetches.Add(1)
+		slog.Debug("prefetched", "key", key)
+	}()
+}
+
+// serveUDP answers datagrams until pc fails. Answers larger than the
+// client accepts are replaced by a truncated reply, so it retries over TCP.
+func (s *server) serveUDP(pc net.PacketConn) error {
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		if !s.begin() {
+			continue
+		}
+		go func() {
+			defer s.end()
+			resp := s.answer(query, from)
+			if resp == nil {
+				return
+			}
+			if len(resp) > doh.UDPSize(query) {
+				if resp, _ = doh.Reply(query, int(resp[3]&0x0F), true); resp == nil {
+					return
+				}
+			}
+			pc.WriteTo(resp, from)
+		}()
+	}
+}
+
+// serveTCP accepts connections until ln fails
+func (s *server) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers the length prefixed queries of one TCP connection, in
+// order, until the client goes away or stays idle for too long.
+func (s *server) serveConn(conn net.Conn) {
+
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdle))
+		var n uint16
+		if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("connection closed", "client", conn.RemoteAddr(), "error", err)
+			}
+			return
+		}
+		query := make([]byte, n)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		if !s.begin() {
+			return
+		}
+		ok := s.reply(conn, query)
+		s.end()
+		if !ok {
+			return
+		}
+	}
+}
+
+// reply answers query on conn, reporting whether the connection is still usable
+func (s *server) reply(conn net.Conn, query []byte) bool {
+	resp := s.answer(query, conn.RemoteAddr())
+	if resp == nil {
+		return false
+	}
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+	_, err := conn.Write(append(frame, resp...))
+	return err == nil
+}
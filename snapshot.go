@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// snapshot is what h53 snapshot save writes: the answers of a list of
+// names and types at one time, which compare resolves again
+type snapshot struct {
+	Time    time.Time       `json:"time"`
+	Lookups []*historyEntry `json:"lookups"`
+}
+
+// cmdSnapshot saves the answers of a list of names and types to a file, or
+// compares the answers of now with a saved snapshot
+func cmdSnapshot() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optFile string
+	var optTTL bool
+
+	fs := newFlagSet("snapshot", "h53 snapshot save [options] -f names.txt snapshot.json\n  h53 snapshot compare [options] snapshot.json",
+		"save resolves the names of -f (lines of: name [types], types default to A) and writes their\n"+
+			"answers to the snapshot file. compare resolves the names of the snapshot again and prints the\n"+
+			"records removed (-), added (+) and changed (~), and RCODE changes; exits 9 when anything drifted.")
+	co.register(fs)
+	fs.StringVar(&optFile, "f", "",
+		"File with names to save, one per line Ex.: example.com A,AAAA")
+	fs.BoolVar(&optTTL, "ttl", false,
+		"Compare TTLs too (caches count TTLs down, so they differ between most lookups)")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 2 || (fs.Arg(0) == "save") != (optFile != "") {
+			fs.Usage()
+			return 1
+		}
+		action, path := fs.Arg(0), fs.Arg(1)
+		if action != "save" && action != "compare" {
+			fmt.Fprintf(os.Stderr, "Unknown snapshot action: %s (use save or compare)\n", action)
+			return 1
+		}
+
+		var saved *snapshot
+		var targets []*monitorTarget
+		if action == "save" {
+			var err error
+			if targets, err = readTargets(optFile); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to read names: %v\n", err)
+				return 1
+			}
+		} else {
+			var err error
+			if saved, err = readSnapshot(path); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to read snapshot: %v\n", err)
+				return 1
+			}
+			for _, e := range saved.Lookups {
+				targets = append(targets, &monitorTarget{name: e.Name, qtype: e.Type})
+			}
+		}
+
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		ctx := signalContext()
+
+		// Lookups that fail are reported and leave the snapshot (or the
+		// comparison) without the target: a transient error is not an answer
+		code := 0
+		cur := &snapshot{Time: time.Now().UTC()}
+		failed := make(map[string]bool) // name and type
+		for _, t := range targets {
+			jdns, err := client.Lookup(ctx, t.name, t.qtype)
+			if ctx.Err() != nil {
+				return exitInterrupted
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s %s: %v\n", t.name, t.qtype, err)
+				if code == 0 {
+					code = exitCode(err)
+				}
+				failed[fqdn(strings.ToLower(t.name))+" "+strings.ToUpper(t.qtype)] = true
+				continue
+			}
+			cur.Lookups = append(cur.Lookups, newHistoryEntry(t.name, t.qtype, jdns, nil))
+		}
+
+		if action == "save" {
+			if err := writeSnapshot(path, cur); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to write snapshot: %v\n", err)
+				return 1
+			}
+			fmt.Printf("Saved %d of %d lookups to %s\n", len(cur.Lookups), len(targets), path)
+			return code
+		}
+
+		old, now := newResultSet(), newResultSet()
+		for _, e := range saved.Lookups {
+			if failed[e.Name+" "+e.Type] {
+				continue
+			}
+			jdns, _ := e.dnsj() // types checked by readSnapshot
+			old.add(jdns)
+		}
+		for _, e := range cur.Lookups {
+			jdns, _ := e.dnsj()
+			now.add(jdns)
+		}
+		changes := old.changes(now, optTTL)
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+		if len(changes) != 0 {
+			return exitCheckFailed
+		}
+		if code == 0 {
+			fmt.Printf("%d lookups match the snapshot of %s\n", len(cur.Lookups), saved.Time.Local().Format(time.DateTime))
+		}
+		return code
+	}
+}
+
+// readSnapshot loads the snapshot file at path
+func readSnapshot(path string) (*snapshot, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(content, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v (expected h53 snapshot save output)", path, err)
+	}
+	if len(s.Lookups) == 0 {
+		return nil, fmt.Errorf("%s: no lookups", path)
+	}
+	for _, e := range s.Lookups {
+		if _, err := doh.TypeCode(e.Type); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, e.Name, err)
+		}
+	}
+	return &s, nil
+}
+
+// writeSnapshot writes s to path, indented so snapshots diff well under
+// version control
+func writeSnapshot(path string, s *snapshot) error {
+
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
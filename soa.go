@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// soaResult is what one nameserver address answered for the zone's SOA
+type soaResult struct {
+	ns   string
+	addr netip.Addr
+	soa  doh.SOA
+	err  error
+}
+
+// cmdSOA compares the SOA serial every nameserver of a zone serves, asking
+// them directly, to find secondaries lagging behind the primary
+func cmdSOA() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+
+	fs := newFlagSet("soa", "h53 soa [options] zone",
+		"Look up the nameservers of zone over DoH, ask each of them (directly, port 53) for the SOA and compare serials.")
+	co.register(fs)
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+		zone := strings.TrimSuffix(fs.Arg(0), ".")
+
+		nsSet, err := r.lookup(zone, "NS")
+		if err == nil {
+			err = nsSet.Err()
+		}
+		var servers []string
+		if err == nil {
+			for _, a := range nsSet.Answers {
+				if a.Type == 2 {
+					servers = append(servers, a.Data)
+				}
+			}
+			slices.Sort(servers)
+			if servers == nil {
+				err = fmt.Errorf("no NS records at %s, not a zone", zone)
+			}
+		}
+		if err != nil {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				if code == 0 {
+					code = 4
+				}
+				return code
+			}
+			return exitInterrupted
+		}
+
+		// The serial the resolver has cached, for reference
+		if jdns, err := r.lookup(zone, "SOA"); err == nil {
+			for _, a := range jdns.Answers {
+				if s, err := doh.ParseSOA(a.Data); a.Type == 6 && err == nil {
+					fmt.Printf("%s: serial %d through DoH, primary %s\n", zone, s.Serial, s.MName)
+				}
+			}
+		}
+
+		var results []soaResult
+		for _, ns := range servers {
+			addrs, err := r.forwardAddrs(strings.TrimSuffix(ns, "."))
+			if err == nil && addrs == nil {
+				err = fmt.Errorf("no addresses")
+			}
+			if err != nil {
+				if exitCode(err) == exitInterrupted {
+					return exitInterrupted
+				}
+				results = append(results, soaResult{ns: ns, err: err})
+				continue
+			}
+			for _, addr := range addrs {
+				results = append(results, soaResult{ns: ns, addr: addr})
+			}
+		}
+
+		var wg sync.WaitGroup
+		for i := range results {
+			if results[i].err != nil {
+				continue
+			}
+			wg.Go(func() {
+				res := &results[i]
+				res.soa, res.err = directSOA(r.ctx, res.addr, zone, client.Timeout)
+			})
+		}
+		wg.Wait()
+		if r.ctx.Err() != nil {
+			return exitInterrupted
+		}
+
+		var latest uint32
+		answered := 0
+		for _, res := range results {
+			if res.err == nil && (answered == 0 || doh.SerialBefore(latest, res.soa.Serial)) {
+				latest = res.soa.Serial
+			}
+			if res.err == nil {
+				answered++
+			}
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAMESERVER\tADDRESS\tSTATE\tSERIAL")
+		lagging := 0
+		for _, res := range results {
+			addr := "-"
+			if res.addr.IsValid() {
+				addr = res.addr.String()
+			}
+			switch {
+			case res.err != nil:
+				fmt.Fprintf(tw, "%s\t%s\terror\t%v\n", res.ns, addr, res.err)
+			case res.soa.Serial != latest:
+				lagging++
+				fmt.Fprintf(tw, "%s\t%s\tLAGGING\t%d (%d behind)\n", res.ns, addr, res.soa.Serial, latest-res.soa.Serial)
+			default:
+				fmt.Fprintf(tw, "%s\t%s\tok\t%d\n", res.ns, addr, res.soa.Serial)
+			}
+		}
+		tw.Flush()
+
+		if answered == 0 {
+			fmt.Printf("None of the %d nameserver addresses answered\n", len(results))
+			return 3
+		}
+		fmt.Printf("%d of %d nameserver addresses serve serial %d", answered-lagging, len(results), latest)
+		if lagging != 0 {
+			fmt.Printf(", %d lag behind", lagging)
+		}
+		if failed := len(results) - answered; failed != 0 {
+			fmt.Printf(", %d failed", failed)
+		}
+		fmt.Println()
+		if lagging != 0 {
+			return exitCheckFailed
+		}
+		return 0
+	}
+}
+
+// directSOA asks the nameserver at addr for the SOA of zone. Anything but an
+// authoritative looking answer (an error RCODE, a referral, no SOA) is an
+// error: the server is lame.
+func directSOA(ctx context.Context, addr netip.Addr, zone string, timeout time.Duration) (doh.SOA, error) {
+
+	jdns, _, err := directQuery(ctx, addr, zone, 6, timeout)
+	if err != nil {
+		return doh.SOA{}, err
+	}
+	if jdns.Status != 0 {
+		return doh.SOA{}, fmt.Errorf("%s, not serving the zone", doh.RcodeString(jdns.Status))
+	}
+	for _, a := range jdns.Answers {
+		if s, err := doh.ParseSOA(a.Data); a.Type == 6 && err == nil {
+			return s, nil
+		}
+	}
+	return doh.SOA{}, fmt.Errorf("no SOA in the answer, not serving the zone")
+}
+
+// directQuery asks the nameserver at addr, without recursion, over plain
+// DNS: UDP, then TCP when the answer is truncated. It returns the response
+// and its size.
+func directQuery(ctx context.Context, addr netip.Addr, name string, qtype uint16, timeout time.Duration) (*doh.DNSJ, int, error) {
+
+	id := uint16(rand.Uint32())
+	msg, err := doh.PackQuery(&doh.WireQuery{ID: id, Name: name, Type: qtype, NoRecurse: true})
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	server := netip.AddrPortFrom(addr, 53)
+	reply, err := directExchange(ctx, "udp", server, id, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	jdns, err := doh.UnpackMsg(reply)
+	if err == nil && jdns.TC {
+		if reply, err = directExchange(ctx, "tcp", server, id, msg); err != nil {
+			return nil, 0, err
+		}
+		jdns, err = doh.UnpackMsg(reply)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return jdns, len(reply), nil
+}
+
+// directExchange sends msg to server over network (udp or tcp) and returns
+// the reply with message ID id
+func directExchange(ctx context.Context, network string, server netip.AddrPort, id uint16, msg []byte) ([]byte, error) {
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		// Two byte length prefix (RFC 1035 4.2.2)
+		msg = append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	if network == "tcp" {
+		var n [2]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return nil, err
+		}
+		reply := make([]byte, int(n[0])<<8|int(n[1]))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Stray datagrams (late replies, spoofing attempts) are skipped
+		if n >= 12 && uint16(buf[0])<<8|uint16(buf[1]) == id {
+			return buf[:n], nil
+		}
+	}
+}
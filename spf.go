@@ -0,0 +1,404 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// SPF (RFC 7208) evaluation is bounded: at most 10 terms may cause DNS
+// lookups (include, a, mx, ptr, exists, redirect) and at most 2 of those
+// may come back empty. Records over either limit fail with permerror.
+const (
+	spfMaxLookups = 10
+	spfMaxVoid    = 2
+	spfMaxMX      = 10 // exchanges looked at per mx term
+	spfChunk      = 255
+)
+
+// cmdSPF expands the SPF record of a domain (see spfWalker)
+func cmdSPF() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optFlatten bool
+
+	fs := newFlagSet("spf", "h53 spf [options] domain",
+		"Expand the SPF record of domain over DoH: includes and redirects, and its DNS lookup count.")
+	co.register(fs)
+	fs.BoolVar(&optFlatten, "flatten", false,
+		"Also print the record with includes, a and mx resolved to ip4/ip6 terms")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		domain := strings.TrimSuffix(fs.Arg(0), ".")
+		s := &spfWalker{r: r, out: os.Stdout, stack: make(map[string]bool)}
+		found, err := s.expand(domain)
+		if err != nil {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return code
+			}
+			return exitInterrupted
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "No SPF record for %s\n", domain)
+			return 4
+		}
+
+		fmt.Printf("DNS lookups: %d of %d, void lookups: %d of %d\n",
+			s.lookups, spfMaxLookups, s.voids, spfMaxVoid)
+		for _, p := range s.problems {
+			fmt.Printf("permerror: %s\n", p)
+		}
+
+		if optFlatten {
+			flat := s.flattened()
+			fmt.Printf("Flattened (%d DNS lookups, %d bytes):\n%s\n", s.kept, len(flat), txtChunks(flat))
+			for _, t := range s.unflattened {
+				fmt.Fprintf(os.Stderr, "Kept as is, cannot be flattened: %s\n", t)
+			}
+		}
+		if len(s.problems) != 0 {
+			return exitCheckFailed
+		}
+		return 0
+	}
+}
+
+// spfWalker expands an SPF record and the records it includes or redirects
+// to, printing each as it goes. It counts DNS lookups the way a receiving
+// mail server would and collects what a flattened record needs: the
+// addresses that pass, in order.
+type spfWalker struct {
+	r     *resolver
+	out   io.Writer       // where the expansion is printed
+	stack map[string]bool // domains being expanded, to catch loops
+
+	lookups  int
+	voids    int
+	problems []string
+
+	flat        []string // ip4/ip6 terms and those kept verbatim, in order
+	unflattened []string // terms kept verbatim (ptr, exists, macros)
+	kept        int      // DNS lookups the flattened record still makes
+	all         string   // the top level all term
+	exp         string   // the top level exp modifier
+}
+
+// expand walks the record of domain and checks the lookup limits. It
+// reports whether domain has a record.
+func (s *spfWalker) expand(domain string) (bool, error) {
+	found, err := s.walk(domain, "", 0, true)
+	if s.lookups > spfMaxLookups {
+		s.permerror("too many DNS lookups")
+	}
+	if s.voids > spfMaxVoid {
+		s.permerror("too many void lookups")
+	}
+	return found, err
+}
+
+func (s *spfWalker) permerror(format string, a ...any) {
+	s.problems = append(s.problems, fmt.Sprintf(format, a...))
+}
+
+// record fetches the SPF record of domain, "" when it has none
+func (s *spfWalker) record(domain string) (string, error) {
+
+	jdns, err := s.r.lookup(domain, "TXT")
+	if err != nil {
+		return "", err
+	}
+	if jdns.Status != 3 {
+		if err := jdns.Err(); err != nil {
+			return "", err
+		}
+	}
+	var records []string
+	for _, a := range jdns.Answers {
+		v := doh.JoinTXT(a.Data)
+		if a.Type == 16 && (strings.EqualFold(v, "v=spf1") || hasPrefixFold(v, "v=spf1 ")) {
+			records = append(records, v)
+		}
+	}
+	if len(records) > 1 {
+		s.permerror("%s: %d SPF records, one is allowed", domain, len(records))
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	return records[0], nil
+}
+
+// walk expands the record of domain, reached through term via, at depth
+// levels of include/redirect. Only passing addresses are collected for
+// flattening below the top level: a fail inside an include merely means
+// the include does not match. It reports whether domain has a record.
+func (s *spfWalker) walk(domain string, via string, depth int, top bool) (bool, error) {
+
+	indent := strings.Repeat("  ", depth)
+	key := strings.ToLower(domain)
+	if s.stack[key] {
+		fmt.Fprintf(s.out, "%s%s: loop\n", indent, via)
+		s.permerror("%s: include loop", domain)
+		return true, nil
+	}
+	rec, err := s.record(domain)
+	if err != nil {
+		return false, err
+	}
+	if rec == "" {
+		if depth != 0 {
+			fmt.Fprintf(s.out, "%s%s: no SPF record\n", indent, via)
+			s.permerror("%s: no SPF record for %s", via, domain)
+		}
+		return false, nil
+	}
+	if via == "" {
+		fmt.Fprintf(s.out, "%s: %s\n", domain, rec)
+	} else {
+		fmt.Fprintf(s.out, "%s%s: %s\n", indent, via, rec)
+	}
+
+	s.stack[key] = true
+	defer delete(s.stack, key)
+
+	var redirect string
+	hasAll := false
+	for _, term := range strings.Fields(rec)[1:] {
+		qual := "+"
+		if strings.ContainsRune("+-~?", rune(term[0])) {
+			qual, term = term[:1], term[1:]
+		}
+		name, arg := splitSPFTerm(term)
+		pass := qual == "+"
+		keep := func() {
+			s.unflattened = append(s.unflattened, qualified(qual, term))
+			s.flat = append(s.flat, qualified(qual, term))
+		}
+
+		switch name {
+		case "all":
+			hasAll = true
+			if top {
+				s.all = qualified(qual, term)
+			}
+		case "ip4", "ip6":
+			if pass || top {
+				s.flat = append(s.flat, qualified(qual, strings.ToLower(term)))
+			}
+		case "include":
+			s.lookups++
+			if strings.Contains(arg, "%") || !pass {
+				s.kept++
+				keep()
+				continue
+			}
+			if _, err := s.walk(arg, term, depth+1, false); err != nil {
+				return true, err
+			}
+		case "a", "mx":
+			s.lookups++
+			if strings.Contains(arg, "%") {
+				s.kept++
+				keep()
+				continue
+			}
+			host, v4, v6 := splitSPFCIDR(arg, domain)
+			addrs, err := s.addresses(name, host)
+			if err != nil {
+				return true, err
+			}
+			if len(addrs) == 0 {
+				s.voids++
+			}
+			if pass || top {
+				s.flat = append(s.flat, spfNets(qual, addrs, v4, v6)...)
+			}
+		case "ptr", "exists":
+			s.lookups++
+			s.kept++
+			keep()
+		case "redirect":
+			redirect = arg
+		case "exp":
+			if top {
+				s.exp = term
+			}
+		default:
+			if !strings.Contains(term, "=") {
+				s.permerror("%s: unknown mechanism %s", domain, term)
+			}
+		}
+	}
+
+	// redirect only applies to records without an all term, and the target
+	// record takes the place of this one
+	if redirect != "" && !hasAll {
+		s.lookups++
+		if strings.Contains(redirect, "%") {
+			s.kept++
+			s.unflattened = append(s.unflattened, "redirect="+redirect)
+			s.flat = append(s.flat, "redirect="+redirect)
+			return true, nil
+		}
+		_, err := s.walk(redirect, "redirect="+redirect, depth+1, top)
+		return true, err
+	}
+	return true, nil
+}
+
+// addresses resolves host for an a or mx term
+func (s *spfWalker) addresses(mech string, host string) ([]netip.Addr, error) {
+
+	hosts := []string{host}
+	if mech == "mx" {
+		jdns, err := s.r.lookup(host, "MX")
+		if err != nil {
+			return nil, err
+		}
+		hosts = nil
+		for _, a := range sortAnswers(jdns).Answers {
+			if mx, err := doh.ParseMX(a.Data); a.Type == 15 && err == nil && mx.Exchange != "." {
+				hosts = append(hosts, mx.Exchange)
+			}
+		}
+		if len(hosts) > spfMaxMX {
+			s.permerror("mx:%s: %d exchanges, at most %d are looked at", host, len(hosts), spfMaxMX)
+			hosts = hosts[:spfMaxMX]
+		}
+	}
+
+	var addrs []netip.Addr
+	for _, h := range hosts {
+		for _, qtype := range []string{"A", "AAAA"} {
+			jdns, err := s.r.lookup(h, qtype)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, addresses(jdns)...)
+		}
+	}
+	return addrs, nil
+}
+
+// flattened is the top level record with every include, a and mx turned
+// into the ip4/ip6 terms they amount to
+func (s *spfWalker) flattened() string {
+	terms := []string{"v=spf1"}
+	for _, t := range s.flat {
+		if !slices.Contains(terms, t) {
+			terms = append(terms, t)
+		}
+	}
+	if s.exp != "" {
+		terms = append(terms, s.exp)
+	}
+	if s.all != "" {
+		terms = append(terms, s.all)
+	}
+	return strings.Join(terms, " ")
+}
+
+// splitSPFTerm splits a mechanism or modifier into its name, lowercased,
+// and its domain or value
+func splitSPFTerm(term string) (string, string) {
+	i := strings.IndexAny(term, ":=/")
+	if i < 0 {
+		return strings.ToLower(term), ""
+	}
+	if term[i] == '/' {
+		return strings.ToLower(term[:i]), term[i:]
+	}
+	return strings.ToLower(term[:i]), term[i+1:]
+}
+
+// splitSPFCIDR splits the argument of an a or mx term ("example.com/24//64")
+// into the domain, current when absent, and the IPv4 and IPv6 prefix lengths
+func splitSPFCIDR(arg string, current string) (string, int, int) {
+	v4, v6 := 32, 128
+	host := arg
+	if i := strings.Index(arg, "//"); i >= 0 {
+		if n, err := strconv.Atoi(arg[i+2:]); err == nil {
+			v6 = n
+		}
+		host = arg[:i]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		if n, err := strconv.Atoi(host[i+1:]); err == nil {
+			v4 = n
+		}
+		host = host[:i]
+	}
+	if host == "" {
+		host = current
+	}
+	return host, v4, v6
+}
+
+// spfNets renders addrs as ip4/ip6 terms with the given prefix lengths
+func spfNets(qual string, addrs []netip.Addr, v4 int, v6 int) []string {
+	var terms []string
+	for _, ip := range addrs {
+		bits, mech := v4, "ip4:"
+		if ip.Is6() {
+			bits, mech = v6, "ip6:"
+		}
+		p, err := ip.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		t := mech + p.String()
+		if p.Bits() == ip.BitLen() {
+			t = mech + ip.String()
+		}
+		terms = append(terms, qualified(qual, t))
+	}
+	return terms
+}
+
+// qualified prefixes term with its qualifier, unless it is the default +
+func qualified(qual string, term string) string {
+	if qual == "+" {
+		return term
+	}
+	return qual + term
+}
+
+func hasPrefixFold(s string, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// txtChunks renders a TXT value as quoted strings of at most 255 bytes,
+// split between terms where possible
+func txtChunks(v string) string {
+	var chunks []string
+	for len(v) > spfChunk {
+		i := strings.LastIndexByte(v[:spfChunk], ' ')
+		if i <= 0 {
+			i = spfChunk - 1
+		}
+		chunks = append(chunks, strconv.Quote(v[:i+1]))
+		v = v[i+1:]
+	}
+	return strings.Join(append(chunks, strconv.Quote(v)), " ")
+}
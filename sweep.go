@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// sweepMaxBits caps the size of a sweep at 2^16 addresses (a /16 of IPv4,
+// a /112 of IPv6)
+const sweepMaxBits = 16
+
+// cmdSweep looks up the PTR records of every address in a CIDR range, with
+// -c lookups in flight, and prints a table of the addresses that have names
+func cmdSweep() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optConcurrency int
+	var optAll bool
+
+	fs := newFlagSet("sweep", "h53 sweep [options] cidr",
+		"Reverse resolve (PTR) every address of a CIDR range over DoH and print the names found.")
+	co.register(fs)
+	fs.IntVar(&optConcurrency, "c", 16,
+		"Lookups in flight at once")
+	fs.BoolVar(&optAll, "all", false,
+		"List addresses without names too")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		prefix, err := netip.ParsePrefix(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid range, expected CIDR notation Ex.: 192.0.2.0/24: %v\n", err)
+			return 1
+		}
+		prefix = prefix.Masked()
+		if bits := prefix.Addr().BitLen() - prefix.Bits(); bits > sweepMaxBits {
+			fmt.Fprintf(os.Stderr, "Range %s is too large (2^%d addresses), at most 2^%d are swept\n", prefix, bits, sweepMaxBits)
+			return 1
+		}
+		if optConcurrency < 1 {
+			fmt.Fprint(os.Stderr, "Concurrency (-c) must be at least 1.\n")
+			return 1
+		}
+
+		var addrs []netip.Addr
+		for a := prefix.Addr(); a.IsValid() && prefix.Contains(a); a = a.Next() {
+			addrs = append(addrs, a)
+		}
+
+		client, err := co.client(set, optConcurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+
+		// Results are kept by position, so the table comes out in address order
+		names := make([][]string, len(addrs))
+		var mu sync.Mutex // serializes error output and the counter
+		failed := 0
+
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		for range optConcurrency {
+			wg.Go(func() {
+				for i := range jobs {
+					ptr, err := r.ptrNames(addrs[i])
+					if err != nil {
+						mu.Lock()
+						if exitCode(err) != exitInterrupted {
+							failed++
+							fmt.Fprintf(os.Stderr, "%s: %v\n", addrs[i], err)
+						}
+						mu.Unlock()
+						continue
+					}
+					names[i] = ptr
+				}
+			})
+		}
+
+	feed:
+		for i := range addrs {
+			select {
+			case jobs <- i:
+			case <-r.ctx.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		if r.ctx.Err() != nil {
+			return exitInterrupted
+		}
+
+		width := 0
+		for _, a := range addrs {
+			width = max(width, len(a.String()))
+		}
+		found := 0
+		for i, a := range addrs {
+			switch {
+			case names[i] != nil:
+				found++
+				fmt.Printf("%-*s  %s\n", width, a, strings.Join(names[i], ", "))
+			case optAll:
+				fmt.Printf("%-*s  -\n", width, a)
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "%d of %d addresses have names", found, len(addrs))
+		if failed != 0 {
+			fmt.Fprintf(os.Stderr, ", %d lookups failed", failed)
+		}
+		fmt.Fprintln(os.Stderr)
+		if found == 0 {
+			return 4
+		}
+		return 0
+	}
+}
+
+// ptrNames returns the names addr reverse resolves to, nil for none. The
+// CNAMEs of classless delegations (RFC 2317) are left out.
+func (r *resolver) ptrNames(addr netip.Addr) ([]string, error) {
+
+	rname, _ := reverseName(addr.String())
+	jdns, err := r.lookup(rname, "PTR")
+	if err == nil && jdns.Status != 3 {
+		err = jdns.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, a := range jdns.Answers {
+		if a.Type == 12 {
+			names = append(names, a.Data)
+		}
+	}
+	return names, nil
+}
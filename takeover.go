@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// takeoverProviders are hosting services on which a CNAME to a name that
+// no longer exists (NXDOMAIN) can be claimed by anyone who registers that
+// name with the service, by the suffixes of their hostnames
+var takeoverProviders = []struct {
+	name     string
+	suffixes []string
+}{
+	{"Azure", []string{
+		".cloudapp.net", ".cloudapp.azure.com", ".azurewebsites.net", ".trafficmanager.net",
+		".blob.core.windows.net", ".azureedge.net", ".azure-api.net", ".azurecontainer.io",
+		".azurehdinsight.net", ".azurecr.io", ".database.windows.net", ".search.windows.net",
+		".servicebus.windows.net", ".redis.cache.windows.net", ".azuredatalakestore.net", ".visualstudio.com",
+	}},
+	{"AWS Elastic Beanstalk", []string{".elasticbeanstalk.com"}},
+	{"Heroku", []string{".herokuapp.com"}},
+}
+
+// takeoverProvider returns the provider target is hosted on, "" for none
+// known
+func takeoverProvider(target string) string {
+	t := strings.ToLower(strings.TrimSuffix(target, "."))
+	for _, p := range takeoverProviders {
+		for _, s := range p.suffixes {
+			if strings.HasSuffix(t, s) {
+				return p.name
+			}
+		}
+	}
+	return ""
+}
+
+// cmdTakeover checks names for CNAMEs left pointing at names that no longer
+// exist: on a known hosting provider that is a likely subdomain takeover
+func cmdTakeover() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optFile string
+	var optConcurrency int
+
+	fs := newFlagSet("takeover", "h53 takeover [options] name ... | -f names.txt",
+		"Find CNAMEs pointing at names that do not exist (dangling), flagging those on hosting providers that allow takeover.")
+	co.register(fs)
+	fs.StringVar(&optFile, "f", "",
+		"File with names, one per line; - reads standard input Ex.: names.txt")
+	fs.IntVar(&optConcurrency, "c", 16,
+		"Lookups in flight at once")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		names := fs.Args()
+		if optFile != "" {
+			fh := os.Stdin
+			if optFile != "-" {
+				f, err := os.Open(optFile)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to open names file: %v\n", err)
+					return 1
+				}
+				defer f.Close()
+				fh = f
+			}
+			more, err := readNames(fh)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to read names: %v\n", err)
+				return 1
+			}
+			names = append(names, more...)
+		}
+		if len(names) == 0 {
+			fs.Usage()
+			return 1
+		}
+		if optConcurrency < 1 {
+			fmt.Fprint(os.Stderr, "Concurrency (-c) must be at least 1.\n")
+			return 1
+		}
+
+		client, err := co.client(set, optConcurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store, followCNAME: true}
+
+		var mu sync.Mutex // serializes output and the counters
+		likely, dangling, failed := 0, 0, 0
+
+		jobs := make(chan string)
+		var wg sync.WaitGroup
+		for range optConcurrency {
+			wg.Go(func() {
+				for name := range jobs {
+					verdict, detail, err := r.danglingCNAME(name)
+					mu.Lock()
+					switch {
+					case err != nil:
+						if exitCode(err) != exitInterrupted {
+							failed++
+							fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+						}
+					case verdict == "TAKEOVER":
+						likely++
+						fmt.Printf("%-8s %s %s\n", verdict, name, detail)
+					case verdict == "DANGLING":
+						dangling++
+						fmt.Printf("%-8s %s %s\n", verdict, name, detail)
+					}
+					mu.Unlock()
+				}
+			})
+		}
+
+	feed:
+		for _, name := range names {
+			select {
+			case jobs <- name:
+			case <-r.ctx.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+
+		fmt.Fprintf(os.Stderr, "%d likely takeovers, %d other dangling CNAMEs in %d names", likely, dangling, len(names))
+		if failed != 0 {
+			fmt.Fprintf(os.Stderr, ", %d lookups failed", failed)
+		}
+		fmt.Fprintln(os.Stderr)
+		switch {
+		case r.ctx.Err() != nil:
+			return exitInterrupted
+		case likely+dangling != 0:
+			return exitCheckFailed
+		}
+		return 0
+	}
+}
+
+// danglingCNAME resolves name and, when its CNAME chain ends in NXDOMAIN,
+// says "TAKEOVER" for a target on a provider of takeoverProviders, else
+// "DANGLING", along with the chain. Names resolving fine get "".
+func (r *resolver) danglingCNAME(name string) (string, string, error) {
+
+	jdns, err := r.lookup(name, "A")
+	if err == nil && jdns.Status != 3 {
+		err = jdns.Err()
+	}
+	if err != nil {
+		return "", "", err
+	}
+	chain, _, _ := cnameChain(jdns, name)
+	if len(chain) < 2 || jdns.Status != 3 {
+		return "", "", nil
+	}
+
+	// Any name along the chain may be the one to claim
+	for _, n := range chain[1:] {
+		if p := takeoverProvider(n); p != "" {
+			return "TAKEOVER", fmt.Sprintf("(%s): %s NXDOMAIN", p, strings.Join(chain, " -> ")), nil
+		}
+	}
+	return "DANGLING", fmt.Sprintf("%s NXDOMAIN", strings.Join(chain, " -> ")), nil
+}
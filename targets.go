@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// addTargets returns jdns with the addresses of the hosts its records point
+// at (MX exchanges with -resolve-mx, SRV targets with -resolve-srv) added to the additional section,
+// resolved through the same client and cache. Hosts that fail to resolve
+// are left out.
+func (r *resolver) addTargets(jdns *doh.DNSJ) *doh.DNSJ {
+
+	var hosts []string
+	for _, a := range jdns.Answers {
+		if (a.Type == 15 && r.resolveMX) || (a.Type == 33 && r.resolveSRV) {
+			if host := targetHost(a); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		return jdns
+	}
+
+	c := *jdns
+	c.Additional = append([]doh.Answer(nil), jdns.Additional...)
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		// A null MX (RFC 7505) or SRV target (RFC 2782) points nowhere
+		key := strings.ToLower(fqdn(host))
+		if host == "." || seen[key] || len(targetAddrs(&c, host)) != 0 {
+			continue
+		}
+		seen[key] = true
+		for _, t := range []string{"A", "AAAA"} {
+			res, err := r.lookup(host, t)
+			if err != nil {
+				slog.Debug("target lookup failed", "name", host, "type", t, "error", err)
+				continue
+			}
+			for _, a := range res.Answers {
+				if a.Type == 1 || a.Type == 28 {
+					c.Additional = append(c.Additional, a)
+				}
+			}
+		}
+	}
+	return &c
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// rootHints are the root servers and their IPv4 addresses, where iterative
+// resolution starts (https://www.iana.org/domains/root/servers)
+var rootHints = []struct {
+	name string
+	addr string
+}{
+	{"a.root-servers.net.", "198.41.0.4"},
+	{"b.root-servers.net.", "170.247.170.2"},
+	{"c.root-servers.net.", "192.33.4.12"},
+	{"d.root-servers.net.", "199.7.91.13"},
+	{"e.root-servers.net.", "192.203.230.10"},
+	{"f.root-servers.net.", "192.5.5.241"},
+	{"g.root-servers.net.", "192.112.36.4"},
+	{"h.root-servers.net.", "198.97.190.53"},
+	{"i.root-servers.net.", "192.36.148.17"},
+	{"j.root-servers.net.", "192.58.128.30"},
+	{"k.root-servers.net.", "193.0.14.129"},
+	{"l.root-servers.net.", "199.7.83.42"},
+	{"m.root-servers.net.", "202.12.27.33"},
+}
+
+const (
+	traceMaxSteps   = 16              // referrals followed before giving up
+	traceMaxServers = 4               // servers of a zone tried before giving up
+	traceTimeout    = 3 * time.Second // per server, within -T
+)
+
+// nsAddr is a nameserver address to send a trace query to
+type nsAddr struct {
+	name string
+	addr netip.Addr
+}
+
+// trace resolves name iteratively from the root, asking the servers of each
+// zone directly (port 53, no recursion) and printing every response the way
+// dig +trace does. The resolver only provides the addresses of nameservers
+// delegated to without glue.
+func trace(r *resolver, name string, qtype string) int {
+
+	qname, qtype, err := queryFor(name, qtype)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	code, _ := doh.TypeCode(qtype)
+	qname = fqdn(strings.ToLower(qname))
+	timeout := min(r.client.Timeout, traceTimeout)
+
+	zone := "."
+	var servers []nsAddr
+	for _, h := range rootHints {
+		fmt.Printf(".\t\t\t518400\tIN\tNS\t%s\n", h.name)
+		servers = append(servers, nsAddr{h.name, netip.MustParseAddr(h.addr)})
+	}
+	fmt.Print(";; Root servers from built-in hints\n\n")
+	shuffle(servers)
+
+	for range traceMaxSteps {
+		var jdns *doh.DNSJ
+		var size int
+		var from nsAddr
+		var elapsed time.Duration
+		tried := servers[:min(len(servers), traceMaxServers)]
+		for _, ns := range tried {
+			start := time.Now()
+			jdns, size, err = directQuery(r.ctx, ns.addr, qname, code, timeout)
+			if r.ctx.Err() != nil {
+				return exitInterrupted
+			}
+			if err == nil {
+				from, elapsed = ns, time.Since(start)
+				break
+			}
+			fmt.Printf(";; %s (%s): %v\n", ns.addr, ns.name, err)
+		}
+		if err != nil {
+			fmt.Printf(";; None of the %d servers of %s tried answered\n", len(tried), zone)
+			return 3
+		}
+
+		for _, a := range append(jdns.Answers, jdns.Authority...) {
+			fmt.Printf("%s\t%d\tIN\t%s\t%s\n", fqdn(a.Name), a.TTL, doh.TypeString(a.Type), a.Data)
+		}
+		fmt.Printf(";; Received %d bytes from %s#53(%s) in %d ms\n\n", size, from.addr, from.name, elapsed.Milliseconds())
+
+		switch {
+		case jdns.Status != 0:
+			fmt.Printf(";; %s for %s\n", doh.RcodeString(jdns.Status), qname)
+			return exitCode(jdns.Err())
+		case len(jdns.Answers) != 0:
+			return 0
+		}
+
+		// A referral delegates a zone closer to qname; NS records for the
+		// zone itself or above would send the trace round in circles
+		next := ""
+		var targets []string
+		for _, a := range jdns.Authority {
+			owner := fqdn(strings.ToLower(a.Name))
+			if a.Type != 2 || !inZone(qname, owner) || !inZone(owner, zone) || owner == zone {
+				continue
+			}
+			if next != "" && owner != next {
+				continue
+			}
+			next = owner
+			targets = append(targets, strings.ToLower(a.Data))
+		}
+		if next == "" {
+			for _, a := range jdns.Authority {
+				if a.Type == 6 {
+					fmt.Printf(";; NODATA: %s has no %s records\n", qname, qtype)
+					return 4
+				}
+			}
+			fmt.Printf(";; %s (%s) neither answered nor referred further down: lame delegation for %s\n",
+				from.addr, from.name, zone)
+			return 3
+		}
+
+		servers = glue(jdns, targets)
+		if servers == nil {
+			fmt.Printf(";; No glue for %s, nameserver addresses resolved over DoH\n\n", next)
+			for _, t := range targets {
+				addrs, err := r.forwardAddrs(strings.TrimSuffix(t, "."))
+				if err != nil && exitCode(err) == exitInterrupted {
+					return exitInterrupted
+				}
+				for _, ip := range addrs {
+					servers = append(servers, nsAddr{t, ip})
+				}
+			}
+			if servers == nil {
+				fmt.Printf(";; None of the nameservers of %s resolve\n", next)
+				return 3
+			}
+		}
+		zone = next
+	}
+	fmt.Printf(";; More than %d referrals, giving up\n", traceMaxSteps)
+	return 3
+}
+
+// glue returns the addresses of the nameservers targets given in the
+// additional section of a referral, in random order but IPv4 ones first as
+// the more likely to be reachable
+func glue(jdns *doh.DNSJ, targets []string) []nsAddr {
+	var v4, v6 []nsAddr
+	for _, a := range jdns.Additional {
+		name := fqdn(strings.ToLower(a.Name))
+		ip, err := netip.ParseAddr(a.Data)
+		if err != nil || !slices.Contains(targets, name) {
+			continue
+		}
+		if ip.Is4() {
+			v4 = append(v4, nsAddr{name, ip})
+		} else {
+			v6 = append(v6, nsAddr{name, ip})
+		}
+	}
+	shuffle(v4)
+	shuffle(v6)
+	return append(v4, v6...)
+}
+
+// shuffle spreads the load over the servers of a zone, as resolvers do
+func shuffle(servers []nsAddr) {
+	rand.Shuffle(len(servers), func(i, j int) { servers[i], servers[j] = servers[j], servers[i] })
+}
+
+// inZone reports whether the fully qualified name is zone or below it
+func inZone(name string, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
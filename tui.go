@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// Terminal control of the dashboard: the alternate screen keeps the shell's
+// scrollback as it was, and frames are drawn over each other from the top
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l" // and hide the cursor
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l"
+	ansiHome       = "\x1b[H"
+	ansiClearLine  = "\x1b[K"
+	ansiClearDown  = "\x1b[J"
+	ansiReverse    = "\x1b[7m"
+)
+
+// dashHighlight is how long a changed target stays highlighted
+const dashHighlight = 10 * time.Minute
+
+// dashEvents is how many of the recent changes the dashboard lists
+const dashEvents = 8
+
+// sparks are the bars of the latency sparklines, lowest to highest
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// dashboard is the full-screen view of monitor -tui: a row per target with
+// its current answer, the TTL left of it, a sparkline of the recent
+// latencies and when it last changed, and the latest changes below
+type dashboard struct {
+	targets  []*monitorTarget
+	interval time.Duration
+	provider string
+	events   []*monitorEvent // the latest last
+}
+
+// isTerminal reports whether stdout is a terminal the dashboard can draw on
+func isTerminal() bool {
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// open switches to the alternate screen; close switches back
+func (d *dashboard) open()  { fmt.Print(ansiAltScreen) }
+func (d *dashboard) close() { fmt.Print(ansiMainScreen) }
+
+// event adds a change to the list of recent ones
+func (d *dashboard) event(ev *monitorEvent) {
+	d.events = append(d.events, ev)
+	if len(d.events) > dashEvents {
+		d.events = d.events[1:]
+	}
+}
+
+// width is the width of the terminal as the shell tells it (COLUMNS), 120
+// columns otherwise; lines longer are cut
+func (d *dashboard) width() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 20 {
+		return n
+	}
+	return 120
+}
+
+// draw renders a frame
+func (d *dashboard) draw() {
+
+	now := time.Now()
+	var b bytes.Buffer
+	b.WriteString(ansiHome)
+	line := func(s string, code string) {
+		if r := []rune(s); len(r) > d.width() {
+			s = string(r[:d.width()-1]) + "…"
+		}
+		if code != "" {
+			s = code + s + ansiReset
+		}
+		b.WriteString(s + ansiClearLine + "\n")
+	}
+
+	line(fmt.Sprintf("h53 monitor  %d targets, every %s, provider %s  %s", len(d.targets), d.interval,
+		d.provider, now.Format(time.DateTime)), ansiReverse)
+	line("", "")
+
+	var t bytes.Buffer
+	tw := tabwriter.NewWriter(&t, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tRCODE\tTTL\tLATENCY\t\tCHANGED\tANSWER")
+	codes := []string{ansiDim}
+	for _, tg := range d.targets {
+		rcode, ttl, latency, changed, answer, code := "-", "-", "-", "-", "waiting for the first check", ""
+		if tg.last != nil {
+			rcode = doh.RcodeString(tg.last.Status)
+			ttl = ttlLeft(tg.last, tg.checked, now)
+			answer = newAnswerSet(tg.last).String()
+			if tg.last.Status != 0 {
+				code = ansiRed
+			}
+		}
+		if len(tg.rtts) != 0 {
+			latency = fmt.Sprintf("%.1fms", float64(tg.rtts[len(tg.rtts)-1].Microseconds())/1000)
+		}
+		if !tg.changed.IsZero() {
+			changed = now.Sub(tg.changed).Truncate(time.Second).String() + " ago"
+			if now.Sub(tg.changed) < dashHighlight {
+				code = ansiYellow + ansiReverse
+			}
+		}
+		if tg.err != nil {
+			rcode, answer, code = "ERROR", tg.err.Error(), ansiRed
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", tg.name, tg.qtype, rcode, ttl, latency,
+			sparkline(tg.rtts), changed, answer)
+		codes = append(codes, code)
+	}
+	tw.Flush()
+	for i, l := range strings.Split(strings.TrimSuffix(t.String(), "\n"), "\n") {
+		line(l, codes[i])
+	}
+
+	line("", "")
+	line("Recent changes", ansiDim)
+	if len(d.events) == 0 {
+		line("  none yet", "")
+	}
+	for _, ev := range slices.Backward(d.events) {
+		line(fmt.Sprintf("  %s %s %s: %s %s", ev.Time.Format(time.TimeOnly), ev.Name, ev.Type,
+			strings.ToUpper(ev.Event), ev.Info), "")
+	}
+	b.WriteString(ansiClearDown)
+	os.Stdout.Write(b.Bytes())
+}
+
+// ttlLeft is what remains of the lowest answer TTL of jdns, checked at
+// then: the time until a cache would ask again
+func ttlLeft(jdns *doh.DNSJ, then time.Time, now time.Time) string {
+
+	if len(jdns.Answers) == 0 {
+		return "-"
+	}
+	ttl := jdns.Answers[0].TTL
+	for _, a := range jdns.Answers {
+		ttl = min(ttl, a.TTL)
+	}
+	left := time.Duration(ttl)*time.Second - now.Sub(then)
+	if left <= 0 {
+		return "expired"
+	}
+	return left.Truncate(time.Second).String()
+}
+
+// sparkline draws latencies as bars, scaled from none to the highest
+func sparkline(rtts []time.Duration) string {
+
+	if len(rtts) == 0 {
+		return ""
+	}
+	top := slices.Max(rtts)
+	s := make([]rune, len(rtts))
+	for i, d := range rtts {
+		s[i] = sparks[0]
+		if top > 0 {
+			s[i] = sparks[int(d*time.Duration(len(sparks)-1)/top)]
+		}
+	}
+	return string(s)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// walkProbeTries bounds the random labels hashed locally for one NSEC3
+// probe, looking for one whose hash falls in a gap of the chain
+const walkProbeTries = 100000
+
+// nsec3Link is an NSEC3 record of a zone's chain, with its owner's hash
+type nsec3Link struct {
+	owner []byte
+	doh.NSEC3
+}
+
+// cmdWalk enumerates the names of a DNSSEC signed zone from its denial of
+// existence records: NSEC records chain the names themselves, NSEC3 records
+// chain their hashes, which a wordlist may crack
+func cmdWalk() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+	var optWordlist string
+	var optMax int
+
+	fs := newFlagSet("walk", "h53 walk [options] zone",
+		"Enumerate the names of a signed zone by following its NSEC chain, or collect its NSEC3 chain\n"+
+			"and crack the hashes with a wordlist (-w). Queries go in wireformat unless -wire or -method is set.")
+	co.register(fs)
+	fs.StringVar(&optWordlist, "w", "",
+		"Wordlist of labels to crack NSEC3 hashes with, one per line Ex.: subdomains.txt")
+	fs.IntVar(&optMax, "max", 1000,
+		"Queries allowed before giving up on completing the chain")
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		var words []string
+		if optWordlist != "" {
+			f, err := os.Open(optWordlist)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			sc := bufio.NewScanner(f)
+			for sc.Scan() {
+				if w := strings.ToLower(strings.TrimSpace(sc.Text())); w != "" && !strings.HasPrefix(w, "#") {
+					words = append(words, w)
+				}
+			}
+			f.Close()
+		}
+		// Names with arbitrary bytes (the \000 label) cannot go through the JSON
+		// APIs
+		if !set["wire"] && !set["method"] {
+			co.wire = true
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		client.DO = true
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+		zone := fqdn(strings.ToLower(strings.TrimSuffix(fs.Arg(0), ".")))
+
+		// The apex tells which kind of chain the zone has: its NSEC record, or
+		// the NSEC3 records proving a random name does not exist
+		jdns, err := r.lookup(zone, "NSEC")
+		if err == nil {
+			err = jdns.Err()
+		}
+		if err != nil {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return code
+			}
+			return exitInterrupted
+		}
+		for _, a := range jdns.Answers {
+			if a.Type == 47 && fqdn(strings.ToLower(a.Name)) == zone {
+				return walkNSEC(r, zone, optMax)
+			}
+		}
+		return walkNSEC3(r, zone, words, optMax)
+	}
+}
+
+// walkNSEC follows the NSEC chain of zone from the apex until it wraps
+// around, printing each name and its types
+func walkNSEC(r *resolver, zone string, max int) int {
+
+	seen := make(map[string]bool)
+	name := zone
+	for queries := 0; ; queries++ {
+		if queries == max {
+			fmt.Printf(";; %d names, chain incomplete after %d queries (-max)\n", len(seen), max)
+			return 0
+		}
+		nsec, err := r.nsecAt(name)
+		if err != nil {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				return code
+			}
+			return exitInterrupted
+		}
+		if nsec == nil {
+			fmt.Printf(";; No NSEC record for %s, the chain breaks off\n", name)
+			return 4
+		}
+		seen[name] = true
+		fmt.Printf("%s\t%s\n", name, strings.Join(nsec.Types, " "))
+
+		next := fqdn(strings.ToLower(nsec.Next))
+		switch {
+		case strings.HasPrefix(next, "\\000.") || strings.HasPrefix(next, "\x00."):
+			// Compact denial ("black lies", RFC 9824) invents a successor
+			// for every name asked about
+			fmt.Printf(";; %s answers with minimally covering NSEC records (%s): the zone cannot be walked\n", zone, next)
+			return 4
+		case next == zone || seen[next]:
+			fmt.Printf(";; %d names in %s, NSEC chain complete (%d queries)\n", len(seen), zone, queries+1)
+			return 0
+		case !inZone(next, zone):
+			fmt.Printf(";; NSEC record of %s points out of the zone to %s\n", name, next)
+			return 4
+		}
+		name = next
+	}
+}
+
+// nsecAt returns the NSEC record at name: asked for directly, else taken
+// from the denial of the name right after it (a \000 label below it)
+func (r *resolver) nsecAt(name string) (*doh.NSEC, error) {
+
+	for _, qname := range []string{name, "\x00." + name} {
+		var jdns *doh.DNSJ
+		var err error
+		if qname == name {
+			jdns, err = r.lookup(qname, "NSEC")
+		} else {
+			// Not a name h53 would let through, but a valid one on the wire
+			jdns, err = r.client.Lookup(r.ctx, qname, "A")
+			if err != nil && r.ctx.Err() != nil {
+				err = errInterrupted
+			}
+		}
+		if err == nil && jdns.Status != 3 {
+			err = jdns.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range append(jdns.Answers, jdns.Authority...) {
+			if a.Type != 47 || fqdn(strings.ToLower(a.Name)) != name {
+				continue
+			}
+			if nsec, err := doh.ParseNSEC(a.Data); err == nil {
+				return &nsec, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// walkNSEC3 collects the NSEC3 chain of zone from the denials of names
+// picked so that their hashes fall in its gaps, then cracks the hashes with
+// words
+func walkNSEC3(r *resolver, zone string, words []string, max int) int {
+
+	links := make(map[string]nsec3Link) // by owner hash
+	var params *doh.NSEC3
+	complete := func() bool {
+		if len(links) == 0 {
+			return false
+		}
+		for _, l := range links {
+			if _, ok := links[string(l.Next)]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	var owners [][]byte // sorted
+	covered := func(hash []byte) bool {
+		i, found := slices.BinarySearchFunc(owners, hash, bytes.Compare)
+		if found {
+			return true
+		}
+		// The record before the hash, or the last one wrapping around
+		l := links[string(owners[(i+len(owners)-1)%len(owners)])]
+		return l.Covers(l.owner, hash)
+	}
+
+	queries := 0
+	for ; queries < max && !complete(); queries++ {
+		// A random name whose hash no known record covers yet
+		probe := randomLabel() + "." + zone
+		if params != nil {
+			owners = owners[:0]
+			for _, l := range links {
+				owners = append(owners, l.owner)
+			}
+			slices.SortFunc(owners, bytes.Compare)
+			for range walkProbeTries {
+				hash, err := params.Hash(probe)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+					return 1
+				}
+				if !covered(hash) {
+					break
+				}
+				probe = randomLabel() + "." + zone
+			}
+		}
+		jdns, err := r.lookup(probe, "A")
+		if err == nil && jdns.Status != 3 {
+			err = jdns.Err()
+		}
+		if err != nil {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", probe, err)
+				return code
+			}
+			return exitInterrupted
+		}
+		found := false
+		for _, a := range jdns.Authority {
+			if a.Type != 50 || !inZone(fqdn(strings.ToLower(a.Name)), zone) {
+				continue
+			}
+			n, err1 := doh.ParseNSEC3(a.Data)
+			owner, err2 := doh.NSEC3Owner(a.Name)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			links[string(owner)] = nsec3Link{owner, n}
+			found = true
+			if params == nil {
+				params = &n
+			}
+		}
+		if !found && queries == 0 {
+			for _, a := range jdns.Authority {
+				if a.Type == 47 {
+					fmt.Printf(";; %s denies with NSEC records that do not chain from the apex: the zone cannot be walked\n", zone)
+					return 4
+				}
+			}
+			fmt.Printf(";; %s has neither NSEC nor NSEC3 records: not signed\n", zone)
+			return 4
+		}
+	}
+	if params == nil {
+		return 4
+	}
+	if params.Flags&1 != 0 {
+		fmt.Printf(";; Opt-out: unsigned delegations of %s are not in the chain\n", zone)
+	}
+
+	// Every name the wordlist makes, the apex included, against the hashes
+	cracked := make(map[string]string)
+	for _, w := range append([]string{""}, words...) {
+		name := zone
+		if w != "" {
+			name = w + "." + zone
+		}
+		hash, err := params.Hash(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		if _, ok := links[string(hash)]; ok {
+			cracked[string(hash)] = name
+		}
+	}
+
+	owners = owners[:0]
+	for _, l := range links {
+		owners = append(owners, l.owner)
+	}
+	slices.SortFunc(owners, bytes.Compare)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, o := range owners {
+		name := cracked[string(o)]
+		if name == "" {
+			name = "?"
+		}
+		fmt.Fprintf(tw, "%s.%s\t%s\t%s\n", doh.NSEC3Label(o), zone, name, strings.Join(links[string(o)].Types, " "))
+	}
+	tw.Flush()
+	state := "complete"
+	if !complete() {
+		state = "incomplete"
+	}
+	salt := "-"
+	if params.Salt != nil {
+		salt = fmt.Sprintf("%x", params.Salt)
+	}
+	fmt.Printf(";; %d NSEC3 hashes (%d iterations, salt %s), chain %s after %d queries, %d cracked\n",
+		len(links), params.Iterations, salt, state, queries, len(cracked))
+	return 0
+}
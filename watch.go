@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// answerSet is the comparable outcome of one lookup: the rcode and the
+// sorted record data. TTLs are left out, they change on every query.
+type answerSet struct {
+	status int
+	data   []string
+}
+
+func newAnswerSet(jdns *doh.DNSJ) answerSet {
+	s := answerSet{status: jdns.Status}
+	for _, a := range jdns.Answers {
+		s.data = append(s.data, a.Data)
+	}
+	sort.Strings(s.data)
+	return s
+}
+
+func (s answerSet) String() string {
+	if s.status != 0 {
+		return doh.RcodeString(s.status)
+	}
+	if len(s.data) == 0 {
+		return "NOT FOUND"
+	}
+	return strings.Join(s.data, ", ")
+}
+
+func (s answerSet) equal(o answerSet) bool {
+	return s.String() == o.String()
+}
+
+// diff lists the records only in s (prefixed -) and only in o (prefixed +)
+func (s answerSet) diff(o answerSet) []string {
+	in := func(v string, set []string) bool {
+		i := sort.SearchStrings(set, v)
+		return i < len(set) && set[i] == v
+	}
+	var d []string
+	for _, v := range s.data {
+		if !in(v, o.data) {
+			d = append(d, "- "+v)
+		}
+	}
+	for _, v := range o.data {
+		if !in(v, s.data) {
+			d = append(d, "+ "+v)
+		}
+	}
+	return d
+}
+
+// watch re-resolves name for each of types every interval, bypassing the
+// cache, and prints one timestamped line per type and round. Changes of the
+// answer set are flagged, with the records that came and went. It runs
+// until interrupted, which ends it successfully.
+func watch(r *resolver, name string, types []string, interval time.Duration) int {
+
+	last := make(map[string]answerSet)
+	for {
+		for _, qtype := range types {
+			ts := time.Now().Format(time.RFC3339)
+			qname, qt, err := queryFor(name, qtype)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			jdns, err := r.client.Lookup(r.ctx, qname, qt)
+			if r.ctx.Err() != nil {
+				return 0
+			}
+			if err != nil {
+				fmt.Printf("%s %s %s: ERROR %v\n", ts, name, qt, err)
+				continue
+			}
+
+			cur := newAnswerSet(jdns)
+			prev, seen := last[qt]
+			last[qt] = cur
+			if !seen || prev.equal(cur) {
+				fmt.Printf("%s %s %s: %s\n", ts, name, qt, cur)
+				continue
+			}
+			fmt.Printf("%s %s %s: CHANGED %s (was %s)\n", ts, name, qt, cur, prev)
+			for _, d := range prev.diff(cur) {
+				fmt.Printf("    %s\n", d)
+			}
+		}
+		select {
+		case <-time.After(interval):
+		case <-r.ctx.Done():
+			return 0
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// wildcardProbes is how many random labels are tried to detect a wildcard
+const wildcardProbes = 3
+
+// wildcardAnswers resolves random names under zone: when they exist the
+// zone has a wildcard, and the data they answer with is returned. An empty
+// qtype probes the way enum does, A then AAAA (see probe).
+func (r *resolver) wildcardAnswers(zone string, qtype string) ([]string, error) {
+
+	var all []string
+	for range wildcardProbes {
+		name := randomLabel() + "." + zone
+		var data []string
+		if qtype == "" {
+			d, exists, err := r.probe(name)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				data = d
+			}
+		} else {
+			jdns, err := r.lookup(name, qtype)
+			if err != nil {
+				return nil, err
+			}
+			data = answerData(jdns)
+		}
+		for _, d := range data {
+			if !slices.Contains(all, d) {
+				all = append(all, d)
+			}
+		}
+	}
+	slices.Sort(all)
+	return all, nil
+}
+
+// wildcardOf returns "*.zone" when the answers to name/qtype are those the
+// wildcard of its parent zone gives any name, "" otherwise or when that
+// cannot be told.
+func (r *resolver) wildcardOf(name string, qtype string, jdns *doh.DNSJ) string {
+
+	data := answerData(jdns)
+	_, zone, ok := strings.Cut(strings.TrimSuffix(name, "."), ".")
+	if len(data) == 0 || !ok || !strings.Contains(zone, ".") {
+		return ""
+	}
+	wildcard, err := r.wildcardAnswers(zone, qtype)
+	if err != nil || len(wildcard) == 0 || !subset(data, wildcard) {
+		return ""
+	}
+	return "*." + zone
+}
+
+// annotate returns the print options for the answer jdns to name/qtype:
+// po, with the wildcard it matches noted when -detect-wildcard is set, the
+// origin of its addresses when -enrich is and their names when -ptr is
+func (r *resolver) annotate(po *printOpts, name string, qtype string, jdns *doh.DNSJ) *printOpts {
+	if !r.detectWildcard && !r.enrich && !r.reversePTR {
+		return po
+	}
+	p := *po
+	if r.detectWildcard {
+		p.wildcard = r.wildcardOf(name, qtype, jdns)
+	}
+	if r.enrich {
+		p.origins = r.origins(jdns)
+	}
+	if r.reversePTR {
+		p.ptrs = r.ptrs(jdns)
+	}
+	return &p
+}
+
+// randomLabel is a label no zone is likely to hold
+func randomLabel() string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 16)
+	for i := range b {
+		b[i] = chars[rand.IntN(len(chars))]
+	}
+	return "h53-" + string(b)
+}
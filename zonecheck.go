@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dsnezhkov/h53/doh"
+)
+
+// cmdZonecheck checks the delegation of a zone: the NS records and glue the
+// parent zone hands out against the NS records the zone itself serves, and
+// whether every nameserver answers for the zone with authority
+func cmdZonecheck() (*flag.FlagSet, func(args []string) int) {
+
+	var co clientOpts
+
+	fs := newFlagSet("zonecheck", "h53 zonecheck [options] zone",
+		"Compare the delegation (NS, glue) of zone at its parent with the zone's own NS records and\n"+
+			"ask each nameserver directly (port 53) whether it answers for the zone with authority.")
+	co.register(fs)
+	return fs, func(args []string) int {
+		set, _ := parseArgs(fs, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 1
+		}
+		client, err := co.client(set, 1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		store, _ := newCache("")
+		r := &resolver{ctx: signalContext(), client: client, cache: store}
+		zone := fqdn(strings.ToLower(strings.TrimSuffix(fs.Arg(0), ".")))
+		timeout := min(client.Timeout, traceTimeout)
+
+		parent, parentServers, err := r.parentServers(zone)
+		if err != nil {
+			if code := exitCode(err); code != exitInterrupted {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return code
+			}
+			return exitInterrupted
+		}
+
+		// The delegation, as the parent's servers hand it out
+		var referral *doh.DNSJ
+		var from nsAddr
+		for _, ns := range parentServers[:min(len(parentServers), traceMaxServers)] {
+			if referral, _, err = directQuery(r.ctx, ns.addr, zone, 2, timeout); err == nil {
+				from = ns
+				break
+			}
+			if r.ctx.Err() != nil {
+				return exitInterrupted
+			}
+			fmt.Fprintf(os.Stderr, "%s (%s): %v\n", ns.addr, ns.name, err)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "None of the servers of the parent zone %s answered\n", parent)
+			return 3
+		}
+		if referral.Status != 0 {
+			fmt.Fprintf(os.Stderr, "%s (%s, server of %s): %s for %s, not delegated\n",
+				from.addr, from.name, parent, doh.RcodeString(referral.Status), zone)
+			return exitCode(referral.Err())
+		}
+		var delegated []string
+		for _, a := range append(referral.Authority, referral.Answers...) {
+			if a.Type == 2 && fqdn(strings.ToLower(a.Name)) == zone {
+				delegated = append(delegated, strings.ToLower(a.Data))
+			}
+		}
+		slices.Sort(delegated)
+		delegated = slices.Compact(delegated)
+		if delegated == nil {
+			fmt.Fprintf(os.Stderr, "%s (%s, server of %s) has no NS records for %s, not delegated\n",
+				from.addr, from.name, parent, zone)
+			return 4
+		}
+		glued := make(map[string][]netip.Addr)
+		for _, g := range glue(referral, delegated) {
+			glued[g.name] = append(glued[g.name], g.addr)
+		}
+
+		fmt.Printf("%s delegated by %s (%s) to %s\n", zone, parent, from.name, strings.Join(delegated, ", "))
+		var findings []finding
+		add := func(verdict int, check string, format string, args ...any) {
+			findings = append(findings, finding{verdict, check, fmt.Sprintf(format, args...)})
+		}
+		if len(delegated) < 2 {
+			add(checkWarn, "NS", "a single nameserver, at least two are required for redundancy (RFC 1034 4.1)")
+		}
+
+		// Every nameserver, delegated to or listed by the zone, is asked for the
+		// zone's NS records
+		names := slices.Clone(delegated)
+		served := make(map[string][]string) // NS sets served, by server
+		for i := 0; i < len(names); i++ {
+			ns := names[i]
+			addrs, err := r.forwardAddrs(strings.TrimSuffix(ns, "."))
+			if err != nil && exitCode(err) == exitInterrupted {
+				return exitInterrupted
+			}
+			given := glued[ns]
+			switch {
+			case !slices.Contains(delegated, ns):
+			case inZone(ns, zone) && given == nil:
+				add(checkFail, "glue", "%s is inside the zone, but %s gives no glue (address) for it", ns, parent)
+			case given != nil && addrs != nil && !sameAddrs(given, addrs):
+				add(checkWarn, "glue", "%s: glue %s, but its address records say %s", ns,
+					strings.Join(addrStrings(given), ", "), strings.Join(addrStrings(addrs), ", "))
+			case given != nil:
+				add(checkPass, "glue", "%s: glue %s", ns, strings.Join(addrStrings(given), ", "))
+			}
+			for _, ip := range given {
+				if !slices.Contains(addrs, ip) {
+					addrs = append(addrs, ip)
+				}
+			}
+			if addrs == nil {
+				msg := "does not resolve"
+				if err != nil {
+					msg = err.Error()
+				}
+				add(checkFail, "lame", "%s: %s", ns, msg)
+				continue
+			}
+
+			for _, ip := range addrs {
+				jdns, _, err := directQuery(r.ctx, ip, zone, 2, timeout)
+				if r.ctx.Err() != nil {
+					return exitInterrupted
+				}
+				server := fmt.Sprintf("%s (%s)", ns, ip)
+				switch {
+				case err != nil:
+					add(checkFail, "lame", "%s: %v", server, err)
+					continue
+				case jdns.Status != 0:
+					add(checkFail, "lame", "%s: %s, does not serve the zone", server, doh.RcodeString(jdns.Status))
+					continue
+				case !jdns.AA:
+					add(checkFail, "lame", "%s: answers without authority, does not serve the zone", server)
+					continue
+				}
+				var set []string
+				for _, a := range jdns.Answers {
+					if a.Type == 2 && fqdn(strings.ToLower(a.Name)) == zone {
+						set = append(set, strings.ToLower(a.Data))
+					}
+				}
+				slices.Sort(set)
+				set = slices.Compact(set)
+				served[server] = set
+				add(checkPass, "auth", "%s: authoritative", server)
+				for _, n := range set {
+					if !slices.Contains(names, n) {
+						names = append(names, n)
+					}
+				}
+			}
+		}
+
+		// The NS sets: the zone's own against the delegation, and the servers
+		// against each other
+		var sets []string
+		for _, set := range served {
+			if s := strings.Join(set, ", "); !slices.Contains(sets, s) {
+				sets = append(sets, s)
+			}
+		}
+		slices.Sort(sets)
+		switch {
+		case len(sets) > 1:
+			add(checkWarn, "NS", "the nameservers serve different NS sets: %s", strings.Join(sets, " | "))
+		case len(sets) == 1 && sets[0] != strings.Join(delegated, ", "):
+			add(checkWarn, "NS", "the zone lists %s, %s delegates to %s", sets[0], parent, strings.Join(delegated, ", "))
+		case len(sets) == 1:
+			add(checkPass, "NS", "the zone and %s list the same %d nameservers", parent, len(delegated))
+		}
+
+		var count [3]int
+		for _, f := range findings {
+			fmt.Printf("  %s  %-4s  %s\n", verdictNames[f.verdict], f.check, f.msg)
+			count[f.verdict]++
+		}
+		fmt.Printf("Summary: %d pass, %d warn, %d fail\n", count[checkPass], count[checkWarn], count[checkFail])
+		if count[checkFail] != 0 {
+			return exitCheckFailed
+		}
+		return 0
+	}
+}
+
+// parentServers finds the zone above zone (the closest ancestor with NS
+// records) and the addresses of its nameservers, the root's from the hints
+func (r *resolver) parentServers(zone string) (string, []nsAddr, error) {
+
+	labels := strings.Split(strings.TrimSuffix(zone, "."), ".")
+	for i := 1; i < len(labels); i++ {
+		name := fqdn(strings.Join(labels[i:], "."))
+		jdns, err := r.lookup(name, "NS")
+		if err == nil && jdns.Status != 3 {
+			err = jdns.Err()
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		var servers []nsAddr
+		for _, a := range jdns.Answers {
+			if a.Type != 2 || fqdn(strings.ToLower(a.Name)) != name {
+				continue
+			}
+			addrs, err := r.forwardAddrs(strings.TrimSuffix(a.Data, "."))
+			if err != nil && exitCode(err) == exitInterrupted {
+				return "", nil, err
+			}
+			for _, ip := range addrs {
+				servers = append(servers, nsAddr{strings.ToLower(a.Data), ip})
+			}
+			if len(servers) >= traceMaxServers {
+				break
+			}
+		}
+		if servers != nil {
+			return name, servers, nil
+		}
+	}
+
+	var servers []nsAddr
+	for _, h := range rootHints {
+		servers = append(servers, nsAddr{h.name, netip.MustParseAddr(h.addr)})
+	}
+	shuffle(servers)
+	return ".", servers, nil
+}
+
+// sameAddrs reports whether a and b hold the same addresses, in any order
+func sameAddrs(a []netip.Addr, b []netip.Addr) bool {
+	return len(a) == len(b) && !slices.ContainsFunc(a, func(ip netip.Addr) bool { return !slices.Contains(b, ip) })
+}